@@ -27,8 +27,6 @@ import (
 	"hash"
 	"io"
 	"math/big"
-
-	"code.google.com/p/go.crypto/bn256"
 )
 
 // SignatureSize is the size, in bytes, of the signatures produced by this
@@ -38,9 +36,10 @@ const SignatureSize = 12*32
 // Group represents a public key in the group signature scheme. Signatures by
 // the group members can be verified given the Group.
 type Group struct {
-	g1, h, u, v *bn256.G1
-	g2, w *bn256.G2
-	ehw, ehg2, minusEg1g2 *bn256.GT
+	g1, h, u, v G1
+	g2, w G2
+	ehw, ehg2, minusEg1g2 GT
+	pairing Pairing
 }
 
 // Marshal serializes g to a slice of bytes, suitable for Unmarshal.
@@ -58,30 +57,34 @@ func (g *Group) Marshal() []byte {
 // Unmarshal sets g to the result of unmarshaling b and returns both g and a
 // bool that is true on success. Since Group contains some precomputed values
 // that aren't included in the serialisation, Unmarshal does significant
-// computation.
+// computation. If g doesn't already have a Pairing then DefaultPairing is
+// used.
 func (g *Group) Unmarshal(b []byte) (*Group, bool) {
 	if len(b) != 4*2*32 + 2*2*2*32 {
 		return nil, false
 	}
+	if g.pairing == nil {
+		g.pairing = DefaultPairing
+	}
 	var ok bool
-	if g.g1, ok = new(bn256.G1).Unmarshal(b[0*2*32:1*2*32]); !ok {
+	if g.g1, ok = g.pairing.NewG1().Unmarshal(b[0*2*32:1*2*32]); !ok {
 		return nil, false
 	}
-	if g.h, ok = new(bn256.G1).Unmarshal(b[1*2*32:2*2*32]); !ok {
+	if g.h, ok = g.pairing.NewG1().Unmarshal(b[1*2*32:2*2*32]); !ok {
 		return nil, false
 	}
-	if g.u, ok = new(bn256.G1).Unmarshal(b[2*2*32:3*2*32]); !ok {
+	if g.u, ok = g.pairing.NewG1().Unmarshal(b[2*2*32:3*2*32]); !ok {
 		return nil, false
 	}
-	if g.v, ok = new(bn256.G1).Unmarshal(b[3*2*32:4*2*32]); !ok {
+	if g.v, ok = g.pairing.NewG1().Unmarshal(b[3*2*32:4*2*32]); !ok {
 		return nil, false
 	}
 
 	b = b[4*2*32:]
-	if g.g2, ok = new(bn256.G2).Unmarshal(b[0*2*2*32:1*2*2*32]); !ok {
+	if g.g2, ok = g.pairing.NewG2().Unmarshal(b[0*2*2*32:1*2*2*32]); !ok {
 		return nil, false
 	}
-	if g.w, ok = new(bn256.G2).Unmarshal(b[1*2*2*32:2*2*2*32]); !ok {
+	if g.w, ok = g.pairing.NewG2().Unmarshal(b[1*2*2*32:2*2*2*32]); !ok {
 		return nil, false
 	}
 
@@ -90,11 +93,11 @@ func (g *Group) Unmarshal(b []byte) (*Group, bool) {
 }
 
 func (g *Group) precompute() {
-	g.ehw = bn256.Pair(g.h, g.w)
-	g.ehg2 = bn256.Pair(g.h, g.g2)
+	g.ehw = g.pairing.Pair(g.h, g.w)
+	g.ehg2 = g.pairing.Pair(g.h, g.g2)
 
-	t := bn256.Pair(g.g1, g.g2)
-	g.minusEg1g2 = new(bn256.GT).Neg(t)
+	t := g.pairing.Pair(g.g1, g.g2)
+	g.minusEg1g2 = g.pairing.NewGT().Neg(t)
 }
 
 // PrivateKey represents a group private key. The holder of the private key can
@@ -130,13 +133,21 @@ func (priv *PrivateKey) Unmarshal(g *Group, b []byte) (*PrivateKey, bool) {
 	return priv, true
 }
 
+// Wipe overwrites the secret values of priv with zeros. The key may not be
+// used afterwards.
+func (priv *PrivateKey) Wipe() {
+	wipeInt(priv.xi1)
+	wipeInt(priv.xi2)
+	wipeInt(priv.gamma)
+}
+
 // MemberKey represents a member private key. It is capable of signing messages
 // such that nobody, save the holder of the group private key, can determine
 // which member of the group made the signature.
 type MemberKey struct {
 	*Group
 	x *big.Int
-	a *bn256.G1
+	a G1
 }
 
 // Tag returns an opaque byte slice that identifies the member private key for
@@ -163,16 +174,34 @@ func (mem *MemberKey) Unmarshal(g *Group, b []byte) (*MemberKey, bool) {
 	var ok bool
 	mem.Group = g
 	mem.x = new(big.Int).SetBytes(b[0*32:1*32])
-	if mem.a, ok = new(bn256.G1).Unmarshal(b[1*32:]); !ok {
+	if mem.a, ok = g.pairing.NewG1().Unmarshal(b[1*32:]); !ok {
 		return nil, false
 	}
 
 	return mem, true
 }
 
-func randomZp(r io.Reader) (*big.Int, error) {
+// Wipe overwrites the secret value of mem with zeros. The key may not be used
+// afterwards.
+func (mem *MemberKey) Wipe() {
+	wipeInt(mem.x)
+}
+
+// wipeInt overwrites the value of x with zeros and sets x to zero.
+func wipeInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+	words := x.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	x.SetInt64(0)
+}
+
+func randomZp(r io.Reader, order *big.Int) (*big.Int, error) {
 	for {
-		n, err := rand.Int(r, bn256.Order)
+		n, err := rand.Int(r, order)
 		if err != nil {
 			return nil, err
 		}
@@ -184,39 +213,46 @@ func randomZp(r io.Reader) (*big.Int, error) {
 	panic("unreachable")
 }
 
-// GenerateGroup generates a new group and group private key.
+// GenerateGroup generates a new group and group private key using
+// DefaultPairing.
 func GenerateGroup(r io.Reader) (*PrivateKey, error) {
+	return GenerateGroupWithPairing(DefaultPairing, r)
+}
+
+// GenerateGroupWithPairing generates a new group and group private key using
+// the given Pairing.
+func GenerateGroupWithPairing(p Pairing, r io.Reader) (*PrivateKey, error) {
 	priv := new(PrivateKey)
-	priv.Group = new(Group)
+	priv.Group = &Group{pairing: p}
 	var err error
 
-	if _, priv.g1, err = bn256.RandomG1(r); err != nil {
+	if _, priv.g1, err = p.RandomG1(r); err != nil {
 		return nil, err
 	}
-	if _, priv.g2, err = bn256.RandomG2(r); err != nil {
+	if _, priv.g2, err = p.RandomG2(r); err != nil {
 		return nil, err
 	}
-	if _, priv.h, err = bn256.RandomG1(r); err != nil {
+	if _, priv.h, err = p.RandomG1(r); err != nil {
 		return nil, err
 	}
-	if priv.xi1, err = randomZp(r); err != nil {
+	if priv.xi1, err = randomZp(r, p.Order()); err != nil {
 		return nil, err
 	}
-	if priv.xi2, err = randomZp(r); err != nil {
+	if priv.xi2, err = randomZp(r, p.Order()); err != nil {
 		return nil, err
 	}
 
-	z0 := new(big.Int).ModInverse(priv.xi1, bn256.Order)
-	priv.u = new(bn256.G1).ScalarMult(priv.h, z0)
+	z0 := new(big.Int).ModInverse(priv.xi1, p.Order())
+	priv.u = p.NewG1().ScalarMult(priv.h, z0)
 
-	z0.ModInverse(priv.xi2, bn256.Order)
-	priv.v = new(bn256.G1).ScalarMult(priv.h, z0)
+	z0.ModInverse(priv.xi2, p.Order())
+	priv.v = p.NewG1().ScalarMult(priv.h, z0)
 
-	priv.gamma, err = randomZp(r)
+	priv.gamma, err = randomZp(r, p.Order())
 	if err != nil {
 		return nil, err
 	}
-	priv.w = new(bn256.G2).ScalarMult(priv.g2, priv.gamma)
+	priv.w = p.NewG2().ScalarMult(priv.g2, priv.gamma)
 	priv.precompute()
 
 	return priv, nil
@@ -228,24 +264,25 @@ func (priv *PrivateKey) NewMember(r io.Reader) (*MemberKey, error) {
 	var err error
 
 	mem.Group = priv.Group
-	mem.x, err = randomZp(r)
+	mem.x, err = randomZp(r, priv.pairing.Order())
 	if err != nil {
 		return nil, err
 	}
 
 	s := new(big.Int).Add(priv.gamma, mem.x)
-	s.ModInverse(s, bn256.Order)
-	mem.a = new(bn256.G1).ScalarMult(priv.g1, s)
+	s.ModInverse(s, priv.pairing.Order())
+	mem.a = priv.pairing.NewG1().ScalarMult(priv.g1, s)
 
 	return mem, nil
 }
 
 // Sign computes a group signature of digest using the given hash function.
 func (mem *MemberKey) Sign(r io.Reader, digest []byte, hashFunc hash.Hash) ([]byte, error) {
+	p := mem.pairing
 	var rnds [7]*big.Int
 	for i := range rnds {
 		var err error
-		rnds[i], err = randomZp(r)
+		rnds[i], err = randomZp(r, p.Order())
 		if err != nil {
 			return nil, err
 		}
@@ -253,17 +290,17 @@ func (mem *MemberKey) Sign(r io.Reader, digest []byte, hashFunc hash.Hash) ([]by
 	alpha := rnds[0]
 	beta := rnds[1]
 
-	t1 := new(bn256.G1).ScalarMult(mem.u, alpha)
-	t2 := new(bn256.G1).ScalarMult(mem.v, beta)
+	t1 := p.NewG1().ScalarMult(mem.u, alpha)
+	t2 := p.NewG1().ScalarMult(mem.v, beta)
 
 	tmp := new(big.Int).Add(alpha, beta)
-	t3 := new(bn256.G1).ScalarMult(mem.h, tmp)
+	t3 := p.NewG1().ScalarMult(mem.h, tmp)
 	t3.Add(t3, mem.a)
 
 	delta1 := new(big.Int).Mul(mem.x, alpha)
-	delta1.Mod(delta1, bn256.Order)
+	delta1.Mod(delta1, p.Order())
 	delta2 := new(big.Int).Mul(mem.x, beta)
-	delta2.Mod(delta2, bn256.Order)
+	delta2.Mod(delta2, p.Order())
 
 	ralpha := rnds[2]
 	rbeta := rnds[3]
@@ -271,33 +308,33 @@ func (mem *MemberKey) Sign(r io.Reader, digest []byte, hashFunc hash.Hash) ([]by
 	rdelta1 := rnds[5]
 	rdelta2 := rnds[6]
 
-	r1 := new(bn256.G1).ScalarMult(mem.u, ralpha)
-	r2 := new(bn256.G1).ScalarMult(mem.v, rbeta)
+	r1 := p.NewG1().ScalarMult(mem.u, ralpha)
+	r2 := p.NewG1().ScalarMult(mem.v, rbeta)
 
-	r3 := bn256.Pair(t3, mem.g2)
+	r3 := p.Pair(t3, mem.g2)
 	r3.ScalarMult(r3, rx)
 
 	tmp.Neg(ralpha)
 	tmp.Sub(tmp, rbeta)
-	tmp.Mod(tmp, bn256.Order)
-	tmpgt := new(bn256.GT).ScalarMult(mem.ehw, tmp)
+	tmp.Mod(tmp, p.Order())
+	tmpgt := p.NewGT().ScalarMult(mem.ehw, tmp)
 	r3.Add(r3, tmpgt)
 
 	tmp.Neg(rdelta1)
 	tmp.Sub(tmp, rdelta2)
-	tmp.Mod(tmp, bn256.Order)
+	tmp.Mod(tmp, p.Order())
 	tmpgt.ScalarMult(mem.ehg2, tmp)
 	r3.Add(r3, tmpgt)
 
-	r4 := new(bn256.G1).ScalarMult(t1, rx)
+	r4 := p.NewG1().ScalarMult(t1, rx)
 	tmp.Neg(rdelta1)
-	tmp.Add(tmp, bn256.Order)
-	tmpg := new(bn256.G1).ScalarMult(mem.u, tmp)
+	tmp.Add(tmp, p.Order())
+	tmpg := p.NewG1().ScalarMult(mem.u, tmp)
 	r4.Add(r4, tmpg)
 
-	r5 := new(bn256.G1).ScalarMult(t2, rx)
+	r5 := p.NewG1().ScalarMult(t2, rx)
 	tmp.Neg(rdelta2)
-	tmp.Add(tmp, bn256.Order)
+	tmp.Add(tmp, p.Order())
 	tmpg.ScalarMult(mem.v, tmp)
 	r5.Add(r5, tmpg)
 
@@ -316,27 +353,27 @@ func (mem *MemberKey) Sign(r io.Reader, digest []byte, hashFunc hash.Hash) ([]by
 	hashFunc.Write(r4.Marshal())
 	hashFunc.Write(r5.Marshal())
 	c := new(big.Int).SetBytes(hashFunc.Sum(nil))
-	c.Mod(c, bn256.Order)
+	c.Mod(c, p.Order())
 
 	salpha := new(big.Int).Mul(c, alpha)
 	salpha.Add(salpha, ralpha)
-	salpha.Mod(salpha, bn256.Order)
+	salpha.Mod(salpha, p.Order())
 
 	sbeta := new(big.Int).Mul(c, beta)
 	sbeta.Add(sbeta, rbeta)
-	sbeta.Mod(sbeta, bn256.Order)
+	sbeta.Mod(sbeta, p.Order())
 
 	sx := new(big.Int).Mul(c, mem.x)
 	sx.Add(sx, rx)
-	sx.Mod(sx, bn256.Order)
+	sx.Mod(sx, p.Order())
 
 	sdelta1 := new(big.Int).Mul(c, delta1)
 	sdelta1.Add(sdelta1, rdelta1)
-	sdelta1.Mod(sdelta1, bn256.Order)
+	sdelta1.Mod(sdelta1, p.Order())
 
 	sdelta2 := new(big.Int).Mul(c, delta2)
 	sdelta2.Add(sdelta2, rdelta2)
-	sdelta2.Mod(sdelta2, bn256.Order)
+	sdelta2.Mod(sdelta2, p.Order())
 
 	sig := make([]byte, 0, SignatureSize)
 	sig = append(sig, t1Bytes...)
@@ -355,19 +392,20 @@ func (mem *MemberKey) Sign(r io.Reader, digest []byte, hashFunc hash.Hash) ([]by
 // Verify verifies that sig is a valid signature of digest using the given hash
 // function.
 func (g *Group) Verify(digest []byte, hashFunc hash.Hash, sig []byte) bool {
+	p := g.pairing
 	if len(sig) != SignatureSize {
 		return false
 	}
 
-	t1, ok := new(bn256.G1).Unmarshal(sig[:2*32])
+	t1, ok := p.NewG1().Unmarshal(sig[:2*32])
 	if !ok {
 		return false
 	}
-	t2, ok := new(bn256.G1).Unmarshal(sig[2*32:4*32])
+	t2, ok := p.NewG1().Unmarshal(sig[2*32:4*32])
 	if !ok {
 		return false
 	}
-	t3, ok := new(bn256.G1).Unmarshal(sig[4*32:6*32])
+	t3, ok := p.NewG1().Unmarshal(sig[4*32:6*32])
 	if !ok {
 		return false
 	}
@@ -378,47 +416,49 @@ func (g *Group) Verify(digest []byte, hashFunc hash.Hash, sig []byte) bool {
 	sdelta1 := new(big.Int).SetBytes(sig[10*32:11*32])
 	sdelta2 := new(big.Int).SetBytes(sig[11*32:12*32])
 
-	r1 := new(bn256.G1).ScalarMult(g.u, salpha)
+	r1 := p.NewG1().ScalarMult(g.u, salpha)
 	tmp := new(big.Int).Neg(c)
-	tmp.Add(tmp, bn256.Order)
-	tmpg := new(bn256.G1).ScalarMult(t1, tmp)
+	tmp.Add(tmp, p.Order())
+	tmpg := p.NewG1().ScalarMult(t1, tmp)
 	r1.Add(r1, tmpg)
 
-	r2 := new(bn256.G1).ScalarMult(g.v, sbeta)
+	r2 := p.NewG1().ScalarMult(g.v, sbeta)
 	tmpg.ScalarMult(t2, tmp)
 	r2.Add(r2, tmpg)
 
-	r4 := new(bn256.G1).ScalarMult(t1, sx)
+	r4 := p.NewG1().ScalarMult(t1, sx)
 	tmp.Neg(sdelta1)
-	tmp.Add(tmp, bn256.Order)
+	tmp.Add(tmp, p.Order())
 	tmpg.ScalarMult(g.u, tmp)
 	r4.Add(r4, tmpg)
 
-	r5 := new(bn256.G1).ScalarMult(t2, sx)
+	r5 := p.NewG1().ScalarMult(t2, sx)
 	tmp.Neg(sdelta2)
-	tmp.Add(tmp, bn256.Order)
+	tmp.Add(tmp, p.Order())
 	tmpg.ScalarMult(g.v, tmp)
 	r5.Add(r5, tmpg)
 
-	r3 := bn256.Pair(t3, g.g2)
-	r3.ScalarMult(r3, sx)
+	// e(t3, g2)^sx * e(t3, w)^c is calculated as e(t3, sx*g2 + c*w), which
+	// saves a pairing and an exponentiation in GT.
+	q := p.NewG2().ScalarMult(g.g2, sx)
+	tmpq := p.NewG2().ScalarMult(g.w, c)
+	q.Add(q, tmpq)
+	r3 := p.Pair(t3, q)
 
 	tmp.Neg(salpha)
 	tmp.Sub(tmp, sbeta)
-	tmp.Mod(tmp, bn256.Order)
-	tmpgt := new(bn256.GT).ScalarMult(g.ehw, tmp)
+	tmp.Mod(tmp, p.Order())
+	tmpgt := p.NewGT().ScalarMult(g.ehw, tmp)
 	r3.Add(r3, tmpgt)
 
 	tmp.Neg(sdelta1)
 	tmp.Sub(tmp, sdelta2)
-	tmp.Mod(tmp, bn256.Order)
+	tmp.Mod(tmp, p.Order())
 	tmpgt.ScalarMult(g.ehg2, tmp)
 	r3.Add(r3, tmpgt)
 
-	et3w := bn256.Pair(t3, g.w)
-	et3w.Add(et3w, g.minusEg1g2)
-	et3w.ScalarMult(et3w, c)
-	r3.Add(r3, et3w)
+	tmpgt.ScalarMult(g.minusEg1g2, c)
+	r3.Add(r3, tmpgt)
 
 	hashFunc.Reset()
 	hashFunc.Write(digest)
@@ -431,7 +471,7 @@ func (g *Group) Verify(digest []byte, hashFunc hash.Hash, sig []byte) bool {
 	hashFunc.Write(r4.Marshal())
 	hashFunc.Write(r5.Marshal())
 	cprime := new(big.Int).SetBytes(hashFunc.Sum(nil))
-	cprime.Mod(cprime, bn256.Order)
+	cprime.Mod(cprime, p.Order())
 
 	return cprime.Cmp(c) == 0
 }
@@ -444,21 +484,21 @@ func (priv *PrivateKey) Open(sig []byte) ([]byte, bool) {
 		return nil, false
 	}
 
-	t1, ok := new(bn256.G1).Unmarshal(sig[:2*32])
+	t1, ok := priv.pairing.NewG1().Unmarshal(sig[:2*32])
 	if !ok {
 		return nil, false
 	}
-	t2, ok := new(bn256.G1).Unmarshal(sig[2*32:4*32])
+	t2, ok := priv.pairing.NewG1().Unmarshal(sig[2*32:4*32])
 	if !ok {
 		return nil, false
 	}
-	t3, ok := new(bn256.G1).Unmarshal(sig[4*32:6*32])
+	t3, ok := priv.pairing.NewG1().Unmarshal(sig[4*32:6*32])
 	if !ok {
 		return nil, false
 	}
 
-	a := new(bn256.G1).ScalarMult(t1, priv.xi1)
-	b := new(bn256.G1).ScalarMult(t2, priv.xi2)
+	a := priv.pairing.NewG1().ScalarMult(t1, priv.xi1)
+	b := priv.pairing.NewG1().ScalarMult(t2, priv.xi2)
 	a.Add(a, b)
 	a.Neg(a)
 	a.Add(t3, a)
@@ -471,16 +511,16 @@ func (priv *PrivateKey) Open(sig []byte) ([]byte, bool) {
 // new group that does not include the revoked member.
 type Revocation struct {
 	x *big.Int
-	a *bn256.G1
-	aStar *bn256.G2
+	a G1
+	aStar G2
 }
 
 // GenerateRevocation creates a Revocation that revokes the given member
 // private key.
 func (priv *PrivateKey) GenerateRevocation(mem *MemberKey) *Revocation {
 	s := new(big.Int).Add(priv.gamma, mem.x)
-	s.ModInverse(s, bn256.Order)
-	aStar := new(bn256.G2).ScalarMult(priv.g2, s)
+	s.ModInverse(s, priv.pairing.Order())
+	aStar := priv.pairing.NewG2().ScalarMult(priv.g2, s)
 
 	return &Revocation{mem.x, mem.a, aStar}
 }
@@ -500,12 +540,12 @@ func (r *Revocation) Unmarshal(b []byte) (*Revocation, bool) {
 	}
 
 	var ok bool
-	r.a, ok = new(bn256.G1).Unmarshal(b[:2*32])
+	r.a, ok = DefaultPairing.NewG1().Unmarshal(b[:2*32])
 	if !ok {
 		return nil, false
 	}
 	r.x = new(big.Int).SetBytes(b[2*32:3*32])
-	r.aStar, ok = new(bn256.G2).Unmarshal(b[3*32:7*32])
+	r.aStar, ok = DefaultPairing.NewG2().Unmarshal(b[3*32:7*32])
 	if !ok {
 		return nil, false
 	}
@@ -516,12 +556,14 @@ func (r *Revocation) Unmarshal(b []byte) (*Revocation, bool) {
 // save a specifically revoked member.
 func (g *Group) Update(r *Revocation) {
 	tmp := new(big.Int).Neg(r.x)
-	tmp.Add(tmp, bn256.Order)
-	t := new(bn256.G2).ScalarMult(r.aStar, tmp)
+	tmp.Add(tmp, g.pairing.Order())
+	t := g.pairing.NewG2().ScalarMult(r.aStar, tmp)
 	g.w.Add(g.g2, t)
 
-	g.g1 = r.a
-	g.g2 = r.aStar
+	// r may have been unmarshaled with a different Pairing so the new
+	// generators are copied via their serialisation.
+	g.g1, _ = g.pairing.NewG1().Unmarshal(r.a.Marshal())
+	g.g2, _ = g.pairing.NewG2().Unmarshal(r.aStar.Marshal())
 
 	g.precompute()
 }
@@ -535,11 +577,11 @@ func (mem *MemberKey) Update(r *Revocation) bool {
 	}
 
 	d := new(big.Int).Sub(mem.x, r.x)
-	d.Mod(d, bn256.Order)
-	d.ModInverse(d, bn256.Order)
+	d.Mod(d, mem.pairing.Order())
+	d.ModInverse(d, mem.pairing.Order())
 
-	newA := new(bn256.G1).ScalarMult(r.a, d)
-	t := new(bn256.G1).ScalarMult(mem.a, d)
+	newA := mem.pairing.NewG1().ScalarMult(r.a, d)
+	t := mem.pairing.NewG1().ScalarMult(mem.a, d)
 	t.Neg(t)
 	newA.Add(newA, t)
 
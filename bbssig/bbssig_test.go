@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"math/big"
 	"testing"
 )
 
@@ -34,6 +35,35 @@ func TestMarshal(t *testing.T) {
 	}
 }
 
+func TestWipe(t *testing.T) {
+	priv, err := GenerateGroup(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate group: %s", err)
+	}
+	member, err := priv.NewMember(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to add member to group: %s", err)
+	}
+
+	words := priv.gamma.Bits()
+	priv.Wipe()
+	for _, x := range []*big.Int{priv.xi1, priv.xi2, priv.gamma} {
+		if x.Sign() != 0 {
+			t.Errorf("private key value not zero after wiping")
+		}
+	}
+	for _, w := range words {
+		if w != 0 {
+			t.Errorf("private key memory not cleared after wiping")
+		}
+	}
+
+	member.Wipe()
+	if member.x.Sign() != 0 {
+		t.Errorf("member key value not zero after wiping")
+	}
+}
+
 func TestSign(t *testing.T) {
 	priv, err := GenerateGroup(rand.Reader)
 	if err != nil {
@@ -156,3 +186,46 @@ func BenchmarkVerify(b *testing.B) {
 		}
 	}
 }
+
+// countingPairing counts the number of pairings computed by the underlying
+// Pairing.
+type countingPairing struct {
+	Pairing
+	pairings int
+}
+
+func (p *countingPairing) Pair(a G1, b G2) GT {
+	p.pairings++
+	return p.Pairing.Pair(a, b)
+}
+
+func TestVerifyPairings(t *testing.T) {
+	pairing := &countingPairing{Pairing: DefaultPairing}
+	priv, err := GenerateGroupWithPairing(pairing, rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate group: %s", err)
+	}
+	member, err := priv.NewMember(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to add member to group: %s", err)
+	}
+
+	h := sha256.New()
+	h.Write([]byte("hello world"))
+	digest := h.Sum(nil)
+	sig, err := member.Sign(rand.Reader, digest, h)
+	if err != nil {
+		t.Fatalf("failed to sign message: %s", err)
+	}
+
+	// The pairings in the verification equation that don't depend on the
+	// signature are precomputed with the group, and e(t3, g2)^sx ·
+	// e(t3, w)^c is computed with a single pairing.
+	pairing.pairings = 0
+	if !priv.Group.Verify(digest, h, sig) {
+		t.Fatalf("signature failed to verify")
+	}
+	if pairing.pairings != 1 {
+		t.Errorf("Verify computed %d pairings, want 1", pairing.pairings)
+	}
+}
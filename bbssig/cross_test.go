@@ -0,0 +1,127 @@
+// +build bn256cgo
+
+package bbssig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+)
+
+var backends = []struct {
+	name    string
+	pairing Pairing
+}{
+	{"Go", GoPairing},
+	{"cgo", CgoPairing},
+}
+
+// testCrossBackend signs with a group created using signer and verifies,
+// opens and revokes using the serialised group under verifier.
+func testCrossBackend(t *testing.T, signer, verifier Pairing) {
+	priv, err := GenerateGroupWithPairing(signer, rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate group: %s", err)
+	}
+	member, err := priv.NewMember(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to add member to group: %s", err)
+	}
+	member2, err := priv.NewMember(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to add member to group: %s", err)
+	}
+
+	h := sha256.New()
+	h.Write([]byte("hello world"))
+	digest := h.Sum(nil)
+
+	sig, err := member.Sign(rand.Reader, digest, h)
+	if err != nil {
+		t.Fatalf("failed to sign message: %s", err)
+	}
+
+	groupBytes := priv.Group.Marshal()
+	group, ok := (&Group{pairing: verifier}).Unmarshal(groupBytes)
+	if !ok {
+		t.Fatalf("failed to unmarshal group")
+	}
+	if !bytes.Equal(group.Marshal(), groupBytes) {
+		t.Errorf("reserialising group produces different result")
+	}
+	if !group.Verify(digest, h, sig) {
+		t.Errorf("signature failed to verify")
+	}
+	digest[1] ^= 0x80
+	if group.Verify(digest, h, sig) {
+		t.Errorf("signature always verifies")
+	}
+	digest[1] ^= 0x80
+
+	privCopy, ok := new(PrivateKey).Unmarshal(group, priv.Marshal())
+	if !ok {
+		t.Fatalf("failed to unmarshal private key")
+	}
+	tag, ok := privCopy.Open(sig)
+	if !ok {
+		t.Fatalf("failed to open signature")
+	}
+	if !bytes.Equal(tag, member.Tag()) {
+		t.Errorf("signature opened to wrong member")
+	}
+
+	// Revoke member using the signing backend and check that member2,
+	// updated under the verifying backend, still produces valid
+	// signatures.
+	rev := priv.GenerateRevocation(member)
+	member2Copy, ok := new(MemberKey).Unmarshal(group, member2.Marshal())
+	if !ok {
+		t.Fatalf("failed to unmarshal member key")
+	}
+	group.Update(rev)
+	if !member2Copy.Update(rev) {
+		t.Fatalf("failed to update member key")
+	}
+	sig, err = member2Copy.Sign(rand.Reader, digest, h)
+	if err != nil {
+		t.Fatalf("failed to sign message: %s", err)
+	}
+	priv.Group.Update(rev)
+	if !priv.Group.Verify(digest, h, sig) {
+		t.Errorf("signature from updated member failed to verify")
+	}
+}
+
+func TestCrossBackend(t *testing.T) {
+	for _, signer := range backends {
+		for _, verifier := range backends {
+			if signer.pairing == verifier.pairing {
+				continue
+			}
+			t.Logf("signing with %s, verifying with %s", signer.name, verifier.name)
+			testCrossBackend(t, signer.pairing, verifier.pairing)
+		}
+	}
+}
+
+func TestCrossBackendElements(t *testing.T) {
+	for _, b := range backends {
+		for _, other := range backends {
+			_, a, err := b.pairing.RandomG1(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, q, err := other.pairing.RandomG2(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := b.pairing.Pair(a, q).Marshal()
+			want := other.pairing.Pair(a, q).Marshal()
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s and %s backends disagree on a pairing", b.name, other.name)
+			}
+		}
+	}
+}
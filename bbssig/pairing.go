@@ -0,0 +1,61 @@
+package bbssig
+
+import (
+	"io"
+	"math/big"
+)
+
+// Pairing is the interface to an implementation of the BN256 pairing. bbssig
+// is written against this interface so that either the pure-Go bn256 package
+// or the much faster, cgo based bn256cgo package can be used. Both use the
+// same curve and the same serialisation so groups, keys and signatures
+// created with one can be used with the other.
+//
+// Elements follow the conventions of the bn256 package: operations set the
+// receiver to the result and return it.
+type Pairing interface {
+	// Order returns the number of elements in both G₁ and G₂.
+	Order() *big.Int
+	NewG1() G1
+	NewG2() G2
+	NewGT() GT
+	// RandomG1 returns x and g₁ˣ where x is a random, non-zero number
+	// read from r.
+	RandomG1(r io.Reader) (*big.Int, G1, error)
+	// RandomG2 returns x and g₂ˣ where x is a random, non-zero number
+	// read from r.
+	RandomG2(r io.Reader) (*big.Int, G2, error)
+	// Pair calculates an Optimal Ate pairing.
+	Pair(a G1, b G2) GT
+}
+
+// G1 is an element of the group G₁.
+type G1 interface {
+	Add(a, b G1) G1
+	ScalarMult(base G1, k *big.Int) G1
+	Neg(a G1) G1
+	Marshal() []byte
+	Unmarshal(m []byte) (G1, bool)
+}
+
+// G2 is an element of the group G₂.
+type G2 interface {
+	Add(a, b G2) G2
+	ScalarMult(base G2, k *big.Int) G2
+	Marshal() []byte
+	Unmarshal(m []byte) (G2, bool)
+}
+
+// GT is an element of the target group of the pairing.
+type GT interface {
+	Add(a, b GT) GT
+	ScalarMult(base GT, k *big.Int) GT
+	Neg(a GT) GT
+	Marshal() []byte
+	Unmarshal(m []byte) (GT, bool)
+}
+
+// DefaultPairing is the Pairing used by GenerateGroup and when unmarshaling
+// groups and revocations. It's GoPairing unless bbssig is built with the
+// bn256cgo build tag, in which case it's CgoPairing.
+var DefaultPairing Pairing = defaultPairing
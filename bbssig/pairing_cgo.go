@@ -0,0 +1,155 @@
+// +build bn256cgo
+
+package bbssig
+
+import (
+	"io"
+	"math/big"
+
+	"github.com/agl/pond/bn256cgo"
+)
+
+// CgoPairing is a Pairing implemented by the bn256cgo package. It's only
+// available when built with the bn256cgo build tag.
+var CgoPairing Pairing = cgoPairing{}
+
+var defaultPairing = cgoPairing{}
+
+type cgoPairing struct{}
+
+func (cgoPairing) Order() *big.Int { return bn256cgo.Order }
+func (cgoPairing) NewG1() G1       { return &cgoG1{new(bn256cgo.G1)} }
+func (cgoPairing) NewG2() G2       { return &cgoG2{new(bn256cgo.G2)} }
+func (cgoPairing) NewGT() GT       { return &cgoGT{new(bn256cgo.GT)} }
+
+func (cgoPairing) RandomG1(r io.Reader) (*big.Int, G1, error) {
+	k, p, err := bn256cgo.RandomG1(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, &cgoG1{p}, nil
+}
+
+func (cgoPairing) RandomG2(r io.Reader) (*big.Int, G2, error) {
+	k, p, err := bn256cgo.RandomG2(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, &cgoG2{p}, nil
+}
+
+func (cgoPairing) Pair(a G1, b G2) GT {
+	return &cgoGT{bn256cgo.Pair(toCgoG1(a), toCgoG2(b))}
+}
+
+type cgoG1 struct{ p *bn256cgo.G1 }
+type cgoG2 struct{ p *bn256cgo.G2 }
+type cgoGT struct{ p *bn256cgo.GT }
+
+// toCgoG1 returns the bn256cgo value of e. If e is from a different backend
+// then it's converted via its serialisation.
+func toCgoG1(e G1) *bn256cgo.G1 {
+	if g, ok := e.(*cgoG1); ok {
+		return g.p
+	}
+	p, ok := new(bn256cgo.G1).Unmarshal(e.Marshal())
+	if !ok {
+		panic("bbssig: failed to convert G1 element between backends")
+	}
+	return p
+}
+
+func toCgoG2(e G2) *bn256cgo.G2 {
+	if g, ok := e.(*cgoG2); ok {
+		return g.p
+	}
+	p, ok := new(bn256cgo.G2).Unmarshal(e.Marshal())
+	if !ok {
+		panic("bbssig: failed to convert G2 element between backends")
+	}
+	return p
+}
+
+func toCgoGT(e GT) *bn256cgo.GT {
+	if g, ok := e.(*cgoGT); ok {
+		return g.p
+	}
+	p, ok := new(bn256cgo.GT).Unmarshal(e.Marshal())
+	if !ok {
+		panic("bbssig: failed to convert GT element between backends")
+	}
+	return p
+}
+
+func (e *cgoG1) Add(a, b G1) G1 {
+	e.p.Add(toCgoG1(a), toCgoG1(b))
+	return e
+}
+
+func (e *cgoG1) ScalarMult(base G1, k *big.Int) G1 {
+	e.p.ScalarMult(toCgoG1(base), k)
+	return e
+}
+
+func (e *cgoG1) Neg(a G1) G1 {
+	e.p.Neg(toCgoG1(a))
+	return e
+}
+
+func (e *cgoG1) Marshal() []byte {
+	return e.p.Marshal()
+}
+
+func (e *cgoG1) Unmarshal(m []byte) (G1, bool) {
+	if _, ok := e.p.Unmarshal(m); !ok {
+		return nil, false
+	}
+	return e, true
+}
+
+func (e *cgoG2) Add(a, b G2) G2 {
+	e.p.Add(toCgoG2(a), toCgoG2(b))
+	return e
+}
+
+func (e *cgoG2) ScalarMult(base G2, k *big.Int) G2 {
+	e.p.ScalarMult(toCgoG2(base), k)
+	return e
+}
+
+func (e *cgoG2) Marshal() []byte {
+	return e.p.Marshal()
+}
+
+func (e *cgoG2) Unmarshal(m []byte) (G2, bool) {
+	if _, ok := e.p.Unmarshal(m); !ok {
+		return nil, false
+	}
+	return e, true
+}
+
+func (e *cgoGT) Add(a, b GT) GT {
+	e.p.Add(toCgoGT(a), toCgoGT(b))
+	return e
+}
+
+func (e *cgoGT) ScalarMult(base GT, k *big.Int) GT {
+	e.p.ScalarMult(toCgoGT(base), k)
+	return e
+}
+
+func (e *cgoGT) Neg(a GT) GT {
+	e.p.Neg(toCgoGT(a))
+	return e
+}
+
+func (e *cgoGT) Marshal() []byte {
+	return e.p.Marshal()
+}
+
+func (e *cgoGT) Unmarshal(m []byte) (GT, bool) {
+	if _, ok := e.p.Unmarshal(m); !ok {
+		return nil, false
+	}
+	return e, true
+}
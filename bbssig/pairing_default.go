@@ -0,0 +1,5 @@
+// +build !bn256cgo
+
+package bbssig
+
+var defaultPairing = goPairing{}
@@ -0,0 +1,150 @@
+package bbssig
+
+import (
+	"io"
+	"math/big"
+
+	"code.google.com/p/go.crypto/bn256"
+)
+
+// GoPairing is a Pairing implemented by the pure-Go bn256 package.
+var GoPairing Pairing = goPairing{}
+
+type goPairing struct{}
+
+func (goPairing) Order() *big.Int { return bn256.Order }
+func (goPairing) NewG1() G1       { return &goG1{new(bn256.G1)} }
+func (goPairing) NewG2() G2       { return &goG2{new(bn256.G2)} }
+func (goPairing) NewGT() GT       { return &goGT{new(bn256.GT)} }
+
+func (goPairing) RandomG1(r io.Reader) (*big.Int, G1, error) {
+	k, p, err := bn256.RandomG1(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, &goG1{p}, nil
+}
+
+func (goPairing) RandomG2(r io.Reader) (*big.Int, G2, error) {
+	k, p, err := bn256.RandomG2(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, &goG2{p}, nil
+}
+
+func (goPairing) Pair(a G1, b G2) GT {
+	return &goGT{bn256.Pair(toGoG1(a), toGoG2(b))}
+}
+
+type goG1 struct{ p *bn256.G1 }
+type goG2 struct{ p *bn256.G2 }
+type goGT struct{ p *bn256.GT }
+
+// toGoG1 returns the bn256 value of e. If e is from a different backend then
+// it's converted via its serialisation.
+func toGoG1(e G1) *bn256.G1 {
+	if g, ok := e.(*goG1); ok {
+		return g.p
+	}
+	p, ok := new(bn256.G1).Unmarshal(e.Marshal())
+	if !ok {
+		panic("bbssig: failed to convert G1 element between backends")
+	}
+	return p
+}
+
+func toGoG2(e G2) *bn256.G2 {
+	if g, ok := e.(*goG2); ok {
+		return g.p
+	}
+	p, ok := new(bn256.G2).Unmarshal(e.Marshal())
+	if !ok {
+		panic("bbssig: failed to convert G2 element between backends")
+	}
+	return p
+}
+
+func toGoGT(e GT) *bn256.GT {
+	if g, ok := e.(*goGT); ok {
+		return g.p
+	}
+	p, ok := new(bn256.GT).Unmarshal(e.Marshal())
+	if !ok {
+		panic("bbssig: failed to convert GT element between backends")
+	}
+	return p
+}
+
+func (e *goG1) Add(a, b G1) G1 {
+	e.p.Add(toGoG1(a), toGoG1(b))
+	return e
+}
+
+func (e *goG1) ScalarMult(base G1, k *big.Int) G1 {
+	e.p.ScalarMult(toGoG1(base), k)
+	return e
+}
+
+func (e *goG1) Neg(a G1) G1 {
+	e.p.Neg(toGoG1(a))
+	return e
+}
+
+func (e *goG1) Marshal() []byte {
+	return e.p.Marshal()
+}
+
+func (e *goG1) Unmarshal(m []byte) (G1, bool) {
+	if _, ok := e.p.Unmarshal(m); !ok {
+		return nil, false
+	}
+	return e, true
+}
+
+func (e *goG2) Add(a, b G2) G2 {
+	e.p.Add(toGoG2(a), toGoG2(b))
+	return e
+}
+
+func (e *goG2) ScalarMult(base G2, k *big.Int) G2 {
+	e.p.ScalarMult(toGoG2(base), k)
+	return e
+}
+
+func (e *goG2) Marshal() []byte {
+	return e.p.Marshal()
+}
+
+func (e *goG2) Unmarshal(m []byte) (G2, bool) {
+	if _, ok := e.p.Unmarshal(m); !ok {
+		return nil, false
+	}
+	return e, true
+}
+
+func (e *goGT) Add(a, b GT) GT {
+	e.p.Add(toGoGT(a), toGoGT(b))
+	return e
+}
+
+func (e *goGT) ScalarMult(base GT, k *big.Int) GT {
+	e.p.ScalarMult(toGoGT(base), k)
+	return e
+}
+
+func (e *goGT) Neg(a GT) GT {
+	e.p.Neg(toGoGT(a))
+	return e
+}
+
+func (e *goGT) Marshal() []byte {
+	return e.p.Marshal()
+}
+
+func (e *goGT) Unmarshal(m []byte) (GT, bool) {
+	if _, ok := e.p.Unmarshal(m); !ok {
+		return nil, false
+	}
+	return e, true
+}
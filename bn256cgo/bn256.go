@@ -1,14 +1,5 @@
-/*
-Package bn256cgo is a drop in replacement for the bn256 package from go.crypto.
-
-It should be about 10x faster than the pure-Go version when run on an amd64
-based system. It wraps a patched version of
-http://cryptojedi.org/crypto/#dclxvi.
+// +build bn256cgo
 
-See the original package for documentation.
-
-[1] http://cryptojedi.org/papers/dclxvi-20100714.pdf
-*/
 package bn256cgo
 
 import (
@@ -19,8 +10,7 @@ import (
 	"unsafe"
 )
 
-// #cgo CFLAGS: -I/home/agl/devel/dclxvi
-// #cgo LDFLAGS: -L/home/agl/devel/dclxvi -ldclxvipairing -lm
+// #cgo LDFLAGS: -ldclxvipairing -lm
 /*
 #include <stdio.h>
 #include <string.h>
@@ -1,3 +1,5 @@
+// +build bn256cgo
+
 package bn256cgo
 
 import (
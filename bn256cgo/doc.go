@@ -0,0 +1,18 @@
+/*
+Package bn256cgo is a drop in replacement for the bn256 package from go.crypto.
+
+It should be about 10x faster than the pure-Go version when run on an amd64
+based system. It wraps a patched version of
+http://cryptojedi.org/crypto/#dclxvi.
+
+See the original package for documentation.
+
+This package is only built with the bn256cgo build tag, which also causes
+bbssig to use it. The location of the dclxvi headers and library is taken
+from the environment, for example:
+
+	CGO_CFLAGS=-I$HOME/dclxvi CGO_LDFLAGS=-L$HOME/dclxvi go build -tags bn256cgo ./...
+
+[1] http://cryptojedi.org/papers/dclxvi-20100714.pdf
+*/
+package bn256cgo
@@ -106,9 +106,10 @@ type Label struct {
 
 type Entry struct {
 	widgetBase
-	text     string
-	width    int
-	password bool
+	text           string
+	width          int
+	password       bool
+	updateOnChange bool
 }
 
 type Button struct {
@@ -170,7 +171,10 @@ type InsertRow struct {
 
 type Image struct {
 	widgetBase
-	image          Indicator
+	image Indicator
+	// png, if not empty, contains a PNG image that is shown instead of
+	// image.
+	png            []byte
 	xAlign, yAlign float32
 }
 
@@ -1,57 +1,85 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"code.google.com/p/go.crypto/nacl/secretbox"
 	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/client/secret"
+	"github.com/agl/pond/client/system"
 	pond "github.com/agl/pond/protos"
 )
 
 var backgroundCanceledError = errors.New("background task canceled")
 
-func (c *client) startEncryption(id uint64, outPath, inPath string) (cancel func()) {
+// The background operations below are started by functions that return a
+// function to cancel the operation and a channel that's closed once the
+// goroutine doing it has finished with its files. If prev isn't nil then the
+// goroutine waits for it to be closed before starting so that an operation can
+// be restarted before the previous instance has noticed that it was canceled.
+
+func (c *client) startEncryption(prev chan bool, id uint64, outPath, inPath string) (cancel func(), exited chan bool) {
+	var key [32]byte
+	c.randBytes(key[:])
+
 	killChan := make(chan bool, 1)
+	exited = make(chan bool)
 	go func() {
+		defer secret.Wipe(key[:])
+		if prev != nil {
+			<-prev
+		}
+
 		var detachment *pond.Message_Detachment
 		var out *os.File
 		var err error
 		if out, err = os.OpenFile(outPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
 			err = errors.New("failed to open output: " + err.Error())
 		} else {
-			defer out.Close()
-			detachment, err = saveEncrypted(c.rand, c.backgroundChan, out, id, inPath, killChan)
+			detachment, err = saveEncrypted(&key, c.backgroundChan, out, id, inPath, killChan)
+			out.Close()
+		}
+		if detachment == nil {
+			os.Remove(outPath)
 		}
+		close(exited)
 		if detachment != nil {
 			c.backgroundChan <- DetachmentComplete{id, detachment}
 		} else {
-			os.Remove(outPath)
 			c.backgroundChan <- DetachmentError{id, err}
 		}
 	}()
 	return func() {
 		killChan <- true
-	}
+	}, exited
 }
 
-func (c *client) startDecryption(id uint64, outPath, inPath string, detachment *pond.Message_Detachment) (cancel func()) {
+func (c *client) startDecryption(prev chan bool, id uint64, outPath, inPath string, detachment *pond.Message_Detachment) (cancel func(), exited chan bool) {
 	killChan := make(chan bool, 1)
+	exited = make(chan bool)
 	go func() {
+		if prev != nil {
+			<-prev
+		}
 		var in *os.File
 		var err error
 		if in, err = os.Open(inPath); err != nil {
 			err = errors.New("failed to open input: " + err.Error())
 		} else {
-			defer in.Close()
-			err = saveDecrypted(c.backgroundChan, outPath, id, in, detachment, killChan)
+			err = saveDecrypted(c.backgroundChan, c.log, outPath, id, in, detachment, killChan)
+			in.Close()
 		}
+		close(exited)
 		if err != nil {
 			c.backgroundChan <- DetachmentError{id, err}
 		} else {
@@ -60,77 +88,136 @@ func (c *client) startDecryption(id uint64, outPath, inPath string, detachment *
 	}()
 	return func() {
 		killChan <- true
-	}
+	}, exited
 }
 
 func (c *client) buildDetachmentURL(id uint64) string {
-	u, err := url.Parse(c.server)
+	return detachmentURL(c.server, &c.identityPublic, id)
+}
+
+// detachmentURL returns the URL of the file with the given id in the account
+// of owner on server.
+func detachmentURL(server string, owner *[32]byte, id uint64) string {
+	u, err := url.Parse(server)
 	if err != nil {
-		panic("own server failed to parse as URL")
+		panic("server failed to parse as URL: " + server)
 	}
 
-	u.Path = fmt.Sprintf("/%x/%x", c.identityPublic[:], id)
+	u.Path = fmt.Sprintf("/%x/%x", owner[:], id)
 	return u.String()
 }
 
-func (c *client) startUpload(id uint64, inPath string) (cancel func()) {
+// transferPath returns the path of a temporary file for the transfer with
+// the given id. These files live beside the state file so that transfers can
+// be resumed after a restart.
+func (c *client) transferPath(kind string, id uint64) string {
+	return filepath.Join(c.stateFilename+".transfers", fmt.Sprintf("%s-%x", kind, id))
+}
+
+// openTransferFile opens, or creates, the temporary file of a transfer
+// without truncating it.
+func openTransferFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.New("failed to create transfers directory: " + err.Error())
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.New("failed to open temp file: " + err.Error())
+	}
+	return f, nil
+}
+
+// startUpload encrypts inPath to tmpPath, unless detachment shows that has
+// already been done, and uploads the result to the home server, or to the
+// home server of a contact if target is non-nil. Since the server keeps
+// partial uploads, and since encrypting with the same key gives the same
+// result, an interrupted upload continues from where it stopped.
+func (c *client) startUpload(prev chan bool, id uint64, inPath, tmpPath string, key [32]byte, detachment *pond.Message_Detachment, maxDownloads uint32, target *deliveryTarget) (cancel func(), exited chan bool) {
 	killChan := make(chan bool, 1)
+	exited = make(chan bool)
 	go func() {
-		var detachment *pond.Message_Detachment
-		var tmp *os.File
-		var err error
-		if tmp, err = ioutil.TempFile("" /* default tmp dir */, "pond-upload-"); err != nil {
-			err = errors.New("failed to create temp file: " + err.Error())
-		} else {
-			os.Remove(tmp.Name())
-			defer tmp.Close()
-			detachment, err = saveEncrypted(c.rand, c.backgroundChan, tmp, id, inPath, killChan)
+		defer secret.Wipe(key[:])
+		if prev != nil {
+			<-prev
+		}
+
+		tmp, err := openTransferFile(tmpPath)
+		if err == nil {
+			if detachment == nil || !fileHasSize(tmp, int64(detachment.GetPaddedSize())) {
+				// Either the encryption never finished or the
+				// encrypted file has been lost.
+				if err = tmp.Truncate(0); err == nil {
+					detachment, err = saveEncrypted(&key, c.backgroundChan, tmp, id, inPath, killChan)
+				}
+				if err == nil {
+					c.backgroundChan <- DetachmentEncrypted{id, detachment}
+				}
+			}
 			if err == nil {
-				err = c.uploadDetachment(c.backgroundChan, tmp, id, killChan)
+				err = c.uploadDetachment(c.backgroundChan, tmp, id, maxDownloads, target, killChan)
 			}
+			tmp.Close()
+		}
+		if err != backgroundCanceledError {
+			// A canceled upload may be resumed so its file is
+			// kept. Otherwise it's no longer needed.
+			eraseFile(c.log, tmpPath)
 		}
+		close(exited)
 		if err == nil {
-			detachment.Url = proto.String(c.buildDetachmentURL(id))
+			if target != nil {
+				detachment.Url = proto.String(detachmentURL(target.server, &target.to, id))
+			} else {
+				detachment.Url = proto.String(c.buildDetachmentURL(id))
+			}
 			c.log.Printf("Finished upload of %s", *detachment.Url)
 			c.backgroundChan <- DetachmentComplete{id, detachment}
 		} else {
 			c.backgroundChan <- DetachmentError{id, err}
 		}
-		tmp.Close()
 	}()
 	return func() {
 		killChan <- true
-	}
+	}, exited
 }
 
-func (c *client) startDownload(id uint64, outPath string, detachment *pond.Message_Detachment) (cancel func()) {
+// startDownload downloads a detachment into tmpPath, continuing from the
+// current length of that file, and decrypts the result into outPath.
+func (c *client) startDownload(prev chan bool, id uint64, outPath, tmpPath string, detachment *pond.Message_Detachment) (cancel func(), exited chan bool) {
 	killChan := make(chan bool, 1)
+	exited = make(chan bool)
 	go func() {
-		var tmp *os.File
-		var err error
-		if tmp, err = ioutil.TempFile("" /* default tmp dir */, "pond-download-"); err != nil {
-			err = errors.New("failed to create temp file: " + err.Error())
-		} else {
-			os.Remove(tmp.Name())
-			defer tmp.Close()
+		if prev != nil {
+			<-prev
+		}
+		tmp, err := openTransferFile(tmpPath)
+		if err == nil {
 			err = c.downloadDetachment(c.backgroundChan, tmp, id, *detachment.Url, killChan)
 			if err == nil {
-				_, err := tmp.Seek(0, 0 /* from start */)
-				if err == nil {
-					err = saveDecrypted(c.backgroundChan, outPath, id, tmp, detachment, killChan)
+				if _, err = tmp.Seek(0, 0 /* from start */); err == nil {
+					err = saveDecrypted(c.backgroundChan, c.log, outPath, id, tmp, detachment, killChan)
 				}
 			}
+			tmp.Close()
+		}
+		if err != backgroundCanceledError {
+			eraseFile(c.log, tmpPath)
 		}
+		close(exited)
 		if err == nil {
 			c.backgroundChan <- DetachmentComplete{id, nil}
 		} else {
 			c.backgroundChan <- DetachmentError{id, err}
 		}
-		tmp.Close()
 	}()
 	return func() {
 		killChan <- true
-	}
+	}, exited
+}
+
+func fileHasSize(f *os.File, size int64) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Size() == size
 }
 
 type DetachmentProgress struct {
@@ -144,6 +231,14 @@ type DetachmentError struct {
 	err error
 }
 
+// DetachmentEncrypted is sent when the file of an upload has been encrypted
+// so that the resulting detachment can be recorded in case the upload is
+// interrupted.
+type DetachmentEncrypted struct {
+	id         uint64
+	detachment *pond.Message_Detachment
+}
+
 type DetachmentComplete struct {
 	id         uint64
 	detachment *pond.Message_Detachment
@@ -151,7 +246,17 @@ type DetachmentComplete struct {
 
 const defaultDetachmentBlockSize = 16384 - secretbox.Overhead
 
-func saveEncrypted(rand io.Reader, c chan interface{}, out io.Writer, id uint64, inPath string, killChan chan bool) (*pond.Message_Detachment, error) {
+// detachmentFinalMarker starts the trailer at the end of the final chunk of a
+// detachment. The trailer continues with the SHA-256 hash of the contents.
+const detachmentFinalMarker = "pond detachment end\x00"
+
+const detachmentTrailerLen = len(detachmentFinalMarker) + sha256.Size
+
+func isPowerOfTwo(n uint64) bool {
+	return n&(n-1) == 0
+}
+
+func saveEncrypted(key *[32]byte, c chan interface{}, out io.Writer, id uint64, inPath string, killChan chan bool) (*pond.Message_Detachment, error) {
 	in, err := os.Open(inPath)
 	if err != nil {
 		return nil, errors.New("failed to open input: " + err.Error())
@@ -163,15 +268,12 @@ func saveEncrypted(rand io.Reader, c chan interface{}, out io.Writer, id uint64,
 		size = fileInfo.Size()
 	}
 
-	var key [32]byte
 	var nonce [24]byte
 
-	if _, err := io.ReadFull(rand, key[:]); err != nil {
-		panic(err)
-	}
-
 	blockSize := defaultDetachmentBlockSize
+	boxSize := uint64(blockSize + secretbox.Overhead)
 	buf := make([]byte, blockSize)
+	h := sha256.New()
 
 	var fileSize, bytesOut uint64
 	var eof bool
@@ -179,8 +281,11 @@ func saveEncrypted(rand io.Reader, c chan interface{}, out io.Writer, id uint64,
 	var lastUpdate time.Time
 
 	for {
+		// n is the number of bytes of the file in this chunk. The
+		// remainder of the chunk is padding.
+		n := 0
 		if !eof {
-			n, err := io.ReadFull(in, buf)
+			n, err = io.ReadFull(in, buf)
 			switch err {
 			case nil:
 				break
@@ -190,17 +295,29 @@ func saveEncrypted(rand io.Reader, c chan interface{}, out io.Writer, id uint64,
 				return nil, errors.New("failed to read from source file: " + err.Error())
 			}
 			fileSize += uint64(n)
+			h.Write(buf[:n])
 		}
-		boxBuf = secretbox.Seal(boxBuf[:0], buf, &nonce, &key)
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+
+		// Stop when we've read all of the file, have space for the
+		// trailer and will hit a power of two.
+		final := eof && n <= blockSize-detachmentTrailerLen && isPowerOfTwo(bytesOut+boxSize)
+		if final {
+			trailer := buf[blockSize-detachmentTrailerLen:]
+			copy(trailer, detachmentFinalMarker)
+			copy(trailer[len(detachmentFinalMarker):], h.Sum(nil))
+		}
+
+		boxBuf = secretbox.Seal(boxBuf[:0], buf, &nonce, key)
 
 		if _, err := out.Write(boxBuf); err != nil {
 			return nil, errors.New("failed to write to destination: " + err.Error())
 		}
 		bytesOut += uint64(len(boxBuf))
 
-		// Stop when we've read all of the file and have hit a power of
-		// two.
-		if eof && (bytesOut&(bytesOut-1)) == 0 {
+		if final {
 			break
 		}
 
@@ -233,11 +350,22 @@ func saveEncrypted(rand io.Reader, c chan interface{}, out io.Writer, id uint64,
 		Size:       proto.Uint64(fileSize),
 		PaddedSize: proto.Uint64(bytesOut),
 		ChunkSize:  proto.Uint32(uint32(blockSize)),
-		Key:        key[:],
+		Key:        append([]byte(nil), key[:]...),
+		Hash:       h.Sum(nil),
 	}, nil
 }
 
-func saveDecrypted(c chan interface{}, outPath string, id uint64, in *os.File, detachment *pond.Message_Detachment, killChan chan bool) error {
+// eraseFile erases the file at path, as thoroughly as the filesystem allows,
+// and logs the protection that was achieved.
+func eraseFile(log *Log, path string) {
+	erasure, err := disk.EraseFile(path)
+	if err != nil {
+		log.Errorf("Error while erasing %s: %s", path, err)
+	}
+	log.Printf("Erased %s: %s", path, erasure)
+}
+
+func saveDecrypted(c chan interface{}, log *Log, outPath string, id uint64, in *os.File, detachment *pond.Message_Detachment, killChan chan bool) error {
 	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return errors.New("failed to open output: " + err.Error())
@@ -252,11 +380,26 @@ func saveDecrypted(c chan interface{}, outPath string, id uint64, in *os.File, d
 		return errors.New("chunk size too large")
 	}
 
+	// Detachments with a hash end with a trailer that must fit after the
+	// contents.
+	verify := len(detachment.Hash) > 0
+	if verify {
+		chunks := *detachment.PaddedSize / uint64(blockSize)
+		if len(detachment.Hash) != sha256.Size ||
+			*detachment.ChunkSize < uint32(detachmentTrailerLen) ||
+			*detachment.PaddedSize%uint64(blockSize) != 0 ||
+			*detachment.Size+uint64(detachmentTrailerLen) > chunks*uint64(*detachment.ChunkSize) {
+			return errors.New("invalid detachment parameters")
+		}
+	}
+
 	copy(key[:], detachment.Key)
 
 	var bytesIn, bytesOut uint64
 	buf := make([]byte, blockSize)
 	var decrypted []byte
+	var sawFinalChunk bool
+	h := sha256.New()
 	var lastUpdate time.Time
 
 BlockLoop:
@@ -275,19 +418,31 @@ BlockLoop:
 		var ok bool
 		decrypted, ok = secretbox.Open(decrypted[:0], buf, &nonce, &key)
 		if !ok {
-			os.Remove(outPath)
+			eraseFile(log, outPath)
 			return errors.New("input corrupt")
 		}
 
 		if bytesOut != *detachment.Size {
-			if n := bytesOut + uint64(len(decrypted)); n > *detachment.Size {
-				decrypted = decrypted[:*detachment.Size-bytesOut]
+			contents := decrypted
+			if n := bytesOut + uint64(len(contents)); n > *detachment.Size {
+				contents = contents[:*detachment.Size-bytesOut]
 			}
-			bytesOut += uint64(len(decrypted))
+			bytesOut += uint64(len(contents))
 
-			if _, err := out.Write(decrypted); err != nil {
+			if _, err := out.Write(contents); err != nil {
 				return errors.New("failed to write to destination: " + err.Error())
 			}
+			h.Write(contents)
+		}
+
+		if verify && bytesIn == *detachment.PaddedSize {
+			trailer := decrypted[len(decrypted)-detachmentTrailerLen:]
+			if string(trailer[:len(detachmentFinalMarker)]) != detachmentFinalMarker ||
+				!bytes.Equal(trailer[len(detachmentFinalMarker):], detachment.Hash) {
+				eraseFile(log, outPath)
+				return errors.New("final chunk of detachment is missing or corrupt")
+			}
+			sawFinalChunk = true
 		}
 
 		if bytesIn > *detachment.PaddedSize {
@@ -314,7 +469,7 @@ BlockLoop:
 
 		select {
 		case <-killChan:
-			os.Remove(outPath)
+			eraseFile(log, outPath)
 			return backgroundCanceledError
 		default:
 			break
@@ -325,6 +480,17 @@ BlockLoop:
 		return errors.New("input truncated")
 	}
 
+	if verify {
+		if !sawFinalChunk {
+			eraseFile(log, outPath)
+			return errors.New("final chunk of detachment is missing")
+		}
+		if !bytes.Equal(h.Sum(nil), detachment.Hash) {
+			eraseFile(log, outPath)
+			return errors.New("detachment hash mismatch")
+		}
+	}
+
 	return nil
 }
 
@@ -336,3 +502,417 @@ func incNonce(nonce *[24]byte) {
 		s >>= 8
 	}
 }
+
+// startDetachment starts, or restarts, the operation that turns the file of
+// pending into a detachment.
+func (c *client) startDetachment(id uint64, pending *pendingDetachment) {
+	pending.paused = false
+	if !pending.upload {
+		pending.cancel, pending.exited = c.startEncryption(pending.exited, id, pending.outPath, pending.path)
+		return
+	}
+
+	if len(pending.tmpPath) == 0 {
+		pending.tmpPath = c.transferPath("upload", id)
+	}
+	if len(pending.key) != 32 {
+		pending.key = make([]byte, 32)
+		c.randBytes(pending.key)
+		pending.detachment = nil
+	}
+	var target *deliveryTarget
+	if pending.deliverTo != 0 {
+		var err error
+		if target, err = c.newDeliveryTarget(pending.deliverTo); err != nil {
+			go func() {
+				c.backgroundChan <- DetachmentError{id, err}
+			}()
+			return
+		}
+	}
+	var key [32]byte
+	copy(key[:], pending.key)
+	var detachment *pond.Message_Detachment
+	if pending.detachment != nil {
+		detachment = proto.Clone(pending.detachment).(*pond.Message_Detachment)
+	}
+	pending.cancel, pending.exited = c.startUpload(pending.exited, id, pending.path, pending.tmpPath, key, detachment, pending.maxDownloads, target)
+}
+
+// startPendingDecryption starts, or restarts, the download and decryption of
+// a detachment of msg.
+func (c *client) startPendingDecryption(id uint64, msg *InboxMessage, pending *pendingDecryption) {
+	pending.paused = false
+	detachment := msg.message.DetachedFiles[pending.index]
+	if len(pending.inPath) > 0 {
+		pending.cancel, pending.exited = c.startDecryption(pending.exited, id, pending.outPath, pending.inPath, detachment)
+		return
+	}
+
+	if len(pending.tmpPath) == 0 {
+		pending.tmpPath = c.transferPath("download", id)
+	}
+	pending.cancel, pending.exited = c.startDownload(pending.exited, id, pending.outPath, pending.tmpPath, detachment)
+}
+
+// resumeTransfers restarts the detachment operations that were in progress
+// when the state was saved, unless the user paused them.
+func (c *client) resumeTransfers() {
+	for _, draft := range c.drafts {
+		for id, pending := range draft.pendingDetachments {
+			if pending.paused {
+				continue
+			}
+			c.log.Printf("Restarting attachment of %s", pending.path)
+			c.startDetachment(id, pending)
+		}
+	}
+	for _, msg := range c.inbox {
+		for id, pending := range msg.decryptions {
+			if pending.paused {
+				continue
+			}
+			c.log.Printf("Restarting decryption to %s", pending.outPath)
+			c.startPendingDecryption(id, msg, pending)
+		}
+	}
+}
+
+// stop stops the operation, if it's running, but keeps its temporary file.
+func (pending *pendingDetachment) stop() {
+	if pending.cancel != nil {
+		pending.cancel()
+		pending.cancel = nil
+	}
+}
+
+// abandon stops the operation and erases its temporary file.
+func (pending *pendingDetachment) abandon(log *Log) {
+	pending.stop()
+	if len(pending.tmpPath) > 0 {
+		eraseWhenExited(log, pending.exited, pending.tmpPath)
+	}
+	secret.Wipe(pending.key)
+}
+
+func (pending *pendingDecryption) stop() {
+	if pending.cancel != nil {
+		pending.cancel()
+		pending.cancel = nil
+	}
+}
+
+func (pending *pendingDecryption) abandon(log *Log) {
+	pending.stop()
+	if len(pending.tmpPath) > 0 {
+		eraseWhenExited(log, pending.exited, pending.tmpPath)
+	}
+}
+
+// eraseWhenExited erases the file at path, if it exists, once exited is
+// closed, or immediately if exited is nil. This stops the file from being
+// erased while a canceled operation is still using it.
+func eraseWhenExited(log *Log, exited chan bool, path string) {
+	erase := func() {
+		if _, err := os.Stat(path); err == nil {
+			eraseFile(log, path)
+		}
+	}
+	if exited == nil {
+		erase()
+		return
+	}
+	go func() {
+		<-exited
+		erase()
+	}()
+}
+
+func (draft *Draft) cancelDetachments(log *Log) {
+	for id, pending := range draft.pendingDetachments {
+		pending.abandon(log)
+		delete(draft.pendingDetachments, id)
+	}
+}
+
+func (msg *InboxMessage) cancelDecryptions(log *Log) {
+	for id, pending := range msg.decryptions {
+		pending.abandon(log)
+		delete(msg.decryptions, id)
+	}
+}
+
+// eraseStaged erases the files that detachments of msg were automatically
+// downloaded to.
+func (msg *InboxMessage) eraseStaged(log *Log) {
+	for _, path := range msg.staged {
+		if _, err := os.Stat(path); err == nil {
+			eraseFile(log, path)
+		}
+	}
+	msg.staged = nil
+}
+
+// processDetachmentInBackground records the progress of detachment operations
+// and completes those that the active view doesn't handle. It returns true if
+// event has been fully handled.
+func (c *client) processDetachmentInBackground(event interface{}) bool {
+	var id uint64
+	var detachment *pond.Message_Detachment
+	var err error
+
+	switch e := event.(type) {
+	case DetachmentProgress:
+		for _, draft := range c.drafts {
+			if pending, ok := draft.pendingDetachments[e.id]; ok {
+				pending.done, pending.total = e.done, e.total
+			}
+		}
+		for _, msg := range c.inbox {
+			if pending, ok := msg.decryptions[e.id]; ok {
+				pending.done, pending.total = e.done, e.total
+			}
+		}
+		return false
+	case DetachmentEncrypted:
+		for _, draft := range c.drafts {
+			if pending, ok := draft.pendingDetachments[e.id]; ok {
+				pending.detachment = e.detachment
+				c.save()
+			}
+		}
+		return true
+	case DetachmentComplete:
+		id, detachment = e.id, e.detachment
+	case DetachmentError:
+		if e.err == backgroundCanceledError {
+			// Whatever canceled the operation has already
+			// updated the state.
+			return true
+		}
+		id, err = e.id, e.err
+	default:
+		return false
+	}
+
+	if c.activeDetachmentUI != nil && c.activeDetachmentUI.IsValid(id) {
+		return false
+	}
+
+	for _, draft := range c.drafts {
+		pending, ok := draft.pendingDetachments[id]
+		if !ok {
+			continue
+		}
+		delete(draft.pendingDetachments, id)
+		secret.Wipe(pending.key)
+		if err != nil {
+			c.log.Errorf("Failed to attach %s: %s", pending.path, err)
+		} else {
+			draft.detachments = append(draft.detachments, detachment)
+			c.log.Printf("Finished attaching %s", pending.path)
+		}
+		c.save()
+		c.ui.Signal()
+		return true
+	}
+
+	for _, msg := range c.inbox {
+		pending, ok := msg.decryptions[id]
+		if !ok {
+			continue
+		}
+		delete(msg.decryptions, id)
+		if err != nil {
+			c.log.Errorf("Failed to decrypt detachment to %s: %s", pending.outPath, err)
+		} else {
+			c.log.Printf("Decrypted detachment to %s", pending.outPath)
+		}
+		c.save()
+		c.ui.Signal()
+		return true
+	}
+
+	// The operation belonged to a draft or message that has since been
+	// deleted.
+	return true
+}
+
+// stagingPath returns the path in the staging directory that the detachment
+// at the given index of msg is automatically downloaded to.
+func (c *client) stagingPath(msg *InboxMessage, index int) (string, error) {
+	dir := c.stagingDir
+	if len(dir) == 0 {
+		var err error
+		if dir, err = system.SafeTempDir(); err != nil {
+			return "", err
+		}
+	}
+
+	name := filepath.Base(*msg.message.DetachedFiles[index].Filename)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = "detachment"
+	}
+	return filepath.Join(dir, fmt.Sprintf("pond-%x-%d-%s", msg.id, index, name)), nil
+}
+
+// autoDownloadDetachments starts downloading each of the detachments of msg
+// that has a URL, if automatic downloads are enabled.
+func (c *client) autoDownloadDetachments(msg *InboxMessage) {
+	if !c.autoDownload {
+		return
+	}
+
+	for i, detachment := range msg.message.DetachedFiles {
+		if len(detachment.GetUrl()) == 0 {
+			continue
+		}
+		outPath, err := c.stagingPath(msg, i)
+		if err != nil {
+			c.log.Errorf("Cannot download detachment automatically: %s", err)
+			return
+		}
+		if msg.decryptions == nil {
+			msg.decryptions = make(map[uint64]*pendingDecryption)
+		}
+		id := c.randId()
+		pending := &pendingDecryption{
+			index:   i,
+			outPath: outPath,
+		}
+		msg.decryptions[id] = pending
+		msg.staged = append(msg.staged, outPath)
+		c.log.Printf("Downloading detachment %s to %s", detachment.GetFilename(), outPath)
+		c.startPendingDecryption(id, msg, pending)
+	}
+}
+
+// transfer is an entry in the list of transfers. Exactly one of detachment
+// and decryption is set.
+type transfer struct {
+	id         uint64
+	detachment *pendingDetachment
+	decryption *pendingDecryption
+	msg        *InboxMessage
+}
+
+type transfersByID []transfer
+
+func (s transfersByID) Len() int           { return len(s) }
+func (s transfersByID) Less(i, j int) bool { return s[i].id < s[j].id }
+func (s transfersByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// transfers returns the detachment operations that have been started, in a
+// stable order.
+func (c *client) transfers() []transfer {
+	var transfers []transfer
+	for _, draft := range c.drafts {
+		for id, pending := range draft.pendingDetachments {
+			if !pending.upload && len(pending.outPath) == 0 {
+				continue
+			}
+			transfers = append(transfers, transfer{id: id, detachment: pending})
+		}
+	}
+	for _, msg := range c.inbox {
+		for id, pending := range msg.decryptions {
+			transfers = append(transfers, transfer{id: id, decryption: pending, msg: msg})
+		}
+	}
+	sort.Sort(transfersByID(transfers))
+	return transfers
+}
+
+func (c *client) findTransfer(id uint64) (transfer, bool) {
+	for _, t := range c.transfers() {
+		if t.id == id {
+			return t, true
+		}
+	}
+	return transfer{}, false
+}
+
+func (t transfer) description() string {
+	if pending := t.detachment; pending != nil {
+		base := filepath.Base(pending.path)
+		if pending.upload {
+			return "Upload of " + base
+		}
+		return "Encryption of " + base
+	}
+	pending := t.decryption
+	if len(pending.inPath) > 0 {
+		return "Decryption of " + filepath.Base(pending.inPath)
+	}
+	return "Download of " + t.msg.message.DetachedFiles[pending.index].GetFilename()
+}
+
+func (t transfer) status() string {
+	var done, total uint64
+	var paused bool
+	if pending := t.detachment; pending != nil {
+		done, total, paused = pending.done, pending.total, pending.paused
+	} else {
+		done, total, paused = t.decryption.done, t.decryption.total, t.decryption.paused
+	}
+
+	switch {
+	case paused:
+		return "Paused"
+	case total == 0:
+		return "Starting"
+	case done >= total:
+		return "Finishing"
+	}
+	return fmt.Sprintf("%d%% of %d bytes", done*100/total, total)
+}
+
+func (t transfer) paused() bool {
+	if t.detachment != nil {
+		return t.detachment.paused
+	}
+	return t.decryption.paused
+}
+
+// pauseTransfer stops a transfer but keeps its record and temporary file so
+// that it can be resumed later, including after a restart.
+func (c *client) pauseTransfer(t transfer) {
+	if pending := t.detachment; pending != nil {
+		pending.stop()
+		pending.paused = true
+		c.log.Printf("Paused attachment of %s", pending.path)
+	} else {
+		pending := t.decryption
+		pending.stop()
+		pending.paused = true
+		c.log.Printf("Paused decryption to %s", pending.outPath)
+	}
+	c.save()
+}
+
+func (c *client) resumeTransfer(t transfer) {
+	if pending := t.detachment; pending != nil {
+		c.log.Printf("Resuming attachment of %s", pending.path)
+		c.startDetachment(t.id, pending)
+	} else {
+		c.log.Printf("Resuming decryption to %s", t.decryption.outPath)
+		c.startPendingDecryption(t.id, t.msg, t.decryption)
+	}
+	c.save()
+}
+
+// cancelTransfer stops a transfer and forgets it.
+func (c *client) cancelTransfer(t transfer) {
+	if pending := t.detachment; pending != nil {
+		pending.abandon(c.log)
+		for _, draft := range c.drafts {
+			delete(draft.pendingDetachments, t.id)
+		}
+		c.log.Printf("Canceled attachment of %s", pending.path)
+	} else {
+		t.decryption.abandon(c.log)
+		delete(t.msg.decryptions, t.id)
+		c.log.Printf("Canceled decryption to %s", t.decryption.outPath)
+	}
+	c.save()
+}
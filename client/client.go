@@ -19,6 +19,8 @@ import (
 	"github.com/agl/ed25519"
 	"github.com/agl/pond/bbssig"
 	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/client/secret"
+	"github.com/agl/pond/client/system"
 	pond "github.com/agl/pond/protos"
 )
 
@@ -26,8 +28,19 @@ const (
 	// messageLifetime is the default amount of time for which we'll keep a
 	// message. (Counting from the time that it was received.)
 	messageLifetime = 7 * 24 * time.Hour
-	// The current protocol version implemented by this code.
-	protoVersion = 1
+	// uploadLifetime is the expiry hint given to the server for uploaded
+	// detachments. A detachment is needed while its draft is being
+	// written and then until the message that it was sent in expires.
+	uploadLifetime = 2 * messageLifetime
+	// The current protocol version implemented by this code. Version 4
+	// added hashes, and a final chunk marker, to detachments.
+	protoVersion = 4
+	// receiptVersion is the first protocol version that understands
+	// delivery receipts. Earlier clients would take them to be acks.
+	receiptVersion = 2
+	// ratchetVersion is the first protocol version that can decrypt
+	// messages that use a hash ratchet.
+	ratchetVersion = 3
 )
 
 const (
@@ -73,8 +86,21 @@ const (
 	uiStateShowIdentity
 	uiStatePassphrase
 	uiStateInbox
+	uiStateThread
 	uiStateLog
 	uiStateRevocationProcessed
+	uiStateSearched
+	uiStateTransfers
+	uiStateServerFiles
+	uiStatePreview
+)
+
+// These are the ids of the entries in the clientUI.
+const (
+	clientUIIdentity = iota + 1
+	clientUIActivity
+	clientUITransfers
+	clientUIServerFiles
 )
 
 const shortTimeFormat = "Jan _2 15:04"
@@ -136,10 +162,20 @@ type client struct {
 	// The network goroutine needs to resign all pending messages for that
 	// contact.
 	revocationUpdateChan chan revocationUpdate
+	// queueChangedChan is signaled when a message is added to queue so
+	// that the network goroutine can reconsider when to next transact.
+	queueChangedChan chan bool
 
 	log *Log
 
 	inboxUI, outboxUI, contactsUI, clientUI, draftsUI *listUI
+	// torProblem and systemProblem record whether the checks of Tor and
+	// of the system, which are summarised in the clientUI, found
+	// problems.
+	torProblem, systemProblem bool
+	// searchQuery is the current filter for the inbox, outbox and drafts
+	// lists, or nil if there isn't one.
+	searchQuery *searchQuery
 
 	outbox   []*queuedMessage
 	drafts   map[uint64]*Draft
@@ -150,6 +186,41 @@ type client struct {
 	// network goroutine and protected by queueMutex.
 	queue      []*queuedMessage
 	queueMutex sync.Mutex
+	// coverTraffic is true if the network goroutine should make dummy
+	// deliveries in order to hide which servers the user communicates
+	// with.
+	coverTraffic bool
+	// decoyServers contains servers, in addition to those of contacts,
+	// that dummy deliveries may be made to.
+	decoyServers []string
+	// coverTargets contains the possible destinations for dummy
+	// deliveries. It's shared with the network goroutine and protected by
+	// queueMutex.
+	coverTargets []coverTarget
+	// schedulingPolicy determines the distribution of the time between
+	// network transactions. It's shared with the network goroutine and
+	// protected by queueMutex.
+	schedulingPolicy disk.State_SchedulingPolicy
+	// deliveryReceipts is true if a delivery receipt should be sent for
+	// each message received from a contact.
+	deliveryReceipts bool
+	// replayCache contains hashes of recently received messages so that
+	// replays can be detected.
+	replayCache *replayCache
+	// autoDownload is true if detachments should be downloaded to the
+	// staging directory as soon as they are received.
+	autoDownload bool
+	// stagingDir, if not empty, overrides the directory that detachments
+	// are automatically downloaded to. It's set in tests.
+	stagingDir string
+	// activeDetachmentUI is the DetachmentUI of the view being displayed,
+	// if any. Detachment operations that it doesn't handle are completed
+	// in the background.
+	activeDetachmentUI DetachmentUI
+	// serverFiles is the most recent listing of the files that are
+	// stored on the home server. It's displayed while a new listing is
+	// fetched.
+	serverFiles *pond.FileList
 	// newMessageChan receives messages that have been read from the home
 	// server by the network goroutine.
 	newMessageChan chan NewMessage
@@ -166,6 +237,15 @@ type messageSendResult struct {
 	revocation *pond.SignedRevocation
 }
 
+// coverTarget is a possible destination for a dummy delivery.
+type coverTarget struct {
+	server string
+	// to contains the identity that the dummy delivery will be addressed
+	// to. For decoy servers, where we don't know of any accounts, it's
+	// random.
+	to [32]byte
+}
+
 type revocationUpdate struct {
 	// id contains the contact id that needs to be updated.
 	id  uint64
@@ -176,10 +256,26 @@ type revocationUpdate struct {
 }
 
 // pendingDecryption represents a detachment decryption/download operation
-// that's in progress. These are not saved to disk.
+// that's in progress. These are saved to disk and restarted when the client
+// starts.
 type pendingDecryption struct {
-	index  int
+	index int
+	// outPath is the file that the decrypted detachment is written to.
+	outPath string
+	// inPath is the encrypted file, or empty if the detachment is being
+	// downloaded.
+	inPath string
+	// tmpPath is the file that the encrypted detachment is downloaded to.
+	// It persists across restarts so that the download can be resumed.
+	tmpPath string
+	// done and total record the progress of the operation.
+	done, total uint64
+	// paused is true if the user has stopped the operation for now.
+	paused bool
 	cancel func()
+	// exited, if not nil, is closed once the goroutine of the last
+	// operation has finished with its files.
+	exited chan bool
 }
 
 // InboxMessage represents a message in the client's inbox. (Although acks also
@@ -198,6 +294,9 @@ type InboxMessage struct {
 	message *pond.Message
 
 	decryptions map[uint64]*pendingDecryption
+	// staged contains the files that detachments of this message were
+	// automatically downloaded to. They're erased with the message.
+	staged []string
 }
 
 // NewMessage is sent from the network goroutine to the client goroutine and
@@ -244,12 +343,24 @@ type Contact struct {
 	revoked bool
 	// revokedUs is true if this contact has recoved us.
 	revokedUs bool
+	// verified is true if the user has confirmed that the contact's safety
+	// number matches theirs.
+	verified bool
 
 	lastDHPrivate    [32]byte
 	currentDHPrivate [32]byte
 
 	theirLastDHPublic    [32]byte
 	theirCurrentDHPublic [32]byte
+
+	// sendChain is the hash ratchet used for messages to this contact, if
+	// they support it. receiveChains contains the most recent chains that
+	// they have used for messages to us, oldest first, and skippedKeys
+	// contains the keys for messages on those chains that haven't been
+	// received yet.
+	sendChain     *ratchetChain
+	receiveChains []*ratchetChain
+	skippedKeys   []skippedKey
 }
 
 // previousTagLifetime contains the amount of time that we'll store a previous
@@ -277,11 +388,39 @@ type previousGroupPrivateKey struct {
 }
 
 // pendingDetachment represents a detachment conversion/upload operation that's
-// in progress. These are not saved to disk.
+// in progress. Once started, these are saved to disk and restarted when the
+// client starts.
 type pendingDetachment struct {
-	size   int64
-	path   string
-	cancel func()
+	size int64
+	path string
+	// upload is true if the encrypted file is being uploaded to the home
+	// server. Otherwise, outPath is the file that it's being written to.
+	// If neither is set then the operation hasn't been started.
+	upload  bool
+	outPath string
+	// tmpPath is the encrypted file that is being uploaded and key is
+	// the key that it's encrypted with. Since the encryption is
+	// deterministic given the key, a lost tmpPath can be recreated and
+	// the upload resumed from where the server left off. detachment is
+	// set once the encryption has completed.
+	tmpPath    string
+	key        []byte
+	detachment *pond.Message_Detachment
+	// done and total record the progress of the operation.
+	done, total uint64
+	// paused is true if the user has stopped the operation for now.
+	paused bool
+	// maxDownloads, if non-zero, asks the home server to delete the
+	// uploaded file after it has been downloaded that many times.
+	maxDownloads uint32
+	// deliverTo, if non-zero, is the id of the contact whose home server
+	// the file is uploaded to, rather than our own. That contact can then
+	// download it without needing to reach our server.
+	deliverTo uint64
+	cancel    func()
+	// exited, if not nil, is closed once the goroutine of the last
+	// operation has finished with its files.
+	exited chan bool
 }
 
 type Draft struct {
@@ -303,6 +442,7 @@ type queuedMessage struct {
 	server     string
 	created    time.Time
 	sent       time.Time
+	delivered  time.Time
 	acked      time.Time
 	revocation bool
 	message    *pond.Message
@@ -467,13 +607,16 @@ func (c *client) loadUI() {
 	c.writerDone = make(chan bool)
 	c.fetchNowChan = make(chan chan bool, 1)
 	c.revocationUpdateChan = make(chan revocationUpdate, 8)
+	c.queueChangedChan = make(chan bool, 1)
 
 	// Start disk and network workers.
-	go disk.StateWriter(c.stateFilename, &c.diskKey, &c.diskSalt, c.writerChan, c.writerDone)
+	go disk.StateWriter(c.stateFilename, &c.diskKey, &c.diskSalt, c.writerChan, c.writerDone, c.log.Printf)
+	c.updateCoverTargets()
 	go c.transact()
 	if newAccount {
 		c.save()
 	}
+	c.resumeTransfers()
 
 	c.mainUI()
 }
@@ -516,6 +659,39 @@ func (c *client) updateWindowTitle() {
 	c.ui.Signal()
 }
 
+// activityStatus returns the subline and indicator of the Activity Log entry
+// in the clientUI, which summarise any problems with Tor or the system.
+func (c *client) activityStatus() (string, Indicator) {
+	switch {
+	case c.torProblem && c.systemProblem:
+		return "Tor and system problems", indicatorRed
+	case c.torProblem:
+		return "Tor problem", indicatorRed
+	case c.systemProblem:
+		return "System problem", indicatorRed
+	}
+	return "", indicatorNone
+}
+
+// checkSystem logs any problems that the system checks find with the
+// handling of secrets and returns an error if there were any.
+func (c *client) checkSystem() error {
+	err := system.IsSafe(c.stateFilename)
+	if err == nil {
+		c.log.Printf("System checks passed")
+		return nil
+	}
+
+	if problems, ok := err.(system.Problems); ok {
+		for _, problem := range problems {
+			c.log.Errorf("System check: %s", problem.Description)
+		}
+	} else {
+		c.log.Errorf("%s", err)
+	}
+	return err
+}
+
 func (c *client) mainUI() {
 	ui := Paned{
 		left: Scrolled{
@@ -524,6 +700,23 @@ func (c *client) mainUI() {
 				widgetBase: widgetBase{background: colorGray},
 				child: VBox{
 					children: []Widget{
+						EventBox{
+							widgetBase: widgetBase{background: colorHeaderBackground},
+							child: VBox{
+								widgetBase: widgetBase{padding: 6},
+								children: []Widget{
+									Entry{
+										widgetBase:     widgetBase{name: "search", padding: 4},
+										updateOnChange: true,
+									},
+									Label{
+										widgetBase: widgetBase{name: "searcherror", foreground: colorRed, font: fontListSubline},
+										wrap:       200,
+									},
+								},
+							},
+						},
+						EventBox{widgetBase: widgetBase{height: 1, background: colorSep}},
 						EventBox{
 							widgetBase: widgetBase{background: colorHeaderBackground},
 							child: Label{
@@ -655,6 +848,7 @@ func (c *client) mainUI() {
 
 	c.ui.Actions() <- Reset{ui}
 	c.ui.Signal()
+	c.searchQuery = nil
 
 	c.contactsUI = &listUI{
 		ui:       c.ui,
@@ -732,17 +926,32 @@ func (c *client) mainUI() {
 		ui:       c.ui,
 		vboxName: "clientVbox",
 	}
-	const (
-		clientUIIdentity = iota + 1
-		clientUIActivity
-	)
+	var systemErr error
+	if !c.testing {
+		// Querying Tor's control port can take a while so the result
+		// is shown when it arrives.
+		go func() {
+			c.backgroundChan <- torStatusChecked{c.checkTorStatus()}
+		}()
+		systemErr = c.checkSystem()
+		c.systemProblem = systemErr != nil
+	}
+	activitySubline, activityIndicator := c.activityStatus()
 	c.clientUI.Add(clientUIIdentity, "Identity", "", indicatorNone)
-	c.clientUI.Add(clientUIActivity, "Activity Log", "", indicatorNone)
+	c.clientUI.Add(clientUIActivity, "Activity Log", activitySubline, activityIndicator)
+	c.clientUI.Add(clientUITransfers, "Transfers", "", indicatorNone)
+	c.clientUI.Add(clientUIServerFiles, "Server Files", "", indicatorNone)
 
 	c.ui.Actions() <- UIState{uiStateMain}
 	c.ui.Signal()
 
 	var nextEvent interface{}
+	if systemErr != nil {
+		// Show the log, which explains the problems, rather than
+		// starting with a blank pane.
+		c.clientUI.Select(clientUIActivity)
+		nextEvent = c.logUI()
+	}
 	for {
 		event := nextEvent
 		nextEvent = nil
@@ -776,6 +985,10 @@ func (c *client) mainUI() {
 				nextEvent = c.identityUI()
 			case clientUIActivity:
 				nextEvent = c.logUI()
+			case clientUITransfers:
+				nextEvent = c.transfersUI()
+			case clientUIServerFiles:
+				nextEvent = c.serverFilesUI()
 			default:
 				panic("bad clientUI event")
 			}
@@ -812,7 +1025,14 @@ type listUI struct {
 type listItem struct {
 	id                                                           uint64
 	name, sepName, boxName, imageName, lineName, sublineTextName string
+	subline                                                      string
+	indicator                                                    Indicator
 	insensitive                                                  bool
+	// hidden is true if the item has been filtered out, in which case it
+	// has no widgets.
+	hidden bool
+	// hasSep is true if the item has a separator bar above it.
+	hasSep bool
 }
 
 func (cs *listUI) Event(event interface{}) (uint64, bool) {
@@ -834,24 +1054,45 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 	c := listItem{
 		id:              id,
 		name:            name,
+		subline:         subline,
+		indicator:       indicator,
 		sepName:         cs.newIdent(),
 		boxName:         cs.newIdent(),
 		imageName:       cs.newIdent(),
 		lineName:        cs.newIdent(),
 		sublineTextName: cs.newIdent(),
 	}
+
+	pos := 0
+	for _, entry := range cs.entries {
+		if !entry.hidden {
+			pos++
+		}
+	}
 	cs.entries = append(cs.entries, c)
-	index := len(cs.entries) - 1
+	cs.addWidgets(&cs.entries[len(cs.entries)-1], pos)
+	cs.ui.Signal()
+}
 
-	if index > 0 {
+// addWidgets creates the widgets for c and inserts them into the list such
+// that c is at position pos amongst the visible items.
+func (cs *listUI) addWidgets(c *listItem, pos int) {
+	c.hasSep = pos > 0
+	if c.hasSep {
 		// Add the separator bar.
 		cs.ui.Actions() <- AddToBox{
 			box:   cs.vboxName,
-			pos:   index*2 - 1,
+			pos:   pos*2 - 1,
 			child: EventBox{widgetBase: widgetBase{height: 1, background: 0xe5e6e6, name: c.sepName}},
 		}
 	}
+	cs.addBox(c, pos)
+}
 
+// addBox creates the box containing the widgets for c, but not its separator,
+// and inserts it into the list such that c is at position pos amongst the
+// visible items.
+func (cs *listUI) addBox(c *listItem, pos int) {
 	children := []Widget{
 		HBox{
 			widgetBase: widgetBase{padding: 1},
@@ -862,7 +1103,7 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 						padding: 5,
 						font:    fontListEntry,
 					},
-					text: name,
+					text: c.name,
 				},
 			},
 		},
@@ -870,7 +1111,7 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 
 	var sublineChildren []Widget
 
-	if len(subline) > 0 {
+	if len(c.subline) > 0 {
 		sublineChildren = append(sublineChildren, Label{
 			widgetBase: widgetBase{
 				padding:    5,
@@ -878,7 +1119,7 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 				font:       fontListSubline,
 				name:       c.sublineTextName,
 			},
-			text: subline,
+			text: c.subline,
 		})
 	}
 
@@ -889,7 +1130,7 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 			fill:    true,
 			name:    c.imageName,
 		},
-		image:  indicator,
+		image:  c.indicator,
 		xAlign: 1,
 		yAlign: 0.5,
 	})
@@ -899,15 +1140,19 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 		children:   sublineChildren,
 	})
 
+	var background uint32 = colorGray
+	if c.id == cs.selected {
+		background = colorHighlight
+	}
+
 	cs.ui.Actions() <- AddToBox{
 		box: cs.vboxName,
-		pos: index * 2,
+		pos: pos * 2,
 		child: EventBox{
-			widgetBase: widgetBase{name: c.boxName, background: colorGray},
+			widgetBase: widgetBase{name: c.boxName, background: background},
 			child:      VBox{children: children},
 		},
 	}
-	cs.ui.Signal()
 }
 
 func (cs *listUI) SetInsensitive(id uint64) {
@@ -920,22 +1165,64 @@ func (cs *listUI) SetInsensitive(id uint64) {
 
 func (cs *listUI) Remove(id uint64) {
 	for i, entry := range cs.entries {
-		if entry.id == id {
-			if i > 0 {
+		if entry.id != id {
+			continue
+		}
+		if !entry.hidden {
+			if entry.hasSep {
 				cs.ui.Actions() <- Destroy{name: entry.sepName}
+			} else {
+				// This is the first visible item so the next
+				// visible item loses its separator.
+				for j := i + 1; j < len(cs.entries); j++ {
+					if next := &cs.entries[j]; !next.hidden {
+						cs.ui.Actions() <- Destroy{name: next.sepName}
+						next.hasSep = false
+						break
+					}
+				}
 			}
 			cs.ui.Actions() <- Destroy{name: entry.boxName}
 			cs.ui.Signal()
-			if cs.selected == id {
-				cs.selected = 0
-			}
-			return
 		}
+		if cs.selected == id {
+			cs.selected = 0
+		}
+		cs.entries = append(cs.entries[:i], cs.entries[i+1:]...)
+		return
 	}
 
 	panic("unknown id passed to Remove")
 }
 
+// Filter hides the items for which visible returns false and shows the
+// remainder. If visible is nil then all items are shown. Items that are added
+// later are always shown.
+func (cs *listUI) Filter(visible func(id uint64) bool) {
+	for i := range cs.entries {
+		entry := &cs.entries[i]
+		if entry.hidden {
+			continue
+		}
+		if entry.hasSep {
+			cs.ui.Actions() <- Destroy{name: entry.sepName}
+		}
+		cs.ui.Actions() <- Destroy{name: entry.boxName}
+	}
+
+	pos := 0
+	for i := range cs.entries {
+		entry := &cs.entries[i]
+		entry.hidden = visible != nil && !visible(entry.id)
+		if entry.hidden {
+			continue
+		}
+		cs.addWidgets(entry, pos)
+		pos++
+	}
+	cs.ui.Signal()
+}
+
 func (cs *listUI) Deselect() {
 	if cs.selected == 0 {
 		return
@@ -944,13 +1231,15 @@ func (cs *listUI) Deselect() {
 	var currentlySelected string
 
 	for _, entry := range cs.entries {
-		if entry.id == cs.selected {
+		if entry.id == cs.selected && !entry.hidden {
 			currentlySelected = entry.boxName
 			break
 		}
 	}
 
-	cs.ui.Actions() <- SetBackground{name: currentlySelected, color: colorGray}
+	if len(currentlySelected) > 0 {
+		cs.ui.Actions() <- SetBackground{name: currentlySelected, color: colorGray}
+	}
 	cs.selected = 0
 	cs.ui.Signal()
 }
@@ -961,62 +1250,86 @@ func (cs *listUI) Select(id uint64) {
 	}
 
 	var currentlySelected, newSelected string
+	found := false
 
 	for _, entry := range cs.entries {
-		if entry.id == cs.selected {
+		if entry.id == cs.selected && !entry.hidden {
 			currentlySelected = entry.boxName
 		} else if entry.id == id {
-			newSelected = entry.boxName
-		}
-
-		if len(currentlySelected) > 0 && len(newSelected) > 0 {
-			break
+			found = true
+			if !entry.hidden {
+				newSelected = entry.boxName
+			}
 		}
 	}
 
-	if len(newSelected) == 0 {
+	if !found {
 		panic("internal error")
 	}
 
 	if len(currentlySelected) > 0 {
 		cs.ui.Actions() <- SetBackground{name: currentlySelected, color: colorGray}
 	}
-	cs.ui.Actions() <- SetBackground{name: newSelected, color: colorHighlight}
+	if len(newSelected) > 0 {
+		cs.ui.Actions() <- SetBackground{name: newSelected, color: colorHighlight}
+	}
 	cs.selected = id
 	cs.ui.Signal()
 }
 
 func (cs *listUI) SetIndicator(id uint64, indicator Indicator) {
-	for _, entry := range cs.entries {
+	for i := range cs.entries {
+		entry := &cs.entries[i]
 		if entry.id == id {
-			cs.ui.Actions() <- SetImage{name: entry.imageName, image: indicator}
-			cs.ui.Signal()
+			entry.indicator = indicator
+			if !entry.hidden {
+				cs.ui.Actions() <- SetImage{name: entry.imageName, image: indicator}
+				cs.ui.Signal()
+			}
 			break
 		}
 	}
 }
 
 func (cs *listUI) SetLine(id uint64, line string) {
-	for _, entry := range cs.entries {
+	for i := range cs.entries {
+		entry := &cs.entries[i]
 		if entry.id == id {
-			cs.ui.Actions() <- SetText{name: entry.lineName, text: line}
-			cs.ui.Signal()
+			entry.name = line
+			if !entry.hidden {
+				cs.ui.Actions() <- SetText{name: entry.lineName, text: line}
+				cs.ui.Signal()
+			}
 			break
 		}
 	}
 }
 
 func (cs *listUI) SetSubline(id uint64, subline string) {
-	for _, entry := range cs.entries {
-		if entry.id == id {
-			if len(subline) > 0 {
-				cs.ui.Actions() <- SetText{name: entry.sublineTextName, text: subline}
-			} else {
-				cs.ui.Actions() <- Destroy{name: entry.sublineTextName}
+	pos := 0
+	for i := range cs.entries {
+		entry := &cs.entries[i]
+		if entry.id != id {
+			if !entry.hidden {
+				pos++
 			}
-			cs.ui.Signal()
+			continue
+		}
+		hadSubline := len(entry.subline) > 0
+		entry.subline = subline
+		if entry.hidden {
 			break
 		}
+		if hadSubline && len(subline) > 0 {
+			cs.ui.Actions() <- SetText{name: entry.sublineTextName, text: subline}
+		} else if hadSubline || len(subline) > 0 {
+			// The subline's label only exists while there's a
+			// subline so the entry is rebuilt.
+			cs.ui.Actions() <- Destroy{name: entry.boxName}
+			cs.addBox(entry, pos)
+		}
+		cs.ui.Signal()
+		break
 	}
 }
 
@@ -1100,6 +1413,10 @@ func widgetForAttachment(id uint64, label string, isError bool, extraWidgets []W
 	}
 }
 
+// largeAttachment is the argument of a FileOpen for a file that's to be
+// attached as a detachment.
+type largeAttachment struct{}
+
 type DetachmentUI interface {
 	IsValid(id uint64) bool
 	ProgressName(id uint64) string
@@ -1157,6 +1474,7 @@ func (c *client) maybeProcessDetachmentMsg(event interface{}, ui DetachmentUI) b
 			},
 		}
 		ui.OnFinal(id)
+		c.save()
 		c.ui.Signal()
 		return true
 	}
@@ -1190,6 +1508,7 @@ func (c *client) maybeProcessDetachmentMsg(event interface{}, ui DetachmentUI) b
 		}
 		ui.OnFinal(id)
 		ui.OnSuccess(id, complete.detachment)
+		c.save()
 		c.ui.Signal()
 		return true
 	}
@@ -1224,10 +1543,14 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 	}
 
 	var preSelected string
+	// replyToMessageId is saved now because inReplyTo may expire, and be
+	// wiped, while the message is being composed.
+	var replyToMessageId *uint64
 	if inReplyTo != nil {
 		if from, ok := c.contacts[inReplyTo.from]; ok {
 			preSelected = from.name
 		}
+		replyToMessageId = inReplyTo.message.Id
 	}
 
 	attachments := make(map[uint64]int)
@@ -1272,6 +1595,13 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 	initialUsageMessage, overSize := usageString(draft)
 	validContactSelected := len(preSelected) > 0
 
+	var initialWarning string
+	for _, contact := range c.contacts {
+		if contact.name == preSelected {
+			initialWarning = unverifiedWarning(contact)
+		}
+	}
+
 	lhs := VBox{
 		children: []Widget{
 			HBox{
@@ -1290,6 +1620,11 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 						labels:      contactNames,
 						preSelected: preSelected,
 					},
+					Label{
+						widgetBase: widgetBase{name: "unverified", foreground: colorRed, padding: 10},
+						text:       initialWarning,
+						yAlign:     0.5,
+					},
 				},
 			},
 			HBox{
@@ -1318,6 +1653,10 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 						widgetBase: widgetBase{name: "attach", font: "Liberation Sans 8"},
 						image:      indicatorAdd,
 					},
+					Button{
+						widgetBase: widgetBase{name: "attachlarge", font: "Liberation Sans 8", padding: 4},
+						text:       "Large File",
+					},
 				},
 			},
 			HBox{
@@ -1421,6 +1760,8 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 	detachmentUI := ComposeDetachmentUI{draft, detachments, c.ui, func() {
 		overSize = c.updateUsage(validContactSelected, draft)
 	}}
+	c.activeDetachmentUI = detachmentUI
+	defer func() { c.activeDetachmentUI = nil }()
 
 	c.ui.Actions() <- UIState{uiStateCompose}
 	c.ui.Signal()
@@ -1496,6 +1837,18 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 									},
 									text: "Upload",
 								},
+								Button{
+									widgetBase: widgetBase{
+										name: fmt.Sprintf("attachment-uploadonce-%x", id),
+									},
+									text: "Upload for One Download",
+								},
+								Button{
+									widgetBase: widgetBase{
+										name: fmt.Sprintf("attachment-uploadto-%x", id),
+									},
+									text: "Upload to Recipient's Server",
+								},
 							},
 						},
 					},
@@ -1524,9 +1877,52 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 			overSize = c.updateUsage(validContactSelected, draft)
 			c.ui.Signal()
 		}
+		if open, ok := event.(OpenResult); ok && open.ok && open.arg == (largeAttachment{}) {
+			// Opening a large file, which is uploaded and attached
+			// as a detachment without further steps.
+			base := filepath.Base(open.path)
+			fi, err := os.Stat(open.path)
+			if err != nil {
+				c.ui.Actions() <- Append{
+					name: "filesvbox",
+					children: []Widget{
+						widgetForAttachment(c.randId(), base+": "+err.Error(), true, nil),
+					},
+				}
+				c.ui.Signal()
+				continue
+			}
+
+			id := c.randId()
+			pending := &pendingDetachment{
+				path:   open.path,
+				size:   fi.Size(),
+				upload: true,
+			}
+			draft.pendingDetachments[id] = pending
+			c.ui.Actions() <- Append{
+				name: "filesvbox",
+				children: []Widget{
+					widgetForAttachment(id, fmt.Sprintf("%s (%d bytes, external)", base, pending.size), false, []Widget{
+						Progress{
+							widgetBase: widgetBase{
+								name: fmt.Sprintf("attachment-progress-%x", id),
+							},
+						},
+					}),
+				},
+			}
+			c.startDetachment(id, pending)
+			c.save()
+			c.ui.Signal()
+			continue
+		}
 		if open, ok := event.(OpenResult); ok && open.ok && open.arg != nil {
 			// Saving a detachment.
-			id := open.arg.(uint64)
+			id, ok := open.arg.(uint64)
+			if !ok {
+				continue
+			}
 			c.ui.Actions() <- Destroy{name: fmt.Sprintf("attachment-addi-%x", id)}
 			c.ui.Actions() <- Append{
 				name: fmt.Sprintf("attachment-vbox-%x", id),
@@ -1538,7 +1934,10 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 					},
 				},
 			}
-			draft.pendingDetachments[id].cancel = c.startEncryption(id, open.path, draft.pendingDetachments[id].path)
+			pending := draft.pendingDetachments[id]
+			pending.outPath = open.path
+			c.startDetachment(id, pending)
+			c.save()
 			c.ui.Signal()
 		}
 
@@ -1557,6 +1956,14 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 			c.ui.Signal()
 			continue
 		}
+		if click.name == "attachlarge" {
+			c.ui.Actions() <- FileOpen{
+				title: "Attach Large File",
+				arg:   largeAttachment{},
+			}
+			c.ui.Signal()
+			continue
+		}
 		if click.name == "to" {
 			selected := click.combos["to"]
 			if len(selected) > 0 {
@@ -1565,6 +1972,7 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 			for _, contact := range c.contacts {
 				if contact.name == selected {
 					draft.to = contact.id
+					c.ui.Actions() <- SetText{name: "unverified", text: unverifiedWarning(contact)}
 				}
 			}
 			c.draftsUI.SetLine(draft.id, selected)
@@ -1575,6 +1983,7 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 			continue
 		}
 		if click.name == "discard" {
+			draft.cancelDetachments(c.log)
 			c.draftsUI.Remove(draft.id)
 			delete(c.drafts, draft.id)
 			c.save()
@@ -1595,10 +2004,9 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 				delete(attachments, id)
 			}
 			if detachment, ok := draft.pendingDetachments[id]; ok {
-				if detachment.cancel != nil {
-					detachment.cancel()
-				}
+				detachment.abandon(c.log)
 				delete(draft.pendingDetachments, id)
+				c.save()
 			}
 			if index, ok := detachments[id]; ok {
 				draft.detachments = append(draft.detachments[:index], draft.detachments[index+1:]...)
@@ -1624,8 +2032,30 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 			c.ui.Signal()
 		}
 		const uploadPrefix = "attachment-upload-"
-		if strings.HasPrefix(click.name, uploadPrefix) {
-			idStr := click.name[len(uploadPrefix):]
+		const uploadOncePrefix = "attachment-uploadonce-"
+		const uploadToPrefix = "attachment-uploadto-"
+		if strings.HasPrefix(click.name, uploadPrefix) || strings.HasPrefix(click.name, uploadOncePrefix) || strings.HasPrefix(click.name, uploadToPrefix) {
+			var idStr string
+			var maxDownloads uint32
+			var deliverTo uint64
+			switch {
+			case strings.HasPrefix(click.name, uploadOncePrefix):
+				// The server deletes the file once the
+				// recipient has downloaded it.
+				idStr = click.name[len(uploadOncePrefix):]
+				maxDownloads = 1
+			case strings.HasPrefix(click.name, uploadToPrefix):
+				// The file is stored on the recipient's home
+				// server so the recipient needn't reach ours.
+				idStr = click.name[len(uploadToPrefix):]
+				if draft.to == 0 {
+					c.log.Errorf("Select a recipient before uploading to their server")
+					continue
+				}
+				deliverTo = draft.to
+			default:
+				idStr = click.name[len(uploadPrefix):]
+			}
 			id, err := strconv.ParseUint(idStr, 16, 64)
 			if err != nil {
 				panic(click.name)
@@ -1641,7 +2071,12 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 					},
 				},
 			}
-			draft.pendingDetachments[id].cancel = c.startUpload(id, draft.pendingDetachments[id].path)
+			pending := draft.pendingDetachments[id]
+			pending.upload = true
+			pending.maxDownloads = maxDownloads
+			pending.deliverTo = deliverTo
+			c.startDetachment(id, pending)
+			c.save()
 			c.ui.Signal()
 		}
 
@@ -1665,11 +2100,6 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 		var nextDHPub [32]byte
 		curve25519.ScalarBaseMult(&nextDHPub, &to.currentDHPrivate)
 
-		var replyToId *uint64
-		if inReplyTo != nil {
-			replyToId = inReplyTo.message.Id
-		}
-
 		body := click.textViews["body"]
 		// Zero length bodies are ACKs.
 		if len(body) == 0 {
@@ -1682,7 +2112,7 @@ func (c *client) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 			Time:             proto.Int64(time.Now().Unix()),
 			Body:             []byte(body),
 			BodyEncoding:     pond.Message_RAW.Enum(),
-			InReplyTo:        replyToId,
+			InReplyTo:        replyToMessageId,
 			MyNextDh:         nextDHPub[:],
 			Files:            draft.attachments,
 			DetachedFiles:    draft.detachments,
@@ -1714,6 +2144,8 @@ func (qm *queuedMessage) indicator() Indicator {
 	switch {
 	case !qm.acked.IsZero():
 		return indicatorGreen
+	case !qm.delivered.IsZero():
+		return indicatorBlue
 	case !qm.sent.IsZero():
 		if qm.revocation {
 			// Revocations are never acked so they are green as
@@ -1725,11 +2157,79 @@ func (qm *queuedMessage) indicator() Indicator {
 	return indicatorRed
 }
 
+// deleteContact revokes contact, if needed, and removes them along with all
+// the messages and drafts that involve them. Revocations addressed to the
+// contact are kept because the home server still needs to receive them.
+func (c *client) deleteContact(contact *Contact) {
+	// Revocations are sent to the contact's server, which a pending
+	// contact doesn't have yet.
+	if contact.groupKey != nil && !contact.revoked && !contact.isPending {
+		c.revoke(contact)
+	}
+
+	var newInbox []*InboxMessage
+	for _, msg := range c.inbox {
+		if msg.from != contact.id {
+			newInbox = append(newInbox, msg)
+			continue
+		}
+		if msg.message == nil || len(msg.message.Body) > 0 {
+			c.inboxUI.Remove(msg.id)
+		}
+		msg.cancelDecryptions(c.log)
+		msg.eraseStaged(c.log)
+		msg.wipe()
+	}
+	c.inbox = newInbox
+	c.updateWindowTitle()
+
+	var newOutbox []*queuedMessage
+	for _, msg := range c.outbox {
+		if msg.to != contact.id || msg.revocation {
+			newOutbox = append(newOutbox, msg)
+			continue
+		}
+		if len(msg.message.Body) > 0 {
+			c.outboxUI.Remove(msg.id)
+		}
+	}
+	c.outbox = newOutbox
+
+	c.queueMutex.Lock()
+	newQueue := make([]*queuedMessage, 0, len(c.queue))
+	for _, m := range c.queue {
+		if m.to != contact.id || m.revocation {
+			newQueue = append(newQueue, m)
+		}
+	}
+	c.queue = newQueue
+	c.queueMutex.Unlock()
+
+	for id, draft := range c.drafts {
+		if draft.to == contact.id {
+			draft.cancelDetachments(c.log)
+			c.draftsUI.Remove(id)
+			delete(c.drafts, id)
+		}
+	}
+
+	c.contactsUI.Remove(contact.id)
+	delete(c.contacts, contact.id)
+	contact.wipe()
+}
+
 func (c *client) enqueue(m *queuedMessage) {
 	c.queueMutex.Lock()
 	defer c.queueMutex.Unlock()
 
 	c.queue = append(c.queue, m)
+
+	// The network goroutine may not have started yet, in which case
+	// queueChangedChan is nil and this does nothing.
+	select {
+	case c.queueChangedChan <- true:
+	default:
+	}
 }
 
 func (c *client) sendAck(msg *InboxMessage) {
@@ -1753,6 +2253,29 @@ func (c *client) sendAck(msg *InboxMessage) {
 	}
 }
 
+// sendDeliveryReceipt tells the sender of msg that it has been received.
+func (c *client) sendDeliveryReceipt(msg *InboxMessage) {
+	to := c.contacts[msg.from]
+
+	var nextDHPub [32]byte
+	curve25519.ScalarBaseMult(&nextDHPub, &to.currentDHPrivate)
+
+	id := c.randId()
+	err := c.send(to, &pond.Message{
+		Id:               proto.Uint64(id),
+		Time:             proto.Int64(time.Now().Unix()),
+		Body:             make([]byte, 0),
+		BodyEncoding:     pond.Message_RAW.Enum(),
+		MyNextDh:         nextDHPub[:],
+		InReplyTo:        msg.message.Id,
+		SupportedVersion: proto.Int32(protoVersion),
+		DeliveryReceipt:  proto.Bool(true),
+	})
+	if err != nil {
+		c.log.Errorf("Error sending delivery receipt: %s", err)
+	}
+}
+
 func maybeTruncate(s string) string {
 	if runes := []rune(s); len(runes) > 30 {
 		runes = runes[:30]
@@ -1829,7 +2352,7 @@ func (contact *Contact) processKeyExchange(kxsBytes []byte, testing bool) error
 	}
 
 	contact.theirServer = *kx.Server
-	if _, _, err := parseServer(contact.theirServer, testing); err != nil {
+	if _, _, err := disk.ParseServer(contact.theirServer, testing); err != nil {
 		return err
 	}
 
@@ -1865,16 +2388,34 @@ func (c *client) nextEvent() (event interface{}, wanted bool) {
 		}
 	case newMessage := <-c.newMessageChan:
 		c.processNewMessage(newMessage)
+		if c.searchQuery != nil {
+			c.applySearch()
+		}
 		return
 	case msr := <-c.messageSentChan:
 		c.processMessageSent(msr)
 		return
 	case event = <-c.backgroundChan:
-		break
+		if checked, ok := event.(torStatusChecked); ok {
+			c.torProblem = checked.err != nil
+			subline, indicator := c.activityStatus()
+			c.clientUI.SetSubline(clientUIActivity, subline)
+			c.clientUI.SetIndicator(clientUIActivity, indicator)
+			return
+		}
+		if c.processDetachmentInBackground(event) {
+			return
+		}
 	case <-c.log.updateChan:
 		return
 	}
 
+	if update, ok := event.(Update); ok && update.name == "search" {
+		// Searching filters the lists on the left without
+		// disturbing whatever is displayed on the right.
+		c.search(update.text)
+		return nil, false
+	}
 	if _, ok := c.contactsUI.Event(event); ok {
 		wanted = true
 	}
@@ -2036,6 +2577,7 @@ func (c *client) keyPromptUI(state []byte) error {
 			panic(err)
 		} else {
 			copy(c.diskKey[:], diskKey)
+			secret.Wipe(diskKey)
 		}
 
 		err := c.loadState(state)
@@ -2129,6 +2671,7 @@ func (c *client) createPassphraseUI() {
 			panic(err)
 		} else {
 			copy(c.diskKey[:], diskKey)
+			secret.Wipe(diskKey)
 		}
 
 		break
@@ -2275,11 +2818,13 @@ func NewClient(stateFilename string, ui UI, rand io.Reader, testing, autoFetch b
 		rand:            rand,
 		contacts:        make(map[uint64]*Contact),
 		drafts:          make(map[uint64]*Draft),
+		replayCache:     newReplayCache(),
 		newMessageChan:  make(chan NewMessage),
 		messageSentChan: make(chan messageSendResult, 1),
 		backgroundChan:  make(chan interface{}, 8),
 	}
 	c.log.toStderr = true
+	c.lockSecrets()
 
 	go c.loadUI()
 	return c
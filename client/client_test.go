@@ -4,10 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/rand"
+	"encoding/base32"
 	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"io/ioutil"
+	"math"
+	mrand "math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,8 +22,14 @@ import (
 	"testing"
 	"time"
 
+	"code.google.com/p/go.crypto/curve25519"
+	"code.google.com/p/go.crypto/nacl/secretbox"
 	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/pond/bbssig"
+	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/client/secret"
 	pond "github.com/agl/pond/protos"
+	"github.com/agl/pond/transport"
 )
 
 type TestServer struct {
@@ -89,6 +101,43 @@ func (server *TestServer) URL() string {
 	return fmt.Sprintf("pondserver://%s@127.0.0.1:%d", server.identity, server.port)
 }
 
+// Deliveries returns the contents of all the messages queued on the server,
+// keyed by filename.
+func (server *TestServer) Deliveries() (map[string][]byte, error) {
+	accounts, err := filepath.Glob(filepath.Join(server.stateDir, "accounts", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(map[string][]byte)
+	for _, account := range accounts {
+		names, err := filepath.Glob(filepath.Join(account, strings.Repeat("[0-9a-f]", 64)))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			contents, err := ioutil.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			deliveries[name] = contents
+		}
+	}
+
+	return deliveries, nil
+}
+
+// Replay requeues messages previously returned by Deliveries, as a malicious
+// server could.
+func (server *TestServer) Replay(deliveries map[string][]byte) error {
+	for name, contents := range deliveries {
+		if err := ioutil.WriteFile(name, contents, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (server *TestServer) Close() {
 	server.cmd.Process.Kill()
 	server.cmd.Wait()
@@ -166,11 +215,16 @@ func (ui *TestUI) processWidget(widget interface{}) {
 }
 
 func (ui *TestUI) WaitForSignal() error {
-	var uierr error
 	ack, ok := <-ui.signal
 	if !ok {
 		panic("signal channel closed")
 	}
+	return ui.handleSignal(ack)
+}
+
+// handleSignal processes the pending actions for a signal and acknowledges it.
+func (ui *TestUI) handleSignal(ack chan bool) error {
+	var uierr error
 
 ReadActions:
 	for {
@@ -188,6 +242,10 @@ ReadActions:
 				ui.text[action.name] = action.text
 			case SetChild:
 				ui.processWidget(action.child)
+			case SetBoxContents:
+				ui.processWidget(action.child)
+			case AddToBox:
+				ui.processWidget(action.child)
 			case Append:
 				for _, child := range action.children {
 					ui.processWidget(child)
@@ -611,6 +669,163 @@ func TestMessageExchange(t *testing.T) {
 	}
 }
 
+// pairedContacts returns the contact records that two clients would have for
+// each other after a key exchange.
+func pairedContacts() (toBob, toAlice *Contact) {
+	toBob, toAlice = new(Contact), new(Contact)
+	for _, contact := range []*Contact{toBob, toAlice} {
+		rand.Reader.Read(contact.lastDHPrivate[:])
+		rand.Reader.Read(contact.currentDHPrivate[:])
+	}
+	curve25519.ScalarBaseMult(&toAlice.theirCurrentDHPublic, &toBob.lastDHPrivate)
+	curve25519.ScalarBaseMult(&toBob.theirCurrentDHPublic, &toAlice.lastDHPrivate)
+	return
+}
+
+func openSealed(sealed []byte, from *Contact) ([]byte, bool) {
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	return decryptMessage(sealed[24:], &nonce, from)
+}
+
+func TestMessageFormats(t *testing.T) {
+	c := &client{rand: rand.Reader}
+	plaintext := []byte("hello")
+
+	var length int
+	for _, version := range []int32{1, ratchetVersion} {
+		toBob, toAlice := pairedContacts()
+		toBob.supportedVersion = version
+
+		sealed, err := c.sealMessage(toBob, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if length == 0 {
+			length = len(sealed)
+		} else if len(sealed) != length {
+			t.Errorf("version %d messages are %d bytes long, but earlier messages were %d bytes", version, len(sealed), length)
+		}
+
+		opened, ok := openSealed(sealed, toAlice)
+		if !ok || !bytes.Equal(opened, plaintext) {
+			t.Errorf("failed to decrypt version %d message", version)
+		}
+	}
+}
+
+func TestRatchet(t *testing.T) {
+	c := &client{rand: rand.Reader}
+	toBob, toAlice := pairedContacts()
+	toBob.supportedVersion = ratchetVersion
+
+	var sealed [][]byte
+	for i := 0; i < 4; i++ {
+		msg, err := c.sealMessage(toBob, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed = append(sealed, msg)
+	}
+	if toBob.sendChain == nil || toBob.sendChain.counter != 4 {
+		t.Fatalf("sending chain didn't advance")
+	}
+
+	for _, i := range []int{2, 0, 3, 1} {
+		opened, ok := openSealed(sealed[i], toAlice)
+		if !ok || len(opened) != 1 || opened[0] != byte(i) {
+			t.Fatalf("failed to decrypt message %d", i)
+		}
+	}
+	if n := len(toAlice.skippedKeys); n != 0 {
+		t.Errorf("%d skipped keys remain after all messages were received", n)
+	}
+	if _, ok := openSealed(sealed[1], toAlice); ok {
+		t.Errorf("message key wasn't erased after use")
+	}
+	if _, ok := openSealed(sealed[3], toAlice); ok {
+		t.Errorf("chain didn't advance past the last message")
+	}
+
+	// When Bob's DH value changes, a new chain is started but messages on
+	// the old chain can still be received.
+	old, err := c.sealMessage(toBob, []byte("old chain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstChain := toBob.sendChain.public
+	curve25519.ScalarBaseMult(&toBob.theirCurrentDHPublic, &toAlice.currentDHPrivate)
+	msg, err := c.sealMessage(toBob, []byte("new chain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toBob.sendChain.public == firstChain {
+		t.Errorf("new sending chain wasn't started")
+	}
+	if opened, ok := openSealed(old, toAlice); !ok || string(opened) != "old chain" {
+		t.Errorf("failed to decrypt message on old chain")
+	}
+	if opened, ok := openSealed(msg, toAlice); !ok || string(opened) != "new chain" {
+		t.Errorf("failed to decrypt message on new chain")
+	}
+	if n := len(toAlice.receiveChains); n != 2 {
+		t.Errorf("%d receiving chains, want 2", n)
+	}
+}
+
+func TestRatchetExchange(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// The first messages tell each client that the other supports the
+	// ratchet.
+	sendMessage(client1, "client2", "hello")
+	fetchMessage(client2)
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
+
+	for i := 0; i < 2; i++ {
+		testMsg := fmt.Sprintf("test message %d", i)
+		sendMessage(client1, "client2", testMsg)
+		if _, msg := fetchMessage(client2); string(msg.message.Body) != testMsg {
+			t.Fatalf("Incorrect message contents: %s", msg.message.Body)
+		}
+
+		client1.Reload()
+		client1.AdvanceTo(uiStateMain)
+		client2.Reload()
+		client2.AdvanceTo(uiStateMain)
+	}
+
+	_, contact2 := contactByName(client1, "client2")
+	if contact2.sendChain == nil || contact2.sendChain.counter != 2 {
+		t.Errorf("client1's sending chain wasn't used and persisted")
+	}
+	_, contact1 := contactByName(client2, "client1")
+	if len(contact1.receiveChains) != 1 {
+		t.Errorf("client2 has %d receiving chains, want 1", len(contact1.receiveChains))
+	}
+}
+
 func TestACKs(t *testing.T) {
 	t.Parallel()
 
@@ -669,7 +884,7 @@ func TestACKs(t *testing.T) {
 	}
 }
 
-func TestHalfPairedMessageExchange(t *testing.T) {
+func TestDeliveryReceipts(t *testing.T) {
 	t.Parallel()
 
 	server, err := NewTestServer(t)
@@ -690,63 +905,52 @@ func TestHalfPairedMessageExchange(t *testing.T) {
 	}
 	defer client2.Close()
 
-	proceedToKeyExchange(t, client1, server, "client2")
-	proceedToKeyExchange(t, client2, server, "client1")
+	proceedToPaired(t, client1, client2, server)
 
-	client1KX := client1.ui.text["kxout"]
-	client1.ui.events <- Click{
-		name:      "process",
-		textViews: map[string]string{"kxin": client2.ui.text["kxout"]},
+	client2.ui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+	client2.ui.events <- Click{name: "receipts"}
+	client2.AdvanceTo(uiStateShowIdentity)
+	if !client2.deliveryReceipts {
+		t.Fatalf("delivery receipts not enabled")
 	}
-	client1.AdvanceTo(uiStateShowContact)
 
-	// Now client1 is paired with client2, but client2 is still pending on
-	// client1.
+	sendMessage(client1, "client2", "test message")
+	fetchMessage(client2)
 
-	// Send a message from client1 to client2.
-	const testMsg = "test message"
-	sendMessage(client1, "client2", testMsg)
-	from, msg := fetchMessage(client2)
-	if from != "client1" {
-		t.Fatalf("message from %s, expected client1", from)
+	ackChan := make(chan bool)
+	client2.fetchNowChan <- ackChan
+	<-ackChan
+
+	if from, _ := fetchMessage(client1); from != "client2" {
+		t.Fatalf("receipt received from wrong contact: %s", from)
 	}
-	if len(msg.sealed) == 0 {
-		t.Fatalf("no sealed message from client2")
+
+	msg := client1.outbox[0]
+	if msg.delivered.IsZero() {
+		t.Errorf("client1 doesn't believe that its message has been delivered")
 	}
-	if len(client2.inboxUI.entries) == 0 {
-		t.Fatalf("no pending UI entry in client2")
+	if !msg.acked.IsZero() {
+		t.Errorf("client1 believes that a delivery receipt is an ack")
+	}
+	if ind := msg.indicator(); ind != indicatorBlue {
+		t.Errorf("message has indicator %d after delivery, want blue", ind)
 	}
 
-	// Check that viewing the message in client2 doesn't crash anything.
-	client2.ui.events <- Click{
-		name: client2.inboxUI.entries[0].boxName,
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if client1.outbox[0].delivered.IsZero() {
+		t.Errorf("delivered time was not persisted")
 	}
-	client2.AdvanceTo(uiStateInbox)
 
 	client2.Reload()
 	client2.AdvanceTo(uiStateMain)
-
-	// Select the pending contact in client2 to complete the key exchange.
-	client2.ui.events <- Click{
-		name: client2.contactsUI.entries[0].boxName,
-	}
-	client2.AdvanceTo(uiStateNewContact)
-	client2.ui.events <- Click{
-		name:      "process",
-		textViews: map[string]string{"kxin": client1KX},
-	}
-	client2.AdvanceTo(uiStateShowContact)
-	client2.ui.events <- Click{
-		name: client2.inboxUI.entries[0].boxName,
-	}
-	client2.AdvanceTo(uiStateInbox)
-
-	if s := client2.ui.text["body"]; s != testMsg {
-		t.Fatalf("resolved message is incorrect: %s", s)
+	if !client2.deliveryReceipts {
+		t.Errorf("delivery receipts setting was not persisted")
 	}
 }
 
-func TestDraft(t *testing.T) {
+func TestReplay(t *testing.T) {
 	t.Parallel()
 
 	server, err := NewTestServer(t)
@@ -755,158 +959,206 @@ func TestDraft(t *testing.T) {
 	}
 	defer server.Close()
 
-	client, err := NewTestClient(t, "client")
+	client1, err := NewTestClient(t, "client1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client.Close()
+	defer client1.Close()
 
-	proceedToMainUI(t, client, server)
-	client.ui.events <- Click{name: "compose"}
-	client.AdvanceTo(uiStateCompose)
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
 
-	if l := len(client.drafts); l != 1 {
-		t.Fatalf("Bad number of drafts: %d", l)
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "replayed message")
+	deliveries, err := server.Deliveries()
+	if err != nil {
+		t.Fatal(err)
 	}
-	var draftID uint64
-	for id := range client.drafts {
-		draftID = id
-		break
+	if len(deliveries) != 1 {
+		t.Fatalf("found %d deliveries on the server, want 1", len(deliveries))
 	}
+	fetchMessage(client2)
 
-	const initialText = "wibble wobble"
+	// The replay cache must survive a restart and catch replays of
+	// messages that have been erased from the inbox.
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	client2.inbox = nil
 
-	client.ui.events <- Update{
-		name: "body",
-		text: initialText,
+	if err := server.Replay(deliveries); err != nil {
+		t.Fatal(err)
 	}
-	client.Reload()
-	client.AdvanceTo(uiStateMain)
 
-	if l := len(client.drafts); l != 1 {
-		t.Fatalf("Bad number of drafts after reload: %d", l)
+	ackChan := make(chan bool)
+	client2.fetchNowChan <- ackChan
+WaitForAck:
+	for {
+		select {
+		case ack := <-client2.ui.signal:
+			ack <- true
+		case <-ackChan:
+			break WaitForAck
+		}
 	}
 
-	if l := len(client.draftsUI.entries); l != 1 {
-		t.Fatalf("Bad number of draft UI entries after reload: %d", l)
+	if n := len(client2.inbox); n != 0 {
+		t.Fatalf("replayed message was accepted: %d messages in inbox", n)
 	}
-
-	if id := client.draftsUI.entries[0].id; id != draftID {
-		t.Fatalf("Incorrect draft ID after reload: %d vs %d", id, draftID)
+	dropped := false
+	client2.log.Lock()
+	for _, entry := range client2.log.entries {
+		if strings.Contains(entry.s, "Dropping replayed message") {
+			dropped = true
+		}
 	}
-
-	client.ui.events <- Click{name: client.draftsUI.entries[0].boxName}
-	client.AdvanceTo(uiStateCompose)
-	if text := client.ui.text["body"]; text != initialText {
-		t.Fatalf("Wrong message text after reload: '%s' vs '%s'", text, initialText)
+	client2.log.Unlock()
+	if !dropped {
+		t.Errorf("replayed message wasn't fetched and dropped")
 	}
 
-	attachmentFile := filepath.Join(client.stateDir, "attachment")
-	if err := ioutil.WriteFile(attachmentFile, []byte(initialText), 0644); err != nil {
-		t.Fatalf("Failed to write attachment file: %s", err)
+	// New messages must still be accepted.
+	sendMessage(client1, "client2", "new message")
+	if _, msg := fetchMessage(client2); string(msg.message.Body) != "new message" {
+		t.Errorf("received %q, want the new message", msg.message.Body)
 	}
+}
 
-	client.ui.events <- Click{name: "attach"}
-	client.ui.events <- OpenResult{path: attachmentFile, ok: true}
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	rc := newReplayCache()
 
-	client.Reload()
-	client.AdvanceTo(uiStateMain)
-	client.ui.events <- Click{name: client.draftsUI.entries[0].boxName}
-	client.AdvanceTo(uiStateCompose)
+	h1 := messageReplayHash(1, 2)
+	h2 := messageReplayHash(2, 1)
+	if h1 == h2 {
+		t.Fatalf("replay hash doesn't depend on the order of its inputs")
+	}
 
-	const labelPrefix = "attachment-label-"
-	var attachmentID uint64
-	for name := range client.ui.text {
-		if strings.HasPrefix(name, labelPrefix) {
-			attachmentID, err = strconv.ParseUint(name[len(labelPrefix):], 16, 64)
-			if err != nil {
-				t.Fatalf("Failed to parse attachment label: %s", name)
-			}
-			break
-		}
+	rc.add(h1, now.Add(-replayCacheLifetime-time.Hour))
+	rc.add(h2, now)
+	if rc.contains(h1) {
+		t.Errorf("expired entry is still in the cache")
+	}
+	if !rc.contains(h2) {
+		t.Errorf("entry missing from the cache")
 	}
 
-	if attachmentID == 0 {
-		t.Fatalf("failed to find attachment after reload")
+	for i := uint64(0); i < maxReplayCacheEntries; i++ {
+		rc.add(messageReplayHash(3, i), now)
+	}
+	if n := len(rc.entries); n != maxReplayCacheEntries {
+		t.Errorf("cache has %d entries, want %d", n, maxReplayCacheEntries)
+	}
+	if rc.contains(h2) {
+		t.Errorf("oldest entry wasn't evicted from a full cache")
+	}
+	if len(rc.seen) != len(rc.entries) {
+		t.Errorf("cache map has %d entries but list has %d", len(rc.seen), len(rc.entries))
 	}
 
-	client.ui.events <- Click{name: fmt.Sprintf("remove-%x", attachmentID)}
-	client.Reload()
-	client.AdvanceTo(uiStateMain)
-	client.ui.events <- Click{name: client.draftsUI.entries[0].boxName}
-	client.AdvanceTo(uiStateCompose)
+	msg := &InboxMessage{
+		from:         1,
+		receivedTime: now,
+		message:      &pond.Message{Time: proto.Int64(now.Add(-time.Hour).Unix())},
+	}
+	if warning := oldMessageWarning(msg); len(warning) > 0 {
+		t.Errorf("recent message flagged: %s", warning)
+	}
+	msg.message.Time = proto.Int64(now.Add(-replayCacheLifetime - time.Hour).Unix())
+	if warning := oldMessageWarning(msg); len(warning) == 0 {
+		t.Errorf("old message wasn't flagged")
+	}
+	msg.message.Time = proto.Int64(now.Add(2 * maxClockSkew).Unix())
+	if warning := oldMessageWarning(msg); len(warning) == 0 {
+		t.Errorf("message from the future wasn't flagged")
+	}
+}
 
-	for name := range client.ui.text {
-		if strings.HasPrefix(name, labelPrefix) {
-			t.Fatalf("Found attachment after removing")
-		}
+func TestExpireSecrets(t *testing.T) {
+	now := time.Now()
+	c := &client{rand: rand.Reader, contacts: make(map[uint64]*Contact)}
+
+	oldBody := []byte("old message")
+	newBody := []byte("new message")
+	c.inbox = []*InboxMessage{
+		{
+			id:           1,
+			receivedTime: now.Add(-messageLifetime - time.Hour),
+			sealed:       []byte("sealed"),
+			message:      &pond.Message{Body: oldBody},
+		},
+		{
+			id:           2,
+			receivedTime: now,
+			message:      &pond.Message{Body: newBody},
+		},
+	}
+
+	oldPriv, err := bbssig.GenerateGroup(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPriv, err := bbssig.GenerateGroup(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.prevGroupPrivs = []previousGroupPrivateKey{
+		{priv: oldPriv, expired: now.Add(-previousTagLifetime - time.Hour)},
+		{priv: newPriv, expired: now},
 	}
 
-	errorFile := filepath.Join(client.stateDir, "error")
-	if err := ioutil.WriteFile(errorFile, nil, 0); err != nil {
-		t.Fatalf("Failed to write error file: %s", err)
+	toBob, _ := pairedContacts()
+	toBob.skippedKeys = []skippedKey{
+		{counter: 0, key: [32]byte{1}, expires: now.Add(-time.Hour)},
+		{counter: 1, key: [32]byte{2}, expires: now.Add(time.Hour)},
 	}
+	c.contacts[toBob.id] = toBob
+	skipped := toBob.skippedKeys[:2]
 
-	client.ui.events <- Click{name: "attach"}
-	client.ui.WaitForFileOpen()
-	client.ui.events <- OpenResult{path: attachmentFile, ok: true}
-	client.ui.events <- Click{name: "attach"}
-	client.ui.WaitForFileOpen()
-	client.ui.events <- OpenResult{path: errorFile, ok: true}
-	client.ui.WaitForSignal()
-
-	attachmentID = 0
-	const errorPrefix = "attachment-error-"
-	for name := range client.ui.text {
-		if strings.HasPrefix(name, errorPrefix) {
-			attachmentID, err = strconv.ParseUint(name[len(errorPrefix):], 16, 64)
-			if err != nil {
-				t.Fatalf("Failed to parse attachment label: %s", name)
-			}
-			break
-		}
+	expired := c.expireSecrets(now)
+	if len(expired) != 1 || expired[0] != 1 {
+		t.Errorf("expireSecrets returned %v, want [1]", expired)
 	}
-
-	if attachmentID == 0 {
-		t.Fatalf("failed to find error attachment")
+	if len(c.inbox) != 1 || c.inbox[0].id != 2 {
+		t.Errorf("expired message wasn't removed from the inbox")
 	}
-
-	client.ui.events <- Click{name: fmt.Sprintf("remove-%x", attachmentID)}
-	client.ui.WaitForSignal()
-}
-
-func TestDraftDiscard(t *testing.T) {
-	t.Parallel()
-
-	server, err := NewTestServer(t)
-	if err != nil {
-		t.Fatal(err)
+	if !secret.IsZero(oldBody) {
+		t.Errorf("body of expired message wasn't wiped")
 	}
-	defer server.Close()
-
-	client, err := NewTestClient(t, "client")
-	if err != nil {
-		t.Fatal(err)
+	if secret.IsZero(newBody) {
+		t.Errorf("body of current message was wiped")
 	}
-	defer client.Close()
-
-	proceedToMainUI(t, client, server)
-	client.ui.events <- Click{name: "compose"}
-	client.AdvanceTo(uiStateCompose)
 
-	if l := len(client.drafts); l != 1 {
-		t.Fatalf("Bad number of drafts: %d", l)
+	if len(c.prevGroupPrivs) != 1 || c.prevGroupPrivs[0].priv != newPriv {
+		t.Errorf("expired group private key wasn't removed")
+	}
+	if !secret.IsZero(oldPriv.Marshal()) {
+		t.Errorf("expired group private key wasn't wiped")
+	}
+	if secret.IsZero(newPriv.Marshal()) {
+		t.Errorf("current group private key was wiped")
 	}
 
-	client.ui.events <- Click{name: "discard"}
-	client.AdvanceTo(uiStateMain)
+	if len(toBob.skippedKeys) != 1 || toBob.skippedKeys[0].counter != 1 {
+		t.Errorf("expired skipped key wasn't removed")
+	}
+	if !secret.IsZero(skipped[1].key[:]) {
+		t.Errorf("stale copy of skipped key wasn't wiped")
+	}
 
-	if l := len(client.drafts); l != 0 {
-		t.Fatalf("Bad number of drafts after discard: %d", l)
+	toBob.wipe()
+	if !secret.IsZero(toBob.lastDHPrivate[:]) || !secret.IsZero(toBob.currentDHPrivate[:]) {
+		t.Errorf("contact's DH private values weren't wiped")
+	}
+	if toBob.skippedKeys != nil {
+		t.Errorf("contact's skipped keys weren't dropped")
 	}
 }
 
-func testDetached(t *testing.T, upload bool) {
+func TestExpireSecretsWhileRunning(t *testing.T) {
 	t.Parallel()
 
 	server, err := NewTestServer(t)
@@ -928,125 +1180,57 @@ func testDetached(t *testing.T, upload bool) {
 	defer client2.Close()
 
 	proceedToPaired(t, client1, client2, server)
-	client1.ui.events <- Click{name: "compose"}
-	client1.AdvanceTo(uiStateCompose)
-
-	plaintextPath := filepath.Join(client1.stateDir, "file")
-	ciphertextPath := filepath.Join(client1.stateDir, "encrypted")
-	plaintext := make([]byte, 200*1024)
-	io.ReadFull(rand.Reader, plaintext)
-	if err := ioutil.WriteFile(plaintextPath, plaintext, 0644); err != nil {
-		t.Fatal(err)
-	}
-
-	client1.ui.events <- Click{name: "attach"}
-	client1.ui.WaitForFileOpen()
-	client1.ui.events <- OpenResult{path: plaintextPath, ok: true}
-	client1.ui.WaitForSignal()
-	for name := range client1.ui.text {
-		const labelPrefix = "attachment-label-"
-		if strings.HasPrefix(name, labelPrefix) {
-			attachmentID, err := strconv.ParseUint(name[len(labelPrefix):], 16, 64)
-			if err != nil {
-				t.Fatalf("Failed to parse attachment label: %s", name)
-			}
-			if upload {
-				client1.ui.events <- Click{name: fmt.Sprintf("attachment-upload-%x", attachmentID)}
-			} else {
-				client1.ui.events <- Click{name: fmt.Sprintf("attachment-convert-%x", attachmentID)}
-			}
-			break
-		}
-	}
-	if !upload {
-		fo := client1.ui.WaitForFileOpen()
-		client1.ui.events <- OpenResult{path: ciphertextPath, ok: true, arg: fo.arg}
-		client1.ui.WaitForSignal()
-	}
-
-	var draft *Draft
-	for _, d := range client1.drafts {
-		draft = d
-		break
-	}
 
-	for len(draft.detachments) == 0 {
-		client1.ui.WaitForSignal()
+	sendMessage(client1, "client2", "old message")
+	_, old := fetchMessage(client2)
+	client2.ui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
 	}
+	client2.AdvanceTo(uiStateInbox)
 
-	client1.ui.events <- Click{
-		name:      "send",
-		combos:    map[string]string{"to": "client2"},
-		textViews: map[string]string{"body": "foo"},
+	// Expire the displayed message and add an expired ack, which isn't
+	// listed in the inbox UI.
+	old.receivedTime = time.Now().Add(-messageLifetime - time.Hour)
+	ack := &InboxMessage{
+		id:           1,
+		from:         old.from,
+		receivedTime: old.receivedTime,
+		message:      &pond.Message{Id: proto.Uint64(1), Body: []byte{}},
 	}
+	client2.inbox = append(client2.inbox, ack)
 
-	client1.AdvanceTo(uiStateOutbox)
+	// Receiving another message saves the state, which expires them.
+	sendMessage(client1, "client2", "new message")
 	ackChan := make(chan bool)
-	client1.fetchNowChan <- ackChan
-	<-ackChan
-
-	_, msg := fetchMessage(client2)
-	if len(msg.message.DetachedFiles) != 1 {
-		t.Fatalf("message received with no detachments")
-	}
+	client2.fetchNowChan <- ackChan
 
-	for _, e := range client2.inboxUI.entries {
-		if e.id == msg.id {
-			client2.ui.events <- Click{name: e.boxName}
-			break
+WaitForAck:
+	for {
+		select {
+		case ack := <-client2.ui.signal:
+			if err := client2.ui.handleSignal(ack); err != nil {
+				t.Fatal(err)
+			}
+		case <-ackChan:
+			break WaitForAck
 		}
 	}
 
-	client2.AdvanceTo(uiStateInbox)
-	if upload {
-		client2.ui.events <- Click{name: "detachment-download-0"}
-	} else {
-		client2.ui.events <- Click{name: "detachment-decrypt-0"}
-	}
-	fo := client2.ui.WaitForFileOpen()
-	outputPath := filepath.Join(client1.stateDir, "output")
-	if upload {
-		client2.ui.events <- OpenResult{ok: true, path: outputPath, arg: fo.arg}
-	} else {
-		client2.ui.events <- OpenResult{ok: true, path: ciphertextPath, arg: fo.arg}
-		fo = client2.ui.WaitForFileOpen()
-		client2.ui.events <- OpenResult{ok: true, path: outputPath, arg: fo.arg}
-	}
-	client2.ui.WaitForSignal()
-
-	var id uint64
-	for dID := range msg.decryptions {
-		id = dID
-		break
-	}
-
-	if id == 0 {
-		t.Fatalf("Failed to get id of decryption")
-	}
-
-	for len(msg.decryptions) > 0 {
-		client2.ui.WaitForSignal()
+	// The message view is left once the message has expired.
+	for client2.ui.currentStateID != uiStateMain {
+		if err := client2.ui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
 	}
-
-	result, err := ioutil.ReadFile(outputPath)
-	if err != nil {
-		t.Fatal(err)
+	if len(client2.inbox) != 1 || client2.inbox[0] == old || client2.inbox[0] == ack {
+		t.Fatalf("expired messages weren't removed from the inbox")
 	}
-
-	if !bytes.Equal(result, plaintext) {
-		t.Fatalf("bad decryption")
+	if len(client2.inboxUI.entries) != 1 {
+		t.Fatalf("inbox UI has %d entries, want 1", len(client2.inboxUI.entries))
 	}
 }
 
-func TestDetachedFile(t *testing.T) {
-	testDetached(t, false)
-}
-
-func TestUploadDownload(t *testing.T) {
-	testDetached(t, true)
-}
-
-func TestLogOverflow(t *testing.T) {
+func TestExpireSecretsWhileReplying(t *testing.T) {
 	t.Parallel()
 
 	server, err := NewTestServer(t)
@@ -1060,65 +1244,60 @@ func TestLogOverflow(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer client1.Close()
-	proceedToMainUI(t, client1, server)
-
-	client1.ui.events <- Click{name: client1.clientUI.entries[1].boxName}
-	client1.AdvanceTo(uiStateLog)
-
-	for i := 0; i < 2*(logLimit+logSlack); i++ {
-		client1.log.Printf("%d", i)
-	}
-}
-
-func TestServerAnnounce(t *testing.T) {
-	server, err := NewTestServer(t)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer server.Close()
 
-	client, err := NewTestClient(t, "client")
+	client2, err := NewTestClient(t, "client2")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client.Close()
+	defer client2.Close()
 
-	proceedToMainUI(t, client, server)
+	proceedToPaired(t, client1, client2, server)
 
-	const testMessage = "Hello world"
-	announce := &pond.Message{
-		Id:           proto.Uint64(0),
-		Time:         proto.Int64(time.Now().Unix()),
-		Body:         []byte(testMessage),
-		MyNextDh:     []byte{},
-		BodyEncoding: pond.Message_RAW.Enum(),
-	}
-	announceBytes, err := proto.Marshal(announce)
-	if err != nil {
-		t.Fatalf("Failed to marshal announce message: %s", err)
-	}
-	if err := ioutil.WriteFile(fmt.Sprintf("%s/accounts/%x/announce-00000000", server.stateDir, client.identityPublic[:]), announceBytes, 0666); err != nil {
-		t.Fatalf("Failed to write announce message: %s", err)
+	sendMessage(client1, "client2", "old message")
+	_, old := fetchMessage(client2)
+	replyToId := old.message.GetId()
+	client2.ui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
 	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.ui.events <- Click{name: "reply"}
+	client2.AdvanceTo(uiStateCompose)
 
-	fetchMessage(client)
+	// Expire the message that's being replied to.
+	old.receivedTime = time.Now().Add(-messageLifetime - time.Hour)
+	sendMessage(client1, "client2", "new message")
+	ackChan := make(chan bool)
+	client2.fetchNowChan <- ackChan
 
-	if len(client.inbox) != 1 {
-		t.Fatalf("Inbox doesn't have a message")
+WaitForAck:
+	for {
+		select {
+		case ack := <-client2.ui.signal:
+			if err := client2.ui.handleSignal(ack); err != nil {
+				t.Fatal(err)
+			}
+		case <-ackChan:
+			break WaitForAck
+		}
 	}
-	client.ui.events <- Click{
-		name: client.inboxUI.entries[0].boxName,
+	if old.message != nil {
+		t.Fatalf("message wasn't expired")
 	}
-	client.AdvanceTo(uiStateInbox)
-	if s := client.ui.text["body"]; s != testMessage {
-		t.Fatalf("resolved message is incorrect: %s", s)
+
+	client2.ui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client1"},
+		textViews: map[string]string{"body": "reply"},
 	}
+	client2.AdvanceTo(uiStateOutbox)
 
-	client.Reload()
-	client.AdvanceTo(uiStateMain)
+	reply := client2.outbox[len(client2.outbox)-1]
+	if got := reply.message.GetInReplyTo(); got != replyToId {
+		t.Errorf("reply is in reply to %d, want %d", got, replyToId)
+	}
 }
 
-func TestRevoke(t *testing.T) {
+func TestHalfPairedMessageExchange(t *testing.T) {
 	t.Parallel()
 
 	server, err := NewTestServer(t)
@@ -1139,132 +1318,2085 @@ func TestRevoke(t *testing.T) {
 	}
 	defer client2.Close()
 
-	client3, err := NewTestClient(t, "client3")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer client3.Close()
+	proceedToKeyExchange(t, client1, server, "client2")
+	proceedToKeyExchange(t, client2, server, "client1")
 
-	client4, err := NewTestClient(t, "client4")
-	if err != nil {
-		t.Fatal(err)
+	client1KX := client1.ui.text["kxout"]
+	client1.ui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.ui.text["kxout"]},
 	}
-	defer client4.Close()
-
-	proceedToPaired(t, client1, client2, server)
-	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
-	proceedToPairedWithNames(t, client1, client4, "client1", "client4", server)
-
-	initialGeneration := client1.generation
+	client1.AdvanceTo(uiStateShowContact)
 
-	// Have client4 send a message before the revocation.
-	const beforeRevocationMsg = "from before revocation"
-	sendMessage(client4, "client1", beforeRevocationMsg)
+	// Now client1 is paired with client2, but client2 is still pending on
+	// client1.
 
-	var client1FromClient2 *Contact
-	for _, candidate := range client2.contacts {
-		if candidate.name == "client1" {
-			client1FromClient2 = candidate
+	// Send a message from client1 to client2.
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+	from, msg := fetchMessage(client2)
+	if from != "client1" {
+		t.Fatalf("message from %s, expected client1", from)
+	}
+	if len(msg.sealed) == 0 {
+		t.Fatalf("no sealed message from client2")
+	}
+	if len(client2.inboxUI.entries) == 0 {
+		t.Fatalf("no pending UI entry in client2")
+	}
+
+	// Check that viewing the message in client2 doesn't crash anything.
+	client2.ui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+
+	// Select the pending contact in client2 to complete the key exchange.
+	client2.ui.events <- Click{
+		name: client2.contactsUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateNewContact)
+	client2.ui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client1KX},
+	}
+	client2.AdvanceTo(uiStateShowContact)
+	client2.ui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	if s := client2.ui.text["body"]; s != testMsg {
+		t.Fatalf("resolved message is incorrect: %s", s)
+	}
+}
+
+func TestDraft(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+	client.ui.events <- Click{name: "compose"}
+	client.AdvanceTo(uiStateCompose)
+
+	if l := len(client.drafts); l != 1 {
+		t.Fatalf("Bad number of drafts: %d", l)
+	}
+	var draftID uint64
+	for id := range client.drafts {
+		draftID = id
+		break
+	}
+
+	const initialText = "wibble wobble"
+
+	client.ui.events <- Update{
+		name: "body",
+		text: initialText,
+	}
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	if l := len(client.drafts); l != 1 {
+		t.Fatalf("Bad number of drafts after reload: %d", l)
+	}
+
+	if l := len(client.draftsUI.entries); l != 1 {
+		t.Fatalf("Bad number of draft UI entries after reload: %d", l)
+	}
+
+	if id := client.draftsUI.entries[0].id; id != draftID {
+		t.Fatalf("Incorrect draft ID after reload: %d vs %d", id, draftID)
+	}
+
+	client.ui.events <- Click{name: client.draftsUI.entries[0].boxName}
+	client.AdvanceTo(uiStateCompose)
+	if text := client.ui.text["body"]; text != initialText {
+		t.Fatalf("Wrong message text after reload: '%s' vs '%s'", text, initialText)
+	}
+
+	attachmentFile := filepath.Join(client.stateDir, "attachment")
+	if err := ioutil.WriteFile(attachmentFile, []byte(initialText), 0644); err != nil {
+		t.Fatalf("Failed to write attachment file: %s", err)
+	}
+
+	client.ui.events <- Click{name: "attach"}
+	client.ui.events <- OpenResult{path: attachmentFile, ok: true}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	client.ui.events <- Click{name: client.draftsUI.entries[0].boxName}
+	client.AdvanceTo(uiStateCompose)
+
+	const labelPrefix = "attachment-label-"
+	var attachmentID uint64
+	for name := range client.ui.text {
+		if strings.HasPrefix(name, labelPrefix) {
+			attachmentID, err = strconv.ParseUint(name[len(labelPrefix):], 16, 64)
+			if err != nil {
+				t.Fatalf("Failed to parse attachment label: %s", name)
+			}
+			break
+		}
+	}
+
+	if attachmentID == 0 {
+		t.Fatalf("failed to find attachment after reload")
+	}
+
+	client.ui.events <- Click{name: fmt.Sprintf("remove-%x", attachmentID)}
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	client.ui.events <- Click{name: client.draftsUI.entries[0].boxName}
+	client.AdvanceTo(uiStateCompose)
+
+	for name := range client.ui.text {
+		if strings.HasPrefix(name, labelPrefix) {
+			t.Fatalf("Found attachment after removing")
+		}
+	}
+
+	errorFile := filepath.Join(client.stateDir, "error")
+	if err := ioutil.WriteFile(errorFile, nil, 0); err != nil {
+		t.Fatalf("Failed to write error file: %s", err)
+	}
+
+	client.ui.events <- Click{name: "attach"}
+	client.ui.WaitForFileOpen()
+	client.ui.events <- OpenResult{path: attachmentFile, ok: true}
+	client.ui.events <- Click{name: "attach"}
+	client.ui.WaitForFileOpen()
+	client.ui.events <- OpenResult{path: errorFile, ok: true}
+	client.ui.WaitForSignal()
+
+	attachmentID = 0
+	const errorPrefix = "attachment-error-"
+	for name := range client.ui.text {
+		if strings.HasPrefix(name, errorPrefix) {
+			attachmentID, err = strconv.ParseUint(name[len(errorPrefix):], 16, 64)
+			if err != nil {
+				t.Fatalf("Failed to parse attachment label: %s", name)
+			}
+			break
+		}
+	}
+
+	if attachmentID == 0 {
+		t.Fatalf("failed to find error attachment")
+	}
+
+	client.ui.events <- Click{name: fmt.Sprintf("remove-%x", attachmentID)}
+	client.ui.WaitForSignal()
+}
+
+func TestDraftDiscard(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+	client.ui.events <- Click{name: "compose"}
+	client.AdvanceTo(uiStateCompose)
+
+	if l := len(client.drafts); l != 1 {
+		t.Fatalf("Bad number of drafts: %d", l)
+	}
+
+	client.ui.events <- Click{name: "discard"}
+	client.AdvanceTo(uiStateMain)
+
+	if l := len(client.drafts); l != 0 {
+		t.Fatalf("Bad number of drafts after discard: %d", l)
+	}
+}
+
+func testDetached(t *testing.T, upload bool) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	client1.ui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+
+	plaintextPath := filepath.Join(client1.stateDir, "file")
+	ciphertextPath := filepath.Join(client1.stateDir, "encrypted")
+	plaintext := make([]byte, 200*1024)
+	io.ReadFull(rand.Reader, plaintext)
+	if err := ioutil.WriteFile(plaintextPath, plaintext, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client1.ui.events <- Click{name: "attach"}
+	client1.ui.WaitForFileOpen()
+	client1.ui.events <- OpenResult{path: plaintextPath, ok: true}
+	client1.ui.WaitForSignal()
+	for name := range client1.ui.text {
+		const labelPrefix = "attachment-label-"
+		if strings.HasPrefix(name, labelPrefix) {
+			attachmentID, err := strconv.ParseUint(name[len(labelPrefix):], 16, 64)
+			if err != nil {
+				t.Fatalf("Failed to parse attachment label: %s", name)
+			}
+			if upload {
+				client1.ui.events <- Click{name: fmt.Sprintf("attachment-upload-%x", attachmentID)}
+			} else {
+				client1.ui.events <- Click{name: fmt.Sprintf("attachment-convert-%x", attachmentID)}
+			}
 			break
 		}
 	}
-	if client1FromClient2.generation != initialGeneration {
-		t.Errorf("Initial generations don't match")
+	if !upload {
+		fo := client1.ui.WaitForFileOpen()
+		client1.ui.events <- OpenResult{path: ciphertextPath, ok: true, arg: fo.arg}
+		client1.ui.WaitForSignal()
+	}
+
+	var draft *Draft
+	for _, d := range client1.drafts {
+		draft = d
+		break
+	}
+
+	for len(draft.detachments) == 0 {
+		client1.ui.WaitForSignal()
+	}
+
+	client1.ui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client2"},
+		textViews: map[string]string{"body": "foo"},
+	}
+
+	client1.AdvanceTo(uiStateOutbox)
+	ackChan := make(chan bool)
+	client1.fetchNowChan <- ackChan
+	<-ackChan
+
+	_, msg := fetchMessage(client2)
+	if len(msg.message.DetachedFiles) != 1 {
+		t.Fatalf("message received with no detachments")
+	}
+
+	for _, e := range client2.inboxUI.entries {
+		if e.id == msg.id {
+			client2.ui.events <- Click{name: e.boxName}
+			break
+		}
+	}
+
+	client2.AdvanceTo(uiStateInbox)
+	if upload {
+		client2.ui.events <- Click{name: "detachment-download-0"}
+	} else {
+		client2.ui.events <- Click{name: "detachment-decrypt-0"}
+	}
+	fo := client2.ui.WaitForFileOpen()
+	outputPath := filepath.Join(client1.stateDir, "output")
+	if upload {
+		client2.ui.events <- OpenResult{ok: true, path: outputPath, arg: fo.arg}
+	} else {
+		client2.ui.events <- OpenResult{ok: true, path: ciphertextPath, arg: fo.arg}
+		fo = client2.ui.WaitForFileOpen()
+		client2.ui.events <- OpenResult{ok: true, path: outputPath, arg: fo.arg}
+	}
+	client2.ui.WaitForSignal()
+
+	var id uint64
+	for dID := range msg.decryptions {
+		id = dID
+		break
+	}
+
+	if id == 0 {
+		t.Fatalf("Failed to get id of decryption")
+	}
+
+	for len(msg.decryptions) > 0 {
+		client2.ui.WaitForSignal()
+	}
+
+	result, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, plaintext) {
+		t.Fatalf("bad decryption")
+	}
+}
+
+func TestDetachmentIntegrity(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pond-detachment-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var key [32]byte
+	io.ReadFull(rand.Reader, key[:])
+
+	encrypt := func(contents []byte) ([]byte, *pond.Message_Detachment) {
+		inPath := filepath.Join(dir, "in")
+		if err := ioutil.WriteFile(inPath, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		detachment, err := saveEncrypted(&key, nil, &out, 0, inPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes(), detachment
+	}
+
+	outPath := filepath.Join(dir, "out")
+	decrypt := func(encrypted []byte, detachment *pond.Message_Detachment) error {
+		encPath := filepath.Join(dir, "encrypted")
+		if err := ioutil.WriteFile(encPath, encrypted, 0600); err != nil {
+			t.Fatal(err)
+		}
+		in, err := os.Open(encPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		return saveDecrypted(nil, NewLog(), outPath, 0, in, detachment, nil)
+	}
+
+	contents := make([]byte, 3*defaultDetachmentBlockSize+100)
+	io.ReadFull(rand.Reader, contents)
+	encrypted, detachment := encrypt(contents)
+
+	if len(detachment.Hash) == 0 {
+		t.Fatalf("detachment doesn't include a hash")
+	}
+	if err := decrypt(encrypted, detachment); err != nil {
+		t.Fatalf("failed to decrypt detachment: %s", err)
+	}
+	if result, _ := ioutil.ReadFile(outPath); !bytes.Equal(result, contents) {
+		t.Fatalf("decrypted detachment doesn't match original")
+	}
+
+	// Clients that predate the hash ignore the trailer.
+	legacy := proto.Clone(detachment).(*pond.Message_Detachment)
+	legacy.Hash = nil
+	if err := decrypt(encrypted, legacy); err != nil {
+		t.Fatalf("failed to decrypt detachment without hash: %s", err)
+	}
+
+	chunkLen := defaultDetachmentBlockSize + secretbox.Overhead
+	chunk := func(b []byte, i int) []byte {
+		return b[i*chunkLen : (i+1)*chunkLen]
+	}
+
+	if err := decrypt(encrypted[:len(encrypted)/2], detachment); err == nil {
+		t.Errorf("truncated detachment was accepted")
+	}
+
+	// Truncating at a power of two and adjusting the sizes to match leaves
+	// a file that is otherwise valid, but without the final chunk.
+	truncated := proto.Clone(detachment).(*pond.Message_Detachment)
+	truncated.PaddedSize = proto.Uint64(uint64(len(encrypted) / 2))
+	truncated.Size = proto.Uint64(uint64(defaultDetachmentBlockSize))
+	if err := decrypt(encrypted[:len(encrypted)/2], truncated); err == nil {
+		t.Errorf("detachment truncated at a chunk boundary was accepted")
+	}
+
+	reordered := append([]byte(nil), encrypted...)
+	copy(chunk(reordered, 0), chunk(encrypted, 1))
+	copy(chunk(reordered, 1), chunk(encrypted, 0))
+	if err := decrypt(reordered, detachment); err == nil {
+		t.Errorf("detachment with reordered chunks was accepted")
+	}
+
+	// A chunk from another file that was encrypted with the same key
+	// authenticates, but changes the hash.
+	other := make([]byte, len(contents))
+	io.ReadFull(rand.Reader, other)
+	otherEncrypted, _ := encrypt(other)
+	spliced := append([]byte(nil), encrypted...)
+	copy(chunk(spliced, 1), chunk(otherEncrypted, 1))
+	if err := decrypt(spliced, detachment); err == nil {
+		t.Errorf("detachment with spliced chunk was accepted")
+	}
+	if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+		t.Errorf("output of corrupt detachment wasn't removed")
+	}
+}
+
+func TestDetachedFile(t *testing.T) {
+	testDetached(t, false)
+}
+
+func TestUploadDownload(t *testing.T) {
+	testDetached(t, true)
+}
+
+func TestLargeAttachment(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	client2.stagingDir = client2.stateDir
+	client2.ui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+	client2.ui.events <- Click{name: "autodownload"}
+	client2.AdvanceTo(uiStateShowIdentity)
+	if !client2.autoDownload {
+		t.Fatalf("automatic download not enabled")
+	}
+
+	plaintextPath := filepath.Join(client1.stateDir, "file")
+	plaintext := make([]byte, 200*1024)
+	io.ReadFull(rand.Reader, plaintext)
+	if err := ioutil.WriteFile(plaintextPath, plaintext, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client1.ui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+	client1.ui.events <- Click{name: "attachlarge"}
+	fo := client1.ui.WaitForFileOpen()
+	client1.ui.events <- OpenResult{path: plaintextPath, ok: true, arg: fo.arg}
+
+	var draft *Draft
+	for _, d := range client1.drafts {
+		draft = d
+		break
+	}
+	for len(draft.detachments) == 0 {
+		client1.ui.WaitForSignal()
+	}
+	if len(draft.detachments[0].GetUrl()) == 0 {
+		t.Fatalf("large attachment wasn't uploaded")
+	}
+
+	client1.ui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client2"},
+		textViews: map[string]string{"body": "foo"},
+	}
+	client1.AdvanceTo(uiStateOutbox)
+	ackChan := make(chan bool)
+	client1.fetchNowChan <- ackChan
+	<-ackChan
+
+	_, msg := fetchMessage(client2)
+	if len(msg.message.DetachedFiles) != 1 {
+		t.Fatalf("message received with no detachments")
+	}
+	for len(msg.decryptions) > 0 {
+		client2.ui.WaitForSignal()
+	}
+
+	stagedPath := filepath.Join(client2.stateDir, fmt.Sprintf("pond-%x-0-file", msg.id))
+	result, err := ioutil.ReadFile(stagedPath)
+	if err != nil {
+		t.Fatalf("failed to read automatically downloaded file: %s", err)
+	}
+	if !bytes.Equal(result, plaintext) {
+		t.Fatalf("bad decryption")
+	}
+
+	// The downloaded file is erased when the message expires, including
+	// after a restart.
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if len(client2.inbox) != 1 || len(client2.inbox[0].staged) != 1 {
+		t.Fatalf("staged file wasn't recorded in the state")
+	}
+	client2.inbox[0].receivedTime = time.Now().Add(-messageLifetime - time.Hour)
+	client2.ui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+	client2.ui.events <- Click{name: "autodownload"}
+	client2.AdvanceTo(uiStateShowIdentity)
+	if len(client2.inbox) != 0 {
+		t.Fatalf("message didn't expire")
+	}
+	if _, err := os.Stat(stagedPath); !os.IsNotExist(err) {
+		t.Errorf("automatically downloaded file wasn't erased")
+	}
+}
+
+func TestResumeTransfers(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	plaintextPath := filepath.Join(client.stateDir, "file")
+	if err := ioutil.WriteFile(plaintextPath, make([]byte, 200*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a draft with an upload that was interrupted. It's saved when
+	// the client shuts down.
+	const pendingID = 42
+	client.drafts[1] = &Draft{
+		id:      1,
+		created: time.Now(),
+		pendingDetachments: map[uint64]*pendingDetachment{
+			pendingID: {
+				path:   plaintextPath,
+				size:   200 * 1024,
+				upload: true,
+			},
+		},
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	draft := client.drafts[1]
+	for len(draft.detachments) == 0 {
+		client.ui.WaitForSignal()
+	}
+	if len(draft.pendingDetachments) != 0 {
+		t.Errorf("pending detachment remains after upload completed")
+	}
+	if url := draft.detachments[0].GetUrl(); url != client.buildDetachmentURL(pendingID) {
+		t.Errorf("restarted upload has URL %s, want %s", url, client.buildDetachmentURL(pendingID))
+	}
+}
+
+func TestPauseResumeTransfers(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	plaintextPath := filepath.Join(client.stateDir, "file")
+	if err := ioutil.WriteFile(plaintextPath, make([]byte, 200*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a draft with two paused uploads. They shouldn't be started
+	// when the client restarts.
+	const resumeID, cancelID = 0x42, 0x43
+	client.drafts[1] = &Draft{
+		id:      1,
+		created: time.Now(),
+		pendingDetachments: map[uint64]*pendingDetachment{
+			resumeID: {
+				path:   plaintextPath,
+				size:   200 * 1024,
+				upload: true,
+				paused: true,
+			},
+			cancelID: {
+				path:   plaintextPath,
+				size:   200 * 1024,
+				upload: true,
+				paused: true,
+			},
+		},
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	draft := client.drafts[1]
+	for id, pending := range draft.pendingDetachments {
+		if !pending.paused || pending.cancel != nil {
+			t.Fatalf("paused transfer %x was restarted", id)
+		}
+	}
+
+	client.ui.events <- Click{name: client.clientUI.entries[2].boxName}
+	client.AdvanceTo(uiStateTransfers)
+
+	client.ui.events <- Click{name: fmt.Sprintf("transfer-cancel-%x", cancelID)}
+	client.AdvanceTo(uiStateTransfers)
+	if _, ok := draft.pendingDetachments[cancelID]; ok {
+		t.Fatalf("canceled transfer remains")
+	}
+
+	client.ui.events <- Click{name: fmt.Sprintf("transfer-resume-%x", resumeID)}
+	client.AdvanceTo(uiStateTransfers)
+	for len(draft.detachments) == 0 {
+		client.ui.WaitForSignal()
+	}
+	if len(draft.pendingDetachments) != 0 {
+		t.Errorf("pending detachment remains after upload completed")
+	}
+	if url := draft.detachments[0].GetUrl(); url != client.buildDetachmentURL(resumeID) {
+		t.Errorf("resumed upload has URL %s, want %s", url, client.buildDetachmentURL(resumeID))
+	}
+
+	tmpFiles, err := ioutil.ReadDir(client.stateFilename + ".transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Errorf("%d temporary files remain after the upload", len(tmpFiles))
+	}
+}
+
+func TestRestartWaitsForPreviousOperation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pond-restart-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inPath := filepath.Join(dir, "in")
+	outPath := filepath.Join(dir, "out")
+	if err := ioutil.WriteFile(inPath, make([]byte, 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &client{rand: rand.Reader, log: NewLog(), backgroundChan: make(chan interface{}, 8)}
+	prev := make(chan bool)
+	_, exited := c.startEncryption(prev, 1, outPath, inPath)
+
+	select {
+	case <-exited:
+		t.Fatalf("operation finished before the previous one exited")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+		t.Fatalf("operation wrote its output before the previous one exited")
+	}
+
+	close(prev)
+	<-exited
+	for event := range c.backgroundChan {
+		if _, ok := event.(DetachmentProgress); ok {
+			continue
+		}
+		if _, ok := event.(DetachmentComplete); !ok {
+			t.Fatalf("operation failed: %#v", event)
+		}
+		break
+	}
+}
+
+func TestUploadForDelivery(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	plaintextPath := filepath.Join(client1.stateDir, "file")
+	if err := ioutil.WriteFile(plaintextPath, make([]byte, 20*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const uploadID = 0x42
+	client2ID, _ := contactByName(client1, "client2")
+	client1.drafts[1] = &Draft{
+		id:      1,
+		created: time.Now(),
+		to:      client2ID,
+		pendingDetachments: map[uint64]*pendingDetachment{
+			uploadID: {
+				path:      plaintextPath,
+				size:      20 * 1024,
+				upload:    true,
+				deliverTo: client2ID,
+			},
+		},
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+
+	draft := client1.drafts[1]
+	for len(draft.detachments) == 0 {
+		client1.ui.WaitForSignal()
+	}
+	if url := draft.detachments[0].GetUrl(); url != client2.buildDetachmentURL(uploadID) {
+		t.Errorf("upload for delivery has URL %s, want %s", url, client2.buildDetachmentURL(uploadID))
+	}
+
+	client2.ui.events <- Click{name: client2.clientUI.entries[3].boxName}
+	client2.AdvanceTo(uiStateServerFiles)
+
+	files := client2.serverFiles
+	if files == nil || len(files.Files) != 1 || files.Files[0].GetId() != uploadID {
+		t.Fatalf("uploaded file not stored in recipient's account: %s", files)
+	}
+}
+
+func TestUploadForDeliveryIsAnonymous(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var serverIdentity, serverIdentityPublic [32]byte
+	io.ReadFull(rand.Reader, serverIdentity[:])
+	curve25519.ScalarBaseMult(&serverIdentityPublic, &serverIdentity)
+	serverURL := fmt.Sprintf("pondserver://%s@%s", strings.TrimRight(base32.StdEncoding.EncodeToString(serverIdentityPublic[:]), "="), listener.Addr())
+
+	peers := make(chan [32]byte, 1)
+	go func() {
+		defer close(peers)
+		rawConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer rawConn.Close()
+		conn := transport.NewServer(rawConn, &serverIdentity)
+		if err := conn.Handshake(); err != nil {
+			t.Errorf("handshake failed: %s", err)
+			return
+		}
+		peers <- conn.Peer
+		if err := conn.ReadProto(new(pond.Request)); err != nil {
+			return
+		}
+		conn.WriteProto(&pond.Reply{Status: pond.Reply_OVER_QUOTA.Enum()})
+	}()
+
+	c := &client{rand: rand.Reader, log: NewLog(), testing: true}
+	c.log.toStderr = false
+	io.ReadFull(rand.Reader, c.identity[:])
+	curve25519.ScalarBaseMult(&c.identityPublic, &c.identity)
+
+	groupPriv, err := bbssig.GenerateGroup(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memberKey, err := groupPriv.NewMember(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := ioutil.TempFile("", "pond-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(in.Name())
+	defer in.Close()
+	in.Write(make([]byte, 1024))
+
+	target := &deliveryTarget{server: serverURL, key: memberKey}
+	if err := c.uploadDetachment(make(chan interface{}, 8), in, 1, 0, target, make(chan bool)); err == nil {
+		t.Errorf("upload succeeded despite the server's error")
+	}
+
+	peer, ok := <-peers
+	if !ok {
+		t.Fatal("server didn't see a connection")
+	}
+	if peer == c.identityPublic {
+		t.Errorf("upload for delivery used our identity")
+	}
+}
+
+func TestServerFiles(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	plaintextPath := filepath.Join(client.stateDir, "file")
+	if err := ioutil.WriteFile(plaintextPath, make([]byte, 20*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const uploadID = 0x42
+	client.drafts[1] = &Draft{
+		id:      1,
+		created: time.Now(),
+		pendingDetachments: map[uint64]*pendingDetachment{
+			uploadID: {
+				path:         plaintextPath,
+				size:         20 * 1024,
+				upload:       true,
+				maxDownloads: 1,
+			},
+		},
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	draft := client.drafts[1]
+	for len(draft.detachments) == 0 {
+		client.ui.WaitForSignal()
+	}
+
+	client.ui.events <- Click{name: client.clientUI.entries[3].boxName}
+	client.AdvanceTo(uiStateServerFiles)
+
+	files := client.serverFiles
+	if files == nil || len(files.Files) != 1 || files.Files[0].GetId() != uploadID {
+		t.Fatalf("bad listing of server files: %s", files)
+	}
+	if files.GetCount() != 1 || files.GetSize() != int64(draft.detachments[0].GetPaddedSize()) {
+		t.Errorf("bad quota in listing of server files: %s", files)
+	}
+	if remaining := files.Files[0].DownloadsRemaining; remaining == nil || *remaining != 1 {
+		t.Errorf("download limit not recorded by server: %s", files)
+	}
+	if expiry := files.Files[0].GetExpiry(); expiry < time.Now().Add(uploadLifetime-time.Hour).Unix() {
+		t.Errorf("expiry hint not recorded by server: %s", files)
+	}
+	if use := client.serverFileUse(uploadID); !strings.Contains(use, "draft") {
+		t.Errorf("uploaded file described as %q", use)
+	}
+
+	client.ui.events <- Click{name: fmt.Sprintf("serverfile-delete-%x", uploadID)}
+	client.AdvanceTo(uiStateServerFiles)
+
+	if files := client.serverFiles; len(files.Files) != 0 || files.GetCount() != 0 {
+		t.Errorf("file remains after deletion: %s", files)
+	}
+}
+
+func TestLogOverflow(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+	proceedToMainUI(t, client1, server)
+
+	client1.ui.events <- Click{name: client1.clientUI.entries[1].boxName}
+	client1.AdvanceTo(uiStateLog)
+
+	for i := 0; i < 2*(logLimit+logSlack); i++ {
+		client1.log.Printf("%d", i)
+	}
+}
+
+func TestServerAnnounce(t *testing.T) {
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	const testMessage = "Hello world"
+	announce := &pond.Message{
+		Id:           proto.Uint64(0),
+		Time:         proto.Int64(time.Now().Unix()),
+		Body:         []byte(testMessage),
+		MyNextDh:     []byte{},
+		BodyEncoding: pond.Message_RAW.Enum(),
+	}
+	announceBytes, err := proto.Marshal(announce)
+	if err != nil {
+		t.Fatalf("Failed to marshal announce message: %s", err)
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/accounts/%x/announce-00000000", server.stateDir, client.identityPublic[:]), announceBytes, 0666); err != nil {
+		t.Fatalf("Failed to write announce message: %s", err)
+	}
+
+	fetchMessage(client)
+
+	if len(client.inbox) != 1 {
+		t.Fatalf("Inbox doesn't have a message")
+	}
+	client.ui.events <- Click{
+		name: client.inboxUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateInbox)
+	if s := client.ui.text["body"]; s != testMessage {
+		t.Fatalf("resolved message is incorrect: %s", s)
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+}
+
+func TestAttachmentPreview(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	var pngBytes bytes.Buffer
+	if err := png.Encode(&pngBytes, image.NewGray(image.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatal(err)
+	}
+
+	const testText = "Hello world"
+	announce := &pond.Message{
+		Id:           proto.Uint64(0),
+		Time:         proto.Int64(time.Now().Unix()),
+		Body:         []byte("attachments"),
+		MyNextDh:     []byte{},
+		BodyEncoding: pond.Message_RAW.Enum(),
+		Files: []*pond.Message_Attachment{
+			{Filename: proto.String("text"), Contents: []byte(testText)},
+			{Filename: proto.String("image"), Contents: pngBytes.Bytes()},
+		},
+	}
+	announceBytes, err := proto.Marshal(announce)
+	if err != nil {
+		t.Fatalf("Failed to marshal announce message: %s", err)
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/accounts/%x/announce-00000000", server.stateDir, client.identityPublic[:]), announceBytes, 0666); err != nil {
+		t.Fatalf("Failed to write announce message: %s", err)
+	}
+
+	fetchMessage(client)
+	client.ui.events <- Click{name: client.inboxUI.entries[0].boxName}
+	client.AdvanceTo(uiStateInbox)
+
+	client.ui.events <- Click{name: "preview-0"}
+	client.AdvanceTo(uiStatePreview)
+	if s := client.ui.text["preview-text"]; s != testText {
+		t.Errorf("text preview is %q, want %q", s, testText)
+	}
+
+	client.ui.events <- Click{name: "preview-1"}
+	client.AdvanceTo(uiStatePreview)
+	if s := client.ui.text["preview-error"]; len(s) > 0 {
+		t.Errorf("image preview failed: %s", s)
+	}
+}
+
+func TestDecodePreview(t *testing.T) {
+	t.Parallel()
+
+	if kind := previewKindOf([]byte("hello")); kind != previewText {
+		t.Errorf("text classified as %d", kind)
+	}
+	if kind := previewKindOf([]byte{'a', 0, 'b'}); kind != previewNone {
+		t.Errorf("binary data classified as %d", kind)
+	}
+	if kind := previewKindOf([]byte{0xff, 0xfe}); kind != previewNone {
+		t.Errorf("invalid UTF-8 classified as %d", kind)
+	}
+
+	var large bytes.Buffer
+	if err := png.Encode(&large, image.NewGray(image.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatal(err)
+	}
+	if kind := previewKindOf(large.Bytes()); kind != previewImage {
+		t.Errorf("PNG classified as %d", kind)
+	}
+	preview, err := decodePreview(large.Bytes())
+	if err != nil {
+		t.Fatalf("failed to decode preview: %s", err)
+	}
+	img, err := png.Decode(bytes.NewReader(preview))
+	if err != nil {
+		t.Fatalf("preview isn't a valid PNG: %s", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != previewMaxDimension || bounds.Dy() != previewMaxDimension/2 {
+		t.Errorf("preview has dimensions %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	var huge bytes.Buffer
+	if err := png.Encode(&huge, image.NewGray(image.Rect(0, 0, 3000, 3000))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodePreview(huge.Bytes()); err == nil {
+		t.Errorf("oversized image was decoded")
+	}
+	if _, err := decodePreview(large.Bytes()[:100]); err == nil {
+		t.Errorf("truncated image was decoded")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	client3, err := NewTestClient(t, "client3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	client4, err := NewTestClient(t, "client4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client4.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
+	proceedToPairedWithNames(t, client1, client4, "client1", "client4", server)
+
+	initialGeneration := client1.generation
+
+	// Have client4 send a message before the revocation.
+	const beforeRevocationMsg = "from before revocation"
+	sendMessage(client4, "client1", beforeRevocationMsg)
+
+	var client1FromClient2 *Contact
+	for _, candidate := range client2.contacts {
+		if candidate.name == "client1" {
+			client1FromClient2 = candidate
+			break
+		}
+	}
+	if client1FromClient2.generation != initialGeneration {
+		t.Errorf("Initial generations don't match")
+	}
+
+	var client1FromClient3 *Contact
+	for _, candidate := range client3.contacts {
+		if candidate.name == "client1" {
+			client1FromClient3 = candidate
+			break
+		}
+	}
+
+	client1.ui.events <- Click{name: client1.contactsUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateShowContact)
+	client1.ui.events <- Click{name: "revoke"}
+	client1.ui.WaitForSignal()
+
+	if client1.generation != initialGeneration+1 {
+		t.Errorf("Generation did not advance")
+	}
+
+	if len(client1.outboxUI.entries) != 1 {
+		t.Errorf("No revocation entry found after click")
+	}
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+
+	if len(client1.outboxUI.entries) != 1 {
+		t.Errorf("No revocation entry found after reload")
+	}
+
+	ackChan := make(chan bool)
+	client1.fetchNowChan <- ackChan
+NextEvent:
+	for {
+		select {
+		case ack := <-client1.ui.signal:
+		ReadActions:
+			for {
+				select {
+				case <-client1.ui.actions:
+				default:
+					break ReadActions
+				}
+			}
+			ack <- true
+		case <-ackChan:
+			break NextEvent
+		}
+	}
+
+	sendMessage(client2, "client1", "test1")
+	client2.AdvanceTo(uiStateRevocationProcessed)
+
+	if gen := client1FromClient2.generation; gen != client1.generation {
+		t.Errorf("Generation number didn't update: found %d, want %d", gen, client1.generation)
+	}
+	if !client1FromClient2.revokedUs {
+		t.Errorf("Client1 isn't marked as revoked")
+	}
+
+	sendMessage(client3, "client1", "test2")
+	client3.AdvanceTo(uiStateRevocationProcessed)
+
+	if gen := client1FromClient3.generation; gen != client1.generation {
+		t.Errorf("Generation number didn't update for non-revoked: found %d, want %d", gen, client1.generation)
+	}
+	if client1FromClient3.revokedUs {
+		t.Errorf("Client3 believes that it was revoked")
+	}
+
+	// Have client3 resend.
+	client3.fetchNowChan <- ackChan
+	<-ackChan
+
+	// Have client1 fetch the resigned message from client3, and the
+	// message from client4 using previousTags.
+	var seenClient3, seenClient4 bool
+	for i := 0; i < 2; i++ {
+		from, msg := fetchMessage(client1)
+		switch from {
+		case "client3":
+			if seenClient3 {
+				t.Fatalf("client3 message observed twice")
+			}
+			if string(msg.message.Body) != "test2" {
+				t.Fatalf("Incorrect message contents from client3: %s", msg)
+			}
+			seenClient3 = true
+		case "client4":
+			if seenClient4 {
+				t.Fatalf("client4 message observed twice")
+			}
+			if string(msg.message.Body) != beforeRevocationMsg {
+				t.Fatalf("Incorrect message contents client4: %s", msg)
+			}
+			seenClient4 = true
+		}
+	}
+}
+
+func TestDeleteContact(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	initialGeneration := client1.generation
+
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
+	sendMessage(client1, "client2", "hello back")
+
+	client1.ui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+	client1.ui.events <- Click{
+		name:   "to",
+		combos: map[string]string{"to": "client2"},
+	}
+
+	selectContact(t, client1, "client2")
+	client1.ui.events <- Click{name: "delete"}
+	client1.AdvanceTo(uiStateMain)
+
+	checkDeleted := func() {
+		if l := len(client1.contacts); l != 0 {
+			t.Errorf("%d contacts remain after deletion", l)
+		}
+		if l := len(client1.inbox); l != 0 {
+			t.Errorf("%d inbox messages remain after deletion", l)
+		}
+		if l := len(client1.drafts); l != 0 {
+			t.Errorf("%d drafts remain after deletion", l)
+		}
+		for _, msg := range client1.outbox {
+			if !msg.revocation {
+				t.Errorf("non-revocation message remains in outbox after deletion")
+			}
+		}
+	}
+
+	checkDeleted()
+	if client1.generation != initialGeneration+1 {
+		t.Errorf("Deleting a contact didn't revoke it")
+	}
+	if l := len(client1.outboxUI.entries); l != 1 {
+		t.Errorf("Found %d outbox entries, want just the revocation", l)
+	}
+	client1.queueMutex.Lock()
+	for _, msg := range client1.queue {
+		if !msg.revocation {
+			t.Errorf("non-revocation message remains in queue after deletion")
+		}
+	}
+	client1.queueMutex.Unlock()
+
+	// A pending contact can also be deleted. It has no server to send a
+	// revocation to.
+	proceedToKeyExchange(t, client1, server, "client3")
+	client1.ui.events <- Click{name: "delete"}
+	client1.AdvanceTo(uiStateMain)
+	checkDeleted()
+	if client1.generation != initialGeneration+1 {
+		t.Errorf("Deleting a pending contact revoked it")
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	checkDeleted()
+	if l := len(client1.contactsUI.entries); l != 0 {
+		t.Errorf("%d contacts displayed after reload", l)
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	var a, b, c [32]byte
+	rand.Reader.Read(a[:])
+	rand.Reader.Read(b[:])
+	rand.Reader.Read(c[:])
+
+	ab := safetyNumber(&a, &b)
+	if ba := safetyNumber(&b, &a); ab != ba {
+		t.Errorf("Safety number isn't symmetric: %s vs %s", ab, ba)
+	}
+	if ac := safetyNumber(&a, &c); ab == ac {
+		t.Errorf("Different keys resulted in the same safety number")
+	}
+	if groups := strings.Fields(ab); len(groups) != safetyNumberGroups {
+		t.Errorf("Safety number has %d groups, want %d: %s", len(groups), safetyNumberGroups, ab)
+	}
+	if lines := strings.Split(ab, "\n"); len(lines) != 3 {
+		t.Errorf("Safety number has %d lines, want 3", len(lines))
+	}
+
+	if safetyNumberGrid(&a, &b) != safetyNumberGrid(&b, &a) {
+		t.Errorf("Safety number grid isn't symmetric")
+	}
+	if safetyNumberGrid(&a, &b) == safetyNumberGrid(&a, &c) {
+		t.Errorf("Different keys resulted in the same safety number grid")
+	}
+}
+
+func TestVerifyContact(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	_, contact2 := contactByName(client1, "client2")
+	_, contact1 := contactByName(client2, "client1")
+	if safetyNumber(&client1.pub, &contact2.theirPub) != safetyNumber(&client2.pub, &contact1.theirPub) {
+		t.Errorf("Contacts calculated different safety numbers")
+	}
+	if contact2.verified {
+		t.Errorf("Contact is verified before being marked as such")
+	}
+
+	selectContact(t, client1, "client2")
+	client1.ui.events <- Click{name: "verify"}
+	client1.AdvanceTo(uiStateShowContact)
+	if !contact2.verified {
+		t.Errorf("Contact isn't verified after clicking verify")
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if _, contact2 = contactByName(client1, "client2"); !contact2.verified {
+		t.Errorf("Contact isn't verified after reload")
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	msg := &searchable{
+		contact:       "Alice",
+		time:          time.Date(2013, 6, 15, 12, 0, 0, 0, time.Local),
+		canRead:       true,
+		read:          false,
+		canAck:        true,
+		acked:         true,
+		hasAttachment: true,
+		body:          []byte("Meet me at the Station at noon"),
+	}
+	draft := &searchable{
+		contact: "Bob",
+		time:    time.Date(2013, 6, 20, 12, 0, 0, 0, time.Local),
+		body:    []byte("unfinished"),
+	}
+
+	tests := []struct {
+		query      string
+		msg, draft     bool
+	}{
+		{"station", true, false},
+		{"STATION noon", true, false},
+		{"station midnight", false, false},
+		{"from:ali", true, false},
+		{"to:bob", false, true},
+		{"after:2013-06-16", false, true},
+		{"before:2013-06-16", true, false},
+		{"after:2013-06-01 before:2013-07-01", true, true},
+		{"is:unread", true, false},
+		{"is:read", false, false},
+		{"is:acked", true, false},
+		{"is:unacked", false, false},
+		{"has:attachment", true, false},
+	}
+
+	for _, test := range tests {
+		q, err := parseSearchQuery(test.query)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", test.query, err)
+			continue
+		}
+		if got := q.matches(msg); got != test.msg {
+			t.Errorf("%q matched message: %t, want %t", test.query, got, test.msg)
+		}
+		if got := q.matches(draft); got != test.draft {
+			t.Errorf("%q matched draft: %t, want %t", test.query, got, test.draft)
+		}
+	}
+
+	if q, err := parseSearchQuery("   "); q != nil || err != nil {
+		t.Errorf("Empty query resulted in %#v, %s", q, err)
+	}
+	for _, bad := range []string{"after:yesterday", "is:lost", "has:nothing"} {
+		if _, err := parseSearchQuery(bad); err == nil {
+			t.Errorf("%q parsed without error", bad)
+		}
+	}
+}
+
+func visibleEntries(list *listUI) (n int) {
+	for _, entry := range list.entries {
+		if !entry.hidden {
+			n++
+		}
+	}
+	return
+}
+
+func TestSearch(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client2, "client1", "the first message")
+	fetchMessage(client1)
+	sendMessage(client2, "client1", "the second message")
+	fetchMessage(client1)
+	sendMessage(client1, "client2", "a reply")
+
+	search := func(query string) {
+		client1.ui.events <- Update{name: "search", text: query}
+		client1.AdvanceTo(uiStateSearched)
+	}
+
+	search("second")
+	if n := visibleEntries(client1.inboxUI); n != 1 {
+		t.Errorf("%d inbox entries visible after search, want 1", n)
+	}
+	if n := visibleEntries(client1.outboxUI); n != 0 {
+		t.Errorf("%d outbox entries visible after search, want 0", n)
+	}
+
+	search("to:client2 reply")
+	if n := visibleEntries(client1.inboxUI); n != 0 {
+		t.Errorf("%d inbox entries visible after second search, want 0", n)
+	}
+	if n := visibleEntries(client1.outboxUI); n != 1 {
+		t.Errorf("%d outbox entries visible after second search, want 1", n)
+	}
+
+	search("")
+	if n := visibleEntries(client1.inboxUI); n != 2 {
+		t.Errorf("%d inbox entries visible after clearing search, want 2", n)
+	}
+
+	// The search must never be saved.
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if client1.searchQuery != nil {
+		t.Errorf("Search query survived a reload")
+	}
+}
+
+func TestBuildThreads(t *testing.T) {
+	const contactID = 1
+	start := time.Unix(1000000000, 0)
+
+	inbox := func(id, inReplyTo uint64, minutes int, body string) *InboxMessage {
+		return &InboxMessage{
+			id:   id,
+			from: contactID,
+			message: &pond.Message{
+				Id:        proto.Uint64(id),
+				Time:      proto.Int64(start.Add(time.Duration(minutes) * time.Minute).Unix()),
+				Body:      []byte(body),
+				InReplyTo: proto.Uint64(inReplyTo),
+			},
+		}
+	}
+	outbox := func(id, inReplyTo uint64, minutes int, body string) *queuedMessage {
+		return &queuedMessage{
+			id:      id,
+			to:      contactID,
+			created: start.Add(time.Duration(minutes) * time.Minute),
+			message: &pond.Message{
+				Id:        proto.Uint64(id),
+				Body:      []byte(body),
+				InReplyTo: proto.Uint64(inReplyTo),
+			},
+		}
+	}
+
+	c := &client{
+		contacts: map[uint64]*Contact{contactID: {id: contactID, name: "alice"}},
+		inbox: []*InboxMessage{
+			inbox(10, 0, 0, "A"),
+			// An ack of B.
+			inbox(11, 20, 2, ""),
+			inbox(12, 21, 4, "D"),
+		},
+		outbox: []*queuedMessage{
+			outbox(20, 10, 1, "B"),
+			outbox(21, 0, 3, "C"),
+		},
+	}
+
+	threads := c.buildThreads(contactID)
+	if len(threads) != 2 {
+		t.Fatalf("got %d threads, want 2", len(threads))
+	}
+
+	expected := []struct {
+		body  string
+		depth int
+	}{
+		{"A", 0}, {"B", 1}, {"C", 0}, {"D", 1},
+	}
+	var entries []*threadEntry
+	for _, thread := range threads {
+		entries = append(entries, thread...)
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(expected))
+	}
+	for i, entry := range entries {
+		if body := string(entry.body); body != expected[i].body || entry.depth != expected[i].depth {
+			t.Errorf("entry %d is %q at depth %d, want %q at depth %d", i, body, entry.depth, expected[i].body, expected[i].depth)
+		}
+	}
+
+	if b := entries[1]; !b.acked || !b.ackTime.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("ack wasn't folded into the acknowledged message")
+	}
+	if entry := entries[2]; entry.acked {
+		t.Errorf("unacknowledged message is marked as acked")
+	}
+}
+
+func TestThread(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer client1.Close()
 
-	var client1FromClient3 *Contact
-	for _, candidate := range client3.contacts {
-		if candidate.name == "client1" {
-			client1FromClient3 = candidate
-			break
-		}
+	client2, err := NewTestClient(t, "client2")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer client2.Close()
 
-	client1.ui.events <- Click{name: client1.contactsUI.entries[0].boxName}
-	client1.AdvanceTo(uiStateShowContact)
-	client1.ui.events <- Click{name: "revoke"}
-	client1.ui.WaitForSignal()
+	proceedToPaired(t, client1, client2, server)
 
-	if client1.generation != initialGeneration+1 {
-		t.Errorf("Generation did not advance")
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
+	sendMessage(client1, "client2", "hi")
+
+	selectContact(t, client1, "client2")
+	client1.ui.events <- Click{name: "thread"}
+	client1.AdvanceTo(uiStateThread)
+
+	id, _ := contactByName(client1, "client2")
+	threads := client1.buildThreads(id)
+	if len(threads) != 2 {
+		t.Errorf("got %d threads, want 2", len(threads))
 	}
+}
 
-	if len(client1.outboxUI.entries) != 1 {
-		t.Errorf("No revocation entry found after click")
+func TestTorStatusShownWhenChecked(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
 	}
-	client1.Reload()
-	client1.AdvanceTo(uiStateMain)
+	defer server.Close()
 
-	if len(client1.outboxUI.entries) != 1 {
-		t.Errorf("No revocation entry found after reload")
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer client.Close()
 
-	ackChan := make(chan bool)
-	client1.fetchNowChan <- ackChan
-NextEvent:
+	proceedToMainUI(t, client, server)
+
+	entry := &client.clientUI.entries[clientUIActivity-1]
+	if entry.id != clientUIActivity || len(entry.subline) > 0 {
+		t.Fatalf("unexpected Activity Log entry: %#v", entry)
+	}
+
+	client.backgroundChan <- torStatusChecked{errors.New("Tor has not finished bootstrapping")}
+	for client.ui.text[entry.sublineTextName] != "Tor problem" || entry.indicator != indicatorRed {
+		if err := client.ui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client.backgroundChan <- torStatusChecked{nil}
+	for entry.indicator != indicatorNone {
+		if err := client.ui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(entry.subline) > 0 {
+		t.Errorf("Activity Log subline is %q after Tor was found to be fine", entry.subline)
+	}
+}
+
+// fakeTorControl is a minimal Tor control port that answers commands from a
+// fixed table of replies.
+type fakeTorControl struct {
+	listener net.Listener
+	replies  map[string]string
+}
+
+func newFakeTorControl(t *testing.T, replies map[string]string) *fakeTorControl {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeTorControl{listener, replies}
+	go fake.loop()
+	return fake
+}
+
+func (fake *fakeTorControl) loop() {
 	for {
-		select {
-		case ack := <-client1.ui.signal:
-		ReadActions:
-			for {
-				select {
-				case <-client1.ui.actions:
-				default:
-					break ReadActions
-				}
+		conn, err := fake.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fake.handle(conn)
+	}
+}
+
+func (fake *fakeTorControl) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "QUIT" {
+			io.WriteString(conn, "250 closing connection\r\n")
+			return
+		}
+
+		reply, ok := fake.replies[line]
+		if !ok {
+			if strings.HasPrefix(line, "AUTHENTICATE") {
+				reply = "515 Authentication failed\r\n"
+			} else {
+				reply = "510 Unrecognized command\r\n"
 			}
-			ack <- true
-		case <-ackChan:
-			break NextEvent
 		}
+		io.WriteString(conn, reply)
 	}
+}
 
-	sendMessage(client2, "client1", "test1")
-	client2.AdvanceTo(uiStateRevocationProcessed)
+func (fake *fakeTorControl) Addr() string {
+	return fake.listener.Addr().String()
+}
 
-	if gen := client1FromClient2.generation; gen != client1.generation {
-		t.Errorf("Generation number didn't update: found %d, want %d", gen, client1.generation)
+func (fake *fakeTorControl) Close() {
+	fake.listener.Close()
+}
+
+const (
+	torNullAuthReply      = "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=NULL\r\n250-VERSION Tor=\"0.2.4.17-rc\"\r\n250 OK\r\n"
+	torBootstrappedReply  = "250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY=\"Done\"\r\n250 OK\r\n"
+	torBootstrappingReply = "250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=45 TAG=requesting_descriptors SUMMARY=\"Asking for relay descriptors\"\r\n250 OK\r\n"
+)
+
+func TestTorControlBootstrapped(t *testing.T) {
+	t.Parallel()
+
+	fake := newFakeTorControl(t, map[string]string{
+		"PROTOCOLINFO 1":                 torNullAuthReply,
+		"AUTHENTICATE":                   "250 OK\r\n",
+		"GETINFO status/bootstrap-phase": torBootstrappedReply,
+		"GETCONF SocksPort":              "250 SocksPort\r\n",
+	})
+	defer fake.Close()
+
+	status, err := checkTor(fake.Addr(), torAddr)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !client1FromClient2.revokedUs {
-		t.Errorf("Client1 isn't marked as revoked")
+	if status.bootstrapProgress != 100 || status.bootstrapSummary != "Done" {
+		t.Errorf("Bad bootstrap status: %d %q", status.bootstrapProgress, status.bootstrapSummary)
 	}
+	if !status.socksIsolated {
+		t.Errorf("Default SocksPort wasn't considered to be isolated")
+	}
+}
 
-	sendMessage(client3, "client1", "test2")
-	client3.AdvanceTo(uiStateRevocationProcessed)
+func TestTorControlBootstrapping(t *testing.T) {
+	t.Parallel()
 
-	if gen := client1FromClient3.generation; gen != client1.generation {
-		t.Errorf("Generation number didn't update for non-revoked: found %d, want %d", gen, client1.generation)
+	fake := newFakeTorControl(t, map[string]string{
+		"PROTOCOLINFO 1":                 torNullAuthReply,
+		"AUTHENTICATE":                   "250 OK\r\n",
+		"GETINFO status/bootstrap-phase": torBootstrappingReply,
+		"GETCONF SocksPort":              "250 SocksPort=9050 IsolateDestAddr\r\n",
+	})
+	defer fake.Close()
+
+	status, err := checkTor(fake.Addr(), torAddr)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if client1FromClient3.revokedUs {
-		t.Errorf("Client3 believes that it was revoked")
+	if status.bootstrapProgress != 45 {
+		t.Errorf("Bad bootstrap progress: %d", status.bootstrapProgress)
 	}
+	if status.bootstrapSummary != "Asking for relay descriptors" {
+		t.Errorf("Bad bootstrap summary: %q", status.bootstrapSummary)
+	}
+}
 
-	// Have client3 resend.
-	client3.fetchNowChan <- ackChan
-	<-ackChan
+func TestTorControlNoIsolation(t *testing.T) {
+	t.Parallel()
 
-	// Have client1 fetch the resigned message from client3, and the
-	// message from client4 using previousTags.
-	var seenClient3, seenClient4 bool
-	for i := 0; i < 2; i++ {
-		from, msg := fetchMessage(client1)
-		switch from {
-		case "client3":
-			if seenClient3 {
-				t.Fatalf("client3 message observed twice")
+	fake := newFakeTorControl(t, map[string]string{
+		"PROTOCOLINFO 1":                 torNullAuthReply,
+		"AUTHENTICATE":                   "250 OK\r\n",
+		"GETINFO status/bootstrap-phase": torBootstrappedReply,
+		"GETCONF SocksPort":              "250-SocksPort=127.0.0.1:9150\r\n250 SocksPort=127.0.0.1:9050 NoIsolateSOCKSAuth\r\n",
+	})
+	defer fake.Close()
+
+	status, err := checkTor(fake.Addr(), torAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.socksIsolated {
+		t.Errorf("SocksPort with NoIsolateSOCKSAuth was considered to be isolated")
+	}
+
+	if _, err := checkTor(fake.Addr(), "127.0.0.1:9999"); err == nil {
+		t.Errorf("Missing SOCKS port was not reported")
+	}
+}
+
+func TestTorControlCookieAuth(t *testing.T) {
+	t.Parallel()
+
+	cookieFile, err := ioutil.TempFile("", "pond-tor-cookie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cookieFile.Name())
+	cookie := []byte{1, 2, 3, 4, 0xfe}
+	cookieFile.Write(cookie)
+	cookieFile.Close()
+
+	fake := newFakeTorControl(t, map[string]string{
+		"PROTOCOLINFO 1":                 "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=" + strconv.Quote(cookieFile.Name()) + "\r\n250 OK\r\n",
+		"AUTHENTICATE 01020304fe":        "250 OK\r\n",
+		"GETINFO status/bootstrap-phase": torBootstrappedReply,
+		"GETCONF SocksPort":              "250 SocksPort\r\n",
+	})
+	defer fake.Close()
+
+	if _, err := checkTor(fake.Addr(), torAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	passwordOnly := newFakeTorControl(t, map[string]string{
+		"PROTOCOLINFO 1": "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=HASHEDPASSWORD\r\n250 OK\r\n",
+	})
+	defer passwordOnly.Close()
+
+	if _, err := checkTor(passwordOnly.Addr(), torAddr); err == nil {
+		t.Errorf("Password-only control port didn't cause an error")
+	}
+}
+
+func TestSchedulingPolicyDistributions(t *testing.T) {
+	t.Parallel()
+
+	// The expected means are taken from the specification of the
+	// policies, rather than the constants in the code, so that changes to
+	// the constants are caught.
+	tests := []struct {
+		policy   disk.State_SchedulingPolicy
+		queueLen int
+		mean     float64
+	}{
+		{disk.State_EXPONENTIAL, 0, 300},
+		{disk.State_EXPONENTIAL, 5, 300},
+		{disk.State_BURST, 0, 300},
+		{disk.State_BURST, 5, 60},
+		{disk.State_LOW_POWER, 0, 1800},
+		{disk.State_LOW_POWER, 5, 1800},
+	}
+
+	const samples = 200000
+
+	for i, test := range tests {
+		r := mrand.New(mrand.NewSource(int64(i)))
+		var sum, sumSquares float64
+		aboveMean := 0
+
+		for j := 0; j < samples; j++ {
+			delay := transactionDelay(test.policy, test.queueLen, r)
+			if delay < 0 {
+				t.Fatalf("#%d: negative delay: %f", i, delay)
 			}
-			if string(msg.message.Body) != "test2" {
-				t.Fatalf("Incorrect message contents from client3: %s", msg)
+			sum += delay
+			sumSquares += delay * delay
+			if delay > test.mean {
+				aboveMean++
 			}
-			seenClient3 = true
-		case "client4":
-			if seenClient4 {
-				t.Fatalf("client4 message observed twice")
+		}
+
+		// An exponential distribution has a variance equal to the
+		// square of its mean and a probability of exceeding the mean of
+		// 1/e.
+		mean := sum / samples
+		variance := sumSquares/samples - mean*mean
+		wantVariance := test.mean * test.mean
+		if math.Abs(mean-test.mean)/test.mean > 0.02 {
+			t.Errorf("#%d: %s with %d queued: mean is %f, want %f", i, test.policy, test.queueLen, mean, test.mean)
+		}
+		if math.Abs(variance-wantVariance)/wantVariance > 0.06 {
+			t.Errorf("#%d: %s with %d queued: variance is %f, want %f", i, test.policy, test.queueLen, variance, wantVariance)
+		}
+		if fraction := float64(aboveMean) / samples; math.Abs(fraction-1/math.E) > 0.01 {
+			t.Errorf("#%d: %s with %d queued: fraction above mean is %f, want %f", i, test.policy, test.queueLen, fraction, 1/math.E)
+		}
+	}
+}
+
+func TestEnqueueResamplesDelay(t *testing.T) {
+	t.Parallel()
+
+	// With the burst policy, queuing a message changes the delay before
+	// the next transaction so the network goroutine must be told about it.
+	c := &client{queueChangedChan: make(chan bool, 1)}
+	c.enqueue(&queuedMessage{})
+	c.enqueue(&queuedMessage{})
+
+	select {
+	case <-c.queueChangedChan:
+	default:
+		t.Fatalf("enqueue didn't signal the network goroutine")
+	}
+	if len(c.queue) != 2 {
+		t.Errorf("queue has %d messages, want 2", len(c.queue))
+	}
+}
+
+func TestSchedulingPolicySelection(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	client.ui.events <- Click{name: client.clientUI.entries[0].boxName}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.ui.events <- Click{
+		name:   "setschedule",
+		combos: map[string]string{"schedule": schedulingPolicyLabels[disk.State_LOW_POWER]},
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	if client.schedulingPolicy != disk.State_LOW_POWER {
+		t.Errorf("Scheduling policy was not persisted: got %s", client.schedulingPolicy)
+	}
+}
+
+func TestCoverTraffic(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	client.ui.events <- Click{name: client.clientUI.entries[0].boxName}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.ui.events <- Click{
+		name:      "setdecoys",
+		textViews: map[string]string{"decoys": "not a server"},
+	}
+	for {
+		if err := client.ui.WaitForSignal(); err != nil {
+			break
+		}
+	}
+	if len(client.decoyServers) != 0 {
+		t.Fatalf("invalid decoy server was accepted")
+	}
+	if len(client.ui.text["decoyerror"]) == 0 {
+		t.Errorf("no error shown for invalid decoy server")
+	}
+
+	client.ui.events <- Click{
+		name:      "setdecoys",
+		textViews: map[string]string{"decoys": "\n" + server.URL() + "\n"},
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.ui.events <- Click{name: "covertraffic"}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	if !client.coverTraffic || len(client.decoyServers) != 1 || client.decoyServers[0] != server.URL() {
+		t.Fatalf("cover traffic settings weren't persisted: %t %v", client.coverTraffic, client.decoyServers)
+	}
+
+	// A quarter of transactions are cover deliveries so it's very unlikely
+	// that none are in this many attempts.
+	sentCover := false
+	for i := 0; i < 64 && !sentCover; i++ {
+		ackChan := make(chan bool)
+		client.fetchNowChan <- ackChan
+	WaitForAck:
+		for {
+			select {
+			case ack := <-client.ui.signal:
+				ack <- true
+			case <-ackChan:
+				break WaitForAck
 			}
-			if string(msg.message.Body) != beforeRevocationMsg {
-				t.Fatalf("Incorrect message contents client4: %s", msg)
+		}
+
+		client.log.Lock()
+		for _, entry := range client.log.entries {
+			if strings.Contains(entry.s, "for cover delivery") {
+				t.Errorf("cover delivery failed: %s", entry.s)
+			}
+			if entry.s == "Starting cover delivery to "+server.URL() {
+				sentCover = true
 			}
-			seenClient4 = true
 		}
+		client.log.Unlock()
+	}
+	if !sentCover {
+		t.Fatalf("no cover delivery was sent")
+	}
+
+	deliveries, err := server.Deliveries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("server kept %d cover deliveries", len(deliveries))
 	}
 }
@@ -6,9 +6,7 @@ import (
 
 	"code.google.com/p/go.crypto/curve25519"
 	"code.google.com/p/goprotobuf/proto"
-	"github.com/agl/pond/bbssig"
 	"github.com/agl/pond/client/disk"
-	pond "github.com/agl/pond/protos"
 )
 
 func (c *client) loadState(state []byte) error {
@@ -21,63 +19,66 @@ func (c *client) loadState(state []byte) error {
 
 func (c *client) save() {
 	c.log.Printf("Saving state")
+	if expired := c.expireSecrets(time.Now()); len(expired) > 0 {
+		if c.inboxUI != nil {
+			for _, id := range expired {
+				c.inboxUI.Remove(id)
+			}
+			c.ui.Signal()
+		}
+		c.updateWindowTitle()
+	}
+	// Any change to the set of contacts is followed by a save so this is
+	// a convenient point to update the destinations for cover traffic.
+	c.updateCoverTargets()
 	serialized := c.marshal()
 	c.writerChan <- serialized
 }
 
 func (c *client) unmarshal(state *disk.State) error {
+	// editstate validates states with the same function before writing
+	// them.
+	parsed, errs := disk.ParseState(state, c.testing)
+	if len(errs) > 0 {
+		return errors.New("client: invalid state: " + errs[0].Error())
+	}
+
 	c.server = *state.Server
 
-	if len(state.Identity) != len(c.identity) {
-		return errors.New("client: identity is wrong length in State")
-	}
 	copy(c.identity[:], state.Identity)
 	curve25519.ScalarBaseMult(&c.identityPublic, &c.identity)
-
-	group, ok := new(bbssig.Group).Unmarshal(state.Group)
-	if !ok {
-		return errors.New("client: failed to unmarshal group")
-	}
-	c.groupPriv, ok = new(bbssig.PrivateKey).Unmarshal(group, state.GroupPrivate)
-	if !ok {
-		return errors.New("client: failed to unmarshal group private key")
-	}
-
-	if len(state.Private) != len(c.priv) {
-		return errors.New("client: failed to unmarshal private key")
-	}
+	c.groupPriv = parsed.GroupPrivate
 	copy(c.priv[:], state.Private)
-	if len(state.Public) != len(c.pub) {
-		return errors.New("client: failed to unmarshal public key")
-	}
 	copy(c.pub[:], state.Public)
 	c.generation = *state.Generation
+	c.coverTraffic = state.GetCoverTraffic()
+	c.decoyServers = state.DecoyServers
+	c.schedulingPolicy = state.GetSchedulingPolicy()
+	c.deliveryReceipts = state.GetDeliveryReceipts()
+	c.autoDownload = state.GetAutoDownload()
+
+	for _, entry := range state.ReplayCache {
+		var h replayHash
+		copy(h[:], entry.Hash)
+		c.replayCache.add(h, time.Unix(*entry.Time, 0))
+	}
+	c.replayCache.expire(time.Now())
 
-	for _, prevGroupPriv := range state.PreviousGroupPrivateKeys {
-		group, ok := new(bbssig.Group).Unmarshal(prevGroupPriv.Group)
-		if !ok {
-			return errors.New("client: failed to unmarshal previous group")
-		}
-		priv, ok := new(bbssig.PrivateKey).Unmarshal(group, prevGroupPriv.GroupPrivate)
-		if !ok {
-			return errors.New("client: failed to unmarshal previous group private key")
-		}
+	for i, prevGroupPriv := range state.PreviousGroupPrivateKeys {
 		c.prevGroupPrivs = append(c.prevGroupPrivs, previousGroupPrivateKey{
-			priv:    priv,
+			priv:    parsed.PreviousGroupPrivateKeys[i],
 			expired: time.Unix(*prevGroupPriv.Expired, 0),
 		})
 	}
 
-	for _, cont := range state.Contacts {
+	for i, cont := range state.Contacts {
 		contact := &Contact{
 			id:       *cont.Id,
 			name:     *cont.Name,
 			kxsBytes: cont.KeyExchangeBytes,
+			groupKey: parsed.Contacts[i].GroupKey,
 		}
 		c.contacts[contact.id] = contact
-		if contact.groupKey, ok = new(bbssig.MemberKey).Unmarshal(c.groupPriv.Group, cont.GroupKey); !ok {
-			return errors.New("client: failed to unmarshal group member key")
-		}
 		copy(contact.lastDHPrivate[:], cont.LastPrivate)
 		copy(contact.currentDHPrivate[:], cont.CurrentPrivate)
 		if cont.IsPending != nil && *cont.IsPending {
@@ -85,27 +86,10 @@ func (c *client) unmarshal(state *disk.State) error {
 			continue
 		}
 
-		theirGroup, ok := new(bbssig.Group).Unmarshal(cont.TheirGroup)
-		if !ok {
-			return errors.New("client: failed to unmarshal their group")
-		}
-		if contact.myGroupKey, ok = new(bbssig.MemberKey).Unmarshal(theirGroup, cont.MyGroupKey); !ok {
-			return errors.New("client: failed to unmarshal my group key")
-		}
-
-		if cont.TheirServer == nil {
-			return errors.New("client: contact missing server")
-		}
+		contact.myGroupKey = parsed.Contacts[i].MyGroupKey
 		contact.theirServer = *cont.TheirServer
-
-		if len(cont.TheirPub) != len(contact.theirPub) {
-			return errors.New("client: contact missing public key")
-		}
 		copy(contact.theirPub[:], cont.TheirPub)
-
-		if len(cont.TheirIdentityPublic) != len(contact.theirIdentityPublic) {
-			return errors.New("client: contact missing identity public key")
-		}
+		contact.verified = cont.GetVerified()
 		copy(contact.theirIdentityPublic[:], cont.TheirIdentityPublic)
 
 		copy(contact.theirLastDHPublic[:], cont.TheirLastPublic)
@@ -126,9 +110,25 @@ func (c *client) unmarshal(state *disk.State) error {
 		if cont.SupportedVersion != nil {
 			contact.supportedVersion = *cont.SupportedVersion
 		}
+
+		if cont.SendChain != nil {
+			contact.sendChain = unmarshalChain(cont.SendChain)
+		}
+		for _, m := range cont.ReceiveChains {
+			contact.receiveChains = append(contact.receiveChains, unmarshalChain(m))
+		}
+		for _, m := range cont.SkippedKeys {
+			skipped := skippedKey{
+				counter: *m.Counter,
+				expires: time.Unix(*m.Expires, 0),
+			}
+			copy(skipped.public[:], m.Public)
+			copy(skipped.key[:], m.Key)
+			contact.skippedKeys = append(contact.skippedKeys, skipped)
+		}
 	}
 
-	for _, m := range state.Inbox {
+	for i, m := range state.Inbox {
 		msg := &InboxMessage{
 			id:           *m.Id,
 			from:         *m.From,
@@ -136,42 +136,45 @@ func (c *client) unmarshal(state *disk.State) error {
 			acked:        *m.Acked,
 			read:         *m.Read,
 			sealed:       m.Sealed,
+			staged:       m.StagedPaths,
+			message:      parsed.InboxMessages[i],
 		}
-		if len(m.Message) > 0 {
-			msg.message = new(pond.Message)
-			if err := proto.Unmarshal(m.Message, msg.message); err != nil {
-				return errors.New("client: corrupt message in inbox: " + err.Error())
+		for _, pd := range m.PendingDecryptions {
+			if msg.decryptions == nil {
+				msg.decryptions = make(map[uint64]*pendingDecryption)
+			}
+			msg.decryptions[c.randId()] = &pendingDecryption{
+				index:   int(*pd.Index),
+				outPath: *pd.OutPath,
+				inPath:  pd.GetInPath(),
+				tmpPath: pd.GetTmpPath(),
+				done:    pd.GetDone(),
+				total:   pd.GetTotal(),
+				paused:  pd.GetPaused(),
 			}
 		}
 
 		c.inbox = append(c.inbox, msg)
 	}
 
-	for _, m := range state.Outbox {
+	for i, m := range state.Outbox {
 		msg := &queuedMessage{
 			id:      *m.Id,
 			to:      *m.To,
 			server:  *m.Server,
 			created: time.Unix(*m.Created, 0),
-		}
-		if len(m.Message) > 0 {
-			msg.message = new(pond.Message)
-			if err := proto.Unmarshal(m.Message, msg.message); err != nil {
-				return errors.New("client: corrupt message in outbox: " + err.Error())
-			}
+			message: parsed.OutboxMessages[i],
+			request: parsed.OutboxRequests[i],
 		}
 		if m.Sent != nil {
 			msg.sent = time.Unix(*m.Sent, 0)
 		}
+		if m.Delivered != nil {
+			msg.delivered = time.Unix(*m.Delivered, 0)
+		}
 		if m.Acked != nil {
 			msg.acked = time.Unix(*m.Acked, 0)
 		}
-		if len(m.Request) != 0 {
-			msg.request = new(pond.Request)
-			if err := proto.Unmarshal(m.Request, msg.request); err != nil {
-				return errors.New("client: corrupt request in outbox: " + err.Error())
-			}
-		}
 		msg.revocation = m.GetRevocation()
 
 		c.outbox = append(c.outbox, msg)
@@ -196,6 +199,25 @@ func (c *client) unmarshal(state *disk.State) error {
 		if m.InReplyTo != nil {
 			draft.inReplyTo = *m.InReplyTo
 		}
+		for _, pd := range m.PendingDetachments {
+			if draft.pendingDetachments == nil {
+				draft.pendingDetachments = make(map[uint64]*pendingDetachment)
+			}
+			draft.pendingDetachments[*pd.Id] = &pendingDetachment{
+				path:         *pd.Path,
+				size:         *pd.Size,
+				upload:       pd.GetUpload(),
+				outPath:      pd.GetOutPath(),
+				tmpPath:      pd.GetTmpPath(),
+				key:          pd.Key,
+				detachment:   pd.Detachment,
+				done:         pd.GetDone(),
+				total:        pd.GetTotal(),
+				paused:       pd.GetPaused(),
+				maxDownloads: pd.GetMaxDownloads(),
+				deliverTo:    pd.GetDeliverTo(),
+			}
+		}
 
 		c.drafts[draft.id] = draft
 	}
@@ -227,6 +249,22 @@ func (c *client) marshal() []byte {
 			cont.TheirLastPublic = contact.theirLastDHPublic[:]
 			cont.TheirCurrentPublic = contact.theirCurrentDHPublic[:]
 			cont.Generation = proto.Uint32(contact.generation)
+			cont.Verified = proto.Bool(contact.verified)
+			if contact.sendChain != nil {
+				cont.SendChain = marshalChain(contact.sendChain)
+			}
+			for _, chain := range contact.receiveChains {
+				cont.ReceiveChains = append(cont.ReceiveChains, marshalChain(chain))
+			}
+			contact.expireSkippedKeys(time.Now())
+			for _, skipped := range contact.skippedKeys {
+				cont.SkippedKeys = append(cont.SkippedKeys, &disk.Contact_SkippedKey{
+					Public:  append([]byte(nil), skipped.public[:]...),
+					Counter: proto.Uint32(skipped.counter),
+					Key:     append([]byte(nil), skipped.key[:]...),
+					Expires: proto.Int64(skipped.expires.Unix()),
+				})
+			}
 		}
 		for _, prevTag := range contact.previousTags {
 			if time.Since(prevTag.expired) > previousTagLifetime {
@@ -252,12 +290,24 @@ func (c *client) marshal() []byte {
 			Acked:        proto.Bool(msg.acked),
 			Read:         proto.Bool(msg.read),
 			Sealed:       msg.sealed,
+			StagedPaths:  msg.staged,
 		}
 		if msg.message != nil {
 			if m.Message, err = proto.Marshal(msg.message); err != nil {
 				panic(err)
 			}
 		}
+		for _, pending := range msg.decryptions {
+			m.PendingDecryptions = append(m.PendingDecryptions, &disk.Inbox_PendingDecryption{
+				Index:   proto.Int32(int32(pending.index)),
+				OutPath: proto.String(pending.outPath),
+				InPath:  proto.String(pending.inPath),
+				TmpPath: proto.String(pending.tmpPath),
+				Done:    proto.Uint64(pending.done),
+				Total:   proto.Uint64(pending.total),
+				Paused:  proto.Bool(pending.paused),
+			})
+		}
 		inbox = append(inbox, m)
 	}
 
@@ -281,6 +331,9 @@ func (c *client) marshal() []byte {
 		if !msg.sent.IsZero() {
 			m.Sent = proto.Int64(msg.sent.Unix())
 		}
+		if !msg.delivered.IsZero() {
+			m.Delivered = proto.Int64(msg.delivered.Unix())
+		}
 		if !msg.acked.IsZero() {
 			m.Acked = proto.Int64(msg.acked.Unix())
 		}
@@ -308,6 +361,28 @@ func (c *client) marshal() []byte {
 		if draft.inReplyTo != 0 {
 			m.InReplyTo = proto.Uint64(draft.inReplyTo)
 		}
+		for id, pending := range draft.pendingDetachments {
+			if !pending.upload && len(pending.outPath) == 0 {
+				// The user hasn't chosen what to do with this
+				// file yet.
+				continue
+			}
+			m.PendingDetachments = append(m.PendingDetachments, &disk.Draft_PendingDetachment{
+				Id:           proto.Uint64(id),
+				Path:         proto.String(pending.path),
+				Size:         proto.Int64(pending.size),
+				Upload:       proto.Bool(pending.upload),
+				OutPath:      proto.String(pending.outPath),
+				TmpPath:      proto.String(pending.tmpPath),
+				Key:          pending.key,
+				Detachment:   pending.detachment,
+				Done:         proto.Uint64(pending.done),
+				Total:        proto.Uint64(pending.total),
+				Paused:       proto.Bool(pending.paused),
+				MaxDownloads: proto.Uint32(pending.maxDownloads),
+				DeliverTo:    proto.Uint64(pending.deliverTo),
+			})
+		}
 
 		drafts = append(drafts, m)
 	}
@@ -324,7 +399,28 @@ func (c *client) marshal() []byte {
 		Inbox:        inbox,
 		Outbox:       outbox,
 		Drafts:       drafts,
+		DecoyServers: c.decoyServers,
+	}
+	if c.coverTraffic {
+		state.CoverTraffic = proto.Bool(true)
+	}
+	if c.deliveryReceipts {
+		state.DeliveryReceipts = proto.Bool(true)
+	}
+	if c.autoDownload {
+		state.AutoDownload = proto.Bool(true)
+	}
+	for _, entry := range c.replayCache.entries {
+		state.ReplayCache = append(state.ReplayCache, &disk.State_ReplayEntry{
+			Hash: append([]byte(nil), entry.hash[:]...),
+			Time: proto.Int64(entry.time.Unix()),
+		})
+	}
+	c.queueMutex.Lock()
+	if c.schedulingPolicy != disk.State_EXPONENTIAL {
+		state.SchedulingPolicy = c.schedulingPolicy.Enum()
 	}
+	c.queueMutex.Unlock()
 	for _, prevGroupPriv := range c.prevGroupPrivs {
 		if time.Since(prevGroupPriv.expired) > previousTagLifetime {
 			continue
@@ -342,3 +438,22 @@ func (c *client) marshal() []byte {
 	}
 	return s
 }
+
+func marshalChain(chain *ratchetChain) *disk.Contact_Chain {
+	return &disk.Contact_Chain{
+		Public:      append([]byte(nil), chain.public[:]...),
+		Key:         append([]byte(nil), chain.key[:]...),
+		HeaderKey:   append([]byte(nil), chain.headerKey[:]...),
+		Counter:     proto.Uint32(chain.counter),
+		TheirPublic: append([]byte(nil), chain.theirPublic[:]...),
+	}
+}
+
+func unmarshalChain(m *disk.Contact_Chain) *ratchetChain {
+	chain := &ratchetChain{counter: *m.Counter}
+	copy(chain.public[:], m.Public)
+	copy(chain.key[:], m.Key)
+	copy(chain.headerKey[:], m.HeaderKey)
+	copy(chain.theirPublic[:], m.TheirPublic)
+	return chain
+}
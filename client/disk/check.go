@@ -0,0 +1,232 @@
+package disk
+
+import (
+	"fmt"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/pond/bbssig"
+	pond "github.com/agl/pond/protos"
+)
+
+// A StateError describes a problem that would prevent a client from loading a
+// State.
+type StateError struct {
+	// Path is the location of the problem, for example
+	// "Contacts[2].TheirServer". Field names are the Go names and repeated
+	// fields are indexed.
+	Path    string
+	Message string
+}
+
+func (e *StateError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ParsedState contains the values that ParseState parses from a State so that
+// a client loading the State needn't parse them again.
+type ParsedState struct {
+	GroupPrivate *bbssig.PrivateKey
+	// PreviousGroupPrivateKeys parallels State.PreviousGroupPrivateKeys.
+	PreviousGroupPrivateKeys []*bbssig.PrivateKey
+	// Contacts parallels State.Contacts.
+	Contacts []ParsedContact
+	// InboxMessages parallels State.Inbox. An element is nil if the entry
+	// has no message.
+	InboxMessages []*pond.Message
+	// OutboxMessages and OutboxRequests parallel State.Outbox. An element
+	// is nil if the entry has no message or request.
+	OutboxMessages []*pond.Message
+	OutboxRequests []*pond.Request
+}
+
+// ParsedContact contains the values parsed from a Contact. MyGroupKey is nil
+// for pending contacts.
+type ParsedContact struct {
+	GroupKey   *bbssig.MemberKey
+	MyGroupKey *bbssig.MemberKey
+}
+
+// stateChecker accumulates the problems found by ParseState.
+type stateChecker struct {
+	errs    []*StateError
+	testing bool
+}
+
+func (c *stateChecker) report(path, format string, args ...interface{}) {
+	c.errs = append(c.errs, &StateError{path, fmt.Sprintf(format, args...)})
+}
+
+func (c *stateChecker) checkLen(path string, value []byte, length int) {
+	if len(value) != length {
+		c.report(path, "must be %d bytes long, not %d", length, len(value))
+	}
+}
+
+func (c *stateChecker) checkServer(path, server string) {
+	if _, _, err := ParseServer(server, c.testing); err != nil {
+		c.report(path, "not a valid server: %s", err)
+	}
+}
+
+func (c *stateChecker) checkMinLen(path string, value []byte, length int) {
+	if len(value) < length {
+		c.report(path, "must be at least %d bytes long, not %d", length, len(value))
+	}
+}
+
+// ParseState checks state and parses the values within it that a client needs
+// in order to load it. If any problems are found, they are returned and the
+// ParsedState must not be used. Both the client and editstate validate states
+// with this function so that they agree on which states are loadable. testing
+// has the same meaning as for ParseServer.
+func ParseState(state *State, testing bool) (*ParsedState, []*StateError) {
+	c := &stateChecker{testing: testing}
+	parsed := new(ParsedState)
+
+	c.checkLen("Identity", state.Identity, 32)
+	c.checkLen("Private", state.Private, 64)
+	c.checkLen("Public", state.Public, 32)
+	c.checkServer("Server", state.GetServer())
+	for i, server := range state.DecoyServers {
+		c.checkServer(fmt.Sprintf("DecoyServers[%d]", i), server)
+	}
+
+	group, ok := new(bbssig.Group).Unmarshal(state.Group)
+	if !ok {
+		c.report("Group", "not a valid group")
+	} else if parsed.GroupPrivate, ok = new(bbssig.PrivateKey).Unmarshal(group, state.GroupPrivate); !ok {
+		c.report("GroupPrivate", "not a valid private key for the group")
+	}
+
+	for i, entry := range state.ReplayCache {
+		c.checkMinLen(fmt.Sprintf("ReplayCache[%d].Hash", i), entry.Hash, 16)
+	}
+
+	parsed.PreviousGroupPrivateKeys = make([]*bbssig.PrivateKey, len(state.PreviousGroupPrivateKeys))
+	for i, prev := range state.PreviousGroupPrivateKeys {
+		path := fmt.Sprintf("PreviousGroupPrivateKeys[%d]", i)
+		prevGroup, ok := new(bbssig.Group).Unmarshal(prev.Group)
+		if !ok {
+			c.report(path+".Group", "not a valid group")
+		} else if parsed.PreviousGroupPrivateKeys[i], ok = new(bbssig.PrivateKey).Unmarshal(prevGroup, prev.GroupPrivate); !ok {
+			c.report(path+".GroupPrivate", "not a valid private key for the group")
+		}
+	}
+
+	parsed.Contacts = make([]ParsedContact, len(state.Contacts))
+	contactIds := make(map[uint64]bool)
+	for i, contact := range state.Contacts {
+		path := fmt.Sprintf("Contacts[%d]", i)
+		if contactIds[contact.GetId()] {
+			c.report(path+".Id", "another contact has the same id")
+		}
+		contactIds[contact.GetId()] = true
+		c.checkContact(path, contact, group, &parsed.Contacts[i])
+	}
+
+	parsed.InboxMessages = make([]*pond.Message, len(state.Inbox))
+	for i, msg := range state.Inbox {
+		path := fmt.Sprintf("Inbox[%d]", i)
+		// Messages from the home server have no contact.
+		if from := msg.GetFrom(); from != 0 && !contactIds[from] {
+			c.report(path+".From", "no such contact")
+		}
+		var message *pond.Message
+		if len(msg.Message) > 0 {
+			message = new(pond.Message)
+			if err := proto.Unmarshal(msg.Message, message); err != nil {
+				c.report(path+".Message", "corrupt message: %s", err)
+				message = nil
+			}
+		}
+		parsed.InboxMessages[i] = message
+		for j, pd := range msg.PendingDecryptions {
+			if index := int(pd.GetIndex()); message == nil || index < 0 || index >= len(message.DetachedFiles) {
+				c.report(fmt.Sprintf("%s.PendingDecryptions[%d].Index", path, j), "no such detachment in the message")
+			}
+		}
+	}
+
+	parsed.OutboxMessages = make([]*pond.Message, len(state.Outbox))
+	parsed.OutboxRequests = make([]*pond.Request, len(state.Outbox))
+	for i, msg := range state.Outbox {
+		path := fmt.Sprintf("Outbox[%d]", i)
+		// Revocations remain in the outbox after the revoked contact
+		// has been deleted.
+		if !msg.GetRevocation() && !contactIds[msg.GetTo()] {
+			c.report(path+".To", "no such contact")
+		}
+		if len(msg.Message) > 0 {
+			message := new(pond.Message)
+			if err := proto.Unmarshal(msg.Message, message); err != nil {
+				c.report(path+".Message", "corrupt message: %s", err)
+			}
+			parsed.OutboxMessages[i] = message
+		}
+		if len(msg.Request) > 0 {
+			request := new(pond.Request)
+			if err := proto.Unmarshal(msg.Request, request); err != nil {
+				c.report(path+".Request", "corrupt request: %s", err)
+			}
+			parsed.OutboxRequests[i] = request
+		}
+	}
+
+	for i, draft := range state.Drafts {
+		if to := draft.GetTo(); to != 0 && !contactIds[to] {
+			c.report(fmt.Sprintf("Drafts[%d].To", i), "no such contact")
+		}
+	}
+
+	if len(c.errs) > 0 {
+		return nil, c.errs
+	}
+	return parsed, nil
+}
+
+// checkContact checks a contact and records the keys parsed from it in
+// parsed. group is our group, or nil if it's invalid.
+func (c *stateChecker) checkContact(path string, contact *Contact, group *bbssig.Group, parsed *ParsedContact) {
+	var ok bool
+	if group != nil {
+		if parsed.GroupKey, ok = new(bbssig.MemberKey).Unmarshal(group, contact.GroupKey); !ok {
+			c.report(path+".GroupKey", "not a valid member key for our group")
+		}
+	}
+	if contact.GetIsPending() {
+		return
+	}
+
+	theirGroup, ok := new(bbssig.Group).Unmarshal(contact.TheirGroup)
+	if !ok {
+		c.report(path+".TheirGroup", "not a valid group")
+	} else if parsed.MyGroupKey, ok = new(bbssig.MemberKey).Unmarshal(theirGroup, contact.MyGroupKey); !ok {
+		c.report(path+".MyGroupKey", "not a valid member key for their group")
+	}
+
+	if contact.TheirServer == nil {
+		c.report(path, "contact has no server")
+	} else {
+		c.checkServer(path+".TheirServer", *contact.TheirServer)
+	}
+	c.checkLen(path+".TheirPub", contact.TheirPub, 32)
+	c.checkLen(path+".TheirIdentityPublic", contact.TheirIdentityPublic, 32)
+
+	if contact.SendChain != nil {
+		c.checkChain(path+".SendChain", contact.SendChain)
+	}
+	for i, chain := range contact.ReceiveChains {
+		c.checkChain(fmt.Sprintf("%s.ReceiveChains[%d]", path, i), chain)
+	}
+	for i, skipped := range contact.SkippedKeys {
+		skippedPath := fmt.Sprintf("%s.SkippedKeys[%d]", path, i)
+		c.checkMinLen(skippedPath+".Public", skipped.Public, 32)
+		c.checkMinLen(skippedPath+".Key", skipped.Key, 32)
+	}
+}
+
+func (c *stateChecker) checkChain(path string, chain *Contact_Chain) {
+	c.checkMinLen(path+".Public", chain.Public, 32)
+	c.checkMinLen(path+".Key", chain.Key, 32)
+	c.checkMinLen(path+".HeaderKey", chain.HeaderKey, 32)
+}
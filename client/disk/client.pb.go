@@ -14,6 +14,45 @@ var _ = proto.Marshal
 var _ = &json.SyntaxError{}
 var _ = math.Inf
 
+type State_SchedulingPolicy int32
+
+const (
+	State_EXPONENTIAL State_SchedulingPolicy = 0
+	State_BURST       State_SchedulingPolicy = 1
+	State_LOW_POWER   State_SchedulingPolicy = 2
+)
+
+var State_SchedulingPolicy_name = map[int32]string{
+	0: "EXPONENTIAL",
+	1: "BURST",
+	2: "LOW_POWER",
+}
+var State_SchedulingPolicy_value = map[string]int32{
+	"EXPONENTIAL": 0,
+	"BURST":       1,
+	"LOW_POWER":   2,
+}
+
+func (x State_SchedulingPolicy) Enum() *State_SchedulingPolicy {
+	p := new(State_SchedulingPolicy)
+	*p = x
+	return p
+}
+func (x State_SchedulingPolicy) String() string {
+	return proto.EnumName(State_SchedulingPolicy_name, int32(x))
+}
+func (x State_SchedulingPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.String())
+}
+func (x *State_SchedulingPolicy) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(State_SchedulingPolicy_value, data, "State_SchedulingPolicy")
+	if err != nil {
+		return err
+	}
+	*x = State_SchedulingPolicy(value)
+	return nil
+}
+
 type Contact struct {
 	Id                  *uint64                `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
 	Name                *string                `protobuf:"bytes,2,req,name=name" json:"name,omitempty"`
@@ -32,6 +71,10 @@ type Contact struct {
 	TheirCurrentPublic  []byte                 `protobuf:"bytes,14,opt,name=their_current_public" json:"their_current_public,omitempty"`
 	PreviousTags        []*Contact_PreviousTag `protobuf:"bytes,17,rep,name=previous_tags" json:"previous_tags,omitempty"`
 	IsPending           *bool                  `protobuf:"varint,15,opt,name=is_pending,def=0" json:"is_pending,omitempty"`
+	Verified            *bool                  `protobuf:"varint,18,opt,name=verified" json:"verified,omitempty"`
+	SendChain           *Contact_Chain         `protobuf:"bytes,19,opt,name=send_chain" json:"send_chain,omitempty"`
+	ReceiveChains       []*Contact_Chain       `protobuf:"bytes,20,rep,name=receive_chains" json:"receive_chains,omitempty"`
+	SkippedKeys         []*Contact_SkippedKey  `protobuf:"bytes,21,rep,name=skipped_keys" json:"skipped_keys,omitempty"`
 	XXX_unrecognized    []byte                 `json:"-"`
 }
 
@@ -160,6 +203,34 @@ func (this *Contact) GetIsPending() bool {
 	return Default_Contact_IsPending
 }
 
+func (this *Contact) GetVerified() bool {
+	if this != nil && this.Verified != nil {
+		return *this.Verified
+	}
+	return false
+}
+
+func (this *Contact) GetSendChain() *Contact_Chain {
+	if this != nil {
+		return this.SendChain
+	}
+	return nil
+}
+
+func (this *Contact) GetReceiveChains() []*Contact_Chain {
+	if this != nil {
+		return this.ReceiveChains
+	}
+	return nil
+}
+
+func (this *Contact) GetSkippedKeys() []*Contact_SkippedKey {
+	if this != nil {
+		return this.SkippedKeys
+	}
+	return nil
+}
+
 type Contact_PreviousTag struct {
 	Tag              []byte `protobuf:"bytes,1,req,name=tag" json:"tag,omitempty"`
 	Expired          *int64 `protobuf:"varint,2,req,name=expired" json:"expired,omitempty"`
@@ -184,17 +255,107 @@ func (this *Contact_PreviousTag) GetExpired() int64 {
 	return 0
 }
 
-type Inbox struct {
-	Id               *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
-	From             *uint64 `protobuf:"fixed64,2,req,name=from" json:"from,omitempty"`
-	ReceivedTime     *int64  `protobuf:"varint,3,req,name=received_time" json:"received_time,omitempty"`
-	Acked            *bool   `protobuf:"varint,4,req,name=acked" json:"acked,omitempty"`
-	Message          []byte  `protobuf:"bytes,5,opt,name=message" json:"message,omitempty"`
-	Read             *bool   `protobuf:"varint,6,req,name=read" json:"read,omitempty"`
-	Sealed           []byte  `protobuf:"bytes,7,opt,name=sealed" json:"sealed,omitempty"`
+type Contact_Chain struct {
+	Public           []byte  `protobuf:"bytes,1,req,name=public" json:"public,omitempty"`
+	Key              []byte  `protobuf:"bytes,2,req,name=key" json:"key,omitempty"`
+	HeaderKey        []byte  `protobuf:"bytes,3,req,name=header_key" json:"header_key,omitempty"`
+	Counter          *uint32 `protobuf:"varint,4,req,name=counter" json:"counter,omitempty"`
+	TheirPublic      []byte  `protobuf:"bytes,5,opt,name=their_public" json:"their_public,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *Contact_Chain) Reset()         { *this = Contact_Chain{} }
+func (this *Contact_Chain) String() string { return proto.CompactTextString(this) }
+func (*Contact_Chain) ProtoMessage()       {}
+
+func (this *Contact_Chain) GetPublic() []byte {
+	if this != nil {
+		return this.Public
+	}
+	return nil
+}
+
+func (this *Contact_Chain) GetKey() []byte {
+	if this != nil {
+		return this.Key
+	}
+	return nil
+}
+
+func (this *Contact_Chain) GetHeaderKey() []byte {
+	if this != nil {
+		return this.HeaderKey
+	}
+	return nil
+}
+
+func (this *Contact_Chain) GetCounter() uint32 {
+	if this != nil && this.Counter != nil {
+		return *this.Counter
+	}
+	return 0
+}
+
+func (this *Contact_Chain) GetTheirPublic() []byte {
+	if this != nil {
+		return this.TheirPublic
+	}
+	return nil
+}
+
+type Contact_SkippedKey struct {
+	Public           []byte  `protobuf:"bytes,1,req,name=public" json:"public,omitempty"`
+	Counter          *uint32 `protobuf:"varint,2,req,name=counter" json:"counter,omitempty"`
+	Key              []byte  `protobuf:"bytes,3,req,name=key" json:"key,omitempty"`
+	Expires          *int64  `protobuf:"varint,4,req,name=expires" json:"expires,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
+func (this *Contact_SkippedKey) Reset()         { *this = Contact_SkippedKey{} }
+func (this *Contact_SkippedKey) String() string { return proto.CompactTextString(this) }
+func (*Contact_SkippedKey) ProtoMessage()       {}
+
+func (this *Contact_SkippedKey) GetPublic() []byte {
+	if this != nil {
+		return this.Public
+	}
+	return nil
+}
+
+func (this *Contact_SkippedKey) GetCounter() uint32 {
+	if this != nil && this.Counter != nil {
+		return *this.Counter
+	}
+	return 0
+}
+
+func (this *Contact_SkippedKey) GetKey() []byte {
+	if this != nil {
+		return this.Key
+	}
+	return nil
+}
+
+func (this *Contact_SkippedKey) GetExpires() int64 {
+	if this != nil && this.Expires != nil {
+		return *this.Expires
+	}
+	return 0
+}
+
+type Inbox struct {
+	Id                 *uint64                    `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	From               *uint64                    `protobuf:"fixed64,2,req,name=from" json:"from,omitempty"`
+	ReceivedTime       *int64                     `protobuf:"varint,3,req,name=received_time" json:"received_time,omitempty"`
+	Acked              *bool                      `protobuf:"varint,4,req,name=acked" json:"acked,omitempty"`
+	Message            []byte                     `protobuf:"bytes,5,opt,name=message" json:"message,omitempty"`
+	Read               *bool                      `protobuf:"varint,6,req,name=read" json:"read,omitempty"`
+	Sealed             []byte                     `protobuf:"bytes,7,opt,name=sealed" json:"sealed,omitempty"`
+	PendingDecryptions []*Inbox_PendingDecryption `protobuf:"bytes,8,rep,name=pending_decryptions" json:"pending_decryptions,omitempty"`
+	StagedPaths        []string                   `protobuf:"bytes,9,rep,name=staged_paths" json:"staged_paths,omitempty"`
+	XXX_unrecognized   []byte                     `json:"-"`
+}
+
 func (this *Inbox) Reset()         { *this = Inbox{} }
 func (this *Inbox) String() string { return proto.CompactTextString(this) }
 func (*Inbox) ProtoMessage()       {}
@@ -248,6 +409,84 @@ func (this *Inbox) GetSealed() []byte {
 	return nil
 }
 
+func (this *Inbox) GetPendingDecryptions() []*Inbox_PendingDecryption {
+	if this != nil {
+		return this.PendingDecryptions
+	}
+	return nil
+}
+
+func (this *Inbox) GetStagedPaths() []string {
+	if this != nil {
+		return this.StagedPaths
+	}
+	return nil
+}
+
+type Inbox_PendingDecryption struct {
+	Index            *int32  `protobuf:"varint,1,req,name=index" json:"index,omitempty"`
+	OutPath          *string `protobuf:"bytes,2,req,name=out_path" json:"out_path,omitempty"`
+	InPath           *string `protobuf:"bytes,3,opt,name=in_path" json:"in_path,omitempty"`
+	Done             *uint64 `protobuf:"varint,4,opt,name=done" json:"done,omitempty"`
+	Total            *uint64 `protobuf:"varint,5,opt,name=total" json:"total,omitempty"`
+	TmpPath          *string `protobuf:"bytes,6,opt,name=tmp_path" json:"tmp_path,omitempty"`
+	Paused           *bool   `protobuf:"varint,7,opt,name=paused" json:"paused,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *Inbox_PendingDecryption) Reset()         { *this = Inbox_PendingDecryption{} }
+func (this *Inbox_PendingDecryption) String() string { return proto.CompactTextString(this) }
+func (*Inbox_PendingDecryption) ProtoMessage()       {}
+
+func (this *Inbox_PendingDecryption) GetIndex() int32 {
+	if this != nil && this.Index != nil {
+		return *this.Index
+	}
+	return 0
+}
+
+func (this *Inbox_PendingDecryption) GetOutPath() string {
+	if this != nil && this.OutPath != nil {
+		return *this.OutPath
+	}
+	return ""
+}
+
+func (this *Inbox_PendingDecryption) GetInPath() string {
+	if this != nil && this.InPath != nil {
+		return *this.InPath
+	}
+	return ""
+}
+
+func (this *Inbox_PendingDecryption) GetDone() uint64 {
+	if this != nil && this.Done != nil {
+		return *this.Done
+	}
+	return 0
+}
+
+func (this *Inbox_PendingDecryption) GetTotal() uint64 {
+	if this != nil && this.Total != nil {
+		return *this.Total
+	}
+	return 0
+}
+
+func (this *Inbox_PendingDecryption) GetTmpPath() string {
+	if this != nil && this.TmpPath != nil {
+		return *this.TmpPath
+	}
+	return ""
+}
+
+func (this *Inbox_PendingDecryption) GetPaused() bool {
+	if this != nil && this.Paused != nil {
+		return *this.Paused
+	}
+	return false
+}
+
 type Outbox struct {
 	Id               *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
 	To               *uint64 `protobuf:"fixed64,2,req,name=to" json:"to,omitempty"`
@@ -258,6 +497,7 @@ type Outbox struct {
 	Request          []byte  `protobuf:"bytes,7,opt,name=request" json:"request,omitempty"`
 	Acked            *int64  `protobuf:"varint,8,opt,name=acked" json:"acked,omitempty"`
 	Revocation       *bool   `protobuf:"varint,9,opt,name=revocation" json:"revocation,omitempty"`
+	Delivered        *int64  `protobuf:"varint,10,opt,name=delivered" json:"delivered,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -328,15 +568,23 @@ func (this *Outbox) GetRevocation() bool {
 	return false
 }
 
+func (this *Outbox) GetDelivered() int64 {
+	if this != nil && this.Delivered != nil {
+		return *this.Delivered
+	}
+	return 0
+}
+
 type Draft struct {
-	Id               *uint64                      `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
-	Created          *int64                       `protobuf:"varint,2,req,name=created" json:"created,omitempty"`
-	To               *uint64                      `protobuf:"fixed64,3,opt,name=to" json:"to,omitempty"`
-	Body             *string                      `protobuf:"bytes,4,req,name=body" json:"body,omitempty"`
-	InReplyTo        *uint64                      `protobuf:"fixed64,5,opt,name=in_reply_to" json:"in_reply_to,omitempty"`
-	Attachments      []*protos.Message_Attachment `protobuf:"bytes,6,rep,name=attachments" json:"attachments,omitempty"`
-	Detachments      []*protos.Message_Detachment `protobuf:"bytes,7,rep,name=detachments" json:"detachments,omitempty"`
-	XXX_unrecognized []byte                       `json:"-"`
+	Id                 *uint64                      `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	Created            *int64                       `protobuf:"varint,2,req,name=created" json:"created,omitempty"`
+	To                 *uint64                      `protobuf:"fixed64,3,opt,name=to" json:"to,omitempty"`
+	Body               *string                      `protobuf:"bytes,4,req,name=body" json:"body,omitempty"`
+	InReplyTo          *uint64                      `protobuf:"fixed64,5,opt,name=in_reply_to" json:"in_reply_to,omitempty"`
+	Attachments        []*protos.Message_Attachment `protobuf:"bytes,6,rep,name=attachments" json:"attachments,omitempty"`
+	Detachments        []*protos.Message_Detachment `protobuf:"bytes,7,rep,name=detachments" json:"detachments,omitempty"`
+	PendingDetachments []*Draft_PendingDetachment   `protobuf:"bytes,8,rep,name=pending_detachments" json:"pending_detachments,omitempty"`
+	XXX_unrecognized   []byte                       `json:"-"`
 }
 
 func (this *Draft) Reset()         { *this = Draft{} }
@@ -392,26 +640,153 @@ func (this *Draft) GetDetachments() []*protos.Message_Detachment {
 	return nil
 }
 
+func (this *Draft) GetPendingDetachments() []*Draft_PendingDetachment {
+	if this != nil {
+		return this.PendingDetachments
+	}
+	return nil
+}
+
+type Draft_PendingDetachment struct {
+	Id               *uint64                    `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	Path             *string                    `protobuf:"bytes,2,req,name=path" json:"path,omitempty"`
+	Size             *int64                     `protobuf:"varint,3,req,name=size" json:"size,omitempty"`
+	Upload           *bool                      `protobuf:"varint,4,opt,name=upload" json:"upload,omitempty"`
+	OutPath          *string                    `protobuf:"bytes,5,opt,name=out_path" json:"out_path,omitempty"`
+	Done             *uint64                    `protobuf:"varint,6,opt,name=done" json:"done,omitempty"`
+	Total            *uint64                    `protobuf:"varint,7,opt,name=total" json:"total,omitempty"`
+	TmpPath          *string                    `protobuf:"bytes,8,opt,name=tmp_path" json:"tmp_path,omitempty"`
+	Key              []byte                     `protobuf:"bytes,9,opt,name=key" json:"key,omitempty"`
+	Detachment       *protos.Message_Detachment `protobuf:"bytes,10,opt,name=detachment" json:"detachment,omitempty"`
+	Paused           *bool                      `protobuf:"varint,11,opt,name=paused" json:"paused,omitempty"`
+	MaxDownloads     *uint32                    `protobuf:"varint,12,opt,name=max_downloads" json:"max_downloads,omitempty"`
+	DeliverTo        *uint64                    `protobuf:"fixed64,13,opt,name=deliver_to" json:"deliver_to,omitempty"`
+	XXX_unrecognized []byte                     `json:"-"`
+}
+
+func (this *Draft_PendingDetachment) Reset()         { *this = Draft_PendingDetachment{} }
+func (this *Draft_PendingDetachment) String() string { return proto.CompactTextString(this) }
+func (*Draft_PendingDetachment) ProtoMessage()       {}
+
+func (this *Draft_PendingDetachment) GetId() uint64 {
+	if this != nil && this.Id != nil {
+		return *this.Id
+	}
+	return 0
+}
+
+func (this *Draft_PendingDetachment) GetPath() string {
+	if this != nil && this.Path != nil {
+		return *this.Path
+	}
+	return ""
+}
+
+func (this *Draft_PendingDetachment) GetSize() int64 {
+	if this != nil && this.Size != nil {
+		return *this.Size
+	}
+	return 0
+}
+
+func (this *Draft_PendingDetachment) GetUpload() bool {
+	if this != nil && this.Upload != nil {
+		return *this.Upload
+	}
+	return false
+}
+
+func (this *Draft_PendingDetachment) GetOutPath() string {
+	if this != nil && this.OutPath != nil {
+		return *this.OutPath
+	}
+	return ""
+}
+
+func (this *Draft_PendingDetachment) GetDone() uint64 {
+	if this != nil && this.Done != nil {
+		return *this.Done
+	}
+	return 0
+}
+
+func (this *Draft_PendingDetachment) GetTotal() uint64 {
+	if this != nil && this.Total != nil {
+		return *this.Total
+	}
+	return 0
+}
+
+func (this *Draft_PendingDetachment) GetTmpPath() string {
+	if this != nil && this.TmpPath != nil {
+		return *this.TmpPath
+	}
+	return ""
+}
+
+func (this *Draft_PendingDetachment) GetKey() []byte {
+	if this != nil {
+		return this.Key
+	}
+	return nil
+}
+
+func (this *Draft_PendingDetachment) GetDetachment() *protos.Message_Detachment {
+	if this != nil {
+		return this.Detachment
+	}
+	return nil
+}
+
+func (this *Draft_PendingDetachment) GetPaused() bool {
+	if this != nil && this.Paused != nil {
+		return *this.Paused
+	}
+	return false
+}
+
+func (this *Draft_PendingDetachment) GetMaxDownloads() uint32 {
+	if this != nil && this.MaxDownloads != nil {
+		return *this.MaxDownloads
+	}
+	return 0
+}
+
+func (this *Draft_PendingDetachment) GetDeliverTo() uint64 {
+	if this != nil && this.DeliverTo != nil {
+		return *this.DeliverTo
+	}
+	return 0
+}
+
 type State struct {
-	Identity                 []byte                 `protobuf:"bytes,1,req,name=identity" json:"identity,omitempty"`
-	Public                   []byte                 `protobuf:"bytes,2,req,name=public" json:"public,omitempty"`
-	Private                  []byte                 `protobuf:"bytes,3,req,name=private" json:"private,omitempty"`
-	Server                   *string                `protobuf:"bytes,4,req,name=server" json:"server,omitempty"`
-	Group                    []byte                 `protobuf:"bytes,5,req,name=group" json:"group,omitempty"`
-	GroupPrivate             []byte                 `protobuf:"bytes,6,req,name=group_private" json:"group_private,omitempty"`
-	PreviousGroupPrivateKeys []*State_PreviousGroup `protobuf:"bytes,12,rep,name=previous_group_private_keys" json:"previous_group_private_keys,omitempty"`
-	Generation               *uint32                `protobuf:"varint,7,req,name=generation" json:"generation,omitempty"`
-	Contacts                 []*Contact             `protobuf:"bytes,8,rep,name=contacts" json:"contacts,omitempty"`
-	Inbox                    []*Inbox               `protobuf:"bytes,9,rep,name=inbox" json:"inbox,omitempty"`
-	Outbox                   []*Outbox              `protobuf:"bytes,10,rep,name=outbox" json:"outbox,omitempty"`
-	Drafts                   []*Draft               `protobuf:"bytes,11,rep,name=drafts" json:"drafts,omitempty"`
-	XXX_unrecognized         []byte                 `json:"-"`
+	Identity                 []byte                  `protobuf:"bytes,1,req,name=identity" json:"identity,omitempty"`
+	Public                   []byte                  `protobuf:"bytes,2,req,name=public" json:"public,omitempty"`
+	Private                  []byte                  `protobuf:"bytes,3,req,name=private" json:"private,omitempty"`
+	Server                   *string                 `protobuf:"bytes,4,req,name=server" json:"server,omitempty"`
+	Group                    []byte                  `protobuf:"bytes,5,req,name=group" json:"group,omitempty"`
+	GroupPrivate             []byte                  `protobuf:"bytes,6,req,name=group_private" json:"group_private,omitempty"`
+	PreviousGroupPrivateKeys []*State_PreviousGroup  `protobuf:"bytes,12,rep,name=previous_group_private_keys" json:"previous_group_private_keys,omitempty"`
+	Generation               *uint32                 `protobuf:"varint,7,req,name=generation" json:"generation,omitempty"`
+	Contacts                 []*Contact              `protobuf:"bytes,8,rep,name=contacts" json:"contacts,omitempty"`
+	Inbox                    []*Inbox                `protobuf:"bytes,9,rep,name=inbox" json:"inbox,omitempty"`
+	Outbox                   []*Outbox               `protobuf:"bytes,10,rep,name=outbox" json:"outbox,omitempty"`
+	Drafts                   []*Draft                `protobuf:"bytes,11,rep,name=drafts" json:"drafts,omitempty"`
+	CoverTraffic             *bool                   `protobuf:"varint,13,opt,name=cover_traffic" json:"cover_traffic,omitempty"`
+	DecoyServers             []string                `protobuf:"bytes,14,rep,name=decoy_servers" json:"decoy_servers,omitempty"`
+	SchedulingPolicy         *State_SchedulingPolicy `protobuf:"varint,15,opt,name=scheduling_policy,enum=disk.State_SchedulingPolicy,def=0" json:"scheduling_policy,omitempty"`
+	DeliveryReceipts         *bool                   `protobuf:"varint,16,opt,name=delivery_receipts" json:"delivery_receipts,omitempty"`
+	ReplayCache              []*State_ReplayEntry    `protobuf:"bytes,17,rep,name=replay_cache" json:"replay_cache,omitempty"`
+	AutoDownload             *bool                   `protobuf:"varint,18,opt,name=auto_download" json:"auto_download,omitempty"`
+	XXX_unrecognized         []byte                  `json:"-"`
 }
 
 func (this *State) Reset()         { *this = State{} }
 func (this *State) String() string { return proto.CompactTextString(this) }
 func (*State) ProtoMessage()       {}
 
+const Default_State_SchedulingPolicy State_SchedulingPolicy = State_EXPONENTIAL
+
 func (this *State) GetIdentity() []byte {
 	if this != nil {
 		return this.Identity
@@ -496,6 +871,48 @@ func (this *State) GetDrafts() []*Draft {
 	return nil
 }
 
+func (this *State) GetCoverTraffic() bool {
+	if this != nil && this.CoverTraffic != nil {
+		return *this.CoverTraffic
+	}
+	return false
+}
+
+func (this *State) GetDecoyServers() []string {
+	if this != nil {
+		return this.DecoyServers
+	}
+	return nil
+}
+
+func (this *State) GetSchedulingPolicy() State_SchedulingPolicy {
+	if this != nil && this.SchedulingPolicy != nil {
+		return *this.SchedulingPolicy
+	}
+	return Default_State_SchedulingPolicy
+}
+
+func (this *State) GetDeliveryReceipts() bool {
+	if this != nil && this.DeliveryReceipts != nil {
+		return *this.DeliveryReceipts
+	}
+	return false
+}
+
+func (this *State) GetReplayCache() []*State_ReplayEntry {
+	if this != nil {
+		return this.ReplayCache
+	}
+	return nil
+}
+
+func (this *State) GetAutoDownload() bool {
+	if this != nil && this.AutoDownload != nil {
+		return *this.AutoDownload
+	}
+	return false
+}
+
 type State_PreviousGroup struct {
 	Group            []byte `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
 	GroupPrivate     []byte `protobuf:"bytes,2,req,name=group_private" json:"group_private,omitempty"`
@@ -528,5 +945,30 @@ func (this *State_PreviousGroup) GetExpired() int64 {
 	return 0
 }
 
+type State_ReplayEntry struct {
+	Hash             []byte `protobuf:"bytes,1,req,name=hash" json:"hash,omitempty"`
+	Time             *int64 `protobuf:"varint,2,req,name=time" json:"time,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (this *State_ReplayEntry) Reset()         { *this = State_ReplayEntry{} }
+func (this *State_ReplayEntry) String() string { return proto.CompactTextString(this) }
+func (*State_ReplayEntry) ProtoMessage()       {}
+
+func (this *State_ReplayEntry) GetHash() []byte {
+	if this != nil {
+		return this.Hash
+	}
+	return nil
+}
+
+func (this *State_ReplayEntry) GetTime() int64 {
+	if this != nil && this.Time != nil {
+		return *this.Time
+	}
+	return 0
+}
+
 func init() {
+	proto.RegisterEnum("disk.State_SchedulingPolicy", State_SchedulingPolicy_name, State_SchedulingPolicy_value)
 }
@@ -11,10 +11,13 @@ import (
 	"code.google.com/p/go.crypto/nacl/secretbox"
 	"code.google.com/p/go.crypto/scrypt"
 	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/pond/client/secret"
 )
 
 func DeriveKey(pw string, diskSalt *[32]byte) ([]byte, error) {
-	return scrypt.Key([]byte(pw), diskSalt[:], 32768, 16, 1, 32)
+	pwBytes := []byte(pw)
+	defer secret.Wipe(pwBytes)
+	return scrypt.Key(pwBytes, diskSalt[:], 32768, 16, 1, 32)
 }
 
 const SCryptSaltLen = 32
@@ -54,7 +57,18 @@ func LockStateFile(stateFile *os.File) (*Lock, bool) {
 	return &Lock{newFd}, true
 }
 
-func StateWriter(stateFilename string, key *[32]byte, salt *[SCryptSaltLen]byte, states chan []byte, done chan bool) {
+// minStateSizeLog2 is the log2 of the minimum length of the plaintext of a
+// state file. States are padded to a power of two length.
+const minStateSizeLog2 = 17
+
+// StateWriter encrypts and writes each state received from states to
+// stateFilename until states is closed. Each state overwrites the previous
+// one in place and, if the new state is shorter, the remainder of the old is
+// erased. (The state file is locked so it can't be replaced by renaming a new
+// file over it.) log is called whenever the erasure that was achieved differs
+// from that of the previous write.
+func StateWriter(stateFilename string, key *[32]byte, salt *[SCryptSaltLen]byte, states chan []byte, done chan bool, log func(format string, args ...interface{})) {
+	var lastErasure string
 	for {
 		s, ok := <-states
 		if !ok {
@@ -63,7 +77,7 @@ func StateWriter(stateFilename string, key *[32]byte, salt *[SCryptSaltLen]byte,
 		}
 
 		length := uint32(len(s)) + 4
-		for i := uint(17); i < 32; i++ {
+		for i := uint(minStateSizeLog2); i < 32; i++ {
 			if n := (uint32(1) << i); n >= length {
 				length = n
 				break
@@ -90,8 +104,16 @@ func StateWriter(stateFilename string, key *[32]byte, salt *[SCryptSaltLen]byte,
 		}
 
 		ciphertext := secretbox.Seal(nil, plaintext, &nonce, key)
+		secret.Wipe(plaintext)
+		secret.Wipe(s)
 
-		out, err := os.Create(stateFilename)
+		// The file isn't truncated when opened so that the new state
+		// overwrites the blocks of the old one.
+		out, err := os.OpenFile(stateFilename, os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			panic(err)
+		}
+		info, err := out.Stat()
 		if err != nil {
 			panic(err)
 		}
@@ -104,7 +126,24 @@ func StateWriter(stateFilename string, key *[32]byte, salt *[SCryptSaltLen]byte,
 		if _, err := out.Write(ciphertext); err != nil {
 			panic(err)
 		}
+
+		var erasure Erasure
+		written := int64(len(salt) + len(nonceSmear) + len(ciphertext))
+		if err := eraseRange(out, written, info.Size(), &erasure); err != nil {
+			panic(err)
+		}
+		if err := out.Truncate(written); err != nil {
+			panic(err)
+		}
 		out.Close()
+
+		if info.Size() == 0 {
+			continue
+		}
+		if s := erasure.String(); s != lastErasure {
+			log("Previous state erased: %s", s)
+			lastErasure = s
+		}
 	}
 }
 
@@ -126,9 +165,20 @@ func LoadState(b []byte, key *[32]byte) (*State, error) {
 
 	b = b[24*smearedCopies:]
 	plaintext, ok := secretbox.Open(nil, b, &nonce, key)
+	// StateWriter overwrites the previous state in place so, if it was
+	// interrupted before truncating the file, the new state may be followed
+	// by the tail of a longer, old one. Since the plaintext length is always
+	// a power of two, the new state can be found by trying the shorter
+	// lengths.
+	for n := 1 << minStateSizeLog2; !ok && n+secretbox.Overhead < len(b); n <<= 1 {
+		plaintext, ok = secretbox.Open(nil, b[:n+secretbox.Overhead], &nonce, key)
+	}
 	if !ok {
 		return nil, BadPasswordError
 	}
+	// proto.Unmarshal copies byte fields so the decrypted state can be
+	// wiped once it has been parsed.
+	defer secret.Wipe(plaintext)
 	if len(plaintext) < 4 {
 		return nil, errors.New("state file corrupt")
 	}
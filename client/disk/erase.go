@@ -0,0 +1,132 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Erasure records the steps that were taken to erase a file, or part of one,
+// so that users can be told what protection they actually got.
+type Erasure struct {
+	// Filesystem is the name of the filesystem holding the file, or empty
+	// if unknown.
+	Filesystem string
+	// Overwritten is true if the data was overwritten in place.
+	Overwritten bool
+	// Synced is true if the overwritten data was flushed to the disk.
+	Synced bool
+	// Discarded is true if the blocks of the file were deallocated by
+	// punching a hole, which results in a TRIM for SSDs if the filesystem
+	// is mounted with the discard option.
+	Discarded bool
+	// Trimmed is true if the free space of the filesystem was trimmed.
+	// This generally requires root and, since it covers the whole
+	// filesystem, is done at most every few minutes.
+	Trimmed bool
+	// Removed is true if the file was unlinked.
+	Removed bool
+}
+
+func (e *Erasure) String() string {
+	var steps []string
+	for _, step := range []struct {
+		done bool
+		name string
+	}{
+		{e.Overwritten, "overwritten"},
+		{e.Synced, "synced"},
+		{e.Discarded, "discarded"},
+		{e.Trimmed, "trimmed"},
+		{e.Removed, "removed"},
+	} {
+		if step.done {
+			steps = append(steps, step.name)
+		}
+	}
+	if len(steps) == 0 {
+		steps = append(steps, "nothing done")
+	}
+
+	filesystem := e.Filesystem
+	if len(filesystem) == 0 {
+		filesystem = "unknown"
+	}
+	s := strings.Join(steps, ", ") + " on " + filesystem + " filesystem"
+	if copyOnWriteFilesystems[filesystem] {
+		s += " (which may keep old copies regardless)"
+	}
+	return s
+}
+
+// copyOnWriteFilesystems contains the filesystems where overwriting a file
+// doesn't overwrite the blocks that held the old contents.
+var copyOnWriteFilesystems = map[string]bool{
+	"btrfs":  true,
+	"nilfs2": true,
+	"zfs":    true,
+}
+
+// eraseBufferSize is the size of the writes used to overwrite files.
+const eraseBufferSize = 64 * 1024
+
+// EraseFile erases the file at path as thoroughly as the filesystem permits:
+// its contents are overwritten and synced, its blocks discarded and it's
+// truncated and removed. Then the free space of the filesystem is trimmed,
+// unless that was done recently.
+// Erasure continues past failures and the returned Erasure records which
+// steps succeeded. The error is that of the first failure, if any.
+func EraseFile(path string) (*Erasure, error) {
+	e := new(Erasure)
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			err = eraseRange(f, 0, info.Size(), e)
+		}
+		if truncErr := f.Truncate(0); err == nil {
+			err = truncErr
+		}
+		f.Close()
+	}
+
+	if removeErr := os.Remove(path); removeErr == nil {
+		e.Removed = true
+	} else if err == nil {
+		err = removeErr
+	}
+	e.Trimmed = trim(filepath.Dir(path))
+
+	return e, err
+}
+
+// eraseRange overwrites the bytes of f from start to end with zeros, syncs
+// them and then discards the blocks that held them, recording each step in
+// e. It doesn't change the size of f.
+func eraseRange(f *os.File, start, end int64, e *Erasure) error {
+	e.Filesystem = filesystemName(f)
+
+	zeros := make([]byte, eraseBufferSize)
+	for pos := start; pos < end; {
+		n := end - pos
+		if n > int64(len(zeros)) {
+			n = int64(len(zeros))
+		}
+		if _, err := f.WriteAt(zeros[:n], pos); err != nil {
+			return err
+		}
+		pos += n
+	}
+	e.Overwritten = true
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	e.Synced = true
+
+	if end > start {
+		e.Discarded = punchHole(f, start, end-start)
+	}
+	return nil
+}
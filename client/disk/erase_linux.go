@@ -0,0 +1,133 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	fallocKeepSize  = 1 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 2 // FALLOC_FL_PUNCH_HOLE
+	// fitrim is the FITRIM ioctl: _IOWR('X', 121, struct fstrim_range).
+	fitrim = 0xc0185879
+)
+
+// filesystemMagics maps from the f_type values returned by statfs to the
+// names of filesystems.
+var filesystemMagics = map[uint32]string{
+	0x0000ef53: "ext4",
+	0x01021994: "tmpfs",
+	0x00003434: "nilfs2",
+	0x00004d44: "vfat",
+	0x00006969: "nfs",
+	0x2fc12fc1: "zfs",
+	0x58465342: "xfs",
+	0x65735546: "fuse",
+	0x9123683e: "btrfs",
+	0xf2f52010: "f2fs",
+}
+
+func filesystemName(f *os.File) string {
+	var stat syscall.Statfs_t
+	if err := syscall.Fstatfs(int(f.Fd()), &stat); err != nil {
+		return ""
+	}
+	if name, ok := filesystemMagics[uint32(stat.Type)]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#x", uint32(stat.Type))
+}
+
+var (
+	// unsupported records, per device, the operations that have failed
+	// so that they aren't retried for every erasure.
+	unsupported      = make(map[unsupportedKey]bool)
+	unsupportedMutex sync.Mutex
+)
+
+type unsupportedKey struct {
+	dev uint64
+	op  string
+}
+
+// attempt runs op for the filesystem holding f unless it has previously
+// failed there. It returns whether op succeeded.
+func attempt(f *os.File, name string, op func() error) bool {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &stat); err != nil {
+		return false
+	}
+	key := unsupportedKey{uint64(stat.Dev), name}
+
+	unsupportedMutex.Lock()
+	skip := unsupported[key]
+	unsupportedMutex.Unlock()
+	if skip {
+		return false
+	}
+
+	if err := op(); err != nil {
+		unsupportedMutex.Lock()
+		unsupported[key] = true
+		unsupportedMutex.Unlock()
+		return false
+	}
+	return true
+}
+
+func punchHole(f *os.File, offset, length int64) bool {
+	return attempt(f, "punch hole", func() error {
+		return syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+	})
+}
+
+// minTrimInterval is the minimum time between trims of a filesystem. A trim
+// covers all the free space of the filesystem, which can take a long time, so
+// erasing several files shouldn't trim for each one.
+const minTrimInterval = 10 * time.Minute
+
+var (
+	// lastTrim records, per device, when the filesystem was last trimmed.
+	lastTrim      = make(map[uint64]time.Time)
+	lastTrimMutex sync.Mutex
+)
+
+// trim discards the free space of the filesystem holding dir, which requires
+// CAP_SYS_ADMIN. It does nothing if the filesystem was trimmed within the last
+// minTrimInterval.
+func trim(dir string) bool {
+	d, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer d.Close()
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(d.Fd()), &stat); err != nil {
+		return false
+	}
+	now := time.Now()
+	lastTrimMutex.Lock()
+	last, ok := lastTrim[uint64(stat.Dev)]
+	if ok && now.Sub(last) < minTrimInterval {
+		lastTrimMutex.Unlock()
+		return false
+	}
+	lastTrim[uint64(stat.Dev)] = now
+	lastTrimMutex.Unlock()
+
+	return attempt(d, "trim", func() error {
+		// struct fstrim_range.
+		r := struct {
+			start, len, minLen uint64
+		}{0, ^uint64(0), 0}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.Fd(), fitrim, uintptr(unsafe.Pointer(&r))); errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package disk
+
+import (
+	"os"
+)
+
+func filesystemName(f *os.File) string {
+	return ""
+}
+
+func punchHole(f *os.File, offset, length int64) bool {
+	return false
+}
+
+func trim(dir string) bool {
+	return false
+}
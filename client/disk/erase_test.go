@@ -0,0 +1,112 @@
+package disk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+func TestEraseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pond-erase-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte{0xff}, 3*eraseBufferSize/2), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	erasure, err := EraseFile(path)
+	if err != nil {
+		t.Fatalf("EraseFile failed: %s (%s)", err, erasure)
+	}
+	if !erasure.Overwritten || !erasure.Synced || !erasure.Removed {
+		t.Errorf("erasure missed required steps: %s", erasure)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file still exists after erasure")
+	}
+}
+
+func TestStateWriterShrink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pond-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var key [32]byte
+	var salt [SCryptSaltLen]byte
+	path := filepath.Join(dir, "state")
+
+	write := func(state *State) {
+		serialized, err := proto.Marshal(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := make(chan []byte)
+		done := make(chan bool)
+		go StateWriter(path, &key, &salt, states, done, t.Logf)
+		states <- serialized
+		close(states)
+		<-done
+	}
+	size := func() int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	newState := func(server string, identityLen int) *State {
+		return &State{
+			Identity:     make([]byte, identityLen),
+			Public:       []byte{},
+			Private:      []byte{},
+			Server:       proto.String(server),
+			Group:        []byte{},
+			GroupPrivate: []byte{},
+			Generation:   proto.Uint32(0),
+		}
+	}
+
+	write(newState("large", 1<<18))
+	large := size()
+	largeContents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(newState("small", 32))
+	if small := size(); small >= large {
+		t.Errorf("state file didn't shrink: %d bytes, previously %d", small, large)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadState(contents, &key)
+	if err != nil {
+		t.Fatalf("failed to load state: %s", err)
+	}
+	if state.GetServer() != "small" {
+		t.Errorf("loaded state has server %q, want \"small\"", state.GetServer())
+	}
+
+	// Simulate a crash before the file was truncated, which leaves the
+	// tail of the old state after the new one.
+	interrupted := append(contents, largeContents[len(contents):]...)
+	if state, err = LoadState(interrupted, &key); err != nil {
+		t.Fatalf("failed to load state followed by the tail of the previous one: %s", err)
+	}
+	if state.GetServer() != "small" {
+		t.Errorf("loaded state has server %q, want \"small\"", state.GetServer())
+	}
+}
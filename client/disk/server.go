@@ -0,0 +1,59 @@
+package disk
+
+import (
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ParseServer parses a server URL of the form
+// pondserver://<base32 identity>@<host>. It returns the server's public
+// identity and the address to connect to. Unless testing is true, the host must
+// be a .onion address or localhost and the default port is used.
+func ParseServer(server string, testing bool) (serverIdentity *[32]byte, host string, err error) {
+	url, err := url.Parse(server)
+	if err != nil {
+		return
+	}
+	if url.Scheme != "pondserver" {
+		err = errors.New("bad URL scheme, should be pondserver")
+		return
+	}
+	if url.User == nil || len(url.User.Username()) == 0 {
+		err = errors.New("no server ID in URL")
+		return
+	}
+	serverIdSlice, err := decodeBase32(url.User.Username())
+	if err != nil {
+		return
+	}
+	if len(serverIdSlice) != 32 {
+		err = errors.New("bad server ID length")
+		return
+	}
+
+	host = url.Host
+	if !testing {
+		if strings.ContainsRune(host, ':') {
+			err = errors.New("URL contains a port number")
+			return
+		}
+		if !strings.HasSuffix(host, ".onion") && host != "localhost" {
+			err = errors.New("host is neither a .onion address nor localhost")
+			return
+		}
+		host += ":16333"
+	}
+
+	serverIdentity = new([32]byte)
+	copy(serverIdentity[:], serverIdSlice)
+	return
+}
+
+func decodeBase32(s string) ([]byte, error) {
+	for len(s)%8 != 0 {
+		s += "="
+	}
+	return base32.StdEncoding.DecodeString(s)
+}
@@ -259,6 +259,11 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 			entry.Connect("activate", func() {
 				ui.clicked(v.name)
 			})
+			if v.updateOnChange {
+				entry.Connect("changed", func() {
+					ui.events <- Update{name, entry.GetText()}
+				})
+			}
 		}
 		if v.password {
 			entry.SetVisibility(false)
@@ -305,6 +310,7 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		} else {
 			scrolled.Add(child)
 		}
+		configureWidget(&scrolled.GtkWidget, v.widgetBase)
 		return scrolled
 	case TextView:
 		view := gtk.TextView()
@@ -360,7 +366,13 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		configureWidget(&combo.GtkWidget, v.widgetBase)
 		return combo
 	case Image:
-		image := gtk.ImageFromPixbuf(v.image.Image())
+		pixbuf := v.image.Image()
+		if len(v.png) > 0 {
+			if decoded, err := pixbufFromPNG(v.png); err == nil {
+				pixbuf = decoded
+			}
+		}
+		image := gtk.ImageFromPixbuf(pixbuf)
 		image.SetAlignment(v.xAlign, v.yAlign)
 		configureWidget(&image.GtkWidget, v.widgetBase)
 		return image
@@ -22,18 +22,27 @@ var indicatorImages [indicatorCount]*gdkpixbuf.GdkPixbuf
 
 func (i Indicator) Image() *gdkpixbuf.GdkPixbuf {
 	if indicatorImages[i] == nil {
-		loader, err := gdkpixbuf.PixbufLoaderWithType("png")
+		pixbuf, err := pixbufFromPNG(indicatorPNGBytes[i])
 		if err != nil {
 			panic(err)
 		}
-		if ok, err := loader.Write(indicatorPNGBytes[i]); !ok {
-			panic(err)
-		}
-		indicatorImages[i] = loader.GetPixbuf()
+		indicatorImages[i] = pixbuf
 	}
 	return indicatorImages[i]
 }
 
+// pixbufFromPNG returns a pixbuf containing the image in pngBytes.
+func pixbufFromPNG(pngBytes []byte) (*gdkpixbuf.GdkPixbuf, error) {
+	loader, err := gdkpixbuf.PixbufLoaderWithType("png")
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := loader.Write(pngBytes); !ok {
+		return nil, err
+	}
+	return loader.GetPixbuf(), nil
+}
+
 var indicatorPNGBytes = [][]byte{
 	{
 		0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
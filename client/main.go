@@ -5,6 +5,8 @@ import (
 	"flag"
 	"os"
 	"runtime"
+
+	"github.com/agl/pond/client/system"
 )
 
 var stateFile *string = flag.String("state-file", "state", "File in which to save persistent state")
@@ -24,6 +26,10 @@ func main() {
 	runtime.GOMAXPROCS(4)
 	flag.Parse()
 
+	// Any failure to harden the process is reported by the system checks
+	// once the UI is running.
+	system.Harden()
+
 	ui := NewGTKUI()
 	NewClient(*stateFile, ui, rand.Reader, testing, true /* autoFetch */)
 	ui.Run()
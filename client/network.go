@@ -24,6 +24,8 @@ import (
 	"code.google.com/p/goprotobuf/proto"
 	"github.com/agl/ed25519"
 	"github.com/agl/pond/bbssig"
+	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/client/secret"
 	pond "github.com/agl/pond/protos"
 	"github.com/agl/pond/transport"
 )
@@ -48,34 +50,11 @@ func (c *client) send(to *Contact, message *pond.Message) error {
 	copy(plaintext[4:], messageBytes)
 	c.randBytes(plaintext[4+len(messageBytes):])
 
-	var innerNonce [24]byte
-	c.randBytes(innerNonce[:])
-	var sealed, innerSealed []byte
-	sealedLen := nonceLen + len(plaintext) + box.Overhead
-	dhPrivate := &to.lastDHPrivate
-
-	if to.supportedVersion >= 1 {
-		public, private, err := box.GenerateKey(c.rand)
-		if err != nil {
-			return err
-		}
-		dhPrivate = private
-
-		var outerNonce [24]byte
-		c.randBytes(outerNonce[:])
-		sealedLen += ephemeralBlockLen
-		sealed = make([]byte, sealedLen)
-		copy(sealed, outerNonce[:])
-		box.Seal(sealed[nonceLen:nonceLen], public[:], &outerNonce, &to.theirCurrentDHPublic, &to.lastDHPrivate)
-		innerSealed = sealed[ephemeralBlockLen:]
-	} else {
-		sealed = make([]byte, sealedLen)
-		innerSealed = sealed
+	sealed, err := c.sealMessage(to, plaintext)
+	if err != nil {
+		return err
 	}
 
-	copy(innerSealed, innerNonce[:])
-	box.Seal(innerSealed[nonceLen:nonceLen], plaintext, &innerNonce, &to.theirCurrentDHPublic, dhPrivate)
-
 	sha := sha256.New()
 	sha.Write(sealed)
 	digest := sha.Sum(nil)
@@ -110,6 +89,45 @@ func (c *client) send(to *Contact, message *pond.Message) error {
 	return nil
 }
 
+// sealMessage encrypts plaintext to contact using the newest message format
+// that they support.
+func (c *client) sealMessage(to *Contact, plaintext []byte) ([]byte, error) {
+	if to.supportedVersion >= ratchetVersion {
+		return c.sealRatchet(to, plaintext)
+	}
+
+	var innerNonce [24]byte
+	c.randBytes(innerNonce[:])
+	var sealed, innerSealed []byte
+	sealedLen := nonceLen + len(plaintext) + box.Overhead
+	dhPrivate := &to.lastDHPrivate
+
+	if to.supportedVersion >= 1 {
+		public, private, err := box.GenerateKey(c.rand)
+		if err != nil {
+			return nil, err
+		}
+		dhPrivate = private
+
+		var outerNonce [24]byte
+		c.randBytes(outerNonce[:])
+		sealedLen += ephemeralBlockLen
+		sealed = make([]byte, sealedLen)
+		copy(sealed, outerNonce[:])
+		box.Seal(sealed[nonceLen:nonceLen], public[:], &outerNonce, &to.theirCurrentDHPublic, &to.lastDHPrivate)
+		innerSealed = sealed[ephemeralBlockLen:]
+		defer secret.Wipe(private[:])
+	} else {
+		sealed = make([]byte, sealedLen)
+		innerSealed = sealed
+	}
+
+	copy(innerSealed, innerNonce[:])
+	box.Seal(innerSealed[nonceLen:nonceLen], plaintext, &innerNonce, &to.theirCurrentDHPublic, dhPrivate)
+
+	return sealed, nil
+}
+
 // revocationSignaturePrefix is prepended to a SignedRevocation_Revocation
 // message before signing in order to give context to the signature.
 var revocationSignaturePrefix = []byte("revocation\x00")
@@ -179,16 +197,22 @@ func (c *client) revoke(to *Contact) {
 	c.outbox = append(c.outbox, out)
 }
 
+// decryptMessage decrypts a message from a contact. Messages from version
+// zero clients are a single box, version one messages have an ephemeral
+// block and later messages use a hash ratchet (see sealRatchet).
 func decryptMessage(sealed []byte, nonce *[24]byte, from *Contact) ([]byte, bool) {
-	plaintext, ok := decryptMessageInner(sealed, nonce, from)
+	plaintext, usedCurrent, ok := decryptMessageInner(sealed, nonce, from)
 	if ok {
+		if usedCurrent {
+			from.rotateDH()
+		}
 		return plaintext, true
 	}
 
 	// The message might have an ephemeral block, the nonce of which has already been split off.
 	headerLen := ephemeralBlockLen - len(nonce)
 	if len(sealed) > headerLen {
-		publicBytes, ok := decryptMessageInner(sealed[:headerLen], nonce, from)
+		publicBytes, usedCurrent, ok := decryptMessageInner(sealed[:headerLen], nonce, from)
 		if !ok || len(publicBytes) != 32 {
 			return nil, false
 		}
@@ -199,19 +223,21 @@ func decryptMessage(sealed []byte, nonce *[24]byte, from *Contact) ([]byte, bool
 		var ephemeralPublicKey [32]byte
 		copy(ephemeralPublicKey[:], publicBytes)
 
-		if plaintext, ok := box.Open(nil, sealed, &innerNonce, &ephemeralPublicKey, &from.lastDHPrivate); ok {
-			return plaintext, ok
+		dhPrivate := &from.lastDHPrivate
+		if usedCurrent {
+			dhPrivate = &from.currentDHPrivate
 		}
-
-		plaintext, ok := box.Open(nil, sealed, &innerNonce, &ephemeralPublicKey, &from.currentDHPrivate)
+		plaintext, ok := from.openRatchet(sealed, nonce, &innerNonce, &ephemeralPublicKey, dhPrivate)
 		if !ok {
-			return nil, false
+			if plaintext, ok = box.Open(nil, sealed, &innerNonce, &ephemeralPublicKey, &from.lastDHPrivate); !ok {
+				if plaintext, ok = box.Open(nil, sealed, &innerNonce, &ephemeralPublicKey, &from.currentDHPrivate); !ok {
+					return nil, false
+				}
+				usedCurrent = true
+			}
 		}
-		// They have clearly received our current DH value. Time to
-		// rotate.
-		copy(from.lastDHPrivate[:], from.currentDHPrivate[:])
-		if _, err := io.ReadFull(rand.Reader, from.currentDHPrivate[:]); err != nil {
-			panic(err)
+		if usedCurrent {
+			from.rotateDH()
 		}
 		return plaintext, true
 	}
@@ -219,30 +245,36 @@ func decryptMessage(sealed []byte, nonce *[24]byte, from *Contact) ([]byte, bool
 	return nil, false
 }
 
-func decryptMessageInner(sealed []byte, nonce *[24]byte, from *Contact) ([]byte, bool) {
+// decryptMessageInner opens a box from contact, trying each combination of
+// their and our DH values. It reports whether our current DH private value
+// was used.
+func decryptMessageInner(sealed []byte, nonce *[24]byte, from *Contact) (plaintext []byte, usedCurrent, ok bool) {
 	if plaintext, ok := box.Open(nil, sealed, nonce, &from.theirLastDHPublic, &from.lastDHPrivate); ok {
-		return plaintext, true
+		return plaintext, false, true
 	}
 
 	if plaintext, ok := box.Open(nil, sealed, nonce, &from.theirCurrentDHPublic, &from.lastDHPrivate); ok {
-		return plaintext, true
+		return plaintext, false, true
 	}
 
-	plaintext, ok := box.Open(nil, sealed, nonce, &from.theirLastDHPublic, &from.currentDHPrivate)
+	plaintext, ok = box.Open(nil, sealed, nonce, &from.theirLastDHPublic, &from.currentDHPrivate)
 	if !ok {
 		plaintext, ok = box.Open(nil, sealed, nonce, &from.theirCurrentDHPublic, &from.currentDHPrivate)
 		if !ok {
-			return nil, false
+			return nil, false, false
 		}
 	}
 
-	// They have clearly received our current DH value. Time to
-	// rotate.
-	copy(from.lastDHPrivate[:], from.currentDHPrivate[:])
-	if _, err := io.ReadFull(rand.Reader, from.currentDHPrivate[:]); err != nil {
+	return plaintext, true, true
+}
+
+// rotateDH is called when a contact has clearly received our current DH
+// value. Time to rotate.
+func (contact *Contact) rotateDH() {
+	copy(contact.lastDHPrivate[:], contact.currentDHPrivate[:])
+	if _, err := io.ReadFull(rand.Reader, contact.currentDHPrivate[:]); err != nil {
 		panic(err)
 	}
-	return plaintext, true
 }
 
 func (c *client) processNewMessage(m NewMessage) {
@@ -397,7 +429,13 @@ func (c *client) unsealMessage(inboxMsg *InboxMessage, from *Contact) bool {
 		return false
 	}
 
-	// Check for duplicate message.
+	// Check for duplicate message. The replay cache covers messages that
+	// have been erased from the inbox.
+	replayID := messageReplayHash(from.id, *msg.Id)
+	if c.replayCache.contains(replayID) {
+		c.log.Printf("Dropping replayed message from %s", from.name)
+		return false
+	}
 	for _, candidate := range c.inbox {
 		if candidate.from == from.id &&
 			candidate.id != inboxMsg.id &&
@@ -418,10 +456,17 @@ func (c *client) unsealMessage(inboxMsg *InboxMessage, from *Contact) bool {
 		id := *msg.InReplyTo
 
 		for _, candidate := range c.outbox {
-			if candidate.id == id {
+			if candidate.id != id {
+				continue
+			}
+			if msg.GetDeliveryReceipt() {
+				if candidate.delivered.IsZero() {
+					candidate.delivered = time.Now()
+				}
+			} else {
 				candidate.acked = time.Now()
-				c.outboxUI.SetIndicator(id, indicatorGreen)
 			}
+			c.outboxUI.SetIndicator(id, candidate.indicator())
 		}
 	}
 
@@ -433,6 +478,12 @@ func (c *client) unsealMessage(inboxMsg *InboxMessage, from *Contact) bool {
 	inboxMsg.message = msg
 	inboxMsg.sealed = nil
 	inboxMsg.read = false
+	c.replayCache.add(replayID, time.Now())
+
+	if c.deliveryReceipts && len(msg.Body) > 0 && from.supportedVersion >= receiptVersion {
+		c.sendDeliveryReceipt(inboxMsg)
+	}
+	c.autoDownloadDetachments(inboxMsg)
 
 	return true
 }
@@ -445,6 +496,11 @@ func (c *client) processMessageSent(msr messageSendResult) {
 			break
 		}
 	}
+	if msg == nil {
+		// The message was removed from the outbox, e.g. because its
+		// contact was deleted, while it was being sent.
+		return
+	}
 
 	if msr.revocation != nil {
 		// We tried to deliver a message to a user but the server told
@@ -525,13 +581,6 @@ func (c *client) processMessageSent(msr messageSendResult) {
 	c.save()
 }
 
-func decodeBase32(s string) ([]byte, error) {
-	for len(s)%8 != 0 {
-		s += "="
-	}
-	return base32.StdEncoding.DecodeString(s)
-}
-
 func replyToError(reply *pond.Reply) error {
 	if reply.Status == nil || *reply.Status == pond.Reply_OK {
 		return nil
@@ -542,46 +591,6 @@ func replyToError(reply *pond.Reply) error {
 	return errors.New("unknown error from server: " + strconv.Itoa(int(*reply.Status)))
 }
 
-func parseServer(server string, testing bool) (serverIdentity *[32]byte, host string, err error) {
-	url, err := url.Parse(server)
-	if err != nil {
-		return
-	}
-	if url.Scheme != "pondserver" {
-		err = errors.New("bad URL scheme, should be pondserver")
-		return
-	}
-	if url.User == nil || len(url.User.Username()) == 0 {
-		err = errors.New("no server ID in URL")
-		return
-	}
-	serverIdSlice, err := decodeBase32(url.User.Username())
-	if err != nil {
-		return
-	}
-	if len(serverIdSlice) != 32 {
-		err = errors.New("bad server ID length")
-		return
-	}
-
-	host = url.Host
-	if !testing {
-		if strings.ContainsRune(host, ':') {
-			err = errors.New("URL contains a port number")
-			return
-		}
-		if !strings.HasSuffix(host, ".onion") && host != "localhost" {
-			err = errors.New("host is neither a .onion address nor localhost")
-			return
-		}
-		host += ":16333"
-	}
-
-	serverIdentity = new([32]byte)
-	copy(serverIdentity[:], serverIdSlice)
-	return
-}
-
 // torAddr is the address at which we expect to find the local Tor SOCKS proxy.
 const torAddr = "127.0.0.1:9050"
 
@@ -615,7 +624,7 @@ func (c *client) dialServer(server string, useRandomIdentity bool) (*transport.C
 		identityPublic = &randomIdentityPublic
 	}
 
-	serverIdentity, host, err := parseServer(server, c.testing)
+	serverIdentity, host, err := disk.ParseServer(server, c.testing)
 	if err != nil {
 		return nil, err
 	}
@@ -640,7 +649,7 @@ func (c *client) dialServer(server string, useRandomIdentity bool) (*transport.C
 }
 
 func (c *client) doCreateAccount() error {
-	_, _, err := parseServer(c.server, c.testing)
+	_, _, err := disk.ParseServer(c.server, c.testing)
 	if err != nil {
 		return err
 	}
@@ -652,6 +661,13 @@ func (c *client) doCreateAccount() error {
 			return errors.New("Failed to connect to local Tor: " + err.Error())
 		}
 		testConn.Close()
+
+		c.ui.Actions() <- SetText{name: "status", text: "Checking Tor..."}
+		c.ui.Signal()
+
+		if err := c.checkTorStatus(); err != nil {
+			return err
+		}
 	}
 
 	c.ui.Actions() <- SetText{name: "status", text: "Generating keys..."}
@@ -722,11 +738,117 @@ func (c *client) resignQueuedMessages(revUpdate revocationUpdate) {
 	}
 }
 
+// coverTrafficRatio is the reciprocal of the fraction of network transactions
+// that are dummy deliveries when cover traffic is enabled.
+const coverTrafficRatio = 4
+
+// updateCoverTargets recalculates the set of destinations for cover traffic
+// from the current contacts and decoy servers. It runs on the main goroutine.
+func (c *client) updateCoverTargets() {
+	var targets []coverTarget
+
+	if c.coverTraffic {
+		// Each server is only included once so that the distribution of
+		// dummy deliveries doesn't reflect the number of contacts at
+		// each server.
+		seen := make(map[string]bool)
+		for _, contact := range c.contacts {
+			if contact.isPending || contact.revokedUs || seen[contact.theirServer] {
+				continue
+			}
+			seen[contact.theirServer] = true
+			targets = append(targets, coverTarget{
+				server: contact.theirServer,
+				to:     contact.theirIdentityPublic,
+			})
+		}
+		for _, server := range c.decoyServers {
+			if seen[server] {
+				continue
+			}
+			seen[server] = true
+			target := coverTarget{server: server}
+			c.randBytes(target.to[:])
+			targets = append(targets, target)
+		}
+	}
+
+	c.queueMutex.Lock()
+	c.coverTargets = targets
+	c.queueMutex.Unlock()
+}
+
+// coverDelivery returns a dummy delivery request for target. It's the same
+// size as a real delivery but the contents are random and the server is asked
+// to discard it.
+func (c *client) coverDelivery(target *coverTarget) *pond.Request {
+	message := make([]byte, ephemeralBlockLen+nonceLen+pond.MaxSerializedMessage+4+box.Overhead)
+	c.randBytes(message)
+	signature := make([]byte, bbssig.SignatureSize)
+	c.randBytes(signature)
+	to := target.to
+
+	return &pond.Request{
+		Deliver: &pond.Delivery{
+			To:         to[:],
+			Signature:  signature,
+			Generation: proto.Uint32(uint32(c.randId())),
+			Message:    message,
+			Cover:      proto.Bool(true),
+		},
+	}
+}
+
 // transactionRateSeconds is the mean of the exponential distribution that
 // we'll sample in order to distribute the time between our network
 // connections.
 const transactionRateSeconds = 300 // five minutes
 
+// burstTransactionRateSeconds is the mean of the exponential distribution
+// used by the burst scheduling policy when messages are queued for
+// transmission. Note that this means that an observer can tell when a burst
+// client has queued messages.
+const burstTransactionRateSeconds = 60 // one minute
+
+// lowPowerTransactionRateSeconds is the mean of the exponential distribution
+// used by the low-power scheduling policy.
+const lowPowerTransactionRateSeconds = 1800 // thirty minutes
+
+// transactionDelay samples the number of seconds to wait before the next
+// network transaction given a scheduling policy and the number of messages
+// queued for transmission.
+func transactionDelay(policy disk.State_SchedulingPolicy, queueLen int, r *mrand.Rand) float64 {
+	mean := float64(transactionRateSeconds)
+
+	switch policy {
+	case disk.State_BURST:
+		if queueLen > 0 {
+			mean = burstTransactionRateSeconds
+		}
+	case disk.State_LOW_POWER:
+		mean = lowPowerTransactionRateSeconds
+	}
+
+	return r.ExpFloat64() * mean
+}
+
+// transactionTimer returns a channel that receives a value when it's time for
+// the next network transaction.
+func (c *client) transactionTimer() <-chan time.Time {
+	var seedBytes [8]byte
+	c.randBytes(seedBytes[:])
+	seed := int64(binary.LittleEndian.Uint64(seedBytes[:]))
+	r := mrand.New(mrand.NewSource(seed))
+	c.queueMutex.Lock()
+	delay := transactionDelay(c.schedulingPolicy, len(c.queue), r)
+	c.queueMutex.Unlock()
+	if c.testing {
+		delay = 5
+	}
+	c.log.Printf("Next network transaction in %d seconds", int(delay))
+	return time.After(time.Duration(delay*1000) * time.Millisecond)
+}
+
 func (c *client) transact() {
 	startup := true
 
@@ -740,16 +862,7 @@ func (c *client) transact() {
 
 			var timerChan <-chan time.Time
 			if c.autoFetch {
-				var seedBytes [8]byte
-				c.randBytes(seedBytes[:])
-				seed := int64(binary.LittleEndian.Uint64(seedBytes[:]))
-				r := mrand.New(mrand.NewSource(seed))
-				delay := r.ExpFloat64() * transactionRateSeconds
-				if c.testing {
-					delay = 5
-				}
-				c.log.Printf("Next network transaction in %d seconds", int(delay))
-				timerChan = time.After(time.Duration(delay*1000) * time.Millisecond)
+				timerChan = c.transactionTimer()
 			}
 
 			// Revocation updates are always processed first.
@@ -781,6 +894,16 @@ func (c *client) transact() {
 				case <-timerChan:
 					c.log.Printf("Starting fetch because of timer")
 					break NextEvent
+				case <-c.queueChangedChan:
+					// The delay may depend on the length of the
+					// queue so it's sampled again. Since the
+					// delays are exponentially distributed,
+					// resampling doesn't change the distribution
+					// when the policy ignores the queue.
+					if c.autoFetch {
+						timerChan = c.transactionTimer()
+					}
+					continue NextEvent
 				case revUpdate, ok := <-c.revocationUpdateChan:
 					if !ok {
 						return
@@ -802,8 +925,15 @@ func (c *client) transact() {
 
 		useAnonymousIdentity := true
 		isFetch := false
+		isCover := false
 		c.queueMutex.Lock()
-		if len(c.queue) == 0 {
+		if len(c.coverTargets) > 0 && c.randId()%coverTrafficRatio == 0 {
+			isCover = true
+			target := c.coverTargets[c.randId()%uint64(len(c.coverTargets))]
+			req = c.coverDelivery(&target)
+			server = target.server
+			c.log.Printf("Starting cover delivery to %s", server)
+		} else if len(c.queue) == 0 {
 			useAnonymousIdentity = false
 			isFetch = true
 			req = &pond.Request{Fetch: &pond.Fetch{}}
@@ -841,14 +971,30 @@ func (c *client) transact() {
 			continue
 		}
 
+		if isCover {
+			conn.Close()
+			if err := replyToError(reply); err != nil {
+				c.log.Printf("Error from server %s for cover delivery: %s", server, err)
+			}
+			continue
+		}
+
 		if reply.Status == nil {
 			if isFetch && (reply.Fetched != nil || reply.Announce != nil) {
 				ackChan := make(chan bool)
 				c.newMessageChan <- NewMessage{reply.Fetched, reply.Announce, ackChan}
 				<-ackChan
 			} else if !isFetch {
+				// head is usually at the end of the queue but the
+				// queue may have been filtered while we were
+				// sending, e.g. if a contact was deleted.
 				c.queueMutex.Lock()
-				c.queue = c.queue[:len(c.queue)-1]
+				for i, m := range c.queue {
+					if m == head {
+						c.queue = append(c.queue[:i], c.queue[i+1:]...)
+						break
+					}
+				}
 				if len(c.queue) == 0 {
 					c.queue = nil
 				}
@@ -871,6 +1017,46 @@ func (c *client) transact() {
 	}
 }
 
+// requestFromHomeServer makes a single request of the home server and
+// returns the reply.
+func (c *client) requestFromHomeServer(request *pond.Request) (*pond.Reply, error) {
+	conn, err := c.dialServer(c.server, false)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.WriteProto(request); err != nil {
+		return nil, err
+	}
+	reply := new(pond.Reply)
+	if err := conn.ReadProto(reply); err != nil {
+		return nil, err
+	}
+	if err := replyToError(reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// listServerFiles returns the files that this account has stored on the home
+// server.
+func (c *client) listServerFiles() (*pond.FileList, error) {
+	reply, err := c.requestFromHomeServer(&pond.Request{ListFiles: &pond.ListFiles{}})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Files == nil {
+		return nil, errors.New("reply from server didn't include a file list")
+	}
+	return reply.Files, nil
+}
+
+func (c *client) deleteServerFile(id uint64) error {
+	_, err := c.requestFromHomeServer(&pond.Request{DeleteFile: &pond.DeleteFile{Id: proto.Uint64(id)}})
+	return err
+}
+
 type detachmentTransfer interface {
 	Request() *pond.Request
 	ProcessReply(*pond.Reply) (*os.File, bool, int64, bool, error)
@@ -881,13 +1067,25 @@ type uploadTransfer struct {
 	id    uint64
 	file  *os.File
 	total int64
+	// maxDownloads, if non-zero, limits the number of times that the
+	// file can be downloaded before the server deletes it.
+	maxDownloads uint32
+	// expiry is the time after which the file isn't needed.
+	expiry time.Time
 }
 
 func (ut uploadTransfer) Request() *pond.Request {
+	var maxDownloads *uint32
+	if ut.maxDownloads > 0 {
+		maxDownloads = proto.Uint32(ut.maxDownloads)
+	}
+
 	return &pond.Request{
 		Upload: &pond.Upload{
-			Id:   proto.Uint64(ut.id),
-			Size: proto.Int64(ut.total),
+			Id:           proto.Uint64(ut.id),
+			Size:         proto.Int64(ut.total),
+			Expiry:       proto.Int64(ut.expiry.Unix()),
+			MaxDownloads: maxDownloads,
 		},
 	}
 }
@@ -921,8 +1119,52 @@ func (ut uploadTransfer) Complete(conn *transport.Conn) bool {
 	return buf[0] == 0
 }
 
-func (c *client) uploadDetachment(out chan interface{}, in *os.File, id uint64, killChan chan bool) error {
-	transfer := uploadTransfer{file: in, id: id}
+// deliveryTarget contains the details needed to upload a file to the home
+// server of a contact. It's a copy so that it can be used from a background
+// goroutine.
+type deliveryTarget struct {
+	server     string
+	to         [32]byte
+	generation uint32
+	key        *bbssig.MemberKey
+}
+
+func (c *client) newDeliveryTarget(contactID uint64) (*deliveryTarget, error) {
+	contact, ok := c.contacts[contactID]
+	if !ok {
+		return nil, errors.New("recipient of upload has been deleted")
+	}
+	if contact.isPending || contact.revokedUs {
+		return nil, errors.New("cannot upload to the home server of " + contact.name)
+	}
+
+	key, _ := new(bbssig.MemberKey).Unmarshal(contact.myGroupKey.Group, contact.myGroupKey.Marshal())
+	return &deliveryTarget{
+		server:     contact.theirServer,
+		to:         contact.theirIdentityPublic,
+		generation: contact.generation,
+		key:        key,
+	}, nil
+}
+
+// deliveryTransfer is an upload to the home server of a contact. The upload
+// request is authorised with a group signature, as for a message delivery.
+type deliveryTransfer struct {
+	uploadTransfer
+	request *pond.Request
+}
+
+func (dt deliveryTransfer) Request() *pond.Request {
+	return dt.request
+}
+
+func (c *client) uploadDetachment(out chan interface{}, in *os.File, id uint64, maxDownloads uint32, target *deliveryTarget, killChan chan bool) error {
+	transfer := uploadTransfer{
+		file:         in,
+		id:           id,
+		maxDownloads: maxDownloads,
+		expiry:       time.Now().Add(uploadLifetime),
+	}
 
 	fi, err := in.Stat()
 	if err != nil {
@@ -930,7 +1172,33 @@ func (c *client) uploadDetachment(out chan interface{}, in *os.File, id uint64,
 	}
 	transfer.total = fi.Size()
 
-	return c.transferDetachment(out, c.server, transfer, id, killChan)
+	if target == nil {
+		return c.transferDetachment(out, c.server, transfer, id, killChan)
+	}
+
+	upload, err := proto.Marshal(transfer.Request().Upload)
+	if err != nil {
+		return err
+	}
+	sha := sha256.New()
+	sha.Write([]byte(pond.UploadForDeliveryPrefix))
+	sha.Write(upload)
+	digest := sha.Sum(nil)
+	sha.Reset()
+	groupSig, err := target.key.Sign(c.rand, digest, sha)
+	if err != nil {
+		return err
+	}
+
+	request := &pond.Request{
+		UploadForDelivery: &pond.UploadForDelivery{
+			To:         target.to[:],
+			Signature:  groupSig,
+			Generation: proto.Uint32(target.generation),
+			Upload:     upload,
+		},
+	}
+	return c.transferDetachment(out, target.server, deliveryTransfer{transfer, request}, id, killChan)
 }
 
 type downloadTransfer struct {
@@ -1043,12 +1311,16 @@ func (c *client) transferDetachment(out chan interface{}, server string, transfe
 	const maxBackoff = 5 * time.Minute
 	backoff := initialBackoff
 
+	// Uploads to a contact's server are authorised by a group signature,
+	// as deliveries are, so they mustn't reveal our identity either.
+	_, useAnonymousIdentity := transfer.(deliveryTransfer)
+
 	for {
 		sendStatus("Connecting")
 
-		conn, err := c.dialServer(server, false)
+		conn, err := c.dialServer(server, useAnonymousIdentity)
 		if err != nil {
-			c.log.Printf("Failed to connect to %s: %s", c.server, err)
+			c.log.Printf("Failed to connect to %s: %s", server, err)
 			sendStatus("Waiting to reconnect")
 
 			select {
@@ -1068,19 +1340,21 @@ func (c *client) transferDetachment(out chan interface{}, server string, transfe
 
 		sendStatus("Requesting transfer")
 		if err := conn.WriteProto(transfer.Request()); err != nil {
-			c.log.Printf("Failed to write request to %s: %s", c.server, err)
+			c.log.Printf("Failed to write request to %s: %s", server, err)
 			conn.Close()
 			continue
 		}
 
 		reply := new(pond.Reply)
 		if err := conn.ReadProto(reply); err != nil {
-			c.log.Printf("Failed to read reply from %s: %s", c.server, err)
+			c.log.Printf("Failed to read reply from %s: %s", server, err)
 			conn.Close()
 			continue
 		}
 
-		if reply.Status != nil && *reply.Status == pond.Reply_RESUME_PAST_END_OF_FILE {
+		if reply.Status != nil && (*reply.Status == pond.Reply_RESUME_PAST_END_OF_FILE || *reply.Status == pond.Reply_FILE_COMPLETE) {
+			// The transfer had already finished before it was
+			// interrupted.
 			conn.Close()
 			return nil
 		}
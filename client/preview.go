@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"unicode/utf8"
+)
+
+// maxPreviewTextLen is the number of bytes of a text attachment that are
+// shown in a preview.
+const maxPreviewTextLen = 64 * 1024
+
+// maxPreviewPixels limits the size of images that will be decoded for a
+// preview. Since the dimensions are taken from the untrusted image, this
+// bounds the memory that decoding can use.
+const maxPreviewPixels = 2048 * 2048
+
+// previewMaxDimension is the maximum width and height of a preview. Larger
+// images are scaled down to fit.
+const previewMaxDimension = 400
+
+type previewKind int
+
+const (
+	previewNone previewKind = iota
+	previewText
+	previewImage
+)
+
+// imageMagics contains the prefixes of the image formats that can be
+// previewed.
+var imageMagics = [][]byte{
+	[]byte("\x89PNG\r\n\x1a\n"),
+	[]byte("\xff\xd8\xff"),
+	[]byte("GIF87a"),
+	[]byte("GIF89a"),
+}
+
+// previewKindOf returns the type of preview that can be shown for contents.
+// Only the start of images is examined here: they are parsed by
+// decodePreview.
+func previewKindOf(contents []byte) previewKind {
+	for _, magic := range imageMagics {
+		if bytes.HasPrefix(contents, magic) {
+			return previewImage
+		}
+	}
+	if len(contents) > 0 && utf8.Valid(contents) && bytes.IndexByte(contents, 0) == -1 {
+		return previewText
+	}
+	return previewNone
+}
+
+// previewTextOf returns the text of a text attachment, truncated if it's too
+// long to be shown in full.
+func previewTextOf(contents []byte) string {
+	if len(contents) <= maxPreviewTextLen {
+		return string(contents)
+	}
+	end := maxPreviewTextLen
+	for end > 0 && !utf8.RuneStart(contents[end]) {
+		end--
+	}
+	return string(contents[:end]) + "\n\n(truncated)"
+}
+
+// PreviewDecoded is sent when the image in an attachment has been decoded for
+// a preview.
+type PreviewDecoded struct {
+	msgID uint64
+	index int
+	png   []byte
+	err   error
+}
+
+// startPreview decodes the image attachment at the given index of msg. The
+// image is untrusted so it's decoded in its own goroutine, away from the UI.
+func (c *client) startPreview(msg *InboxMessage, index int) {
+	msgID := msg.id
+	contents := msg.message.Files[index].Contents
+	go func() {
+		pngBytes, err := decodePreview(contents)
+		c.backgroundChan <- PreviewDecoded{msgID, index, pngBytes, err}
+	}()
+}
+
+// decodePreview decodes an image and returns it as a PNG, scaled down to fit
+// within previewMaxDimension. The result is only held in memory.
+func decodePreview(contents []byte) (pngBytes []byte, err error) {
+	defer func() {
+		// A bug in a decoder shouldn't take down the client.
+		if r := recover(); r != nil {
+			pngBytes = nil
+			err = fmt.Errorf("failed to decode image: %v", r)
+		}
+	}()
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, errors.New("image has no pixels")
+	}
+	if int64(config.Width)*int64(config.Height) > maxPreviewPixels {
+		return nil, errors.New("image is too large to preview")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, scaleToFit(img, previewMaxDimension)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// scaleToFit returns img, scaled down if needed so that neither dimension is
+// larger than max.
+func scaleToFit(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= max && height <= max {
+		return img
+	}
+
+	newWidth, newHeight := max, max
+	if width > height {
+		newHeight = height * max / width
+	} else {
+		newWidth = width * max / height
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+
+	// Nearest-neighbour sampling is sufficient for a preview.
+	out := image.NewNRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			out.Set(x, y, img.At(bounds.Min.X+x*width/newWidth, bounds.Min.Y+y*height/newHeight))
+		}
+	}
+	return out
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"github.com/agl/pond/client/secret"
+)
+
+// Messages to contacts that support ratchetVersion have the same layout as
+// version one messages, but the ephemeral public value in the header starts
+// a symmetric hash ratchet rather than being used for a single message:
+//
+//	[outer nonce - 24 bytes]
+//	[box(ephemeral public)] - as for version one
+//	[inner nonce - 24 bytes] - the first four bytes are the message
+//	                           counter, masked with the chain's header key.
+//	[secretbox(plaintext)]  - keyed by the message key.
+//
+// A sender starts a new chain whenever the contact's current DH value
+// changes and each message on a chain uses the next key from it. Old message
+// keys can't be derived from the current chain key so a compromise of the
+// ratchet state doesn't expose earlier messages.
+
+const (
+	// maxSkippedMessages is the greatest number of messages that may be
+	// skipped over in a single step of a receiving chain.
+	maxSkippedMessages = 1000
+	// maxSkippedKeys is the greatest number of skipped message keys that
+	// are stored for a contact. When full, the oldest are dropped.
+	maxSkippedKeys = 2000
+	// skippedKeyLifetime is the amount of time for which a skipped message
+	// key is kept.
+	skippedKeyLifetime = messageLifetime
+	// maxReceiveChains is the number of receiving chains that are kept
+	// for a contact so that delayed messages on earlier chains can be
+	// decrypted.
+	maxReceiveChains = 4
+)
+
+// ratchetChain is the state of one direction of a symmetric hash ratchet.
+type ratchetChain struct {
+	// public is the ephemeral public value that started the chain. It's
+	// sent in the header of each message on the chain.
+	public    [32]byte
+	key       [32]byte
+	headerKey [32]byte
+	// counter is the index of the next message on the chain.
+	counter uint32
+	// theirPublic is the contact's DH value that a sending chain was
+	// started with.
+	theirPublic [32]byte
+}
+
+// skippedKey is the key for a message on a receiving chain that was skipped
+// because a later message arrived first.
+type skippedKey struct {
+	public  [32]byte
+	counter uint32
+	key     [32]byte
+	expires time.Time
+}
+
+func ratchetKDF(key []byte, label string) (out [32]byte) {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	copy(out[:], h.Sum(nil))
+	return
+}
+
+// newRatchetChain returns a chain that's identified by public and keyed by
+// the DH shared secret, shared.
+func newRatchetChain(public, shared *[32]byte) *ratchetChain {
+	return &ratchetChain{
+		public:    *public,
+		key:       ratchetKDF(shared[:], "pond chain key"),
+		headerKey: ratchetKDF(shared[:], "pond header key"),
+	}
+}
+
+// step returns the key for the message at chain.counter and advances the
+// chain.
+func (chain *ratchetChain) step() (messageKey [32]byte) {
+	messageKey = ratchetKDF(chain.key[:], "pond message key")
+	chain.key = ratchetKDF(chain.key[:], "pond next chain key")
+	chain.counter++
+	return
+}
+
+// counterMask returns the value that a message counter is XORed with in
+// order to hide it from the server. The outer nonce is random for each
+// message so the masks are unique.
+func counterMask(headerKey *[32]byte, outerNonce *[24]byte) uint32 {
+	h := hmac.New(sha256.New, headerKey[:])
+	h.Write(outerNonce[:])
+	return binary.LittleEndian.Uint32(h.Sum(nil))
+}
+
+// sealRatchet encrypts plaintext to contact using the next key from the
+// current sending chain, starting a new chain if needed.
+func (c *client) sealRatchet(to *Contact, plaintext []byte) ([]byte, error) {
+	chain := to.sendChain
+	if chain == nil || chain.theirPublic != to.theirCurrentDHPublic {
+		public, private, err := box.GenerateKey(c.rand)
+		if err != nil {
+			return nil, err
+		}
+		var shared [32]byte
+		box.Precompute(&shared, &to.theirCurrentDHPublic, private)
+		secret.Wipe(private[:])
+		chain = newRatchetChain(public, &shared)
+		secret.Wipe(shared[:])
+		chain.theirPublic = to.theirCurrentDHPublic
+		if to.sendChain != nil {
+			to.sendChain.wipe()
+		}
+		to.sendChain = chain
+	}
+
+	var outerNonce, innerNonce [24]byte
+	c.randBytes(outerNonce[:])
+	c.randBytes(innerNonce[:])
+	binary.LittleEndian.PutUint32(innerNonce[:4], chain.counter^counterMask(&chain.headerKey, &outerNonce))
+	messageKey := chain.step()
+	defer secret.Wipe(messageKey[:])
+
+	sealed := make([]byte, ephemeralBlockLen+nonceLen, ephemeralBlockLen+nonceLen+len(plaintext)+secretbox.Overhead)
+	copy(sealed, outerNonce[:])
+	box.Seal(sealed[nonceLen:nonceLen], chain.public[:], &outerNonce, &to.theirCurrentDHPublic, &to.lastDHPrivate)
+	copy(sealed[ephemeralBlockLen:], innerNonce[:])
+	return secretbox.Seal(sealed, plaintext, &innerNonce, &messageKey), nil
+}
+
+// openRatchet attempts to decrypt the body of a message that was encrypted
+// by sealRatchet. The ephemeral public value from the header is public and
+// dhPrivate is our DH private value that the header was encrypted to. The
+// contact's ratchet state is only updated if decryption is successful.
+func (contact *Contact) openRatchet(sealed []byte, outerNonce, innerNonce *[24]byte, public, dhPrivate *[32]byte) ([]byte, bool) {
+	var chain *ratchetChain
+	for _, candidate := range contact.receiveChains {
+		if candidate.public == *public {
+			chain = candidate
+			break
+		}
+	}
+	isNew := chain == nil
+	if isNew {
+		var shared [32]byte
+		box.Precompute(&shared, public, dhPrivate)
+		chain = newRatchetChain(public, &shared)
+		secret.Wipe(shared[:])
+	}
+
+	counter := binary.LittleEndian.Uint32(innerNonce[:4]) ^ counterMask(&chain.headerKey, outerNonce)
+
+	if counter < chain.counter {
+		// This message was delayed so its key should have been saved
+		// when a later message arrived.
+		for i, skipped := range contact.skippedKeys {
+			if skipped.public != *public || skipped.counter != counter {
+				continue
+			}
+			plaintext, ok := secretbox.Open(nil, sealed, innerNonce, &skipped.key)
+			if ok {
+				n := len(contact.skippedKeys)
+				contact.skippedKeys[i].wipe()
+				copy(contact.skippedKeys[i:], contact.skippedKeys[i+1:])
+				contact.skippedKeys[n-1].wipe()
+				contact.skippedKeys = contact.skippedKeys[:n-1]
+			}
+			return plaintext, ok
+		}
+		return nil, false
+	}
+	if counter-chain.counter > maxSkippedMessages {
+		return nil, false
+	}
+
+	next := *chain
+	var skipped []skippedKey
+	now := time.Now()
+	for next.counter < counter {
+		key := skippedKey{
+			public:  *public,
+			counter: next.counter,
+			expires: now.Add(skippedKeyLifetime),
+		}
+		key.key = next.step()
+		skipped = append(skipped, key)
+	}
+	messageKey := next.step()
+	plaintext, ok := secretbox.Open(nil, sealed, innerNonce, &messageKey)
+	secret.Wipe(messageKey[:])
+	if !ok {
+		next.wipe()
+		for i := range skipped {
+			skipped[i].wipe()
+		}
+		if isNew {
+			chain.wipe()
+		}
+		return nil, false
+	}
+
+	*chain = next
+	next.wipe()
+	if isNew {
+		contact.receiveChains = append(contact.receiveChains, chain)
+		if n := len(contact.receiveChains); n > maxReceiveChains {
+			for _, old := range contact.receiveChains[:n-maxReceiveChains] {
+				old.wipe()
+			}
+			contact.receiveChains = contact.receiveChains[n-maxReceiveChains:]
+		}
+	}
+	contact.skippedKeys = append(contact.skippedKeys, skipped...)
+	contact.expireSkippedKeys(now)
+
+	return plaintext, true
+}
+
+// expireSkippedKeys removes, and wipes, skipped message keys that have
+// expired and then the oldest keys until no more than maxSkippedKeys remain.
+func (contact *Contact) expireSkippedKeys(now time.Time) {
+	all := contact.skippedKeys
+	keys := all[:0]
+	for i := range all {
+		if now.Before(all[i].expires) {
+			keys = append(keys, all[i])
+		}
+	}
+	if n := len(keys); n > maxSkippedKeys {
+		for i := range keys[:n-maxSkippedKeys] {
+			keys[i].wipe()
+		}
+		keys = append(keys[:0], keys[n-maxSkippedKeys:]...)
+	}
+	// Clear the keys that are no longer in use, including the
+	// duplicates left at the end of the underlying array.
+	for i := len(keys); i < len(all); i++ {
+		all[i].wipe()
+	}
+	contact.skippedKeys = keys
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// replayCacheLifetime is the amount of time for which a received
+	// message is remembered in order to drop replays of it. It's longer
+	// than messageLifetime so that replays are caught after the message
+	// has been erased from the inbox.
+	replayCacheLifetime = 4 * messageLifetime
+	// maxReplayCacheEntries bounds the size of the replay cache. When
+	// full, the oldest entries are dropped.
+	maxReplayCacheEntries = 16384
+	// replayHashLen is the number of bytes of hash stored for each
+	// message.
+	replayHashLen = 16
+	// maxClockSkew is the amount by which a message's time may be in the
+	// future before it's flagged.
+	maxClockSkew = 24 * time.Hour
+)
+
+type replayHash [replayHashLen]byte
+
+type replayEntry struct {
+	hash replayHash
+	// time is when the message was received.
+	time time.Time
+}
+
+// replayCache remembers the messages that have been received recently. A
+// server can replay a message to us at any time so, once a message has
+// been removed from the inbox, the cache is the only way to notice. The
+// cache is bounded in time and size and messages older than its window are
+// flagged instead.
+type replayCache struct {
+	// entries is ordered by receipt time, oldest first.
+	entries []replayEntry
+	seen    map[replayHash]bool
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[replayHash]bool)}
+}
+
+// messageReplayHash returns the value that identifies a message with the
+// given id from the given contact in the replay cache.
+func messageReplayHash(contactID, msgID uint64) (h replayHash) {
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], contactID)
+	binary.LittleEndian.PutUint64(buf[8:], msgID)
+
+	sha := sha256.New()
+	sha.Write([]byte("pond replay\x00"))
+	sha.Write(buf[:])
+	copy(h[:], sha.Sum(nil))
+	return
+}
+
+func (rc *replayCache) contains(h replayHash) bool {
+	return rc.seen[h]
+}
+
+// add records h as having been received at time now.
+func (rc *replayCache) add(h replayHash, now time.Time) {
+	if rc.seen[h] {
+		return
+	}
+	rc.entries = append(rc.entries, replayEntry{h, now})
+	rc.seen[h] = true
+	rc.expire(now)
+}
+
+// expire removes entries that are older than replayCacheLifetime and then
+// the oldest entries until the cache is within maxReplayCacheEntries.
+func (rc *replayCache) expire(now time.Time) {
+	n := 0
+	for n < len(rc.entries) && (len(rc.entries)-n > maxReplayCacheEntries || now.Sub(rc.entries[n].time) > replayCacheLifetime) {
+		delete(rc.seen, rc.entries[n].hash)
+		n++
+	}
+	if n > 0 {
+		rc.entries = append([]replayEntry(nil), rc.entries[n:]...)
+	}
+}
+
+// oldMessageWarning returns a warning to display with msg if its creation
+// time means that it could be a replay that the replay cache wouldn't have
+// caught, or the empty string otherwise.
+func oldMessageWarning(msg *InboxMessage) string {
+	if msg.message == nil || msg.from == 0 {
+		return ""
+	}
+	created := time.Unix(msg.message.GetTime(), 0)
+	switch {
+	case msg.receivedTime.Sub(created) > replayCacheLifetime:
+		return "This message is abnormally old and may have been replayed by a server"
+	case created.Sub(msg.receivedTime) > maxClockSkew:
+		return "This message claims to have been sent in the future"
+	}
+	return ""
+}
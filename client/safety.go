@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+)
+
+// safetyNumberGroups is the number of five digit groups in a safety number.
+const safetyNumberGroups = 12
+
+// safetyNumberGridSize is the width and height, in cells, of the visual
+// encoding of a safety number.
+const safetyNumberGridSize = 16
+
+// safetyNumberHash hashes a pair of Ed25519 public keys. The keys are sorted
+// first so that both parties to a conversation calculate the same value.
+func safetyNumberHash(a, b *[32]byte) []byte {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+
+	h := sha512.New()
+	h.Write([]byte("pond safety number\x00"))
+	h.Write(a[:])
+	h.Write(b[:])
+	return h.Sum(nil)
+}
+
+// safetyNumber returns a human-comparable fingerprint of the two public keys,
+// formatted as three lines of four, five digit groups.
+func safetyNumber(a, b *[32]byte) string {
+	digest := safetyNumberHash(a, b)
+
+	var out bytes.Buffer
+	for i := 0; i < safetyNumberGroups; i++ {
+		var v uint64
+		for _, b := range digest[i*5 : (i+1)*5] {
+			v = v<<8 | uint64(b)
+		}
+		fmt.Fprintf(&out, "%05d", v%100000)
+
+		switch {
+		case i == safetyNumberGroups-1:
+		case i%4 == 3:
+			out.WriteByte('\n')
+		default:
+			out.WriteByte(' ')
+		}
+	}
+
+	return out.String()
+}
+
+// safetyNumberGrid returns a QR-like, block graphic rendering of the safety
+// number for the two public keys. It's intended to be compared side by side
+// when meeting in person, which is quicker than reading out sixty digits. The
+// pattern is mirrored left-to-right to make it easier to compare by eye.
+func safetyNumberGrid(a, b *[32]byte) string {
+	// The digits of the safety number use the first 60 bytes of the hash
+	// so the grid is taken from a second hash in order to have enough bits.
+	h := sha512.New()
+	h.Write(safetyNumberHash(a, b))
+	digest := h.Sum(nil)
+
+	const half = safetyNumberGridSize / 2
+	var out bytes.Buffer
+	for y := 0; y < safetyNumberGridSize; y++ {
+		row := digest[y]
+		var cells [safetyNumberGridSize]bool
+		for x := 0; x < half; x++ {
+			set := row&(1<<uint(x)) != 0
+			cells[x] = set
+			cells[safetyNumberGridSize-1-x] = set
+		}
+		for _, set := range cells {
+			if set {
+				out.WriteString("██")
+			} else {
+				out.WriteString("  ")
+			}
+		}
+		if y != safetyNumberGridSize-1 {
+			out.WriteByte('\n')
+		}
+	}
+
+	return out.String()
+}
+
+// unverifiedWarning returns a warning to display when communicating with
+// contact, or the empty string if the contact has been verified.
+func unverifiedWarning(contact *Contact) string {
+	if contact == nil || contact.verified {
+		return ""
+	}
+	return "Unverified contact: compare safety numbers to verify " + contact.name
+}
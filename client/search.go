@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+)
+
+// searchState is the required value of a boolean property of a message in a
+// search query.
+type searchState int
+
+const (
+	searchAny searchState = iota
+	searchYes
+	searchNo
+)
+
+func (s searchState) matches(applicable, value bool) bool {
+	switch s {
+	case searchYes:
+		return applicable && value
+	case searchNo:
+		return applicable && !value
+	}
+	return true
+}
+
+// searchQuery is a parsed query from the search entry in the main UI.
+// Searches are performed by scanning the in-memory messages and drafts: no
+// index is built and so nothing derived from message contents is ever
+// written to disk.
+type searchQuery struct {
+	// contact, if not empty, is a lower-case substring that must be found
+	// in the name of the message's contact.
+	contact string
+	// after and before, if not zero, limit the time of the message.
+	after, before time.Time
+	read, acked   searchState
+	hasAttachment bool
+	// words contains lower-case strings that must all be found in the
+	// body of the message.
+	words []string
+}
+
+// searchDateFormat is the format of dates in after: and before: terms.
+const searchDateFormat = "2006-01-02"
+
+// parseSearchQuery parses a space separated list of search terms. Terms
+// without a prefix are searched for in message bodies and the following are
+// also understood:
+//
+//	from:NAME, to:NAME, contact:NAME   messages with a matching contact
+//	after:YYYY-MM-DD, before:YYYY-MM-DD
+//	is:read, is:unread, is:acked, is:unacked
+//	has:attachment
+//
+// It returns nil if the query is empty.
+func parseSearchQuery(s string) (*searchQuery, error) {
+	terms := strings.Fields(s)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	q := new(searchQuery)
+	for _, term := range terms {
+		i := strings.Index(term, ":")
+		if i == -1 {
+			q.words = append(q.words, strings.ToLower(term))
+			continue
+		}
+		key, value := strings.ToLower(term[:i]), term[i+1:]
+
+		var err error
+		switch key {
+		case "from", "to", "contact":
+			q.contact = strings.ToLower(value)
+		case "after":
+			if q.after, err = time.ParseInLocation(searchDateFormat, value, time.Local); err != nil {
+				return nil, errors.New("bad date in search: " + value)
+			}
+		case "before":
+			if q.before, err = time.ParseInLocation(searchDateFormat, value, time.Local); err != nil {
+				return nil, errors.New("bad date in search: " + value)
+			}
+		case "is":
+			switch strings.ToLower(value) {
+			case "read":
+				q.read = searchYes
+			case "unread":
+				q.read = searchNo
+			case "acked":
+				q.acked = searchYes
+			case "unacked":
+				q.acked = searchNo
+			default:
+				return nil, errors.New("unknown search term: " + term)
+			}
+		case "has":
+			if strings.ToLower(value) != "attachment" {
+				return nil, errors.New("unknown search term: " + term)
+			}
+			q.hasAttachment = true
+		default:
+			// Not a known prefix, so treat it as text, e.g. a URL.
+			q.words = append(q.words, strings.ToLower(term))
+		}
+	}
+
+	return q, nil
+}
+
+// searchable contains the properties of a message or draft that can be
+// searched for.
+type searchable struct {
+	contact string
+	time    time.Time
+	// canRead and canAck are false when read and acked, respectively,
+	// don't apply to the message.
+	canRead, read bool
+	canAck, acked bool
+	hasAttachment bool
+	body          []byte
+}
+
+func (q *searchQuery) matches(s *searchable) bool {
+	if len(q.contact) > 0 && !strings.Contains(strings.ToLower(s.contact), q.contact) {
+		return false
+	}
+	if !q.after.IsZero() && s.time.Before(q.after) {
+		return false
+	}
+	if !q.before.IsZero() && !s.time.Before(q.before) {
+		return false
+	}
+	if !q.read.matches(s.canRead, s.read) || !q.acked.matches(s.canAck, s.acked) {
+		return false
+	}
+	if q.hasAttachment && !s.hasAttachment {
+		return false
+	}
+	if len(q.words) > 0 {
+		body := bytes.ToLower(s.body)
+		for _, word := range q.words {
+			if !bytes.Contains(body, []byte(word)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *client) contactName(id uint64) string {
+	if contact, ok := c.contacts[id]; ok {
+		return contact.name
+	}
+	return ""
+}
+
+func (c *client) inboxSearchable(msg *InboxMessage) *searchable {
+	s := &searchable{
+		time:    msg.receivedTime,
+		canRead: true,
+		read:    msg.read,
+		canAck:  true,
+		acked:   msg.acked,
+	}
+	if msg.from == 0 {
+		s.contact = "Home Server"
+	} else {
+		s.contact = c.contactName(msg.from)
+	}
+	if msg.message != nil {
+		s.time = time.Unix(*msg.message.Time, 0)
+		s.hasAttachment = len(msg.message.Files) > 0 || len(msg.message.DetachedFiles) > 0
+		s.body = msg.message.Body
+	}
+	return s
+}
+
+func (c *client) outboxSearchable(msg *queuedMessage) *searchable {
+	s := &searchable{
+		contact: c.contactName(msg.to),
+		time:    msg.created,
+		canAck:  !msg.revocation,
+		acked:   !msg.acked.IsZero(),
+	}
+	if msg.message != nil {
+		s.hasAttachment = len(msg.message.Files) > 0 || len(msg.message.DetachedFiles) > 0
+		s.body = msg.message.Body
+	}
+	return s
+}
+
+func (c *client) draftSearchable(draft *Draft) *searchable {
+	return &searchable{
+		contact:       c.contactName(draft.to),
+		time:          draft.created,
+		hasAttachment: len(draft.attachments) > 0 || len(draft.detachments) > 0,
+		body:          []byte(draft.body),
+	}
+}
+
+// search parses query and filters the inbox, outbox and drafts lists to show
+// only matching entries.
+func (c *client) search(query string) {
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		c.ui.Actions() <- SetText{name: "searcherror", text: err.Error()}
+	} else {
+		c.ui.Actions() <- SetText{name: "searcherror", text: ""}
+		c.searchQuery = q
+		c.applySearch()
+	}
+	c.ui.Actions() <- UIState{uiStateSearched}
+	c.ui.Signal()
+}
+
+// applySearch filters the inbox, outbox and drafts lists with the current
+// search query.
+func (c *client) applySearch() {
+	q := c.searchQuery
+	if q == nil {
+		c.inboxUI.Filter(nil)
+		c.outboxUI.Filter(nil)
+		c.draftsUI.Filter(nil)
+		return
+	}
+
+	inbox := make(map[uint64]*InboxMessage)
+	for _, msg := range c.inbox {
+		inbox[msg.id] = msg
+	}
+	c.inboxUI.Filter(func(id uint64) bool {
+		msg, ok := inbox[id]
+		return ok && q.matches(c.inboxSearchable(msg))
+	})
+
+	outbox := make(map[uint64]*queuedMessage)
+	for _, msg := range c.outbox {
+		outbox[msg.id] = msg
+	}
+	c.outboxUI.Filter(func(id uint64) bool {
+		msg, ok := outbox[id]
+		return ok && q.matches(c.outboxSearchable(msg))
+	})
+
+	c.draftsUI.Filter(func(id uint64) bool {
+		draft, ok := c.drafts[id]
+		return ok && q.matches(c.draftSearchable(draft))
+	})
+}
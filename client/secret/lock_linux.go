@@ -0,0 +1,15 @@
+package secret
+
+import (
+	"syscall"
+)
+
+// Lock attempts to prevent the memory pages that contain b from being
+// swapped to disk. It returns false if that isn't possible, for example
+// because the process has reached its limit of locked memory.
+func Lock(b []byte) bool {
+	if len(b) == 0 {
+		return true
+	}
+	return syscall.Mlock(b) == nil
+}
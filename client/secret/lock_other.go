@@ -0,0 +1,10 @@
+// +build !linux
+
+package secret
+
+// Lock attempts to prevent the memory pages that contain b from being
+// swapped to disk. It's not supported on this platform and always returns
+// false.
+func Lock(b []byte) bool {
+	return false
+}
@@ -0,0 +1,40 @@
+// Package secret contains helpers for handling secret values, such as keys
+// and decrypted messages, in memory.
+//
+// Go's garbage collector may move and copy values, so wiping a value can't
+// guarantee that no copies of it remain. But wiping values when they're no
+// longer needed greatly reduces the number of secrets that can be recovered
+// from the memory of the process, or from swap, at a later time.
+package secret
+
+import (
+	"math/big"
+)
+
+// Wipe overwrites b with zeros.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// WipeInt overwrites the value of x with zeros and sets x to zero.
+func WipeInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+	words := x.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	x.SetInt64(0)
+}
+
+// IsZero returns true if b contains only zeros.
+func IsZero(b []byte) bool {
+	var v byte
+	for _, x := range b {
+		v |= x
+	}
+	return v == 0
+}
@@ -0,0 +1,38 @@
+package secret
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestWipe(t *testing.T) {
+	b := []byte("secret")
+	Wipe(b)
+	if !IsZero(b) {
+		t.Errorf("buffer not cleared: %x", b)
+	}
+}
+
+func TestWipeInt(t *testing.T) {
+	x := new(big.Int).Lsh(big.NewInt(0x1234), 200)
+	words := x.Bits()
+	WipeInt(x)
+	if x.Sign() != 0 {
+		t.Errorf("value not zero after wiping: %s", x)
+	}
+	for i, w := range words[:cap(words)] {
+		if w != 0 {
+			t.Errorf("word %d not cleared: %x", i, w)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	// Locking may fail because of resource limits but it must not
+	// disturb the contents.
+	b := []byte("secret")
+	Lock(b)
+	if string(b) != "secret" {
+		t.Errorf("locking changed the buffer")
+	}
+}
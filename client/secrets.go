@@ -0,0 +1,113 @@
+package main
+
+import (
+	"time"
+
+	"github.com/agl/pond/client/secret"
+)
+
+// lockSecrets attempts to keep the long-lived secrets of the client out of
+// swap. It's best effort: the limit on locked memory is often small.
+func (c *client) lockSecrets() {
+	secret.Lock(c.diskKey[:])
+	secret.Lock(c.identity[:])
+	secret.Lock(c.priv[:])
+}
+
+func (chain *ratchetChain) wipe() {
+	secret.Wipe(chain.key[:])
+	secret.Wipe(chain.headerKey[:])
+}
+
+func (skipped *skippedKey) wipe() {
+	secret.Wipe(skipped.key[:])
+}
+
+// wipe overwrites the secret values held for contact. It's called when the
+// contact is deleted.
+func (contact *Contact) wipe() {
+	secret.Wipe(contact.lastDHPrivate[:])
+	secret.Wipe(contact.currentDHPrivate[:])
+	secret.Wipe(contact.kxsBytes)
+	if contact.myGroupKey != nil {
+		contact.myGroupKey.Wipe()
+	}
+	if contact.sendChain != nil {
+		contact.sendChain.wipe()
+	}
+	for _, chain := range contact.receiveChains {
+		chain.wipe()
+	}
+	for i := range contact.skippedKeys {
+		contact.skippedKeys[i].wipe()
+	}
+	contact.sendChain, contact.receiveChains, contact.skippedKeys = nil, nil, nil
+}
+
+// wipe overwrites the contents of msg, both sealed and decrypted.
+func (msg *InboxMessage) wipe() {
+	secret.Wipe(msg.sealed)
+	msg.sealed = nil
+	if msg.message == nil {
+		return
+	}
+	secret.Wipe(msg.message.Body)
+	for _, file := range msg.message.Files {
+		secret.Wipe(file.Contents)
+	}
+	for _, detachment := range msg.message.DetachedFiles {
+		secret.Wipe(detachment.Key)
+	}
+	msg.message = nil
+}
+
+// expireSecrets removes and wipes the inbox messages and previous group
+// private keys that have passed their lifetimes. Otherwise they would only
+// be omitted from the state file and would linger in memory. It returns the
+// ids of the removed inbox messages that were listed in the inbox UI.
+func (c *client) expireSecrets(now time.Time) (expiredInbox []uint64) {
+	inbox := c.inbox[:0]
+	for _, msg := range c.inbox {
+		if now.Sub(msg.receivedTime) > messageLifetime {
+			msg.cancelDecryptions(c.log)
+			msg.eraseStaged(c.log)
+			// Acks and receipts aren't listed in the inbox UI.
+			if msg.message == nil || len(msg.message.Body) > 0 {
+				expiredInbox = append(expiredInbox, msg.id)
+			}
+			msg.wipe()
+			continue
+		}
+		inbox = append(inbox, msg)
+	}
+	for i := len(inbox); i < len(c.inbox); i++ {
+		c.inbox[i] = nil
+	}
+	c.inbox = inbox
+
+	prevGroupPrivs := c.prevGroupPrivs[:0]
+	for _, prev := range c.prevGroupPrivs {
+		if now.Sub(prev.expired) > previousTagLifetime {
+			prev.priv.Wipe()
+			continue
+		}
+		prevGroupPrivs = append(prevGroupPrivs, prev)
+	}
+	c.prevGroupPrivs = prevGroupPrivs
+
+	for _, contact := range c.contacts {
+		contact.expireSkippedKeys(now)
+	}
+
+	return
+}
+
+// inInbox returns true iff msg hasn't been removed from the inbox.
+func (c *client) inInbox(msg *InboxMessage) bool {
+	for _, candidate := range c.inbox {
+		if candidate == msg {
+			return true
+		}
+	}
+	return false
+}
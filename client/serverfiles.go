@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pond "github.com/agl/pond/protos"
+)
+
+// ServerFilesListed is sent when a listing of the files stored on the home
+// server has been received.
+type ServerFilesListed struct {
+	files *pond.FileList
+	err   error
+}
+
+// ServerFileDeleted is sent when a request to delete a file from the home
+// server has completed.
+type ServerFileDeleted struct {
+	id  uint64
+	err error
+}
+
+func (c *client) startListServerFiles() {
+	go func() {
+		files, err := c.listServerFiles()
+		c.backgroundChan <- ServerFilesListed{files, err}
+	}()
+}
+
+func (c *client) startDeleteServerFile(id uint64) {
+	go func() {
+		c.backgroundChan <- ServerFileDeleted{id, c.deleteServerFile(id)}
+	}()
+}
+
+// serverFileUse describes what the file with the given id, on the home
+// server, is used for by reconciling it with the client's drafts, transfers,
+// outbox and, for files that contacts uploaded for us, inbox.
+func (c *client) serverFileUse(id uint64) string {
+	url := c.buildDetachmentURL(id)
+
+	for _, draft := range c.drafts {
+		if pending, ok := draft.pendingDetachments[id]; ok && pending.upload {
+			return "Upload of " + pending.path
+		}
+		for _, detachment := range draft.detachments {
+			if detachment.GetUrl() == url {
+				return detachment.GetFilename() + " in a draft"
+			}
+		}
+	}
+
+	for _, msg := range c.outbox {
+		if msg.message == nil {
+			continue
+		}
+		for _, detachment := range msg.message.DetachedFiles {
+			if detachment.GetUrl() != url {
+				continue
+			}
+			to := "unknown"
+			if contact, ok := c.contacts[msg.to]; ok {
+				to = contact.name
+			}
+			return detachment.GetFilename() + " sent to " + to
+		}
+	}
+
+	for _, msg := range c.inbox {
+		if msg.message == nil {
+			continue
+		}
+		for _, detachment := range msg.message.DetachedFiles {
+			if detachment.GetUrl() != url {
+				continue
+			}
+			from := "unknown"
+			if contact, ok := c.contacts[msg.from]; ok {
+				from = contact.name
+			}
+			return detachment.GetFilename() + " from " + from
+		}
+	}
+
+	return "Unknown"
+}
+
+// serverFilesWidget shows a listing of the files stored on the home server.
+func (c *client) serverFilesWidget(files *pond.FileList) Widget {
+	grid := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 3,
+		colSpacing: 10,
+		rows: [][]GridE{
+			{
+				{6, 1, Label{
+					widgetBase: widgetBase{name: "quota", marginBottom: 10},
+					text:       fmt.Sprintf("%d of %d files, %d of %d bytes", files.GetCount(), files.GetMaxCount(), files.GetSize(), files.GetMaxSize()),
+				}},
+			},
+		},
+	}
+
+	if len(files.Files) == 0 {
+		grid.rows = append(grid.rows, []GridE{
+			{6, 1, Label{text: "No files are stored on the server."}},
+		})
+		return grid
+	}
+
+	header := func(text string) GridE {
+		return GridE{1, 1, Label{
+			widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground},
+			text:       text,
+		}}
+	}
+	grid.rows = append(grid.rows, []GridE{header("FILE"), header("SIZE"), header("UPLOADED"), header("EXPIRES"), header("DOWNLOADS LEFT"), {1, 1, Label{}}})
+
+	for _, file := range files.Files {
+		expires := ""
+		if file.Expiry != nil {
+			expires = time.Unix(*file.Expiry, 0).Format(shortTimeFormat)
+		}
+		downloads := ""
+		if file.DownloadsRemaining != nil {
+			downloads = strconv.FormatUint(uint64(*file.DownloadsRemaining), 10)
+		}
+		grid.rows = append(grid.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{hExpand: true},
+				text:       c.serverFileUse(file.GetId()),
+			}},
+			{1, 1, Label{text: strconv.FormatInt(file.GetSize(), 10)}},
+			{1, 1, Label{text: time.Unix(file.GetModified(), 0).Format(shortTimeFormat)}},
+			{1, 1, Label{text: expires}},
+			{1, 1, Label{
+				widgetBase: widgetBase{name: fmt.Sprintf("serverfile-downloads-%x", file.GetId())},
+				text:       downloads,
+			}},
+			{1, 1, Button{
+				widgetBase: widgetBase{name: fmt.Sprintf("serverfile-delete-%x", file.GetId())},
+				text:       "Delete",
+			}},
+		})
+	}
+
+	return grid
+}
+
+// serverFilesUI shows the files that are stored on the home server and lets
+// the user delete them.
+func (c *client) serverFilesUI() interface{} {
+	var child Widget = Label{
+		widgetBase: widgetBase{margin: 6},
+		text:       "Fetching the list of files from the server...",
+	}
+	if c.serverFiles != nil {
+		child = c.serverFilesWidget(c.serverFiles)
+	}
+	c.ui.Actions() <- SetChild{name: "right", child: rightPane("SERVER FILES", nil, nil, child)}
+	c.ui.Signal()
+
+	c.startListServerFiles()
+
+	for {
+		event, wanted := c.nextEvent()
+		if wanted {
+			return event
+		}
+
+		switch e := event.(type) {
+		case ServerFilesListed:
+			var child Widget
+			if e.err != nil {
+				c.log.Errorf("Failed to list files on server: %s", e.err)
+				child = Label{
+					widgetBase: widgetBase{margin: 6, foreground: colorRed},
+					text:       "Failed to list files: " + e.err.Error(),
+				}
+			} else {
+				c.serverFiles = e.files
+				child = c.serverFilesWidget(e.files)
+			}
+			c.ui.Actions() <- SetChild{name: "right", child: rightPane("SERVER FILES", nil, nil, child)}
+			c.ui.Actions() <- UIState{uiStateServerFiles}
+			c.ui.Signal()
+		case ServerFileDeleted:
+			if e.err != nil {
+				c.log.Errorf("Failed to delete file %x from server: %s", e.id, e.err)
+			} else {
+				c.log.Printf("Deleted file %x from server", e.id)
+			}
+			// Fetch the list again to show the updated quota.
+			return c.serverFilesUI()
+		case Click:
+			const prefix = "serverfile-delete-"
+			if !strings.HasPrefix(e.name, prefix) {
+				continue
+			}
+			id, err := strconv.ParseUint(e.name[len(prefix):], 16, 64)
+			if err != nil {
+				panic(e.name)
+			}
+			c.ui.Actions() <- Sensitive{name: e.name, sensitive: false}
+			c.ui.Signal()
+			c.startDeleteServerFile(id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// rlimitMemlock is RLIMIT_MEMLOCK, which the syscall package doesn't
+// define.
+const rlimitMemlock = 8
+
+// memoryLocked is true if Harden has locked all the memory of the process,
+// in which case swap can't leak secrets.
+var memoryLocked bool
+
+// Harden tries to stop secrets in memory from reaching the disk. It disables
+// core dumps and, if the limit on locked memory allows it, locks all current
+// and future memory of the process. Whether any remaining exposure is a
+// problem is left for IsSafe to report.
+func Harden() error {
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		return errors.New("system: while disabling core dumps: " + err.Error())
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0); errno != 0 {
+		return errors.New("system: while disabling core dumps: " + errno.Error())
+	}
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(rlimitMemlock, &limit); err != nil {
+		return errors.New("system: while getting the locked memory limit: " + err.Error())
+	}
+	if limit.Cur != ^uint64(0) {
+		// Once future allocations are locked, any that would exceed
+		// the limit fail, and the Go runtime can't survive that.
+		return fmt.Errorf("system: cannot lock memory with a limit of %d bytes", limit.Cur)
+	}
+	if err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE); err != nil {
+		return errors.New("system: while locking memory: " + err.Error())
+	}
+	memoryLocked = true
+
+	return nil
+}
+
+// checkCoreDumps returns an error if a crash would write a core dump.
+func checkCoreDumps() error {
+	dumpable, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_GET_DUMPABLE, 0, 0)
+	if errno != 0 {
+		return errors.New("while checking whether core dumps are enabled: " + errno.Error())
+	}
+	if dumpable == 0 {
+		return nil
+	}
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit); err != nil {
+		return errors.New("while checking whether core dumps are enabled: " + err.Error())
+	}
+	if limit.Cur == 0 {
+		return nil
+	}
+	return errors.New("core dumps are enabled and would contain secrets if Pond crashed")
+}
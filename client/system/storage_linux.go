@@ -0,0 +1,123 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// copyOnWriteFilesystems contains the filesystems that don't overwrite files
+// in place, or that keep snapshots, and so may retain old copies of the state
+// file.
+var copyOnWriteFilesystems = map[string]bool{
+	"btrfs":  true,
+	"nilfs2": true,
+	"zfs":    true,
+}
+
+type mount struct {
+	device, path, filesystem string
+}
+
+// parseMount parses a line from /proc/mounts.
+func parseMount(line string) (m mount, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return
+	}
+	m.device = unescapeMountField(fields[0])
+	m.path = unescapeMountField(fields[1])
+	m.filesystem = fields[2]
+	return m, true
+}
+
+// unescapeMountField reverses the octal escaping of whitespace and
+// backslashes in fields of /proc/mounts.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(v))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// findMount returns the last of mounts that contains path, which must be
+// absolute and clean. Later mounts hide earlier ones at the same point.
+func findMount(mounts []mount, path string) (found mount, ok bool) {
+	for _, m := range mounts {
+		if m.path != "/" && path != m.path && !strings.HasPrefix(path, m.path+"/") {
+			continue
+		}
+		if !ok || len(m.path) >= len(found.path) {
+			found, ok = m, true
+		}
+	}
+	return
+}
+
+// isSolidState returns whether the block device with the given device number
+// is non-rotational. Partitions inherit the value of their disk.
+func isSolidState(dev uint64) (bool, error) {
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	base := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+
+	for _, path := range []string{base + "/queue/rotational", base + "/../queue/rotational"} {
+		contents, err := ioutil.ReadFile(path)
+		if err == nil {
+			return strings.TrimSpace(string(contents)) == "0", nil
+		}
+	}
+	return false, errors.New("no block device information for " + base)
+}
+
+// storageProblems returns descriptions of the reasons that the storage
+// holding stateFilename may retain copies of the state file after it has been
+// overwritten.
+func storageProblems(stateFilename string) []string {
+	dir, err := filepath.Abs(filepath.Dir(stateFilename))
+	if err != nil {
+		return []string{"while finding the state file: " + err.Error()}
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+
+	var problems []string
+	var mounts []mount
+	err = processLines("/proc/mounts", func(line string) error {
+		if m, ok := parseMount(line); ok {
+			mounts = append(mounts, m)
+		}
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, "while checking /proc/mounts: "+err.Error())
+	} else if m, ok := findMount(mounts, dir); ok && copyOnWriteFilesystems[m.filesystem] {
+		problems = append(problems, "the state file is on a "+m.filesystem+" filesystem, which may keep old copies of it")
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err == nil {
+		if ssd, err := isSolidState(uint64(stat.Dev)); err == nil && ssd {
+			problems = append(problems, "the state file is on a solid-state drive, which may keep old copies of it")
+		}
+	}
+
+	return problems
+}
@@ -38,9 +38,36 @@ func processLines(filename string, f func(line string) error) error {
 	return nil
 }
 
-// IsSafe checks to see whether the current OS appears to be safe. Specifically
-// it checks that any swap is encrypted.
-func IsSafe() error {
+// IsSafe checks to see whether the current OS appears to be safe.
+// Specifically it checks that any swap is encrypted, unless Harden has locked
+// our memory, and that core dumps are disabled. If stateFilename isn't empty,
+// it also checks whether the storage holding it may keep old copies of the
+// state file. Any error is of type Problems.
+func IsSafe(stateFilename string) error {
+	var problems Problems
+	if err := checkSwap(); err != nil {
+		problems = append(problems, Problem{err.Error(), true})
+	}
+	if err := checkCoreDumps(); err != nil {
+		problems = append(problems, Problem{err.Error(), true})
+	}
+	if len(stateFilename) > 0 {
+		for _, description := range storageProblems(stateFilename) {
+			problems = append(problems, Problem{description, false})
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+func checkSwap() error {
+	if memoryLocked {
+		return nil
+	}
+
 	lineNo := 0
 	err := processLines("/proc/swaps", func(line string) error {
 		lineNo++
@@ -63,7 +90,7 @@ func IsSafe() error {
 	})
 
 	if err != nil {
-		return errors.New("system: while checking /proc/swaps: " + err.Error())
+		return errors.New("while checking /proc/swaps: " + err.Error())
 	}
 	return nil
 }
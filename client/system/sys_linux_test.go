@@ -0,0 +1,58 @@
+package system
+
+import (
+	"testing"
+)
+
+func TestHarden(t *testing.T) {
+	if err := Harden(); err != nil {
+		t.Logf("Harden returned an error: %s", err)
+	}
+	if err := checkCoreDumps(); err != nil {
+		t.Errorf("core dumps weren't disabled: %s", err)
+	}
+}
+
+var testMounts = []string{
+	"rootfs / rootfs rw 0 0",
+	"/dev/sda1 / ext4 rw,relatime 0 0",
+	"tmpfs /tmp tmpfs rw,nosuid,nodev 0 0",
+	"/dev/sdb1 /home btrfs rw,relatime 0 0",
+	"/dev/sdc1 /home/user/My\\040Files zfs rw 0 0",
+	"/dev/sdd1 /homestead ext4 rw 0 0",
+}
+
+var findMountTests = []struct {
+	path       string
+	filesystem string
+}{
+	{"/", "ext4"},
+	{"/etc", "ext4"},
+	{"/tmp/x", "tmpfs"},
+	{"/home", "btrfs"},
+	{"/home/user/.pond", "btrfs"},
+	{"/home/user/My Files/state", "zfs"},
+	{"/homestead/state", "ext4"},
+}
+
+func TestFindMount(t *testing.T) {
+	var mounts []mount
+	for _, line := range testMounts {
+		m, ok := parseMount(line)
+		if !ok {
+			t.Fatalf("failed to parse %q", line)
+		}
+		mounts = append(mounts, m)
+	}
+
+	for _, test := range findMountTests {
+		m, ok := findMount(mounts, test.path)
+		if !ok {
+			t.Errorf("no mount found for %s", test.path)
+			continue
+		}
+		if m.filesystem != test.filesystem {
+			t.Errorf("%s: got filesystem %s (%s), want %s", test.path, m.filesystem, m.path, test.filesystem)
+		}
+	}
+}
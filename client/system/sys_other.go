@@ -0,0 +1,22 @@
+// +build !linux
+
+package system
+
+import (
+	"errors"
+)
+
+// Harden is not implemented on this platform.
+func Harden() error {
+	return errors.New("system: hardening is not supported on this platform")
+}
+
+// IsSafe has no checks for this platform and so never finds a problem.
+func IsSafe(stateFilename string) error {
+	return nil
+}
+
+// SafeTempDir is not implemented on this platform.
+func SafeTempDir() (string, error) {
+	return "", errors.New("system: no safe temporary directory is known on this platform")
+}
@@ -0,0 +1,35 @@
+package system
+
+import (
+	"strings"
+)
+
+// Problem describes one way in which the system appears to be unsafe.
+type Problem struct {
+	Description string
+	// Fatal is true if secrets may be written to disk in the clear, i.e.
+	// by swap or a core dump. Other problems, such as the state file
+	// being on an SSD, only weaken the erasure of old state.
+	Fatal bool
+}
+
+// Problems is the type of error returned by IsSafe.
+type Problems []Problem
+
+func (problems Problems) Error() string {
+	descriptions := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		descriptions = append(descriptions, problem.Description)
+	}
+	return "system: " + strings.Join(descriptions, "; ")
+}
+
+// Fatal returns true if any of the problems are fatal.
+func (problems Problems) Fatal() bool {
+	for _, problem := range problems {
+		if problem.Fatal {
+			return true
+		}
+	}
+	return false
+}
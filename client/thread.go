@@ -0,0 +1,238 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// maxThreadDepth is the greatest indentation level used when displaying a
+// conversation. Deeper replies are displayed at this level.
+const maxThreadDepth = 8
+
+// threadEntry is a message in a conversation with a contact.
+type threadEntry struct {
+	// Exactly one of inbox and outbox is non-nil.
+	inbox  *InboxMessage
+	outbox *queuedMessage
+	// id is the message's pond.Message id, which is what in_reply_to
+	// refers to, and inReplyTo is the id of its parent, or zero.
+	id, inReplyTo uint64
+	time          time.Time
+	body          []byte
+	// acked is true if an ack for this message has been sent or received.
+	// ackTime is the time of that ack, if known.
+	acked   bool
+	ackTime time.Time
+	// depth is the number of replies between this message and the first
+	// message of its conversation.
+	depth int
+
+	parent   *threadEntry
+	children []*threadEntry
+}
+
+func (entry *threadEntry) fromUs() bool {
+	return entry.outbox != nil
+}
+
+type threadEntriesByTime []*threadEntry
+
+func (s threadEntriesByTime) Len() int           { return len(s) }
+func (s threadEntriesByTime) Less(i, j int) bool { return s[i].time.Before(s[j].time) }
+func (s threadEntriesByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// buildThreads stitches together the messages exchanged with the given
+// contact using their in_reply_to links. It returns the conversations in the
+// order that they started and the messages of each conversation in display
+// order, i.e. each message is followed by its replies. Empty messages are acks
+// and are folded into the messages that they acknowledge.
+func (c *client) buildThreads(contactID uint64) [][]*threadEntry {
+	var entries []*threadEntry
+	// Their message ids and ours are in different namespaces: our
+	// messages reply to theirs and vice versa.
+	theirs := make(map[uint64]*threadEntry)
+	ours := make(map[uint64]*threadEntry)
+
+	for _, msg := range c.inbox {
+		if msg.from != contactID || msg.message == nil || msg.message.GetDeliveryReceipt() {
+			// Delivery receipts are reflected in the delivered
+			// time of our messages.
+			continue
+		}
+		entry := &threadEntry{
+			inbox:     msg,
+			id:        msg.message.GetId(),
+			inReplyTo: msg.message.GetInReplyTo(),
+			time:      time.Unix(msg.message.GetTime(), 0),
+			body:      msg.message.Body,
+			acked:     msg.acked,
+		}
+		entries = append(entries, entry)
+		theirs[entry.id] = entry
+	}
+	for _, msg := range c.outbox {
+		if msg.to != contactID || msg.revocation || msg.message == nil || msg.message.GetDeliveryReceipt() {
+			continue
+		}
+		entry := &threadEntry{
+			outbox:    msg,
+			id:        msg.id,
+			inReplyTo: msg.message.GetInReplyTo(),
+			time:      msg.created,
+			body:      msg.message.Body,
+			acked:     !msg.acked.IsZero(),
+			ackTime:   msg.acked,
+		}
+		entries = append(entries, entry)
+		ours[entry.id] = entry
+	}
+
+	sort.Sort(threadEntriesByTime(entries))
+
+	var roots []*threadEntry
+	for _, entry := range entries {
+		var parent *threadEntry
+		if entry.inReplyTo != 0 {
+			if entry.fromUs() {
+				parent = theirs[entry.inReplyTo]
+			} else {
+				parent = ours[entry.inReplyTo]
+			}
+		}
+
+		if len(entry.body) == 0 {
+			// An ack. If the acknowledged message has expired then
+			// there's nothing to show.
+			if parent != nil {
+				parent.acked = true
+				if parent.ackTime.IsZero() || entry.time.Before(parent.ackTime) {
+					parent.ackTime = entry.time
+				}
+			}
+			continue
+		}
+
+		if parent == nil || len(parent.body) == 0 {
+			roots = append(roots, entry)
+			continue
+		}
+		entry.parent = parent
+		parent.children = append(parent.children, entry)
+	}
+
+	var threads [][]*threadEntry
+	for _, root := range roots {
+		var thread []*threadEntry
+		var walk func(entry *threadEntry, depth int)
+		walk = func(entry *threadEntry, depth int) {
+			if depth > maxThreadDepth {
+				depth = maxThreadDepth
+			}
+			entry.depth = depth
+			thread = append(thread, entry)
+			for _, child := range entry.children {
+				walk(child, depth+1)
+			}
+		}
+		walk(root, 0)
+		threads = append(threads, thread)
+	}
+
+	return threads
+}
+
+// threadEntryWidget returns the widget that displays entry in a conversation
+// with contact.
+func threadEntryWidget(contact *Contact, entry *threadEntry) Widget {
+	from := contact.name
+	if entry.fromUs() {
+		from = "You"
+	}
+
+	var status string
+	switch {
+	case entry.acked && !entry.ackTime.IsZero():
+		status = "Acknowledged " + entry.ackTime.Format(shortTimeFormat)
+	case entry.acked:
+		status = "Acknowledged"
+	case entry.fromUs() && !entry.outbox.delivered.IsZero():
+		status = "Delivered " + entry.outbox.delivered.Format(shortTimeFormat)
+	case entry.fromUs() && entry.outbox.sent.IsZero():
+		status = "Not yet sent"
+	case entry.fromUs():
+		status = "Sent " + entry.outbox.sent.Format(shortTimeFormat)
+	}
+
+	grid := Grid{
+		widgetBase: widgetBase{margin: 6, marginLeft: 6 + 25*entry.depth},
+		rowSpacing: 3,
+		colSpacing: 8,
+		rows: [][]GridE{
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground},
+					text:       from,
+				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{foreground: colorSubline, hExpand: true},
+					text:       entry.time.Format(shortTimeFormat),
+				}},
+			},
+			{
+				{2, 1, Label{
+					text:       string(entry.body),
+					wrap:       500,
+					selectable: true,
+				}},
+			},
+		},
+	}
+	if len(status) > 0 {
+		grid.rows = append(grid.rows, []GridE{
+			{2, 1, Label{
+				widgetBase: widgetBase{foreground: colorSubline},
+				text:       status,
+			}},
+		})
+	}
+
+	return grid
+}
+
+// showThread displays the conversations with the given contact.
+func (c *client) showThread(contactID uint64) interface{} {
+	contact := c.contacts[contactID]
+	threads := c.buildThreads(contactID)
+
+	var children []Widget
+	for i, thread := range threads {
+		if i > 0 {
+			children = append(children, EventBox{widgetBase: widgetBase{height: 1, background: colorSep}})
+		}
+		for _, entry := range thread {
+			children = append(children, threadEntryWidget(contact, entry))
+		}
+	}
+	if len(children) == 0 {
+		children = append(children, Label{
+			widgetBase: widgetBase{margin: 6},
+			text:       "No messages have been exchanged with " + contact.name + ".",
+		})
+	}
+
+	main := VBox{
+		widgetBase: widgetBase{hExpand: true, vExpand: true},
+		children:   children,
+	}
+
+	c.ui.Actions() <- SetChild{name: "right", child: rightPane("CONVERSATION WITH "+contact.name, nil, nil, main)}
+	c.ui.Actions() <- UIState{uiStateThread}
+	c.ui.Signal()
+
+	for {
+		event, wanted := c.nextEvent()
+		if wanted {
+			return event
+		}
+	}
+}
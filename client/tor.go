@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// torControlAddr is the address at which we expect to find the local Tor
+// control port.
+const torControlAddr = "127.0.0.1:9051"
+
+// torStatus contains the results of querying the Tor control port.
+type torStatus struct {
+	// bootstrapProgress is the percentage of the bootstrap process that
+	// Tor has completed. Tor can only build circuits once this reaches
+	// 100.
+	bootstrapProgress int
+	// bootstrapSummary is Tor's human readable description of the
+	// current bootstrap phase.
+	bootstrapSummary string
+	// socksIsolated is true if the SOCKS port that we use has
+	// IsolateSOCKSAuth enabled. Without it, the random SOCKS credentials
+	// that we use for each connection don't cause Tor to put them on
+	// different circuits.
+	socksIsolated bool
+}
+
+// torControl is a minimal client for the Tor control protocol. See
+// https://gitweb.torproject.org/torspec.git/blob/HEAD:/control-spec.txt
+type torControl struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTorControl(addr string) (*torControl, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	return &torControl{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}, nil
+}
+
+func (tc *torControl) Close() error {
+	return tc.conn.Close()
+}
+
+// command sends a single command to Tor and returns the lines of a
+// successful reply with the status codes removed. Data from multi-line
+// ("+") replies is appended to the line that introduced it.
+func (tc *torControl) command(cmd string) ([]string, error) {
+	if _, err := tc.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		line, err := tc.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, errors.New("tor: short reply line: " + line)
+		}
+		code, sep, rest := line[:3], line[3], line[4:]
+		if code != "250" {
+			return nil, errors.New("tor: command failed: " + line)
+		}
+
+		switch sep {
+		case ' ':
+			lines = append(lines, rest)
+			return lines, nil
+		case '-':
+			lines = append(lines, rest)
+		case '+':
+			for {
+				data, err := tc.readLine()
+				if err != nil {
+					return nil, err
+				}
+				if data == "." {
+					break
+				}
+				rest += "\n" + strings.TrimPrefix(data, ".")
+			}
+			lines = append(lines, rest)
+		default:
+			return nil, errors.New("tor: malformed reply line: " + line)
+		}
+	}
+
+	panic("unreachable")
+}
+
+func (tc *torControl) readLine() (string, error) {
+	line, err := tc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// authenticate performs the PROTOCOLINFO/AUTHENTICATE exchange. Only the
+// NULL and COOKIE methods are supported since we have no way to know a
+// password.
+func (tc *torControl) authenticate() error {
+	lines, err := tc.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+
+	var methods []string
+	var cookieFile string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range splitQuoted(line[5:]) {
+			switch {
+			case strings.HasPrefix(field, "METHODS="):
+				methods = strings.Split(field[8:], ",")
+			case strings.HasPrefix(field, "COOKIEFILE="):
+				cookieFile = unquote(field[11:])
+			}
+		}
+	}
+
+	authCommand := ""
+	for _, method := range methods {
+		if method == "NULL" {
+			authCommand = "AUTHENTICATE"
+			break
+		}
+		if method == "COOKIE" && len(cookieFile) > 0 {
+			cookie, err := ioutil.ReadFile(cookieFile)
+			if err != nil {
+				return errors.New("tor: failed to read control cookie: " + err.Error())
+			}
+			authCommand = "AUTHENTICATE " + hex.EncodeToString(cookie)
+		}
+	}
+	if len(authCommand) == 0 {
+		return fmt.Errorf("tor: no supported authentication method (offered: %s)", strings.Join(methods, ","))
+	}
+
+	_, err = tc.command(authCommand)
+	return err
+}
+
+// bootstrapStatus returns the progress percentage and summary of Tor's
+// bootstrap process.
+func (tc *torControl) bootstrapStatus() (progress int, summary string, err error) {
+	lines, err := tc.command("GETINFO status/bootstrap-phase")
+	if err != nil {
+		return
+	}
+
+	const prefix = "status/bootstrap-phase="
+	found := false
+	for _, line := range lines {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		for _, field := range splitQuoted(line[len(prefix):]) {
+			switch {
+			case strings.HasPrefix(field, "PROGRESS="):
+				if progress, err = strconv.Atoi(field[9:]); err != nil {
+					return 0, "", errors.New("tor: bad bootstrap progress: " + field)
+				}
+				found = true
+			case strings.HasPrefix(field, "SUMMARY="):
+				summary = unquote(field[8:])
+			}
+		}
+	}
+	if !found {
+		err = errors.New("tor: no bootstrap progress in reply")
+	}
+	return
+}
+
+// socksIsolated returns true if the SOCKS port that listens on port has
+// IsolateSOCKSAuth enabled.
+func (tc *torControl) socksIsolated(port string) (bool, error) {
+	lines, err := tc.command("GETCONF SocksPort")
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range lines {
+		if line == "SocksPort" {
+			// SocksPort is unset so Tor uses the default of port
+			// 9050, which has IsolateSOCKSAuth enabled.
+			return port == "9050", nil
+		}
+		if !strings.HasPrefix(line, "SocksPort=") {
+			continue
+		}
+		fields := strings.Fields(line[10:])
+		if len(fields) == 0 {
+			continue
+		}
+		listen := fields[0]
+		if i := strings.LastIndex(listen, ":"); i != -1 {
+			listen = listen[i+1:]
+		}
+		if listen != port {
+			continue
+		}
+		for _, flag := range fields[1:] {
+			if flag == "NoIsolateSOCKSAuth" {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	return false, errors.New("tor: no SOCKS port configured on port " + port)
+}
+
+// splitQuoted splits s on spaces, except where they appear within a quoted
+// string.
+func splitQuoted(s string) []string {
+	var fields []string
+	inQuote, escaped := false, false
+	start := 0
+
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && inQuote:
+			escaped = true
+		case r == '"':
+			inQuote = !inQuote
+		case r == ' ' && !inQuote:
+			if i > start {
+				fields = append(fields, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		fields = append(fields, s[start:])
+	}
+	return fields
+}
+
+func unquote(s string) string {
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		return unquoted
+	}
+	return s
+}
+
+// checkTor connects to the Tor control port at controlAddr and checks that
+// Tor has bootstrapped and that the SOCKS port at socksAddr isolates
+// connections by SOCKS credentials.
+func checkTor(controlAddr, socksAddr string) (*torStatus, error) {
+	_, socksPort, err := net.SplitHostPort(socksAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tc, err := dialTorControl(controlAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer tc.Close()
+
+	if err := tc.authenticate(); err != nil {
+		return nil, err
+	}
+
+	status := new(torStatus)
+	if status.bootstrapProgress, status.bootstrapSummary, err = tc.bootstrapStatus(); err != nil {
+		return nil, err
+	}
+	if status.socksIsolated, err = tc.socksIsolated(socksPort); err != nil {
+		return nil, err
+	}
+	tc.command("QUIT")
+
+	return status, nil
+}
+
+// torStatusChecked is sent on backgroundChan with the result of
+// checkTorStatus.
+type torStatusChecked struct {
+	err error
+}
+
+// checkTorStatus queries the local Tor control port and logs any problems
+// that it finds. It returns an error if Tor isn't in a state where it's safe
+// to use. Since many Tor installations don't expose a control port, failing
+// to connect to it is only logged.
+func (c *client) checkTorStatus() error {
+	status, err := checkTor(torControlAddr, torAddr)
+	if err != nil {
+		c.log.Printf("Cannot check Tor status via the control port: %s", err)
+		return nil
+	}
+
+	if status.bootstrapProgress < 100 {
+		err := fmt.Errorf("Tor has not finished bootstrapping (%d%%: %s)", status.bootstrapProgress, status.bootstrapSummary)
+		c.log.Errorf("%s", err)
+		return err
+	}
+	if !status.socksIsolated {
+		err := errors.New("Tor's SOCKS port does not have IsolateSOCKSAuth enabled so Pond connections may share circuits")
+		c.log.Errorf("%s", err)
+		return err
+	}
+
+	c.log.Printf("Tor is bootstrapped and isolates SOCKS connections")
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/pond/client/disk"
 	pond "github.com/agl/pond/protos"
 )
 
@@ -89,6 +90,15 @@ func (c *client) showInbox(id uint64) interface{} {
 			},
 		},
 	}
+	for _, warning := range []string{unverifiedWarning(contact), oldMessageWarning(msg)} {
+		if len(warning) == 0 {
+			continue
+		}
+		left.rows = append(left.rows, []GridE{
+			{1, 1, nil},
+			{1, 1, Label{widgetBase: widgetBase{foreground: colorRed}, text: warning}},
+		})
+	}
 	lhsNextRow := len(left.rows)
 
 	right := Grid{
@@ -114,6 +124,15 @@ func (c *client) showInbox(id uint64) interface{} {
 					text: "Ack",
 				}},
 			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "thread",
+						insensitive: isServerAnnounce,
+					},
+					text: "Conversation",
+				}},
+			},
 			{
 				{1, 1, Button{
 					widgetBase: widgetBase{
@@ -140,7 +159,7 @@ func (c *client) showInbox(id uint64) interface{} {
 
 		for i, attachment := range msg.message.Files {
 			filename := maybeTruncate(*attachment.Filename)
-			grid.rows = append(grid.rows, []GridE{
+			row := []GridE{
 				{1, 1, Label{
 					widgetBase: widgetBase{vAlign: AlignCenter, hAlign: AlignStart},
 					text:       filename,
@@ -149,7 +168,14 @@ func (c *client) showInbox(id uint64) interface{} {
 					widgetBase: widgetBase{name: fmt.Sprintf("attachment-%d", i)},
 					text:       "Save",
 				}},
-			})
+			}
+			if previewKindOf(attachment.Contents) != previewNone {
+				row = append(row, GridE{1, 1, Button{
+					widgetBase: widgetBase{name: fmt.Sprintf("preview-%d", i)},
+					text:       "Preview",
+				}})
+			}
+			grid.rows = append(grid.rows, row)
 		}
 
 		c.ui.Actions() <- InsertRow{name: "lhs", pos: lhsNextRow, row: []GridE{
@@ -161,6 +187,12 @@ func (c *client) showInbox(id uint64) interface{} {
 		lhsNextRow++
 		c.ui.Actions() <- InsertRow{name: "lhs", pos: lhsNextRow, row: []GridE{{2, 1, grid}}}
 		lhsNextRow++
+		// Previews of attachments are shown in this box. They are
+		// never written to disk.
+		c.ui.Actions() <- InsertRow{name: "lhs", pos: lhsNextRow, row: []GridE{
+			{2, 1, VBox{widgetBase: widgetBase{name: "preview", marginLeft: 25}}},
+		}}
+		lhsNextRow++
 	}
 
 	if msg.message != nil && len(msg.message.DetachedFiles) != 0 {
@@ -237,6 +269,8 @@ func (c *client) showInbox(id uint64) interface{} {
 	c.ui.Signal()
 
 	detachmentUI := InboxDetachmentUI{msg, c.ui}
+	c.activeDetachmentUI = detachmentUI
+	defer func() { c.activeDetachmentUI = nil }()
 
 	const detachmentDecryptPrefix = "detachment-decrypt-"
 	const detachmentProgressPrefix = "detachment-progress-"
@@ -246,7 +280,19 @@ func (c *client) showInbox(id uint64) interface{} {
 		msg.decryptions = make(map[uint64]*pendingDecryption)
 	}
 
+	// previewIndex is the index of the attachment that was last
+	// previewed, or -1.
+	previewIndex := -1
+
 	for {
+		if !c.inInbox(msg) {
+			// The message expired while it was being displayed.
+			c.ui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
+			c.ui.Actions() <- UIState{uiStateMain}
+			c.ui.Signal()
+			return nil
+		}
+
 		event, wanted := c.nextEvent()
 		if wanted {
 			return event
@@ -302,10 +348,14 @@ func (c *client) showInbox(id uint64) interface{} {
 					},
 				}
 				id := c.randId()
-				msg.decryptions[id] = &pendingDecryption{
-					index:  i.index,
-					cancel: c.startDecryption(id, open.path, i.inPath, msg.message.DetachedFiles[i.index]),
+				pending := &pendingDecryption{
+					index:   i.index,
+					outPath: open.path,
+					inPath:  i.inPath,
 				}
+				msg.decryptions[id] = pending
+				c.startPendingDecryption(id, msg, pending)
+				c.save()
 				c.ui.Signal()
 			case detachmentDownloadIndex:
 				c.ui.Actions() <- Sensitive{
@@ -328,10 +378,13 @@ func (c *client) showInbox(id uint64) interface{} {
 					},
 				}
 				id := c.randId()
-				msg.decryptions[id] = &pendingDecryption{
-					index:  int(i),
-					cancel: c.startDownload(id, open.path, msg.message.DetachedFiles[i]),
+				pending := &pendingDecryption{
+					index:   int(i),
+					outPath: open.path,
 				}
+				msg.decryptions[id] = pending
+				c.startPendingDecryption(id, msg, pending)
+				c.save()
 				c.ui.Signal()
 			default:
 				panic("unimplemented OpenResult")
@@ -343,10 +396,57 @@ func (c *client) showInbox(id uint64) interface{} {
 			continue
 		}
 
+		if decoded, ok := event.(PreviewDecoded); ok {
+			if decoded.msgID != msg.id || decoded.index != previewIndex {
+				// The user has since asked for a different
+				// preview.
+				continue
+			}
+			var preview Widget
+			if decoded.err != nil {
+				preview = Label{
+					widgetBase: widgetBase{name: "preview-error", foreground: colorRed},
+					text:       "Cannot preview image: " + decoded.err.Error(),
+				}
+			} else {
+				preview = Image{
+					widgetBase: widgetBase{name: "preview-image"},
+					png:        decoded.png,
+				}
+			}
+			c.ui.Actions() <- SetBoxContents{name: "preview", child: preview}
+			c.ui.Actions() <- UIState{uiStatePreview}
+			c.ui.Signal()
+			continue
+		}
+
 		click, ok := event.(Click)
 		if !ok {
 			continue
 		}
+		const previewPrefix = "preview-"
+		if strings.HasPrefix(click.name, previewPrefix) {
+			i, _ := strconv.Atoi(click.name[len(previewPrefix):])
+			previewIndex = i
+			contents := msg.message.Files[i].Contents
+			switch previewKindOf(contents) {
+			case previewText:
+				c.ui.Actions() <- SetBoxContents{name: "preview", child: Scrolled{
+					widgetBase: widgetBase{height: 200},
+					child: TextView{
+						widgetBase: widgetBase{name: "preview-text"},
+						text:       previewTextOf(contents),
+						wrap:       true,
+					},
+				}}
+				c.ui.Actions() <- UIState{uiStatePreview}
+			case previewImage:
+				c.ui.Actions() <- SetBoxContents{name: "preview", child: Label{text: "Decoding image..."}}
+				c.startPreview(msg, i)
+			}
+			c.ui.Signal()
+			continue
+		}
 		const attachmentPrefix = "attachment-"
 		if strings.HasPrefix(click.name, attachmentPrefix) {
 			i, _ := strconv.Atoi(click.name[len(attachmentPrefix):])
@@ -398,6 +498,9 @@ func (c *client) showInbox(id uint64) interface{} {
 		case "reply":
 			c.inboxUI.Deselect()
 			return c.composeUI(nil, msg)
+		case "thread":
+			c.inboxUI.Deselect()
+			return c.showThread(msg.from)
 		}
 	}
 
@@ -455,6 +558,16 @@ func (c *client) showOutbox(id uint64) interface{} {
 					text:       sentTime,
 				}},
 			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					text:       "DELIVERED",
+				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{name: "delivered"},
+					text:       formatTime(msg.delivered),
+				}},
+			},
 			{
 				{1, 1, Label{
 					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
@@ -480,6 +593,7 @@ func (c *client) showOutbox(id uint64) interface{} {
 	c.ui.Signal()
 
 	haveSentTime := !msg.sent.IsZero()
+	haveDeliveredTime := !msg.delivered.IsZero()
 	haveAckTime := !msg.acked.IsZero()
 
 	for {
@@ -492,6 +606,10 @@ func (c *client) showOutbox(id uint64) interface{} {
 			c.ui.Actions() <- SetText{name: "sent", text: formatTime(msg.sent)}
 			c.ui.Signal()
 		}
+		if !haveDeliveredTime && !msg.delivered.IsZero() {
+			c.ui.Actions() <- SetText{name: "delivered", text: formatTime(msg.delivered)}
+			c.ui.Signal()
+		}
 		if !haveAckTime && !msg.acked.IsZero() {
 			c.ui.Actions() <- SetText{name: "acked", text: formatTime(msg.acked)}
 			c.ui.Signal()
@@ -550,8 +668,8 @@ func nameValuesLHS(entries []nvEntry) Widget {
 	for _, ent := range entries {
 		var font string
 		vAlign := AlignCenter
-		if strings.HasPrefix(ent.value, "-----") {
-			// PEM block
+		if strings.Contains(ent.value, "\n") {
+			// PEM blocks and safety numbers.
 			font = fontMainMono
 			vAlign = AlignStart
 		}
@@ -573,21 +691,333 @@ func nameValuesLHS(entries []nvEntry) Widget {
 }
 
 func (c *client) identityUI() interface{} {
+	coverTrafficString, coverTrafficButton := "disabled", "Enable"
+	if c.coverTraffic {
+		coverTrafficString, coverTrafficButton = "enabled", "Disable"
+		if len(c.decoyServers) > 0 {
+			coverTrafficString += fmt.Sprintf(" (%d decoy servers)", len(c.decoyServers))
+		}
+	}
+
+	receiptsString, receiptsButton := "disabled", "Enable"
+	if c.deliveryReceipts {
+		receiptsString, receiptsButton = "enabled", "Disable"
+	}
+
+	autoDownloadString, autoDownloadButton := "disabled", "Enable"
+	if c.autoDownload {
+		autoDownloadString, autoDownloadButton = "enabled", "Disable"
+	}
+
 	left := nameValuesLHS([]nvEntry{
 		{"SERVER", c.server},
 		{"PUBLIC IDENTITY", fmt.Sprintf("%x", c.identityPublic[:])},
 		{"PUBLIC KEY", fmt.Sprintf("%x", c.pub[:])},
 		{"STATE FILE", c.stateFilename},
 		{"GROUP GENERATION", fmt.Sprintf("%d", c.generation)},
+		{"COVER TRAFFIC", coverTrafficString},
+		{"DELIVERY RECEIPTS", receiptsString},
+		{"AUTO-DOWNLOAD", autoDownloadString},
 	})
 
-	c.ui.Actions() <- SetChild{name: "right", child: rightPane("IDENTITY", left, nil, nil)}
+	var policyLabels []string
+	for i := int32(0); i < int32(len(schedulingPolicyLabels)); i++ {
+		policyLabels = append(policyLabels, schedulingPolicyLabels[disk.State_SchedulingPolicy(i)])
+	}
+	c.queueMutex.Lock()
+	currentPolicy := c.schedulingPolicy
+	c.queueMutex.Unlock()
+
+	right := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 3,
+		colSpacing: 3,
+		rows: [][]GridE{
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground},
+					text:       "SCHEDULING",
+				}},
+			},
+			{
+				{1, 1, Combo{
+					widgetBase:  widgetBase{name: "schedule"},
+					labels:      policyLabels,
+					preSelected: schedulingPolicyLabels[currentPolicy],
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "setschedule"},
+					text:       "Set",
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, marginTop: 10},
+					text:       "RECEIPTS",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "receipts"},
+					text:       receiptsButton,
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, marginTop: 10},
+					text:       "AUTO-DOWNLOAD",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "autodownload"},
+					text:       autoDownloadButton,
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, marginTop: 10},
+					text:       "COVER TRAFFIC",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "covertraffic"},
+					text:       coverTrafficButton,
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, marginTop: 10},
+					text:       "DECOY SERVERS",
+				}},
+			},
+			{
+				{1, 1, Label{text: "One server URL per line."}},
+			},
+			{
+				{1, 1, TextView{
+					widgetBase: widgetBase{name: "decoys", height: 100},
+					editable:   true,
+					text:       strings.Join(c.decoyServers, "\n"),
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{name: "decoyerror", foreground: colorRed},
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "setdecoys"},
+					text:       "Set",
+				}},
+			},
+		},
+	}
+
+	c.ui.Actions() <- SetChild{name: "right", child: rightPane("IDENTITY", left, right, nil)}
 	c.ui.Actions() <- UIState{uiStateShowIdentity}
 	c.ui.Signal()
 
+	for {
+		event, wanted := c.nextEvent()
+		if wanted {
+			return event
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		if click.name == "receipts" {
+			c.deliveryReceipts = !c.deliveryReceipts
+			if c.deliveryReceipts {
+				c.log.Printf("Delivery receipts enabled")
+			} else {
+				c.log.Printf("Delivery receipts disabled")
+			}
+			c.save()
+			// Redisplay so that the status and button are updated.
+			return c.identityUI()
+		}
+		if click.name == "autodownload" {
+			c.autoDownload = !c.autoDownload
+			if c.autoDownload {
+				c.log.Printf("Automatic download of detachments enabled")
+			} else {
+				c.log.Printf("Automatic download of detachments disabled")
+			}
+			c.save()
+			return c.identityUI()
+		}
+		if click.name == "covertraffic" {
+			c.coverTraffic = !c.coverTraffic
+			if c.coverTraffic {
+				c.log.Printf("Cover traffic enabled")
+			} else {
+				c.log.Printf("Cover traffic disabled")
+			}
+			// save updates the destinations of cover traffic.
+			c.save()
+			return c.identityUI()
+		}
+		if click.name == "setdecoys" {
+			servers, err := parseDecoyServers(click.textViews["decoys"], c.testing)
+			if err != nil {
+				c.ui.Actions() <- SetText{name: "decoyerror", text: err.Error()}
+				c.ui.Actions() <- UIError{err}
+				c.ui.Signal()
+				continue
+			}
+			c.decoyServers = servers
+			c.log.Printf("Decoy servers set: %d servers", len(servers))
+			c.save()
+			return c.identityUI()
+		}
+		if click.name != "setschedule" {
+			continue
+		}
+
+		for policy, label := range schedulingPolicyLabels {
+			if label != click.combos["schedule"] {
+				continue
+			}
+			c.queueMutex.Lock()
+			c.schedulingPolicy = policy
+			c.queueMutex.Unlock()
+			c.log.Printf("Scheduling policy set to %s", label)
+			c.save()
+			break
+		}
+	}
+
 	return nil
 }
 
+// parseDecoyServers parses the list of decoy servers entered in the identity
+// UI, which has one server URL per line.
+func parseDecoyServers(text string, testing bool) ([]string, error) {
+	var servers []string
+	for _, line := range strings.Split(text, "\n") {
+		server := strings.TrimSpace(line)
+		if len(server) == 0 {
+			continue
+		}
+		if _, _, err := disk.ParseServer(server, testing); err != nil {
+			return nil, fmt.Errorf("Invalid server %s: %s", server, err)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// transfersUI lists the uploads, downloads and other detachment operations
+// that are in progress and lets the user pause, resume or cancel them.
+func (c *client) transfersUI() interface{} {
+	transfers := c.transfers()
+
+	list := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 3,
+		colSpacing: 3,
+	}
+	if len(transfers) == 0 {
+		list.rows = append(list.rows, []GridE{
+			{1, 1, Label{text: "No transfers in progress."}},
+		})
+	}
+	for _, t := range transfers {
+		pauseName, pauseText := fmt.Sprintf("transfer-pause-%x", t.id), "Pause"
+		if t.paused() {
+			pauseName, pauseText = fmt.Sprintf("transfer-resume-%x", t.id), "Resume"
+		}
+		list.rows = append(list.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{hExpand: true},
+				text:       t.description(),
+			}},
+			{1, 1, Label{
+				widgetBase: widgetBase{name: fmt.Sprintf("transfer-status-%x", t.id)},
+				text:       t.status(),
+			}},
+			{1, 1, Button{
+				widgetBase: widgetBase{name: pauseName},
+				text:       pauseText,
+			}},
+			{1, 1, Button{
+				widgetBase: widgetBase{name: fmt.Sprintf("transfer-cancel-%x", t.id)},
+				text:       "Cancel",
+			}},
+		})
+	}
+
+	c.ui.Actions() <- SetChild{name: "right", child: rightPane("TRANSFERS", nil, nil, list)}
+	c.ui.Actions() <- UIState{uiStateTransfers}
+	c.ui.Signal()
+
+	for {
+		event, wanted := c.nextEvent()
+		if wanted {
+			return event
+		}
+
+		if len(c.transfers()) != len(transfers) {
+			// A transfer has finished or a new one has started.
+			return c.transfersUI()
+		}
+
+		if prog, ok := event.(DetachmentProgress); ok {
+			if t, ok := c.findTransfer(prog.id); ok {
+				c.ui.Actions() <- SetText{name: fmt.Sprintf("transfer-status-%x", t.id), text: t.status()}
+				c.ui.Signal()
+			}
+			continue
+		}
+
+		click, ok := event.(Click)
+		if !ok || !strings.HasPrefix(click.name, "transfer-") {
+			continue
+		}
+		parts := strings.Split(click.name, "-")
+		if len(parts) != 3 {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[2], 16, 64)
+		if err != nil {
+			panic(click.name)
+		}
+		t, ok := c.findTransfer(id)
+		if !ok {
+			return c.transfersUI()
+		}
+
+		switch parts[1] {
+		case "pause":
+			c.pauseTransfer(t)
+		case "resume":
+			c.resumeTransfer(t)
+		case "cancel":
+			c.cancelTransfer(t)
+		}
+		// Redisplay so that the list and buttons are updated.
+		return c.transfersUI()
+	}
+
+	return nil
+}
+
+// schedulingPolicyLabels maps scheduling policies to the text used for them
+// in the UI.
+var schedulingPolicyLabels = map[disk.State_SchedulingPolicy]string{
+	disk.State_EXPONENTIAL: "Normal",
+	disk.State_BURST:       "Burst when sending",
+	disk.State_LOW_POWER:   "Low power",
+}
+
 func (c *client) showContact(id uint64) interface{} {
 	contact := c.contacts[id]
 	if contact.isPending {
@@ -603,6 +1033,13 @@ func (c *client) showContact(id uint64) interface{} {
 		{"CURRENT DH", fmt.Sprintf("%x", contact.theirCurrentDHPublic[:])},
 		{"GROUP GENERATION", fmt.Sprintf("%d", contact.generation)},
 		{"CLIENT VERSION", fmt.Sprintf("%d", contact.supportedVersion)},
+		{"SAFETY NUMBER", safetyNumber(&c.pub, &contact.theirPub)},
+		{"", safetyNumberGrid(&c.pub, &contact.theirPub)},
+	}
+	if contact.verified {
+		entries = append(entries, nvEntry{"VERIFIED", "yes"})
+	} else {
+		entries = append(entries, nvEntry{"VERIFIED", "no - compare the safety number with " + contact.name + ", ideally in person"})
 	}
 
 	if len(contact.kxsBytes) > 0 {
@@ -625,13 +1062,25 @@ func (c *client) showContact(id uint64) interface{} {
 					text: "Revoke",
 				}},
 			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "delete"},
+					text:       "Delete",
+				}},
+			},
 			{
 				{1, 1, Button{
 					widgetBase: widgetBase{
-						name:        "delete",
-						insensitive: true,
+						name:        "verify",
+						insensitive: contact.verified,
 					},
-					text: "Delete",
+					text: "Mark Verified",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "thread"},
+					text:       "Conversation",
 				}},
 			},
 		},
@@ -653,11 +1102,28 @@ func (c *client) showContact(id uint64) interface{} {
 			continue
 		}
 
-		if click.name == "revoke" {
+		switch click.name {
+		case "revoke":
 			c.revoke(contact)
 			c.ui.Actions() <- Sensitive{name: "revoke", sensitive: false}
 			c.ui.Signal()
 			c.save()
+		case "delete":
+			c.deleteContact(contact)
+			c.save()
+			c.ui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
+			c.ui.Actions() <- UIState{uiStateMain}
+			c.ui.Signal()
+			return nil
+		case "verify":
+			contact.verified = true
+			c.save()
+			// Redisplay the contact so that the VERIFIED entry is
+			// updated.
+			return c.showContact(id)
+		case "thread":
+			c.contactsUI.Deselect()
+			return c.showThread(id)
 		}
 	}
 }
@@ -887,6 +1353,10 @@ func (c *client) newContactManual(contact *Contact, existing bool, nextRow int)
 							text:       "Process",
 						}},
 						{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+						{1, 1, Button{
+							widgetBase: widgetBase{name: "delete"},
+							text:       "Delete",
+						}},
 					},
 				},
 			}},
@@ -916,6 +1386,17 @@ func (c *client) newContactManual(contact *Contact, existing bool, nextRow int)
 		if !ok {
 			continue
 		}
+		if click.name == "delete" {
+			// The key exchange was never completed so this removes
+			// the pending contact and any messages from them that
+			// we couldn't decrypt.
+			c.deleteContact(contact)
+			c.save()
+			c.ui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
+			c.ui.Actions() <- UIState{uiStateMain}
+			c.ui.Signal()
+			return nil
+		}
 		if click.name != "process" {
 			continue
 		}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/agl/pond/client/disk"
+)
+
+// maxDiffValueLen is the length beyond which values are abbreviated when
+// printing a diff.
+const maxDiffValueLen = 64
+
+// maxDiffBytesLen is the number of bytes of a byte string that are printed in
+// a diff. Longer byte strings, which include all keys, are abbreviated so that
+// secrets aren't written to the terminal in full.
+const maxDiffBytesLen = 8
+
+type changeKind int
+
+const (
+	changeAdded changeKind = iota
+	changeRemoved
+	changeModified
+)
+
+// A stateChange is a single difference between two states.
+type stateChange struct {
+	kind changeKind
+	// path locates the change in the form used by get and set.
+	path string
+	// label identifies an added or removed message to the user, for
+	// example by a contact's name. It may be empty.
+	label string
+	// oldValue and newValue contain the values of a modified field.
+	oldValue, newValue string
+}
+
+func (c stateChange) String() string {
+	var s string
+	switch c.kind {
+	case changeAdded:
+		s = "+ " + c.path
+	case changeRemoved:
+		s = "- " + c.path
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", c.path, c.oldValue, c.newValue)
+	}
+	if len(c.label) > 0 {
+		s += " " + c.label
+	}
+	return s
+}
+
+// diffStates returns the changes needed to turn before into after.
+func diffStates(before, after *disk.State) []stateChange {
+	var changes []stateChange
+	diffMessage(&changes, "", reflect.ValueOf(before).Elem(), reflect.ValueOf(after).Elem())
+	return changes
+}
+
+func diffMessage(changes *[]stateChange, path string, before, after reflect.Value) {
+	t := before.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := protoName(f)
+		if len(name) == 0 {
+			// XXX_unrecognized
+			continue
+		}
+		fieldPath := contextAppend(path, name)
+		beforeField, afterField := before.Field(i), after.Field(i)
+
+		switch {
+		case !isMessageField(f):
+			if !diffValuesEqual(beforeField, afterField) {
+				*changes = append(*changes, stateChange{kind: changeModified, path: fieldPath, oldValue: formatDiffValue(beforeField), newValue: formatDiffValue(afterField)})
+			}
+		case f.Type.Kind() == reflect.Ptr:
+			switch {
+			case beforeField.IsNil() && afterField.IsNil():
+			case beforeField.IsNil():
+				*changes = append(*changes, stateChange{kind: changeAdded, path: fieldPath, label: messageLabel(afterField.Elem())})
+			case afterField.IsNil():
+				*changes = append(*changes, stateChange{kind: changeRemoved, path: fieldPath, label: messageLabel(beforeField.Elem())})
+			default:
+				diffMessage(changes, fieldPath, beforeField.Elem(), afterField.Elem())
+			}
+		default:
+			diffRepeated(changes, fieldPath, beforeField, afterField)
+		}
+	}
+}
+
+// diffRepeated compares two values of a repeated message field. Elements are
+// matched by their id field if they have unique ids, otherwise by position.
+func diffRepeated(changes *[]stateChange, path string, before, after reflect.Value) {
+	beforeIds, ok1 := elementIds(before)
+	afterIds, ok2 := elementIds(after)
+
+	if !ok1 || !ok2 {
+		for i := 0; i < before.Len() || i < after.Len(); i++ {
+			elementPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= before.Len():
+				*changes = append(*changes, stateChange{kind: changeAdded, path: elementPath, label: messageLabel(after.Index(i).Elem())})
+			case i >= after.Len():
+				*changes = append(*changes, stateChange{kind: changeRemoved, path: elementPath, label: messageLabel(before.Index(i).Elem())})
+			default:
+				diffMessage(changes, elementPath, before.Index(i).Elem(), after.Index(i).Elem())
+			}
+		}
+		return
+	}
+
+	afterIndex := make(map[string]int)
+	for i, id := range afterIds {
+		afterIndex[id] = i
+	}
+	matched := make(map[string]bool)
+	for i, id := range beforeIds {
+		elementPath := fmt.Sprintf("%s[id=%s]", path, id)
+		j, ok := afterIndex[id]
+		if !ok {
+			*changes = append(*changes, stateChange{kind: changeRemoved, path: elementPath, label: messageLabel(before.Index(i).Elem())})
+			continue
+		}
+		matched[id] = true
+		diffMessage(changes, elementPath, before.Index(i).Elem(), after.Index(j).Elem())
+	}
+	for j, id := range afterIds {
+		if !matched[id] {
+			elementPath := fmt.Sprintf("%s[id=%s]", path, id)
+			*changes = append(*changes, stateChange{kind: changeAdded, path: elementPath, label: messageLabel(after.Index(j).Elem())})
+		}
+	}
+}
+
+// elementIds returns the values of the id field of the elements of v, a
+// repeated message field. It returns false if the elements don't have unique
+// ids.
+func elementIds(v reflect.Value) ([]string, bool) {
+	f, ok := fieldByProtoName(v.Type().Elem().Elem(), "id")
+	if !ok || isMessageField(f) {
+		return nil, false
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	for i := 0; i < v.Len(); i++ {
+		id, ok := formatScalar(v.Index(i).Elem().FieldByIndex(f.Index))
+		if !ok || seen[id] {
+			return nil, false
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// messageLabel returns the name of msg, if it has one, so that added and
+// removed contacts can be recognised.
+func messageLabel(msg reflect.Value) string {
+	f, ok := fieldByProtoName(msg.Type(), "name")
+	if !ok || isMessageField(f) {
+		return ""
+	}
+	return formatDiffValue(msg.FieldByIndex(f.Index))
+}
+
+// diffValuesEqual returns true if two values of a non-message field are equal.
+// The full values are compared because formatDiffValue abbreviates them.
+func diffValuesEqual(before, after reflect.Value) bool {
+	if before.Kind() == reflect.Slice {
+		// Unset and empty repeated fields are treated the same because
+		// parse doesn't distinguish them.
+		if before.Len() == 0 && after.Len() == 0 {
+			return true
+		}
+		if before.Type().Elem().Kind() == reflect.Uint8 {
+			return bytes.Equal(before.Bytes(), after.Bytes())
+		}
+	}
+	return reflect.DeepEqual(before.Interface(), after.Interface())
+}
+
+// formatDiffValue returns the value of a non-message field for printing in a
+// diff. Long values are abbreviated.
+func formatDiffValue(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		switch v.Type().Elem().Kind() {
+		case reflect.Uint8:
+			// Unset and empty byte strings are treated the same
+			// because parse doesn't distinguish them.
+			if v.Len() == 0 {
+				return `""`
+			}
+			if v.Len() > maxDiffBytesLen {
+				return fmt.Sprintf("%x... (%d bytes)", v.Bytes()[:maxDiffBytesLen], v.Len())
+			}
+			return hex.EncodeToString(v.Bytes())
+		case reflect.String:
+			return fmt.Sprintf("%q", v.Interface())
+		}
+	}
+
+	value, ok := formatScalar(v)
+	if !ok {
+		return "(unset)"
+	}
+	if v.Elem().Kind() == reflect.String {
+		if len(value) > maxDiffValueLen {
+			return strconv.Quote(value[:maxDiffValueLen]) + "..."
+		}
+		return strconv.Quote(value)
+	}
+	return value
+}
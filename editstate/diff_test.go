@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/pond/client/disk"
+)
+
+func TestDiffStates(t *testing.T) {
+	before := loadTestState(t)
+	if changes := diffStates(before, proto.Clone(before).(*disk.State)); len(changes) > 0 {
+		t.Fatalf("unexpected changes between identical states: %v", changes)
+	}
+
+	after := proto.Clone(before).(*disk.State)
+	bob := after.Contacts[0]
+	bob.Name = proto.String("Robert")
+	bob.KeyExchangeBytes = nil
+	after.Contacts = append(after.Contacts, &disk.Contact{
+		Id:       proto.Uint64(1),
+		Name:     proto.String("Carol"),
+		GroupKey: bob.GroupKey,
+	})
+	removed := after.Outbox[0]
+	after.Outbox = after.Outbox[1:]
+	after.DecoyServers = append(after.DecoyServers, "pondserver://decoy")
+	after.Identity = make([]byte, len(before.Identity))
+
+	var got []string
+	for _, change := range diffStates(before, after) {
+		got = append(got, change.String())
+	}
+	want := []string{
+		fmt.Sprintf("~ identity: %x... (32 bytes) -> 0000000000000000... (32 bytes)", before.Identity[:8]),
+		fmt.Sprintf("~ contacts[id=%d].name: \"Bob\" -> \"Robert\"", bob.GetId()),
+		"+ contacts[id=1] \"Carol\"",
+		fmt.Sprintf("- outbox[id=%d]", removed.GetId()),
+		"~ decoy_servers: [] -> [\"pondserver://decoy\"]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %q, want %q", got, want)
+	}
+}
+
+func TestDiffRepeatedWithoutIds(t *testing.T) {
+	before := &disk.State{
+		ReplayCache: []*disk.State_ReplayEntry{
+			{Hash: []byte{1}, Time: proto.Int64(1)},
+			{Hash: []byte{2}, Time: proto.Int64(2)},
+		},
+	}
+	after := &disk.State{
+		ReplayCache: []*disk.State_ReplayEntry{
+			{Hash: []byte{1}, Time: proto.Int64(3)},
+		},
+	}
+
+	var got []string
+	for _, change := range diffStates(before, after) {
+		got = append(got, change.String())
+	}
+	want := []string{
+		"~ replay_cache[0].time: 1 -> 3",
+		"- replay_cache[1]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %q, want %q", got, want)
+	}
+}
+
+func TestDiffAbbreviatedValues(t *testing.T) {
+	identity := make([]byte, 32)
+	server := "pondserver://ICYUHSAYGIXTKYKXSAHIBWEAQCTEF26WUWEPOVC764WYELCJMUPA@jb2bfqg7itlyo5ti5z4xwvxpglkkdzs7ro3pamrfhdbnisvj4yedqiqd.onion"
+	before := &disk.State{
+		Identity: identity,
+		Server:   proto.String(server),
+	}
+
+	// Each field is changed past the point at which it's abbreviated.
+	after := proto.Clone(before).(*disk.State)
+	after.Identity[31] ^= 1
+	after.Server = proto.String(server[:len(server)-7] + "a.onion")
+
+	var got []string
+	for _, change := range diffStates(before, after) {
+		got = append(got, change.path)
+	}
+	want := []string{"identity", "server"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes to %q, want %q", got, want)
+	}
+}
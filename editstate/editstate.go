@@ -25,11 +25,56 @@ import (
 )
 
 var stateFileName *string = flag.String("state-file", "state", "File in which to save persistent state")
+var dryRun *bool = flag.Bool("dry-run", false, "Print the changes that would be made to the state, but don't write it")
+var force *bool = flag.Bool("force", false, "Write the modified state even if the client would fail to load it")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] [command]
+
+With no command, the state is opened in $EDITOR. Otherwise the command is one
+of:
+
+  dump              Print the state to stdout.
+  get PATH          Print the value of the fields at PATH.
+  set PATH VALUE    Set the fields at PATH to VALUE. A repeated field is set
+                    to a list containing only VALUE.
+  apply FILE        Set fields from FILE, which contains a path and a value on
+                    each line. Use - to read from stdin.
+
+Paths use the field names from the protobuf definitions. Elements of repeated
+fields are selected by index or by the value of a field, for example:
+
+  contacts[0].name
+  contacts[name=alice].their_server
+
+Before the modified state is written, the changes are printed and, if stdin is
+a terminal, you are asked to confirm them.
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// commandArgs contains the number of arguments, including the command name,
+// for each of the non-interactive commands.
+var commandArgs = map[string]int{
+	"dump":  1,
+	"get":   2,
+	"set":   3,
+	"apply": 2,
+}
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	if !do() {
+	args := flag.Args()
+	if len(args) > 0 && commandArgs[args[0]] != len(args) {
+		usage()
+		os.Exit(2)
+	}
+
+	if !do(args) {
 		os.Exit(1)
 	}
 }
@@ -180,7 +225,10 @@ func serialiseValue(out io.Writer, name string, v reflect.Value, t reflect.Type,
 	fmt.Fprintf(out, "\n")
 }
 
-func parse(state *disk.State, in io.Reader, entities map[uint32][]byte) error {
+// parse sets state from the textual form in in. If lines is not nil then it's
+// filled with the line number of each field, keyed by its location in the form
+// used by disk.StateError.
+func parse(state *disk.State, in io.Reader, entities map[uint32][]byte, lines map[string]int) error {
 	tokenizer := NewTokenizer(in)
 	v := reflect.ValueOf(state).Elem()
 	t := reflect.TypeOf(state).Elem()
@@ -192,14 +240,14 @@ func parse(state *disk.State, in io.Reader, entities map[uint32][]byte) error {
 		if err != nil {
 			return err
 		}
-		if err := parseStructField(v, t, "", fieldName, tokenizer, entities); err != nil {
+		if err := parseStructField(v, t, "", "", fieldName, tokenizer, entities, lines); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func parseStruct(v reflect.Value, t reflect.Type, context string, in *Tokenizer, entities map[uint32][]byte) error {
+func parseStruct(v reflect.Value, t reflect.Type, context, path string, in *Tokenizer, entities map[uint32][]byte, lines map[string]int) error {
 	for {
 		fieldName, err := in.Next()
 		if err != nil {
@@ -208,7 +256,7 @@ func parseStruct(v reflect.Value, t reflect.Type, context string, in *Tokenizer,
 		if fieldName == ">" {
 			return nil
 		}
-		if err := parseStructField(v, t, context, fieldName, in, entities); err != nil {
+		if err := parseStructField(v, t, context, path, fieldName, in, entities, lines); err != nil {
 			return err
 		}
 	}
@@ -216,13 +264,20 @@ func parseStruct(v reflect.Value, t reflect.Type, context string, in *Tokenizer,
 	panic("unreachable")
 }
 
-func parseStructField(v reflect.Value, t reflect.Type, context, fieldName string, in *Tokenizer, entities map[uint32][]byte) error {
+func parseStructField(v reflect.Value, t reflect.Type, context, path, fieldName string, in *Tokenizer, entities map[uint32][]byte, lines map[string]int) error {
 	f, ok := t.FieldByName(fieldName)
 	if !ok {
 		return fmt.Errorf("line %d: unknown field '%s'", in.Line, fieldName)
 	}
 
 	fv := v.FieldByName(fieldName)
+	path = contextAppend(path, fieldName)
+	if f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Ptr {
+		path += fmt.Sprintf("[%d]", fv.Len())
+	}
+	if lines != nil {
+		lines[path] = in.Line
+	}
 
 	sep, err := in.Next()
 	if err != nil {
@@ -261,7 +316,7 @@ func parseStructField(v reflect.Value, t reflect.Type, context, fieldName string
 			}
 		}
 		value := reflect.New(protobufType)
-		if err := parseStruct(value.Elem(), value.Type().Elem(), contextAppend(context, fieldName), in, entities); err != nil {
+		if err := parseStruct(value.Elem(), value.Type().Elem(), contextAppend(context, fieldName), path, in, entities, lines); err != nil {
 			return err
 		}
 
@@ -394,6 +449,8 @@ func parseValue(v reflect.Value, t reflect.StructField, context string, in *Toke
 			if len(value) > 0 || alwaysSet {
 				v.SetBytes(value)
 			}
+		case reflect.String:
+			v.Set(reflect.Append(v, reflect.ValueOf(token)))
 		default:
 			return fmt.Errorf("line %d: unhandled type: slice of %s", in.Line, t.Type.Elem())
 		}
@@ -404,16 +461,215 @@ func parseValue(v reflect.Value, t reflect.StructField, context string, in *Toke
 	return nil
 }
 
-func do() bool {
-	if err := system.IsSafe(); err != nil {
-		fmt.Fprintf(os.Stderr, "System checks failed: %s\n", err)
-		return false
+// describeStateError formats err with the line number of the field that it
+// refers to, or of the closest enclosing field if that's missing.
+func describeStateError(err *disk.StateError, lines map[string]int) string {
+	path := err.Path
+	for len(path) > 0 {
+		if line, ok := lines[path]; ok {
+			return fmt.Sprintf("line %d: %s", line, err)
+		}
+		if i := strings.LastIndexAny(path, ".["); i != -1 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+	return err.Error()
+}
+
+// checkState runs the checks that the client makes when loading state and
+// prints any problems that were found. lines contains the line numbers of the
+// fields of state and may be nil. It returns true if the state should be
+// written, which is only the case for problematic states if --force was given.
+func checkState(state *disk.State, lines map[string]int) bool {
+	// The client accepts the servers of a test environment when run
+	// with POND=dev.
+	_, errs := disk.ParseState(state, os.Getenv("POND") == "dev")
+	if len(errs) == 0 {
+		return true
 	}
 
+	prefix := "Error"
+	if *force {
+		prefix = "Warning"
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, describeStateError(err, lines))
+	}
+	if *force {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "The client would fail to load this state. Use --force to write it anyway.\n")
+	return false
+}
+
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// eraseTempFile erases the temporary file, which contains the decrypted
+// state, and reports how well that worked.
+func eraseTempFile(path string) {
+	erasure, err := disk.EraseFile(path)
+	if err != nil {
+		logf("Error while erasing %s: %s", path, err)
+	}
+	logf("Temporary file %s: %s", path, erasure)
+}
+
+// edit allows the user to edit a textual form of state with $EDITOR and returns
+// the result.
+func edit(state *disk.State) (newStateSerialized []byte, ok bool) {
 	editor := os.Getenv("EDITOR")
 	if len(editor) == 0 {
 		fmt.Fprintf(os.Stderr, "$EDITOR is not set\n")
-		return false
+		return nil, false
+	}
+
+	tempDir, err := system.SafeTempDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get safe temp directory: %s\n", err)
+		return nil, false
+	}
+
+	tempFile, err := ioutil.TempFile(tempDir, "pond-editstate-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create temp file: %s\n", err)
+		return nil, false
+	}
+	tempFileName := tempFile.Name()
+	defer func() {
+		eraseTempFile(tempFileName)
+	}()
+
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		println("Caught signal: removing", tempFileName)
+		eraseTempFile(tempFileName)
+		os.Exit(1)
+	}()
+
+	entities := serialise(tempFile, state)
+
+	for {
+		cmd := exec.Command(editor, tempFileName)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run editor: %s\n", err)
+			return nil, false
+		}
+		tempFile.Close()
+		tempFile, err := os.Open(tempFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open temp file: %s\n", err)
+			return nil, false
+		}
+
+		newState := new(disk.State)
+		lines := make(map[string]int)
+		err = parse(newState, tempFile, entities, lines)
+		if err == nil {
+			newStateSerialized, err = proto.Marshal(newState)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing: %s\n", err)
+		} else if checkState(newState, lines) {
+			return newStateSerialized, true
+		}
+
+		fmt.Fprintf(os.Stderr, "Hit enter to edit again, or Ctrl-C to abort\n")
+
+		var buf [100]byte
+		os.Stdin.Read(buf[:])
+	}
+
+	panic("unreachable")
+}
+
+// runCommand runs one of the non-interactive commands on state. It returns
+// the new state if it was changed.
+func runCommand(state *disk.State, args []string) (newStateSerialized []byte, ok bool) {
+	v := reflect.ValueOf(state).Elem()
+
+	var n int
+	var err error
+	switch args[0] {
+	case "dump":
+		serialise(os.Stdout, state)
+		return nil, true
+	case "get":
+		if err := getPath(os.Stdout, v, args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return nil, false
+		}
+		return nil, true
+	case "set":
+		n, err = setPath(v, args[1], args[2])
+	case "apply":
+		in := os.Stdin
+		if args[1] != "-" {
+			if in, err = os.Open(args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to open patch file: %s\n", err)
+				return nil, false
+			}
+			defer in.Close()
+		}
+		n, err = applyPatch(v, in)
+	default:
+		panic("unknown command " + args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return nil, false
+	}
+	logf("Set %d field(s)", n)
+
+	// The result is parsed again, as if it had been edited, so that it's
+	// subject to the same checks. The serialised form isn't seen by the user
+	// so problems are reported without line numbers.
+	var buf bytes.Buffer
+	entities := serialise(&buf, state)
+	newState := new(disk.State)
+	if err := parse(newState, &buf, entities, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing: %s\n", err)
+		return nil, false
+	}
+	if !checkState(newState, nil) {
+		return nil, false
+	}
+	if newStateSerialized, err = proto.Marshal(newState); err != nil {
+		fmt.Fprintf(os.Stderr, "Error serialising state: %s\n", err)
+		return nil, false
+	}
+	return newStateSerialized, true
+}
+
+// confirm asks the user whether the changes should be written.
+func confirm() bool {
+	fmt.Fprintf(os.Stderr, "Write these changes? [y/N] ")
+	var buf [100]byte
+	n, _ := os.Stdin.Read(buf[:])
+	answer := strings.ToLower(strings.TrimSpace(string(buf[:n])))
+	return answer == "y" || answer == "yes"
+}
+
+func do(args []string) bool {
+	// Any failure to harden the process is reported by IsSafe.
+	system.Harden()
+	if err := system.IsSafe(*stateFileName); err != nil {
+		if problems, ok := err.(system.Problems); ok && !problems.Fatal() {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "System checks failed: %s\n", err)
+			return false
+		}
 	}
 
 	stateFile, err := os.Open(*stateFileName)
@@ -466,70 +722,50 @@ func do() bool {
 		copy(key[:], keySlice)
 	}
 
-	tempDir, err := system.SafeTempDir()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get safe temp directory: %s\n", err)
+	// The commands modify state in place so a copy of the original is
+	// kept in order to show the changes.
+	original := proto.Clone(state).(*disk.State)
+
+	var newStateSerialized []byte
+	if len(args) == 0 {
+		newStateSerialized, ok = edit(state)
+	} else {
+		newStateSerialized, ok = runCommand(state, args)
+	}
+	if !ok {
 		return false
 	}
+	if newStateSerialized == nil {
+		// The command didn't change the state.
+		return true
+	}
 
-	tempFile, err := ioutil.TempFile(tempDir, "pond-editstate-")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create temp file: %s\n", err)
+	newState := new(disk.State)
+	if err := proto.Unmarshal(newStateSerialized, newState); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse modified state: %s\n", err)
 		return false
 	}
-	tempFileName := tempFile.Name()
-	defer func() {
-		os.Remove(tempFileName)
-	}()
-
-	signals := make(chan os.Signal, 8)
-	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-signals
-		println("Caught signal: removing", tempFileName)
-		os.Remove(tempFileName)
-		os.Exit(1)
-	}()
-
-	entities := serialise(tempFile, state)
-
-	var newStateSerialized []byte
-	for {
-		cmd := exec.Command(editor, tempFileName)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		if err := cmd.Run(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to run editor: %s\n", err)
-			return false
-		}
-		tempFile.Close()
-		tempFile, err := os.Open(tempFileName)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open temp file: %s\n", err)
-			return false
-		}
-
-		newState := new(disk.State)
-		err = parse(newState, tempFile, entities)
-		if err == nil {
-			newStateSerialized, err = proto.Marshal(newState)
-		}
-		if err == nil {
-			break
-		}
-
-		fmt.Fprintf(os.Stderr, "Error parsing: %s\n", err)
-		fmt.Fprintf(os.Stderr, "Hit enter to edit again, or Ctrl-C to abort\n")
+	changes := diffStates(original, newState)
+	if len(changes) == 0 {
+		logf("No changes were made")
+		return true
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
 
-		var buf [100]byte
-		os.Stdin.Read(buf[:])
+	if *dryRun {
+		logf("Dry run: the modified state was not written")
+		return true
+	}
+	if terminal.IsTerminal(0) && !confirm() {
+		logf("The modified state was not written")
+		return false
 	}
 
 	states := make(chan []byte)
 	done := make(chan bool)
-	go disk.StateWriter(*stateFileName, &key, &salt, states, done)
+	go disk.StateWriter(*stateFileName, &key, &salt, states, done, logf)
 	states <- newStateSerialized
 	close(states)
 	<-done
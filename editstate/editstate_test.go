@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
 
 	"code.google.com/p/goprotobuf/proto"
@@ -26,7 +29,7 @@ func TestSerializedDeserialize(t *testing.T) {
 	textual := append([]byte(nil), buffer.Bytes()...)
 	ioutil.WriteFile("text", []byte(textual), 0600)
 	newState := new(disk.State)
-	if err := parse(newState, &buffer, entities); err != nil {
+	if err := parse(newState, &buffer, entities, nil); err != nil {
 		t.Fatalf("Failed to parse textual stateproto: %s", err)
 	}
 
@@ -47,3 +50,127 @@ func TestSerializedDeserialize(t *testing.T) {
 		t.Fatalf("Result does not equal original")
 	}
 }
+
+func TestCheckState(t *testing.T) {
+	state := loadTestState(t)
+	if _, errs := disk.ParseState(state, true); len(errs) > 0 {
+		t.Fatalf("test state has problems: %s", errs[0])
+	}
+
+	var buffer bytes.Buffer
+	entities := serialise(&buffer, state)
+
+	// Truncate our identity key and remove the contact's server.
+	var identityLine, contactLine int
+	var edited []string
+	for i, line := range strings.Split(buffer.String(), "\n") {
+		switch {
+		case strings.HasPrefix(line, "Identity: "):
+			identityLine = i + 1
+			line = "Identity: 0011"
+		case strings.HasPrefix(line, "Contacts <"):
+			contactLine = i + 1
+		case strings.HasPrefix(line, "\tTheirServer: "):
+			continue
+		}
+		edited = append(edited, line)
+	}
+
+	newState := new(disk.State)
+	lines := make(map[string]int)
+	if err := parse(newState, strings.NewReader(strings.Join(edited, "\n")), entities, lines); err != nil {
+		t.Fatalf("Failed to parse edited state: %s", err)
+	}
+
+	_, errs := disk.ParseState(newState, true)
+	var got []string
+	for _, err := range errs {
+		got = append(got, describeStateError(err, lines))
+	}
+	want := []string{
+		fmt.Sprintf("line %d: Identity: must be 32 bytes long, not 2", identityLine),
+		fmt.Sprintf("line %d: Contacts[0]: contact has no server", contactLine),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors %q, want %q", got, want)
+	}
+}
+
+func TestCheckStateReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		testing bool
+		edit    func(state *disk.State)
+		// wantErr is a prefix of the first error, or empty if the
+		// state should be accepted.
+		wantErr string
+	}{
+		{
+			name:    "duplicate contact",
+			testing: true,
+			edit: func(state *disk.State) {
+				state.Contacts = append(state.Contacts, proto.Clone(state.Contacts[0]).(*disk.Contact))
+			},
+			wantErr: "Contacts[1].Id: another contact has the same id",
+		},
+		{
+			name:    "message from unknown contact",
+			testing: true,
+			edit:    func(state *disk.State) { state.Inbox[0].From = proto.Uint64(1) },
+			wantErr: "Inbox[0].From: no such contact",
+		},
+		{
+			name:    "message from home server",
+			testing: true,
+			edit:    func(state *disk.State) { state.Inbox[0].From = proto.Uint64(0) },
+		},
+		{
+			name:    "message to unknown contact",
+			testing: true,
+			edit:    func(state *disk.State) { state.Outbox[0].To = proto.Uint64(1) },
+			wantErr: "Outbox[0].To: no such contact",
+		},
+		{
+			name:    "revocation for deleted contact",
+			testing: true,
+			edit: func(state *disk.State) {
+				state.Outbox[0].To = proto.Uint64(1)
+				state.Outbox[0].Revocation = proto.Bool(true)
+			},
+		},
+		{
+			name:    "draft to unknown contact",
+			testing: true,
+			edit:    func(state *disk.State) { state.Drafts[0].To = proto.Uint64(1) },
+			wantErr: "Drafts[0].To: no such contact",
+		},
+		{
+			name:    "bad contact server",
+			testing: true,
+			edit: func(state *disk.State) {
+				state.Contacts[0].TheirServer = proto.String("pondserver://127.0.0.1")
+			},
+			wantErr: "Contacts[0].TheirServer: not a valid server: no server ID in URL",
+		},
+		{
+			name:    "test server outside of testing",
+			wantErr: "Server: not a valid server: URL contains a port number",
+		},
+	}
+
+	for _, test := range tests {
+		state := loadTestState(t)
+		if test.edit != nil {
+			test.edit(state)
+		}
+		_, errs := disk.ParseState(state, test.testing)
+		switch {
+		case len(test.wantErr) == 0 && len(errs) > 0:
+			t.Errorf("%s: unexpected error: %s", test.name, errs[0])
+		case len(test.wantErr) > 0 && len(errs) == 0:
+			t.Errorf("%s: state was accepted", test.name)
+		case len(test.wantErr) > 0 && !strings.HasPrefix(errs[0].Error(), test.wantErr):
+			t.Errorf("%s: got error %q, want %q", test.name, errs[0], test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A pathElement is one component of a path such as
+// contacts[name=alice].their_server. Field names are the names from the
+// protobuf definitions.
+type pathElement struct {
+	name string
+	// index, if not -1, selects a single element of a repeated field.
+	index int
+	// If selectField is not empty then only the elements of a repeated
+	// field where selectField has the value selectValue are selected.
+	selectField, selectValue string
+}
+
+func parsePath(path string) ([]pathElement, error) {
+	var elements []pathElement
+
+	for len(path) > 0 {
+		element := pathElement{index: -1}
+
+		end := strings.IndexAny(path, ".[")
+		if end == -1 {
+			end = len(path)
+		}
+		element.name = path[:end]
+		if len(element.name) == 0 {
+			return nil, errors.New("empty field name in path")
+		}
+		path = path[end:]
+
+		if strings.HasPrefix(path, "[") {
+			// Selector values may contain dots, so the selector
+			// runs to the closing bracket.
+			end := strings.IndexRune(path, ']')
+			if end == -1 {
+				return nil, errors.New("missing ']' in path")
+			}
+			selector := path[1:end]
+			path = path[end+1:]
+
+			if i := strings.IndexRune(selector, '='); i != -1 {
+				element.selectField = selector[:i]
+				element.selectValue = selector[i+1:]
+				if len(element.selectField) == 0 {
+					return nil, errors.New("empty field name in selector")
+				}
+			} else {
+				index, err := strconv.Atoi(selector)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("bad index '%s' in path", selector)
+				}
+				element.index = index
+			}
+		}
+
+		if len(path) > 0 {
+			if path[0] != '.' {
+				return nil, fmt.Errorf("unexpected '%c' in path", path[0])
+			}
+			path = path[1:]
+			if len(path) == 0 {
+				return nil, errors.New("path ends with '.'")
+			}
+		}
+
+		elements = append(elements, element)
+	}
+
+	if len(elements) == 0 {
+		return nil, errors.New("empty path")
+	}
+	return elements, nil
+}
+
+// protoName returns the name of a field in the protobuf definition.
+func protoName(f reflect.StructField) string {
+	for _, part := range strings.Split(f.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(part, "name=") {
+			return part[5:]
+		}
+	}
+	return ""
+}
+
+func fieldByProtoName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); protoName(f) == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// isMessageField returns true if f contains a protocol buffer, or a slice of
+// them.
+func isMessageField(f reflect.StructField) bool {
+	switch f.Type.Kind() {
+	case reflect.Ptr:
+		return f.Type.Elem().Kind() == reflect.Struct
+	case reflect.Slice:
+		return f.Type.Elem().Kind() == reflect.Ptr && f.Type.Elem().Elem().Kind() == reflect.Struct
+	}
+	return false
+}
+
+// formatScalar returns the value of a non-message field in the form that's
+// used in paths and printed by get. It returns false if the field is unset.
+func formatScalar(v reflect.Value) (string, bool) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	case reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+	case reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.IsNil() {
+				return "", false
+			}
+			return hex.EncodeToString(v.Bytes()), true
+		}
+		strs := make([]string, v.Len())
+		for i := range strs {
+			strs[i] = v.Index(i).String()
+		}
+		return strings.Join(strs, "\n"), v.Len() > 0
+	}
+	panic(fmt.Sprintf("Don't know how to format a %s", v.Type()))
+}
+
+// A pathTarget is a field, or an element of a repeated field, that a path
+// refers to.
+type pathTarget struct {
+	// parent is the message that contains the field.
+	parent reflect.Value
+	field  reflect.StructField
+	// elem is set when the target is a single message.
+	elem reflect.Value
+	// context is the position of parent in the state, in the form used
+	// by serialise.
+	context string
+}
+
+// selectElements returns the messages in fv, a message field, that match
+// element.
+func selectElements(fv reflect.Value, element pathElement) ([]reflect.Value, error) {
+	var candidates []reflect.Value
+	if fv.Kind() == reflect.Ptr {
+		if element.index != -1 {
+			return nil, fmt.Errorf("field '%s' isn't repeated", element.name)
+		}
+		if !fv.IsNil() {
+			candidates = append(candidates, fv.Elem())
+		}
+	} else {
+		for i := 0; i < fv.Len(); i++ {
+			if element.index == -1 || element.index == i {
+				candidates = append(candidates, fv.Index(i).Elem())
+			}
+		}
+	}
+
+	if len(element.selectField) == 0 {
+		return candidates, nil
+	}
+
+	var selected []reflect.Value
+	for _, candidate := range candidates {
+		f, ok := fieldByProtoName(candidate.Type(), element.selectField)
+		if !ok || isMessageField(f) {
+			return nil, fmt.Errorf("cannot select '%s' elements by '%s'", element.name, element.selectField)
+		}
+		if value, ok := formatScalar(candidate.FieldByIndex(f.Index)); ok && value == element.selectValue {
+			selected = append(selected, candidate)
+		}
+	}
+	return selected, nil
+}
+
+// resolvePath returns the fields of state that path refers to. The state
+// must be addressable so that the results can be set.
+func resolvePath(state reflect.Value, path string) ([]pathTarget, error) {
+	elements, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []reflect.Value{state}
+	context := ""
+	var targets []pathTarget
+
+	for i, element := range elements {
+		isLast := i == len(elements)-1
+		var next []reflect.Value
+		var fieldName string
+
+		for _, msg := range messages {
+			f, ok := fieldByProtoName(msg.Type(), element.name)
+			if !ok {
+				return nil, fmt.Errorf("%s has no field '%s'", msg.Type().Name(), element.name)
+			}
+			fieldName = f.Name
+
+			if !isMessageField(f) {
+				if !isLast {
+					if (context == "Inbox" || context == "Outbox") && f.Name == "Message" {
+						return nil, errors.New("cannot descend into serialised messages")
+					}
+					return nil, fmt.Errorf("field '%s' isn't a message", element.name)
+				}
+				if element.index != -1 || len(element.selectField) > 0 {
+					return nil, fmt.Errorf("field '%s' isn't a repeated message", element.name)
+				}
+				targets = append(targets, pathTarget{parent: msg, field: f, context: context})
+				continue
+			}
+
+			selected, err := selectElements(msg.FieldByIndex(f.Index), element)
+			if err != nil {
+				return nil, err
+			}
+			if isLast {
+				for _, elem := range selected {
+					targets = append(targets, pathTarget{parent: msg, field: f, elem: elem, context: context})
+				}
+			}
+			next = append(next, selected...)
+		}
+
+		messages = next
+		context = contextAppend(context, fieldName)
+	}
+
+	return targets, nil
+}
+
+// getPath writes the values of the fields of state that path refers to, one
+// per line, or in the serialised form for messages.
+func getPath(out io.Writer, state reflect.Value, path string) error {
+	targets, err := resolvePath(state, path)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	entities := make(map[uint32][]byte)
+	for _, target := range targets {
+		if target.elem.IsValid() {
+			serialiseValue(out, target.field.Name, target.elem, target.elem.Type(), target.context, 0, entities)
+			found = true
+			continue
+		}
+		if value, ok := formatScalar(target.parent.FieldByIndex(target.field.Index)); ok {
+			fmt.Fprintf(out, "%s\n", value)
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("nothing matched '%s'", path)
+	}
+	return nil
+}
+
+// setPath sets the fields of state that path refers to, which must not be
+// messages, to value. A repeated field is set to a list containing only
+// value. It returns the number of fields that were set.
+func setPath(state reflect.Value, path, value string) (int, error) {
+	targets, err := resolvePath(state, path)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, target := range targets {
+		if target.elem.IsValid() {
+			return 0, fmt.Errorf("'%s' is a message: set its fields instead", path)
+		}
+		// parseValue takes its input from a Tokenizer so the value is
+		// quoted in order to be taken literally.
+		in := NewTokenizer(strings.NewReader("\"" + escapeString(value) + "\""))
+		fv := target.parent.FieldByIndex(target.field.Index)
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String {
+			// parseValue appends to repeated fields.
+			fv.Set(reflect.Zero(fv.Type()))
+		}
+		if err := parseValue(fv, target.field, contextAppend(target.context, target.field.Name), in, nil); err != nil {
+			return 0, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	if len(targets) == 0 {
+		return 0, fmt.Errorf("nothing matched '%s'", path)
+	}
+	return len(targets), nil
+}
+
+// applyPatch sets fields of state from the lines of in, each of which
+// contains a path and a value, in the same form as the serialised state. For
+// example:
+//
+//	contacts[name=alice].their_server "pond://..."
+//
+// Blank lines and lines starting with '#' are ignored.
+func applyPatch(state reflect.Value, in io.Reader) (int, error) {
+	contents, err := ioutil.ReadAll(in)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for i, line := range strings.Split(string(contents), "\n") {
+		lineNo := i + 1
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		end := strings.IndexFunc(line, unicode.IsSpace)
+		if end == -1 {
+			return 0, fmt.Errorf("line %d: missing value", lineNo)
+		}
+		path := line[:end]
+
+		tokenizer := NewTokenizer(strings.NewReader(line[end:]))
+		value, err := tokenizer.Next()
+		if err != nil {
+			return 0, fmt.Errorf("line %d: failed to read value: %s", lineNo, err)
+		}
+		if _, err := tokenizer.Next(); err != io.EOF {
+			return 0, fmt.Errorf("line %d: unexpected data after value (values containing punctuation must be quoted)", lineNo)
+		}
+
+		n, err := setPath(state, path, value)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		total += n
+	}
+
+	return total, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/pond/client/disk"
+)
+
+var parsePathTests = []struct {
+	in  string
+	out []pathElement
+	err bool
+}{
+	{in: "server", out: []pathElement{{name: "server", index: -1}}},
+	{in: "contacts[2].name", out: []pathElement{{name: "contacts", index: 2}, {name: "name", index: -1}}},
+	{in: "contacts[their_server=pond://a@b.onion].id", out: []pathElement{
+		{name: "contacts", index: -1, selectField: "their_server", selectValue: "pond://a@b.onion"},
+		{name: "id", index: -1},
+	}},
+	{in: "", err: true},
+	{in: "contacts.", err: true},
+	{in: "contacts..name", err: true},
+	{in: "contacts[0", err: true},
+	{in: "contacts[x].name", err: true},
+	{in: "contacts[0]name", err: true},
+}
+
+func TestParsePath(t *testing.T) {
+	for _, test := range parsePathTests {
+		out, err := parsePath(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected error but got %#v", test.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%q: got %#v, want %#v", test.in, out, test.out)
+		}
+	}
+}
+
+func loadTestState(t *testing.T) *disk.State {
+	serialized, err := ioutil.ReadFile("testdata/stateproto")
+	if err != nil {
+		t.Fatalf("Failed to read stateproto: %s", err)
+	}
+	state := new(disk.State)
+	if err := proto.Unmarshal(serialized, state); err != nil {
+		t.Fatalf("Failed to parse stateproto: %s", err)
+	}
+	return state
+}
+
+func getString(t *testing.T, state *disk.State, path string) string {
+	var out bytes.Buffer
+	if err := getPath(&out, reflect.ValueOf(state).Elem(), path); err != nil {
+		t.Fatalf("get %s failed: %s", path, err)
+	}
+	return out.String()
+}
+
+func TestGetSetPath(t *testing.T) {
+	state := loadTestState(t)
+	v := reflect.ValueOf(state).Elem()
+
+	if name := getString(t, state, "contacts[0].name"); name != "Bob\n" {
+		t.Errorf("contacts[0].name is %q", name)
+	}
+	if id := getString(t, state, "contacts[name=Bob].id"); id != getString(t, state, "outbox[0].to") {
+		t.Errorf("contact id %q doesn't match outbox", id)
+	}
+	if s := getString(t, state, "contacts[name=Bob]"); !strings.HasPrefix(s, "Contacts <\n") {
+		t.Errorf("message printed as %q", s)
+	}
+
+	const newServer = "pondserver://NEW@example.onion:16333"
+	oldServer := strings.TrimSpace(getString(t, state, "contacts[name=Bob].their_server"))
+	n, err := setPath(v, "contacts[their_server="+oldServer+"].their_server", newServer)
+	if err != nil {
+		t.Fatalf("set failed: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("set %d fields, want 1", n)
+	}
+	if got := state.Contacts[0].GetTheirServer(); got != newServer {
+		t.Errorf("server is %q after set", got)
+	}
+
+	if _, err := setPath(v, "contacts[name=Bob].id", "42"); err != nil {
+		t.Fatalf("set of integer failed: %s", err)
+	}
+	if state.Contacts[0].GetId() != 42 {
+		t.Errorf("id is %d after set", state.Contacts[0].GetId())
+	}
+
+	state.DecoyServers = []string{"pondserver://old1", "pondserver://old2"}
+	const decoy = "pondserver://decoy"
+	if _, err := setPath(v, "decoy_servers", decoy); err != nil {
+		t.Fatalf("set of repeated string failed: %s", err)
+	}
+	if !reflect.DeepEqual(state.DecoyServers, []string{decoy}) {
+		t.Errorf("decoy servers are %q after set", state.DecoyServers)
+	}
+
+	for _, path := range []string{"contacts[name=Bob].id", "nosuchfield", "contacts[name=Bob]", "inbox.message.body"} {
+		if _, err := setPath(v, path, "foo"); err == nil {
+			t.Errorf("set of %s succeeded", path)
+		}
+	}
+	if _, err := setPath(v, "contacts[name=Alice].name", "Carol"); err == nil {
+		t.Errorf("set with no matches succeeded")
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	state := loadTestState(t)
+	v := reflect.ValueOf(state).Elem()
+
+	patch := `# Move Bob to a new server.
+contacts[name=Bob].their_server "pondserver://NEW@example.onion:16333"
+
+contacts[name=Bob].name Robert
+`
+	n, err := applyPatch(v, strings.NewReader(patch))
+	if err != nil {
+		t.Fatalf("applyPatch failed: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("patch set %d fields, want 2", n)
+	}
+	if name := state.Contacts[0].GetName(); name != "Robert" {
+		t.Errorf("name is %q after patch", name)
+	}
+
+	for _, patch := range []string{
+		"contacts[name=Bob].their_server pondserver://unquoted",
+		"contacts[name=Bob].name",
+		"contacts[name=Bob].id notanumber",
+	} {
+		if _, err := applyPatch(v, strings.NewReader(patch)); err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+			t.Errorf("%q: bad error %v", patch, err)
+		}
+	}
+}
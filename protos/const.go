@@ -20,3 +20,9 @@ const MessageOverhead = 512
 //    [serialized message     ]  |           |
 //    [padding                ] -|          -|
 const MaxSerializedMessage = TransportSize - box.Overhead - MessageOverhead - 24 - 4
+
+// UploadForDeliveryPrefix is prepended to the serialised Upload in an
+// UploadForDelivery before it's hashed and signed. Delivered messages are
+// signed with the same keys so, without it, the signature on one could be
+// presented as the signature on the other.
+const UploadForDeliveryPrefix = "pond upload for delivery\x00"
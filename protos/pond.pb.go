@@ -34,6 +34,7 @@ const (
 	Reply_RESUME_PAST_END_OF_FILE    Reply_Status = 21
 	Reply_GENERATION_REVOKED         Reply_Status = 22
 	Reply_CANNOT_PARSE_REVOCATION    Reply_Status = 23
+	Reply_FILE_EXISTS                Reply_Status = 24
 )
 
 var Reply_Status_name = map[int32]string{
@@ -55,6 +56,7 @@ var Reply_Status_name = map[int32]string{
 	21: "RESUME_PAST_END_OF_FILE",
 	22: "GENERATION_REVOKED",
 	23: "CANNOT_PARSE_REVOCATION",
+	24: "FILE_EXISTS",
 }
 var Reply_Status_value = map[string]int32{
 	"OK":                         0,
@@ -75,6 +77,7 @@ var Reply_Status_value = map[string]int32{
 	"RESUME_PAST_END_OF_FILE":    21,
 	"GENERATION_REVOKED":         22,
 	"CANNOT_PARSE_REVOCATION":    23,
+	"FILE_EXISTS":                24,
 }
 
 func (x Reply_Status) Enum() *Reply_Status {
@@ -134,13 +137,16 @@ func (x *Message_Encoding) UnmarshalJSON(data []byte) error {
 }
 
 type Request struct {
-	NewAccount       *NewAccount       `protobuf:"bytes,1,opt,name=new_account" json:"new_account,omitempty"`
-	Deliver          *Delivery         `protobuf:"bytes,2,opt,name=deliver" json:"deliver,omitempty"`
-	Fetch            *Fetch            `protobuf:"bytes,3,opt,name=fetch" json:"fetch,omitempty"`
-	Upload           *Upload           `protobuf:"bytes,4,opt,name=upload" json:"upload,omitempty"`
-	Download         *Download         `protobuf:"bytes,5,opt,name=download" json:"download,omitempty"`
-	Revocation       *SignedRevocation `protobuf:"bytes,6,opt,name=revocation" json:"revocation,omitempty"`
-	XXX_unrecognized []byte            `json:"-"`
+	NewAccount        *NewAccount        `protobuf:"bytes,1,opt,name=new_account" json:"new_account,omitempty"`
+	Deliver           *Delivery          `protobuf:"bytes,2,opt,name=deliver" json:"deliver,omitempty"`
+	Fetch             *Fetch             `protobuf:"bytes,3,opt,name=fetch" json:"fetch,omitempty"`
+	Upload            *Upload            `protobuf:"bytes,4,opt,name=upload" json:"upload,omitempty"`
+	Download          *Download          `protobuf:"bytes,5,opt,name=download" json:"download,omitempty"`
+	Revocation        *SignedRevocation  `protobuf:"bytes,6,opt,name=revocation" json:"revocation,omitempty"`
+	DeleteFile        *DeleteFile        `protobuf:"bytes,7,opt,name=delete_file" json:"delete_file,omitempty"`
+	ListFiles         *ListFiles         `protobuf:"bytes,8,opt,name=list_files" json:"list_files,omitempty"`
+	UploadForDelivery *UploadForDelivery `protobuf:"bytes,9,opt,name=upload_for_delivery" json:"upload_for_delivery,omitempty"`
+	XXX_unrecognized  []byte             `json:"-"`
 }
 
 func (this *Request) Reset()         { *this = Request{} }
@@ -189,6 +195,27 @@ func (this *Request) GetRevocation() *SignedRevocation {
 	return nil
 }
 
+func (this *Request) GetDeleteFile() *DeleteFile {
+	if this != nil {
+		return this.DeleteFile
+	}
+	return nil
+}
+
+func (this *Request) GetListFiles() *ListFiles {
+	if this != nil {
+		return this.ListFiles
+	}
+	return nil
+}
+
+func (this *Request) GetUploadForDelivery() *UploadForDelivery {
+	if this != nil {
+		return this.UploadForDelivery
+	}
+	return nil
+}
+
 type Reply struct {
 	Status           *Reply_Status     `protobuf:"varint,1,opt,name=status,enum=protos.Reply_Status,def=0" json:"status,omitempty"`
 	AccountCreated   *AccountCreated   `protobuf:"bytes,2,opt,name=account_created" json:"account_created,omitempty"`
@@ -197,6 +224,7 @@ type Reply struct {
 	Upload           *UploadReply      `protobuf:"bytes,5,opt,name=upload" json:"upload,omitempty"`
 	Download         *DownloadReply    `protobuf:"bytes,6,opt,name=download" json:"download,omitempty"`
 	Revocation       *SignedRevocation `protobuf:"bytes,7,opt,name=revocation" json:"revocation,omitempty"`
+	Files            *FileList         `protobuf:"bytes,8,opt,name=files" json:"files,omitempty"`
 	XXX_unrecognized []byte            `json:"-"`
 }
 
@@ -255,6 +283,13 @@ func (this *Reply) GetRevocation() *SignedRevocation {
 	return nil
 }
 
+func (this *Reply) GetFiles() *FileList {
+	if this != nil {
+		return this.Files
+	}
+	return nil
+}
+
 type NewAccount struct {
 	Generation       *uint32 `protobuf:"fixed32,1,req,name=generation" json:"generation,omitempty"`
 	Group            []byte  `protobuf:"bytes,2,req,name=group" json:"group,omitempty"`
@@ -324,6 +359,7 @@ type Delivery struct {
 	Signature        []byte  `protobuf:"bytes,2,req,name=signature" json:"signature,omitempty"`
 	Generation       *uint32 `protobuf:"fixed32,3,req,name=generation" json:"generation,omitempty"`
 	Message          []byte  `protobuf:"bytes,4,req,name=message" json:"message,omitempty"`
+	Cover            *bool   `protobuf:"varint,5,opt,name=cover" json:"cover,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -359,6 +395,13 @@ func (this *Delivery) GetMessage() []byte {
 	return nil
 }
 
+func (this *Delivery) GetCover() bool {
+	if this != nil && this.Cover != nil {
+		return *this.Cover
+	}
+	return false
+}
+
 type Fetch struct {
 	XXX_unrecognized []byte `json:"-"`
 }
@@ -426,6 +469,8 @@ func (this *ServerAnnounce) GetMessage() *Message {
 type Upload struct {
 	Id               *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
 	Size             *int64  `protobuf:"varint,2,req,name=size" json:"size,omitempty"`
+	Expiry           *int64  `protobuf:"varint,3,opt,name=expiry" json:"expiry,omitempty"`
+	MaxDownloads     *uint32 `protobuf:"varint,4,opt,name=max_downloads" json:"max_downloads,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -447,6 +492,20 @@ func (this *Upload) GetSize() int64 {
 	return 0
 }
 
+func (this *Upload) GetExpiry() int64 {
+	if this != nil && this.Expiry != nil {
+		return *this.Expiry
+	}
+	return 0
+}
+
+func (this *Upload) GetMaxDownloads() uint32 {
+	if this != nil && this.MaxDownloads != nil {
+		return *this.MaxDownloads
+	}
+	return 0
+}
+
 type UploadReply struct {
 	Resume           *int64 `protobuf:"varint,1,opt,name=resume" json:"resume,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
@@ -463,6 +522,46 @@ func (this *UploadReply) GetResume() int64 {
 	return 0
 }
 
+type UploadForDelivery struct {
+	To               []byte  `protobuf:"bytes,1,req,name=to" json:"to,omitempty"`
+	Signature        []byte  `protobuf:"bytes,2,req,name=signature" json:"signature,omitempty"`
+	Generation       *uint32 `protobuf:"fixed32,3,req,name=generation" json:"generation,omitempty"`
+	Upload           []byte  `protobuf:"bytes,4,req,name=upload" json:"upload,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *UploadForDelivery) Reset()         { *this = UploadForDelivery{} }
+func (this *UploadForDelivery) String() string { return proto.CompactTextString(this) }
+func (*UploadForDelivery) ProtoMessage()       {}
+
+func (this *UploadForDelivery) GetTo() []byte {
+	if this != nil {
+		return this.To
+	}
+	return nil
+}
+
+func (this *UploadForDelivery) GetSignature() []byte {
+	if this != nil {
+		return this.Signature
+	}
+	return nil
+}
+
+func (this *UploadForDelivery) GetGeneration() uint32 {
+	if this != nil && this.Generation != nil {
+		return *this.Generation
+	}
+	return 0
+}
+
+func (this *UploadForDelivery) GetUpload() []byte {
+	if this != nil {
+		return this.Upload
+	}
+	return nil
+}
+
 type Download struct {
 	From             []byte  `protobuf:"bytes,1,req,name=from" json:"from,omitempty"`
 	Id               *uint64 `protobuf:"fixed64,2,req,name=id" json:"id,omitempty"`
@@ -511,6 +610,119 @@ func (this *DownloadReply) GetSize() int64 {
 	return 0
 }
 
+type DeleteFile struct {
+	Id               *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *DeleteFile) Reset()         { *this = DeleteFile{} }
+func (this *DeleteFile) String() string { return proto.CompactTextString(this) }
+func (*DeleteFile) ProtoMessage()       {}
+
+func (this *DeleteFile) GetId() uint64 {
+	if this != nil && this.Id != nil {
+		return *this.Id
+	}
+	return 0
+}
+
+type ListFiles struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (this *ListFiles) Reset()         { *this = ListFiles{} }
+func (this *ListFiles) String() string { return proto.CompactTextString(this) }
+func (*ListFiles) ProtoMessage()       {}
+
+type FileList struct {
+	Files            []*FileList_File `protobuf:"bytes,1,rep,name=files" json:"files,omitempty"`
+	Count            *uint32          `protobuf:"varint,2,req,name=count" json:"count,omitempty"`
+	Size             *int64           `protobuf:"varint,3,req,name=size" json:"size,omitempty"`
+	MaxCount         *uint32          `protobuf:"varint,4,req,name=max_count" json:"max_count,omitempty"`
+	MaxSize          *int64           `protobuf:"varint,5,req,name=max_size" json:"max_size,omitempty"`
+	XXX_unrecognized []byte           `json:"-"`
+}
+
+func (this *FileList) Reset()         { *this = FileList{} }
+func (this *FileList) String() string { return proto.CompactTextString(this) }
+func (*FileList) ProtoMessage()       {}
+
+func (this *FileList) GetCount() uint32 {
+	if this != nil && this.Count != nil {
+		return *this.Count
+	}
+	return 0
+}
+
+func (this *FileList) GetSize() int64 {
+	if this != nil && this.Size != nil {
+		return *this.Size
+	}
+	return 0
+}
+
+func (this *FileList) GetMaxCount() uint32 {
+	if this != nil && this.MaxCount != nil {
+		return *this.MaxCount
+	}
+	return 0
+}
+
+func (this *FileList) GetMaxSize() int64 {
+	if this != nil && this.MaxSize != nil {
+		return *this.MaxSize
+	}
+	return 0
+}
+
+type FileList_File struct {
+	Id                 *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	Size               *int64  `protobuf:"varint,2,req,name=size" json:"size,omitempty"`
+	Modified           *int64  `protobuf:"varint,3,req,name=modified" json:"modified,omitempty"`
+	Expiry             *int64  `protobuf:"varint,4,opt,name=expiry" json:"expiry,omitempty"`
+	DownloadsRemaining *uint32 `protobuf:"varint,5,opt,name=downloads_remaining" json:"downloads_remaining,omitempty"`
+	XXX_unrecognized   []byte  `json:"-"`
+}
+
+func (this *FileList_File) Reset()         { *this = FileList_File{} }
+func (this *FileList_File) String() string { return proto.CompactTextString(this) }
+func (*FileList_File) ProtoMessage()       {}
+
+func (this *FileList_File) GetId() uint64 {
+	if this != nil && this.Id != nil {
+		return *this.Id
+	}
+	return 0
+}
+
+func (this *FileList_File) GetSize() int64 {
+	if this != nil && this.Size != nil {
+		return *this.Size
+	}
+	return 0
+}
+
+func (this *FileList_File) GetModified() int64 {
+	if this != nil && this.Modified != nil {
+		return *this.Modified
+	}
+	return 0
+}
+
+func (this *FileList_File) GetExpiry() int64 {
+	if this != nil && this.Expiry != nil {
+		return *this.Expiry
+	}
+	return 0
+}
+
+func (this *FileList_File) GetDownloadsRemaining() uint32 {
+	if this != nil && this.DownloadsRemaining != nil {
+		return *this.DownloadsRemaining
+	}
+	return 0
+}
+
 type SignedRevocation struct {
 	Revocation       *SignedRevocation_Revocation `protobuf:"bytes,1,req,name=revocation" json:"revocation,omitempty"`
 	Signature        []byte                       `protobuf:"bytes,2,req,name=signature" json:"signature,omitempty"`
@@ -657,6 +869,7 @@ type Message struct {
 	Files            []*Message_Attachment `protobuf:"bytes,7,rep,name=files" json:"files,omitempty"`
 	DetachedFiles    []*Message_Detachment `protobuf:"bytes,8,rep,name=detached_files" json:"detached_files,omitempty"`
 	SupportedVersion *int32                `protobuf:"varint,9,opt,name=supported_version" json:"supported_version,omitempty"`
+	DeliveryReceipt  *bool                 `protobuf:"varint,10,opt,name=delivery_receipt" json:"delivery_receipt,omitempty"`
 	XXX_unrecognized []byte                `json:"-"`
 }
 
@@ -727,6 +940,13 @@ func (this *Message) GetSupportedVersion() int32 {
 	return 0
 }
 
+func (this *Message) GetDeliveryReceipt() bool {
+	if this != nil && this.DeliveryReceipt != nil {
+		return *this.DeliveryReceipt
+	}
+	return false
+}
+
 type Message_Attachment struct {
 	Filename         *string `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
 	Contents         []byte  `protobuf:"bytes,2,req,name=contents" json:"contents,omitempty"`
@@ -758,6 +978,7 @@ type Message_Detachment struct {
 	ChunkSize        *uint32 `protobuf:"varint,4,req,name=chunk_size" json:"chunk_size,omitempty"`
 	Key              []byte  `protobuf:"bytes,5,req,name=key" json:"key,omitempty"`
 	Url              *string `protobuf:"bytes,6,opt,name=url" json:"url,omitempty"`
+	Hash             []byte  `protobuf:"bytes,7,opt,name=hash" json:"hash,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -807,6 +1028,13 @@ func (this *Message_Detachment) GetUrl() string {
 	return ""
 }
 
+func (this *Message_Detachment) GetHash() []byte {
+	if this != nil {
+		return this.Hash
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("protos.Reply_Status", Reply_Status_name, Reply_Status_value)
 	proto.RegisterEnum("protos.Message_Encoding", Message_Encoding_name, Message_Encoding_value)
@@ -2,6 +2,8 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -44,6 +46,17 @@ type Account struct {
 	filesValid bool
 	filesCount int
 	filesSize  int64
+	// downloadClaims contains, for each file with a download limit, the
+	// downloads that have been claimed but not yet counted.
+	downloadClaims map[uint64][]*downloadClaim
+}
+
+// A downloadClaim reserves one of the downloads of a file with a download
+// limit. The download is counted once a transfer under the claim completes. If
+// the claim's first transfer is interrupted then it may be resumed once, and
+// the download is counted when that second transfer ends however it ends.
+type downloadClaim struct {
+	resumed bool
 }
 
 func NewAccount(s *Server, id *[32]byte) *Account {
@@ -90,6 +103,26 @@ func (a *Account) RevocationPath() string {
 	return filepath.Join(a.Path(), "revocations")
 }
 
+// ExpiryPath returns the directory that holds the expiry hints for the
+// account's files. Each hint is a file with the same name as the file that
+// it applies to.
+func (a *Account) ExpiryPath() string {
+	return filepath.Join(a.Path(), "expiry")
+}
+
+// DeliveredPath returns the directory that records which of the account's
+// files were uploaded by contacts. Each record holds the size that the upload
+// declared, which must match if the upload is resumed.
+func (a *Account) DeliveredPath() string {
+	return filepath.Join(a.Path(), "delivered")
+}
+
+// DownloadsPath returns the directory that holds the number of remaining
+// downloads for those of the account's files that have a download limit.
+func (a *Account) DownloadsPath() string {
+	return filepath.Join(a.Path(), "downloads")
+}
+
 func (a *Account) LoadFileInfo() bool {
 	a.Lock()
 	defer a.Unlock()
@@ -165,10 +198,226 @@ func (a *Account) ReserveFile(newFile bool, size int64) bool {
 	return true
 }
 
+// InvalidateFileInfo causes the count and size of the account's files to be
+// reloaded. It's called when files are removed behind the account's back.
+func (a *Account) InvalidateFileInfo() {
+	a.Lock()
+	defer a.Unlock()
+
+	a.invalidateFileInfo()
+}
+
+func (a *Account) invalidateFileInfo() {
+	a.filesValid = false
+	a.filesCount = 0
+	a.filesSize = 0
+}
+
+// ListFiles returns the account's files, at most maxFilesCount of them, and
+// the totals that count against its quota. The totals are recalculated from
+// the files themselves.
+func (a *Account) ListFiles() (files []*pond.FileList_File, count int, size int64, ok bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.invalidateFileInfo()
+	if !a.loadFileInfo() {
+		return
+	}
+
+	ents, err := ioutil.ReadDir(a.FilePath())
+	if err != nil {
+		log.Printf("Failed to read %s: %s", a.FilePath(), err)
+		return
+	}
+
+	for _, ent := range ents {
+		if len(files) >= maxFilesCount {
+			break
+		}
+		name := ent.Name()
+		if ent.IsDir() || len(name) == 0 || strings.IndexFunc(name, notLowercaseHex) != -1 {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 16, 64)
+		if err != nil {
+			continue
+		}
+		file := &pond.FileList_File{
+			Id:       proto.Uint64(id),
+			Size:     proto.Int64(ent.Size()),
+			Modified: proto.Int64(ent.ModTime().Unix()),
+		}
+		if expiry := readMetadata(filepath.Join(a.ExpiryPath(), name)); expiry != 0 {
+			file.Expiry = proto.Int64(expiry)
+		}
+		if remaining := readMetadata(filepath.Join(a.DownloadsPath(), name)); remaining > 0 {
+			file.DownloadsRemaining = proto.Uint32(uint32(remaining))
+		}
+		files = append(files, file)
+	}
+
+	return files, a.filesCount, a.filesSize, true
+}
+
+// readMetadata returns the number stored at path, which is an expiry hint or
+// a download count, or zero if there isn't one.
+func readMetadata(path string) int64 {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	expiry, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return expiry
+}
+
+// writeMetadata stores a number that applies to the file with the given id in
+// dir.
+func writeMetadata(dir string, id uint64, value int64) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, strconv.FormatUint(id, 16))
+	return ioutil.WriteFile(path, []byte(strconv.FormatInt(value, 10)), 0600)
+}
+
+// RemoveFile deletes one of the account's files, along with its metadata, and
+// releases the space that it used.
+func (a *Account) RemoveFile(id uint64) error {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.removeFile(id)
+}
+
+func (a *Account) removeFile(id uint64) error {
+	if !a.loadFileInfo() {
+		return errors.New("failed to load file information")
+	}
+
+	name := strconv.FormatUint(id, 16)
+	path := filepath.Join(a.FilePath(), name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(a.ExpiryPath(), name))
+	os.Remove(filepath.Join(a.DownloadsPath(), name))
+	os.Remove(filepath.Join(a.DeliveredPath(), name))
+	delete(a.downloadClaims, id)
+	a.releaseFile(true, fi.Size())
+
+	return nil
+}
+
+// ClaimDownload claims a download of the file with the given id, which the
+// caller has opened and which has the given FileInfo. If resume is true and an
+// earlier claim on the file hasn't been resumed, the transfer is a resumption
+// under that claim. Otherwise a new claim is made, which is refused if the
+// outstanding claims would exceed the file's download limit. The caller must
+// call finish once the transfer has ended, with complete set if the whole file
+// was sent. It returns false if the download isn't permitted, including if the
+// file has been removed since it was opened.
+func (a *Account) ClaimDownload(id uint64, opened os.FileInfo, resume bool) (finish func(complete bool), ok bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	name := strconv.FormatUint(id, 16)
+	if fi, err := os.Stat(filepath.Join(a.FilePath(), name)); err != nil || !os.SameFile(fi, opened) {
+		return nil, false
+	}
+
+	remaining := readMetadata(filepath.Join(a.DownloadsPath(), name))
+	if remaining <= 0 {
+		// The file doesn't have a download limit.
+		return func(bool) {}, true
+	}
+
+	claims := a.downloadClaims[id]
+	var claim *downloadClaim
+	isResumption := false
+	if resume {
+		for _, c := range claims {
+			if !c.resumed {
+				c.resumed = true
+				claim, isResumption = c, true
+				break
+			}
+		}
+	}
+	if claim == nil {
+		if int64(len(claims)) >= remaining {
+			return nil, false
+		}
+		claim = new(downloadClaim)
+		if a.downloadClaims == nil {
+			a.downloadClaims = make(map[uint64][]*downloadClaim)
+		}
+		a.downloadClaims[id] = append(claims, claim)
+	}
+
+	return func(complete bool) {
+		if complete || isResumption {
+			a.countDownload(id, claim)
+		}
+	}, true
+}
+
+// countDownload counts the download made under claim, unless it has already
+// been counted, and removes the file once it has reached its download limit.
+func (a *Account) countDownload(id uint64, claim *downloadClaim) {
+	a.Lock()
+	defer a.Unlock()
+
+	claims := a.downloadClaims[id]
+	found := false
+	for i, c := range claims {
+		if c == claim {
+			claims = append(claims[:i], claims[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		// The download was counted by another transfer under the same
+		// claim, or the file has since been removed.
+		return
+	}
+	if len(claims) == 0 {
+		delete(a.downloadClaims, id)
+	} else {
+		a.downloadClaims[id] = claims
+	}
+
+	name := strconv.FormatUint(id, 16)
+	remaining := readMetadata(filepath.Join(a.DownloadsPath(), name)) - 1
+	if remaining > 0 {
+		if err := writeMetadata(a.DownloadsPath(), id, remaining); err != nil {
+			log.Printf("Failed to update download count: %s", err)
+		}
+		return
+	}
+
+	// An open file can still be read after it has been removed.
+	if err := a.removeFile(id); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove file that reached its download limit: %s", err)
+	}
+}
+
 func (a *Account) ReleaseFile(removedFile bool, size int64) {
 	a.Lock()
 	defer a.Unlock()
 
+	a.releaseFile(removedFile, size)
+}
+
+func (a *Account) releaseFile(removedFile bool, size int64) {
 	if !a.loadFileInfo() {
 		return
 	}
@@ -231,6 +480,16 @@ func (s *Server) Process(conn *transport.Conn) {
 		}
 	} else if req.Revocation != nil {
 		reply = s.revocation(from, req.Revocation)
+	} else if req.DeleteFile != nil {
+		reply = s.deleteFile(from, req.DeleteFile)
+	} else if req.ListFiles != nil {
+		reply = s.listFiles(from)
+	} else if req.UploadForDelivery != nil {
+		reply = s.uploadForDelivery(conn, req.UploadForDelivery)
+		if reply == nil {
+			// Connection will be handled by uploadForDelivery.
+			return
+		}
 	} else {
 		reply = &pond.Reply{Status: pond.Reply_NO_REQUEST.Enum()}
 	}
@@ -295,6 +554,9 @@ func (s *Server) sweep() {
 	for _, ent := range ents {
 		name := ent.Name()
 		if len(name) == 64 && strings.IndexFunc(name, notLowercaseHex) == -1 {
+			expiryPath := filepath.Join(accountsPath, name, "expiry")
+			downloadsPath := filepath.Join(accountsPath, name, "downloads")
+			deliveredPath := filepath.Join(accountsPath, name, "delivered")
 			filesPath := filepath.Join(accountsPath, name, "files")
 			filesDir, err := os.Open(filesPath)
 			if os.IsNotExist(err) {
@@ -304,16 +566,25 @@ func (s *Server) sweep() {
 				continue
 			}
 
+			removed := false
 			filesEnts, err := filesDir.Readdir(0)
 			if err == nil {
 				for _, fileEnt := range filesEnts {
 					name := fileEnt.Name()
 					if len(name) > 0 && strings.IndexFunc(name, notLowercaseHex) == -1 {
 						mtime := fileEnt.ModTime()
-						if now.After(mtime) && now.Sub(mtime) > fileLifetime {
+						expired := now.After(mtime) && now.Sub(mtime) > fileLifetime
+						if expiry := readMetadata(filepath.Join(expiryPath, name)); expiry != 0 && now.Unix() > expiry {
+							expired = true
+						}
+						if expired {
 							if err := os.Remove(filepath.Join(filesPath, name)); err != nil {
 								log.Printf("Failed to delete file: %s", err)
 							}
+							os.Remove(filepath.Join(expiryPath, name))
+							os.Remove(filepath.Join(downloadsPath, name))
+							os.Remove(filepath.Join(deliveredPath, name))
+							removed = true
 						}
 					}
 				}
@@ -322,10 +593,31 @@ func (s *Server) sweep() {
 			}
 
 			filesDir.Close()
+
+			if removed {
+				s.invalidateFileInfo(name)
+			}
 		}
 	}
 }
 
+// invalidateFileInfo causes the cached file totals of the account with the
+// given, hex encoded, name to be reloaded.
+func (s *Server) invalidateFileInfo(name string) {
+	id, err := hex.DecodeString(name)
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	account, ok := s.accounts[string(id)]
+	s.Unlock()
+
+	if ok {
+		account.InvalidateFileInfo()
+	}
+}
+
 func (s *Server) newAccount(from *[32]byte, req *pond.NewAccount) *pond.Reply {
 	account := NewAccount(s, from)
 
@@ -404,34 +696,20 @@ func (s *Server) deliver(from *[32]byte, del *pond.Delivery) *pond.Reply {
 	}
 	copy(to[:], del.To)
 
+	if del.GetCover() {
+		// Cover traffic is discarded without checking the destination
+		// so that it can be sent to any server.
+		return &pond.Reply{}
+	}
+
 	account, ok := s.getAccount(&to)
 	if !ok {
 		return &pond.Reply{Status: pond.Reply_NO_SUCH_ADDRESS.Enum()}
 	}
 
-	revPath := filepath.Join(account.RevocationPath(), fmt.Sprintf("%08x", *del.Generation))
-	revBytes, err := ioutil.ReadFile(revPath)
-	if err == nil {
-		var revocation pond.SignedRevocation
-		if err := proto.Unmarshal(revBytes, &revocation); err != nil {
-			log.Printf("Failed to parse revocation from file %s: %s", revPath, err)
-			return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
-		}
-		return &pond.Reply{Status: pond.Reply_GENERATION_REVOKED.Enum(), Revocation: &revocation}
-	}
-
-	sha := sha256.New()
-	sha.Write(del.Message)
-	digest := sha.Sum(nil)
-	sha.Reset()
-
-	group := account.Group()
-	if group == nil {
-		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
-	}
-
-	if !group.Verify(digest, sha, del.Signature) {
-		return &pond.Reply{Status: pond.Reply_DELIVERY_SIGNATURE_INVALID.Enum()}
+	digest, reply := s.authorizeDelivery(account, *del.Generation, del.Message, del.Signature)
+	if reply != nil {
+		return reply
 	}
 
 	serialized, _ := proto.Marshal(del)
@@ -460,6 +738,38 @@ func (s *Server) deliver(from *[32]byte, del *pond.Delivery) *pond.Reply {
 	return &pond.Reply{}
 }
 
+// authorizeDelivery checks that signature is a valid group signature of
+// signed for account at the given generation. It returns the SHA-256 digest of
+// signed on success, or else a reply explaining the failure.
+func (s *Server) authorizeDelivery(account *Account, generation uint32, signed, signature []byte) ([]byte, *pond.Reply) {
+	revPath := filepath.Join(account.RevocationPath(), fmt.Sprintf("%08x", generation))
+	revBytes, err := ioutil.ReadFile(revPath)
+	if err == nil {
+		var revocation pond.SignedRevocation
+		if err := proto.Unmarshal(revBytes, &revocation); err != nil {
+			log.Printf("Failed to parse revocation from file %s: %s", revPath, err)
+			return nil, &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+		}
+		return nil, &pond.Reply{Status: pond.Reply_GENERATION_REVOKED.Enum(), Revocation: &revocation}
+	}
+
+	sha := sha256.New()
+	sha.Write(signed)
+	digest := sha.Sum(nil)
+	sha.Reset()
+
+	group := account.Group()
+	if group == nil {
+		return nil, &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	}
+
+	if !group.Verify(digest, sha, signature) {
+		return nil, &pond.Reply{Status: pond.Reply_DELIVERY_SIGNATURE_INVALID.Enum()}
+	}
+
+	return digest, nil
+}
+
 const announcePrefix = "announce-"
 
 func (s *Server) fetch(from *[32]byte, fetch *pond.Fetch) (*pond.Reply, string) {
@@ -601,23 +911,90 @@ func (s *Server) upload(from *[32]byte, conn *transport.Conn, upload *pond.Uploa
 		return &pond.Reply{Status: pond.Reply_NO_ACCOUNT.Enum()}
 	}
 
+	return s.receiveFile(account, conn, upload, false)
+}
+
+// uploadForDelivery handles an upload from a contact of the owner of an
+// account. The file is stored, and counted, as if the owner had uploaded it
+// themselves.
+func (s *Server) uploadForDelivery(conn *transport.Conn, ufd *pond.UploadForDelivery) *pond.Reply {
+	var to [32]byte
+	if len(ufd.To) != len(to) {
+		return &pond.Reply{Status: pond.Reply_PARSE_ERROR.Enum()}
+	}
+	copy(to[:], ufd.To)
+
+	account, ok := s.getAccount(&to)
+	if !ok {
+		return &pond.Reply{Status: pond.Reply_NO_SUCH_ADDRESS.Enum()}
+	}
+
+	signed := append([]byte(pond.UploadForDeliveryPrefix), ufd.Upload...)
+	if _, reply := s.authorizeDelivery(account, *ufd.Generation, signed, ufd.Signature); reply != nil {
+		return reply
+	}
+
+	upload := new(pond.Upload)
+	if err := proto.Unmarshal(ufd.Upload, upload); err != nil {
+		return &pond.Reply{Status: pond.Reply_PARSE_ERROR.Enum()}
+	}
+
+	return s.receiveFile(account, conn, upload, true)
+}
+
+// receiveFile stores the contents of an upload in account. If forDelivery is
+// true then the upload is from a contact of the account's owner. It returns
+// nil if it has taken over handling the connection.
+func (s *Server) receiveFile(account *Account, conn *transport.Conn, upload *pond.Upload, forDelivery bool) *pond.Reply {
 	if *upload.Size < 1 {
 		return &pond.Reply{Status: pond.Reply_PARSE_ERROR.Enum()}
 	}
 
-	path := filepath.Join(account.FilePath(), strconv.FormatUint(*upload.Id, 16))
+	name := strconv.FormatUint(*upload.Id, 16)
+	path := filepath.Join(account.FilePath(), name)
 
 	if !account.LoadFileInfo() {
 		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
 	}
 
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	created := true
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		created = false
+		// The owner's files share the namespace of ids, and contacts
+		// learn their ids from detachment URLs, so a contact may only
+		// resume an upload that a contact started.
+		if forDelivery && readMetadata(filepath.Join(account.DeliveredPath(), name)) != *upload.Size {
+			return &pond.Reply{Status: pond.Reply_FILE_EXISTS.Enum()}
+		}
+		file, err = os.OpenFile(path, os.O_WRONLY, 0600)
+	}
 	if err != nil {
 		log.Printf("Failed to create file %s: %s", path, err)
 		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
 	}
 	defer file.Close()
 
+	// The metadata is only written when the file is created so that
+	// resuming an upload can't change that of an existing file.
+	if created {
+		if forDelivery {
+			if err := writeMetadata(account.DeliveredPath(), *upload.Id, *upload.Size); err != nil {
+				log.Printf("Failed to record delivery of %s: %s", path, err)
+				os.Remove(path)
+				return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+			}
+		}
+		if upload.Expiry != nil {
+			if err := writeMetadata(account.ExpiryPath(), *upload.Id, *upload.Expiry); err != nil {
+				log.Printf("Failed to write expiry for %s: %s", path, err)
+				os.Remove(path)
+				os.Remove(filepath.Join(account.DeliveredPath(), name))
+				return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+			}
+		}
+	}
+
 	offset, err := file.Seek(0, 2 /* from end */)
 
 	switch {
@@ -650,11 +1027,22 @@ func (s *Server) upload(from *[32]byte, conn *transport.Conn, upload *pond.Uploa
 	switch {
 	case n == 0:
 		os.Remove(path)
+		os.Remove(filepath.Join(account.ExpiryPath(), name))
+		os.Remove(filepath.Join(account.DeliveredPath(), name))
 		account.ReleaseFile(true, size)
 	case n < size:
 		account.ReleaseFile(false, size-n)
 	case n == size:
 		if err == nil {
+			if upload.MaxDownloads != nil && *upload.MaxDownloads > 0 {
+				// The limit is recorded once the file is
+				// complete so that downloads of a partial file
+				// aren't counted.
+				if err := writeMetadata(account.DownloadsPath(), *upload.Id, int64(*upload.MaxDownloads)); err != nil {
+					log.Printf("Failed to write download limit for %s: %s", path, err)
+					return nil
+				}
+			}
 			conn.Write([]byte{0})
 		}
 	case n > size:
@@ -664,6 +1052,48 @@ func (s *Server) upload(from *[32]byte, conn *transport.Conn, upload *pond.Uploa
 	return nil
 }
 
+func (s *Server) deleteFile(from *[32]byte, del *pond.DeleteFile) *pond.Reply {
+	account, ok := s.getAccount(from)
+	if !ok {
+		return &pond.Reply{Status: pond.Reply_NO_ACCOUNT.Enum()}
+	}
+
+	if !account.LoadFileInfo() {
+		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	}
+
+	if err := account.RemoveFile(*del.Id); os.IsNotExist(err) {
+		return &pond.Reply{Status: pond.Reply_NO_SUCH_FILE.Enum()}
+	} else if err != nil {
+		log.Printf("Failed to delete file %x: %s", *del.Id, err)
+		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	}
+
+	return nil
+}
+
+func (s *Server) listFiles(from *[32]byte) *pond.Reply {
+	account, ok := s.getAccount(from)
+	if !ok {
+		return &pond.Reply{Status: pond.Reply_NO_ACCOUNT.Enum()}
+	}
+
+	files, count, size, ok := account.ListFiles()
+	if !ok {
+		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	}
+
+	return &pond.Reply{
+		Files: &pond.FileList{
+			Files:    files,
+			Count:    proto.Uint32(uint32(count)),
+			Size:     proto.Int64(size),
+			MaxCount: proto.Uint32(maxFilesCount),
+			MaxSize:  proto.Int64(maxFilesSize),
+		},
+	}
+}
+
 func (s *Server) download(conn *transport.Conn, download *pond.Download) *pond.Reply {
 	var from [32]byte
 	if len(download.From) != len(from) {
@@ -705,16 +1135,23 @@ func (s *Server) download(conn *transport.Conn, download *pond.Download) *pond.R
 		}
 	}
 
+	finish, ok := account.ClaimDownload(*download.Id, fi, download.Resume != nil)
+	if !ok {
+		return &pond.Reply{Status: pond.Reply_NO_SUCH_FILE.Enum()}
+	}
+
 	reply := &pond.Reply{
 		Download: &pond.DownloadReply{
 			Size: proto.Int64(size),
 		},
 	}
 	if err := conn.WriteProto(reply); err != nil {
+		finish(false)
 		return nil
 	}
 
-	io.Copy(conn, file)
+	_, err = io.Copy(conn, file)
+	finish(err == nil)
 	return nil
 }
 
@@ -411,6 +411,65 @@ func TestPingPong(t *testing.T) {
 	})
 }
 
+func TestCoverDelivery(t *testing.T) {
+	t.Parallel()
+
+	message := make([]byte, 1000)
+	io.ReadFull(rand.Reader, message)
+
+	runScript(t, script{
+		numPlayers:             2,
+		numPlayersWithAccounts: 1,
+		actions: []action{
+			{
+				player: 1,
+				buildRequest: func(s *scriptState) *pond.Request {
+					req := s.buildDelivery(0, message, 1)
+					req.Deliver.Cover = proto.Bool(true)
+					return req
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Errorf("Bad reply to cover delivery: %s", reply)
+					}
+				},
+			},
+			{
+				player: 1,
+				request: &pond.Request{
+					Deliver: &pond.Delivery{
+						To:         make([]byte, 32),
+						Signature:  make([]byte, 5),
+						Generation: proto.Uint32(0),
+						Message:    message,
+						Cover:      proto.Bool(true),
+					},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Errorf("Bad reply to cover delivery to unknown address: %s", reply)
+					}
+				},
+			},
+			{
+				player: 0,
+				request: &pond.Request{
+					Fetch: &pond.Fetch{},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Errorf("Bad reply to fetch: %s", reply)
+						return
+					}
+					if reply.Fetched != nil {
+						t.Errorf("Cover delivery was queued: %s", reply)
+					}
+				},
+			},
+		},
+	})
+}
+
 func TestUpload(t *testing.T) {
 	t.Parallel()
 
@@ -661,6 +720,521 @@ func TestResumeDownload(t *testing.T) {
 	})
 }
 
+func TestUploadForDelivery(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("hello world")
+	upload, err := proto.Marshal(&pond.Upload{
+		Id:   proto.Uint64(1),
+		Size: proto.Int64(int64(len(payload))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buildUpload := func(s *scriptState) *pond.Request {
+		return s.buildSignedUpload(upload, append([]byte(pond.UploadForDeliveryPrefix), upload...))
+	}
+
+	runScript(t, script{
+		numPlayers:             3,
+		numPlayersWithAccounts: 1,
+		actions: []action{
+			{
+				player: 1,
+				buildRequest: func(s *scriptState) *pond.Request {
+					req := buildUpload(s)
+					req.UploadForDelivery.Upload = append([]byte{}, upload...)
+					req.UploadForDelivery.Upload[len(upload)-1] ^= 1
+					return req
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status == nil || *reply.Status != pond.Reply_DELIVERY_SIGNATURE_INVALID {
+						t.Fatalf("Bad reply to upload with invalid signature: %s", reply)
+					}
+				},
+			},
+			{
+				player: 1,
+				buildRequest: func(s *scriptState) *pond.Request {
+					// A signature as if upload were a delivered
+					// message mustn't be accepted.
+					return s.buildSignedUpload(upload, upload)
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status == nil || *reply.Status != pond.Reply_DELIVERY_SIGNATURE_INVALID {
+						t.Fatalf("Bad reply to upload with a delivery's signature: %s", reply)
+					}
+				},
+			},
+			{
+				player:       1,
+				buildRequest: buildUpload,
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to upload for delivery: %s", reply)
+					}
+				},
+				payload:     payload,
+				payloadSize: 1,
+			},
+			{
+				player: 0,
+				request: &pond.Request{
+					ListFiles: &pond.ListFiles{},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Files == nil || len(reply.Files.Files) != 1 || reply.Files.Files[0].GetId() != 1 {
+						t.Fatalf("Delivered file not in recipient's account: %s", reply)
+					}
+				},
+			},
+			{
+				player: 2,
+				buildRequest: func(s *scriptState) *pond.Request {
+					return &pond.Request{
+						Download: &pond.Download{
+							From: s.publicIdentities[0][:],
+							Id:   proto.Uint64(1),
+						},
+					}
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to download: %s", reply)
+					}
+				},
+				payloadSize: len(payload),
+				validatePayload: func(t *testing.T, got []byte) {
+					if !bytes.Equal(got, payload) {
+						t.Errorf("Downloaded %x, want %x", got, payload)
+					}
+				},
+			},
+		},
+	})
+}
+
+// buildSignedUpload builds a request, from a contact of player 0, to upload
+// into player 0's account. The request carries a group signature of signed.
+func (s *scriptState) buildSignedUpload(upload, signed []byte) *pond.Request {
+	req := s.buildDelivery(0, signed, 0)
+	return &pond.Request{
+		UploadForDelivery: &pond.UploadForDelivery{
+			To:         req.Deliver.To,
+			Signature:  req.Deliver.Signature,
+			Generation: req.Deliver.Generation,
+			Upload:     upload,
+		},
+	}
+}
+
+// buildUploadForDelivery returns a function that builds a request, from a
+// contact of player 0, to upload into player 0's account.
+func buildUploadForDelivery(upload *pond.Upload) func(*scriptState) *pond.Request {
+	return func(s *scriptState) *pond.Request {
+		uploadBytes, err := proto.Marshal(upload)
+		if err != nil {
+			panic(err)
+		}
+		return s.buildSignedUpload(uploadBytes, append([]byte(pond.UploadForDeliveryPrefix), uploadBytes...))
+	}
+}
+
+func TestUploadForDeliveryExistingFile(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("hello world")
+	const partial = 5
+
+	validateFileExists := func(t *testing.T, reply *pond.Reply) {
+		if reply.Status == nil || *reply.Status != pond.Reply_FILE_EXISTS {
+			t.Fatalf("Upload for delivery to the owner's file accepted: %s", reply)
+		}
+	}
+
+	runScript(t, script{
+		numPlayers:             3,
+		numPlayersWithAccounts: 1,
+		actions: []action{
+			{
+				player: 0,
+				request: &pond.Request{
+					Upload: &pond.Upload{
+						Id:   proto.Uint64(1),
+						Size: proto.Int64(int64(len(payload))),
+					},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to upload: %s", reply)
+					}
+				},
+				payload:     payload,
+				payloadSize: 1,
+			},
+			// A contact can neither extend the owner's file nor set
+			// its expiry.
+			{
+				player: 1,
+				buildRequest: buildUploadForDelivery(&pond.Upload{
+					Id:     proto.Uint64(1),
+					Size:   proto.Int64(int64(len(payload)) + 5),
+					Expiry: proto.Int64(1),
+				}),
+				validate: validateFileExists,
+			},
+			{
+				player: 1,
+				buildRequest: buildUploadForDelivery(&pond.Upload{
+					Id:   proto.Uint64(1),
+					Size: proto.Int64(int64(len(payload))),
+				}),
+				validate: validateFileExists,
+			},
+			// A contact's interrupted upload can be resumed, but not
+			// with a different size.
+			{
+				player: 1,
+				buildRequest: buildUploadForDelivery(&pond.Upload{
+					Id:   proto.Uint64(2),
+					Size: proto.Int64(int64(len(payload))),
+				}),
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to upload for delivery: %s", reply)
+					}
+				},
+				payload: payload[:partial],
+			},
+			{
+				player: 2,
+				buildRequest: buildUploadForDelivery(&pond.Upload{
+					Id:   proto.Uint64(2),
+					Size: proto.Int64(int64(len(payload)) + 1),
+				}),
+				validate: validateFileExists,
+			},
+			{
+				player: 2,
+				buildRequest: buildUploadForDelivery(&pond.Upload{
+					Id:     proto.Uint64(2),
+					Size:   proto.Int64(int64(len(payload))),
+					Expiry: proto.Int64(1),
+				}),
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil || reply.Upload == nil || reply.Upload.GetResume() != partial {
+						t.Fatalf("Bad reply to resumed upload for delivery: %s", reply)
+					}
+				},
+				payload:     payload[partial:],
+				payloadSize: 1,
+			},
+			{
+				player: 0,
+				request: &pond.Request{
+					ListFiles: &pond.ListFiles{},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Files == nil || len(reply.Files.Files) != 2 {
+						t.Fatalf("Bad listing of files: %s", reply)
+					}
+					for _, file := range reply.Files.Files {
+						if file.GetSize() != int64(len(payload)) || file.Expiry != nil {
+							t.Errorf("File changed by upload for delivery: %s", file)
+						}
+					}
+				},
+			},
+		},
+	})
+}
+
+func TestOneShotDownload(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("hello world")
+	var dir, filePath string
+
+	download := action{
+		player: 1,
+		buildRequest: func(s *scriptState) *pond.Request {
+			filePath = filepath.Join(dir, "accounts", fmt.Sprintf("%x", s.publicIdentities[0][:]), "files", "1")
+			return &pond.Request{
+				Download: &pond.Download{
+					From: s.publicIdentities[0][:],
+					Id:   proto.Uint64(1),
+				},
+			}
+		},
+		validate: func(t *testing.T, reply *pond.Reply) {
+			if reply.Status != nil {
+				t.Fatalf("Bad reply to download: %s", reply)
+			}
+		},
+		payloadSize: len(payload),
+	}
+
+	runScript(t, script{
+		numPlayers:             2,
+		numPlayersWithAccounts: 1,
+		setupDir: func(d string) {
+			dir = d
+		},
+		actions: []action{
+			{
+				player: 0,
+				request: &pond.Request{
+					Upload: &pond.Upload{
+						Id:           proto.Uint64(1),
+						Size:         proto.Int64(int64(len(payload))),
+						MaxDownloads: proto.Uint32(1),
+					},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to upload: %s", reply)
+					}
+				},
+				payload:     payload,
+				payloadSize: 1,
+			},
+			download,
+		},
+	})
+
+	// The server has finished processing all the connections once
+	// runScript returns.
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("file wasn't removed after being downloaded: %s", err)
+	}
+}
+
+func TestClaimDownload(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "servertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var id [32]byte
+	account := NewAccount(NewServer(dir), &id)
+	if err := os.MkdirAll(account.FilePath(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := filepath.Join(account.FilePath(), "1")
+	if err := ioutil.WriteFile(filePath, []byte("hello world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMetadata(account.DownloadsPath(), 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finish, ok := account.ClaimDownload(1, opened, false)
+	if !ok {
+		t.Fatalf("first download refused")
+	}
+	finish(true)
+	files, count, _, ok := account.ListFiles()
+	if !ok || count != 1 || len(files) != 1 {
+		t.Fatalf("file removed before reaching download limit")
+	}
+	if remaining := files[0].GetDownloadsRemaining(); remaining != 1 {
+		t.Errorf("%d downloads remaining, want 1", remaining)
+	}
+
+	// The second download is interrupted, which doesn't count it, but
+	// no other download may start while it can still be resumed.
+	finish, ok = account.ClaimDownload(1, opened, false)
+	if !ok {
+		t.Fatalf("second download refused")
+	}
+	if _, ok := account.ClaimDownload(1, opened, false); ok {
+		t.Errorf("download beyond the limit accepted")
+	}
+	finish(false)
+	if _, ok := account.ClaimDownload(1, opened, false); ok {
+		t.Errorf("download accepted while another awaits resumption")
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Fatalf("interrupted download removed the file: %s", err)
+	}
+
+	// The interrupted download may be resumed once and counts when
+	// that ends, even if it's interrupted again.
+	finish, ok = account.ClaimDownload(1, opened, true)
+	if !ok {
+		t.Fatalf("resumption of interrupted download refused")
+	}
+	if _, ok := account.ClaimDownload(1, opened, true); ok {
+		t.Errorf("second resumption accepted")
+	}
+	finish(false)
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("file wasn't removed at download limit: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(account.DownloadsPath(), "1")); !os.IsNotExist(err) {
+		t.Errorf("download count wasn't removed with file: %s", err)
+	}
+	if _, count, size, _ := account.ListFiles(); count != 0 || size != 0 {
+		t.Errorf("quota not released: %d files, %d bytes", count, size)
+	}
+
+	// A download that opened the file before it was removed is refused.
+	if _, ok := account.ClaimDownload(1, opened, false); ok {
+		t.Errorf("download of removed file accepted")
+	}
+}
+
+// oneShotUpload returns an action that uploads payload as file 1 of player 0
+// with a download limit of one.
+func oneShotUpload(payload []byte) action {
+	return action{
+		player: 0,
+		request: &pond.Request{
+			Upload: &pond.Upload{
+				Id:           proto.Uint64(1),
+				Size:         proto.Int64(int64(len(payload))),
+				MaxDownloads: proto.Uint32(1),
+			},
+		},
+		validate: func(t *testing.T, reply *pond.Reply) {
+			if reply.Status != nil {
+				t.Fatalf("Bad reply to upload: %s", reply)
+			}
+		},
+		payload:     payload,
+		payloadSize: 1,
+	}
+}
+
+func buildDownload(resume int64) func(*scriptState) *pond.Request {
+	return func(s *scriptState) *pond.Request {
+		download := &pond.Download{
+			From: s.publicIdentities[0][:],
+			Id:   proto.Uint64(1),
+		}
+		if resume > 0 {
+			download.Resume = proto.Int64(resume)
+		}
+		return &pond.Request{Download: download}
+	}
+}
+
+// validateNoSuchFile doesn't stop the test on failure so that the script
+// still closes the connection, which the server may be writing to.
+func validateNoSuchFile(t *testing.T, reply *pond.Reply) {
+	if reply.Status == nil || *reply.Status != pond.Reply_NO_SUCH_FILE {
+		t.Errorf("Download of one-shot file accepted twice: %s", reply)
+	}
+}
+
+func TestOneShotDownloadStoppedShort(t *testing.T) {
+	t.Parallel()
+
+	// An interrupted one-shot download can be resumed, after which the
+	// file is gone. The payload is larger than the socket buffers so that
+	// the server sees the download stop short, rather than buffering the
+	// rest.
+	payload := make([]byte, 8<<20)
+	io.ReadFull(rand.Reader, payload)
+	stop := len(payload) / 2
+
+	runScript(t, script{
+		numPlayers:             2,
+		numPlayersWithAccounts: 1,
+		actions: []action{
+			oneShotUpload(payload),
+			{
+				player:       1,
+				buildRequest: buildDownload(0),
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to download: %s", reply)
+					}
+				},
+				payloadSize: stop,
+			},
+			{
+				player:       1,
+				buildRequest: buildDownload(int64(stop)),
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to resumed download: %s", reply)
+					}
+				},
+				payloadSize: len(payload) - stop,
+				validatePayload: func(t *testing.T, got []byte) {
+					if !bytes.Equal(got, payload[stop:]) {
+						t.Errorf("bad payload in resumed download")
+					}
+				},
+			},
+			{
+				player:       1,
+				buildRequest: buildDownload(0),
+				validate:     validateNoSuchFile,
+			},
+		},
+	})
+}
+
+func TestConcurrentOneShotDownloads(t *testing.T) {
+	t.Parallel()
+
+	// As above, the server is still sending the first download when the
+	// second is requested.
+	payload := make([]byte, 8<<20)
+	io.ReadFull(rand.Reader, payload)
+
+	var first *transport.Conn
+
+	runScript(t, script{
+		numPlayers:             2,
+		numPlayersWithAccounts: 1,
+		actions: []action{
+			oneShotUpload(payload),
+			{
+				player: 1,
+				buildRequest: func(s *scriptState) *pond.Request {
+					first = s.testServer.Dial(&s.identities[1], &s.publicIdentities[1])
+					request := buildDownload(0)(s)
+					if err := first.WriteProto(request); err != nil {
+						t.Fatal(err)
+					}
+					reply := new(pond.Reply)
+					if err := first.ReadProto(reply); err != nil {
+						t.Fatal(err)
+					}
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to first download: %s", reply)
+					}
+					return request
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					defer first.Close()
+					validateNoSuchFile(t, reply)
+
+					fromServer := make([]byte, len(payload))
+					if _, err := io.ReadFull(first, fromServer); err != nil {
+						t.Fatalf("Failed to read first download: %s", err)
+					}
+					if !bytes.Equal(fromServer, payload) {
+						t.Errorf("bad payload in first download")
+					}
+				},
+			},
+		},
+	})
+}
+
 func TestAnnounce(t *testing.T) {
 	t.Parallel()
 
@@ -749,6 +1323,166 @@ func TestSweep(t *testing.T) {
 	}
 }
 
+func TestSweepExpiry(t *testing.T) {
+	t.Parallel()
+
+	var expiredPath, unexpiredPath, expiredHintPath string
+
+	runScript(t, script{
+		numPlayers: 1,
+		setupDir: func(dir string) {
+			accountDir := filepath.Join(dir, "accounts", "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff")
+			fileDir := filepath.Join(accountDir, "files")
+			expiryDir := filepath.Join(accountDir, "expiry")
+			for _, d := range []string{fileDir, expiryDir} {
+				if err := os.MkdirAll(d, 0700); err != nil {
+					t.Fatalf("Failed to create directory: %s", err)
+				}
+			}
+
+			now := time.Now()
+			for name, expiry := range map[string]time.Time{
+				"01": now.Add(-time.Hour),
+				"02": now.Add(time.Hour),
+			} {
+				if err := ioutil.WriteFile(filepath.Join(fileDir, name), nil, 0600); err != nil {
+					t.Fatalf("Failed to create file: %s", err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(expiryDir, name), []byte(fmt.Sprintf("%d", expiry.Unix())), 0600); err != nil {
+					t.Fatalf("Failed to write expiry: %s", err)
+				}
+			}
+
+			expiredPath = filepath.Join(fileDir, "01")
+			expiredHintPath = filepath.Join(expiryDir, "01")
+			unexpiredPath = filepath.Join(fileDir, "02")
+		},
+		actions: []action{
+			{
+				request: &pond.Request{},
+			},
+		},
+	})
+
+	if _, err := os.Stat(expiredPath); !os.IsNotExist(err) {
+		t.Errorf("expired file was not removed: %s", err)
+	}
+	if _, err := os.Stat(expiredHintPath); !os.IsNotExist(err) {
+		t.Errorf("expiry of removed file was not removed: %s", err)
+	}
+	if _, err := os.Stat(unexpiredPath); err != nil {
+		t.Errorf("unexpired file was removed: %s", err)
+	}
+}
+
+func TestListAndDeleteFiles(t *testing.T) {
+	t.Parallel()
+
+	payload1 := []byte("hello world")
+	payload2 := []byte("hi")
+	expiry := time.Now().Add(time.Hour).Unix()
+
+	checkStatus := func(status pond.Reply_Status) func(*testing.T, *pond.Reply) {
+		return func(t *testing.T, reply *pond.Reply) {
+			if reply.GetStatus() != status {
+				t.Fatalf("Bad reply status, got %s, want %s: %s", reply.GetStatus(), status, reply)
+			}
+		}
+	}
+
+	runScript(t, script{
+		numPlayers:             2,
+		numPlayersWithAccounts: 1,
+		actions: []action{
+			{
+				request: &pond.Request{
+					Upload: &pond.Upload{
+						Id:     proto.Uint64(1),
+						Size:   proto.Int64(int64(len(payload1))),
+						Expiry: proto.Int64(expiry),
+					},
+				},
+				validate: checkStatus(pond.Reply_OK),
+				payload:  payload1,
+				// The server sends a zero byte once it has the
+				// whole file.
+				payloadSize: 1,
+			},
+			{
+				request: &pond.Request{
+					Upload: &pond.Upload{
+						Id:   proto.Uint64(2),
+						Size: proto.Int64(int64(len(payload2))),
+					},
+				},
+				validate:    checkStatus(pond.Reply_OK),
+				payload:     payload2,
+				payloadSize: 1,
+			},
+			{
+				request: &pond.Request{ListFiles: &pond.ListFiles{}},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					files := reply.Files
+					if files == nil {
+						t.Fatalf("ListFiles reply missing: %s", reply)
+					}
+					if files.GetCount() != 2 || files.GetSize() != int64(len(payload1)+len(payload2)) {
+						t.Errorf("Bad totals in file list: %s", files)
+					}
+					if files.GetMaxCount() != maxFilesCount || files.GetMaxSize() != maxFilesSize {
+						t.Errorf("Bad limits in file list: %s", files)
+					}
+					if len(files.Files) != 2 {
+						t.Fatalf("Wrong number of files in list: %s", files)
+					}
+					for _, file := range files.Files {
+						switch file.GetId() {
+						case 1:
+							if file.GetSize() != int64(len(payload1)) || file.GetExpiry() != expiry {
+								t.Errorf("Bad entry for file 1: %s", file)
+							}
+						case 2:
+							if file.GetSize() != int64(len(payload2)) || file.Expiry != nil {
+								t.Errorf("Bad entry for file 2: %s", file)
+							}
+						default:
+							t.Errorf("Unexpected file in list: %s", file)
+						}
+					}
+				},
+			},
+			{
+				request:  &pond.Request{DeleteFile: &pond.DeleteFile{Id: proto.Uint64(1)}},
+				validate: checkStatus(pond.Reply_OK),
+			},
+			{
+				request:  &pond.Request{DeleteFile: &pond.DeleteFile{Id: proto.Uint64(1)}},
+				validate: checkStatus(pond.Reply_NO_SUCH_FILE),
+			},
+			{
+				player:   1,
+				request:  &pond.Request{DeleteFile: &pond.DeleteFile{Id: proto.Uint64(2)}},
+				validate: checkStatus(pond.Reply_NO_ACCOUNT),
+			},
+			{
+				request: &pond.Request{ListFiles: &pond.ListFiles{}},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					files := reply.Files
+					if files == nil {
+						t.Fatalf("ListFiles reply missing: %s", reply)
+					}
+					if len(files.Files) != 1 || files.Files[0].GetId() != 2 {
+						t.Errorf("Bad file list after deletion: %s", files)
+					}
+					if files.GetCount() != 1 || files.GetSize() != int64(len(payload2)) {
+						t.Errorf("Bad totals after deletion: %s", files)
+					}
+				},
+			},
+		},
+	})
+}
+
 func TestRevocation(t *testing.T) {
 	t.Parallel()
 